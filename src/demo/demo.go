@@ -20,7 +20,7 @@ func main() {
         return
     }
     fmt.Println("Creating LockClient...")
-    lc, err := locks.CreateLockClient(trans, masterServers)
+    lc, err := locks.CreateLockClient(trans, masterServers, nil)
     if err != nil {
         fmt.Println("error with creating lock client")
         fmt.Println(err)
@@ -65,7 +65,7 @@ func runLockClient(lockList []locks.Lock, clientAddr raft.ServerAddress, masterA
         fmt.Println("err: ", err)
         return
     }
-    lc, lc_err := locks.CreateLockClient(trans, masterAddrs)
+    lc, lc_err := locks.CreateLockClient(trans, masterAddrs, nil)
     if lc_err != nil {
         fmt.Println("err: ", lc_err)
     }
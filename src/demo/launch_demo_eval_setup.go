@@ -41,7 +41,7 @@ func createLocksAndDomains(lockList [][]locks.Lock, domainList []locks.Domain, c
         fmt.Println("err: ", err)
         return
     }
-    lc, lc_err := locks.CreateLockClient(trans, masterAddrs)
+    lc, lc_err := locks.CreateLockClient(trans, masterAddrs, nil)
     if lc_err != nil {
         fmt.Println("err: ", lc_err)
     }
@@ -58,7 +58,10 @@ func main() {
         }
         transports[i] = trans
     }
-    locks.MakeCluster(3, locks.CreateMasters(len(masterAddrs), masterAddrs, recruitList, maxFreq, minFreq, idealFreq, maxInactivePeriods, false, transports), masterAddrs, transports)
+    if _, err := locks.MakeCluster(3, locks.CreateMasters(len(masterAddrs), masterAddrs, recruitList, maxFreq, minFreq, idealFreq, maxInactivePeriods, false, transports, nil), masterAddrs, transports); err != nil {
+        fmt.Println("err : ", err)
+        os.Exit(1)
+    }
     c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
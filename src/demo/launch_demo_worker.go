@@ -33,7 +33,10 @@ func main() {
         }
         transports[i] = trans
     }
-    locks.MakeCluster(3, locks.CreateWorkers(len(workerAddrs), masterAddrs, workerAddrs, transports), workerAddrs, transports)
+    if _, err := locks.MakeCluster(3, locks.CreateWorkers(len(workerAddrs), masterAddrs, workerAddrs, transports, nil), workerAddrs, transports); err != nil {
+        fmt.Println("err : ", err)
+        os.Exit(1)
+    }
     c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
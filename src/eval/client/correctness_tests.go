@@ -18,7 +18,7 @@ func main() {
         fmt.Println("err: ", err)
         return
     }
-    lc, err := locks.CreateLockClient(trans, masterServers)
+    lc, err := locks.CreateLockClient(trans, masterServers, nil)
     if err != nil {
         fmt.Println("error with creating lock client")
         fmt.Println(err)
@@ -47,7 +47,7 @@ func main() {
         fmt.Println("err: ", err)
         return
     }
-    lc2, err2 := locks.CreateLockClient(trans2, masterServers)
+    lc2, err2 := locks.CreateLockClient(trans2, masterServers, nil)
     if err2 != nil {
         fmt.Println("error with creating lock client")
         fmt.Println(err)
@@ -591,7 +591,7 @@ func test_release_unacquired_2(lc1 *locks.LockClient, lc2 *locks.LockClient) boo
 
 func test_client_fails_and_releases(trans *raft.NetworkTransport) bool {
     success := true
-    lc, err := locks.CreateLockClient(trans, masterServers)
+    lc, err := locks.CreateLockClient(trans, masterServers, nil)
     if err != nil {
         success = false
         fmt.Println("error with creating lock client")
@@ -617,7 +617,7 @@ func test_client_fails_and_releases(trans *raft.NetworkTransport) bool {
         fmt.Println(destroy_err)
     }
     time.Sleep(10*time.Second)
-    newlc, err := locks.CreateLockClient(trans, masterServers)
+    newlc, err := locks.CreateLockClient(trans, masterServers, nil)
     if err != nil {
         success = false
         fmt.Println("error with creating lock client")
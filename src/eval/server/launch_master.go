@@ -5,57 +5,89 @@ import(
 	"raft"
 	"os"
     "os/signal"
-    "eval"
+    "flag"
     "fmt"
-    "strconv"
     "time"
 )
 
 func main() {
-    args := os.Args[1:]
-    if len(args) < 2 {
-        fmt.Println("Required 2 arguments, master IP addr, max freq, min freq, ideal freq, max inactive periods, and all worker IP addrs")
-        return
-    }
-    masterIP := args[0]
-    maxFreq,err := strconv.ParseFloat(args[1],64)
+    configPath := flag.String("config", "cluster.json", "path to cluster config file")
+    join := flag.String("join", "", "address of a single server to start that waits to be added to the running master cluster")
+    metricsAddr := flag.String("metrics", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100")
+    logSpec := flag.String("log", "", "levels to log at, e.g. \"info,rebalance=trace\", overrides config file")
+    tracePath := flag.String("trace", "", "file to append spans of traced requests to, as JSON lines")
+    flag.Parse()
+    conf, err := locks.LoadServerConfig(*configPath)
     if err != nil {
-        fmt.Println("bad max freq: ", err)
-        return
+        fmt.Println(err)
+        os.Exit(1)
     }
-    minFreq,err := strconv.ParseFloat(args[2],64)
-    if err != nil {
-        fmt.Println("bad max freq: ", err)
-        return
+    levels := conf.LogLevels()
+    if *logSpec != "" {
+        if err := levels.Set(*logSpec); err != nil {
+            fmt.Println("bad -log: ", err)
+            os.Exit(1)
+        }
     }
-    idealFreq,err := strconv.ParseFloat(args[3],64)
-    if err != nil {
-        fmt.Println("bad ideal freq: ", err)
-        return
+    logger := raft.NewLogger(os.Stdout, levels)
+    if *logSpec == "" {
+        /* kill -HUP picks up a changed log setting. */
+        locks.ReloadLogLevelsOnHangup(*configPath, levels, logger)
     }
-    maxInactivePeriods,err := strconv.Atoi(args[4])
-    if err != nil {
-        fmt.Println("bad max inactive periods: ", err)
+    if *metricsAddr != "" {
+        if _, err := locks.ServeMetrics(*metricsAddr, logger); err != nil {
+            fmt.Println("err : ", err)
+            os.Exit(1)
+        }
+    }
+    if *tracePath != "" {
+        exporter, err := raft.NewFileExporter(*tracePath)
+        if err != nil {
+            fmt.Println("err : ", err)
+            os.Exit(1)
+        }
+        raft.SetSpanExporter(exporter)
+    }
+    locks.LiveMigration = conf.Rebalance.LiveMigration
+    locks.RevocationDeadline = time.Duration(conf.Rebalance.RevokeAfter)
+    if *join != "" {
+        /* Starts from the same state as the other masters, so replaying
+           their log gives the same result. */
+        fmt.Println("Launching master server at ", *join, " to join the master cluster")
+        trans, err := raft.NewTCPTransport(*join, nil, 2, time.Second, nil)
+        if err != nil {
+            fmt.Println("err : ", err)
+            os.Exit(1)
+        }
+        fsms := locks.CreateMastersWithPolicy(1, conf.Masters, conf.Workers, conf.RebalancePolicy(), false, []*raft.NetworkTransport{trans}, logger)
+        cluster, err := conf.JoinCluster(fsms[0], trans)
+        if err != nil {
+            fmt.Println("err : ", err)
+            os.Exit(1)
+        }
+        c := make(chan os.Signal, 1)
+        signal.Notify(c, os.Interrupt)
+        <-c
+        cluster.Shutdown()
         return
     }
-    workerIPs := args[5:]
-    masterAddrs := eval.GenerateMasterServerList(masterIP)
-    recruitList := make([][]raft.ServerAddress, 0)
-    for _,workerIP := range workerIPs {
-        fmt.Println("worker ip", workerIP)
-        workers := eval.GenerateWorkerServerList(workerIP)
-        recruitList = append(recruitList, workers)
-    }
-    transports := make([]*raft.NetworkTransport, len(masterAddrs))
-    for i := range masterAddrs {
-        trans, err := raft.NewTCPTransport(string(masterAddrs[i]), nil, 2, time.Second, nil)
+    fmt.Println("Launching master cluster at ", conf.Masters)
+    transports := make([]*raft.NetworkTransport, len(conf.Masters))
+    for i := range conf.Masters {
+        trans, err := raft.NewTCPTransport(string(conf.Masters[i]), nil, 2, time.Second, nil)
         if err != nil {
             fmt.Println("err : ", err)
+            os.Exit(1)
         }
         transports[i] = trans
     }
-    locks.MakeCluster(3, locks.CreateMasters(len(masterAddrs), masterAddrs, recruitList, maxFreq, minFreq, idealFreq, maxInactivePeriods, false, transports), masterAddrs, transports)
+    cluster, err := conf.StartCluster(locks.CreateMastersWithPolicy(len(conf.Masters), conf.Masters, conf.Workers, conf.RebalancePolicy(), false, transports, logger), conf.Masters, transports)
+    if err != nil {
+        fmt.Println("err : ", err)
+        os.Exit(1)
+    }
     c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
+    cluster.Shutdown()
 }
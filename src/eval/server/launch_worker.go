@@ -4,33 +4,92 @@ import(
     "locks"
 	"os"
     "os/signal"
+    "flag"
     "fmt"
-    "eval"
     "raft"
     "time"
 )
 
 func main() {
-    args := os.Args[1:]
-    if len(args) != 2 {
-        fmt.Println("Need master IP addr and worker IP addr")
+    configPath := flag.String("config", "cluster.json", "path to cluster config file")
+    index := flag.Int("cluster", 0, "index of the worker cluster to launch in the config file's workers list")
+    join := flag.String("join", "", "address of a single server to start that waits to be added to a running worker cluster")
+    metricsAddr := flag.String("metrics", "", "address to serve Prometheus metrics on at /metrics, e.g. :9100")
+    logSpec := flag.String("log", "", "levels to log at, e.g. \"info,rebalance=trace\", overrides config file")
+    tracePath := flag.String("trace", "", "file to append spans of traced requests to, as JSON lines")
+    flag.Parse()
+    conf, err := locks.LoadServerConfig(*configPath)
+    if err != nil {
+        fmt.Println(err)
+        os.Exit(1)
+    }
+    levels := conf.LogLevels()
+    if *logSpec != "" {
+        if err := levels.Set(*logSpec); err != nil {
+            fmt.Println("bad -log: ", err)
+            os.Exit(1)
+        }
+    }
+    logger := raft.NewLogger(os.Stdout, levels)
+    if *logSpec == "" {
+        /* kill -HUP picks up a changed log setting. */
+        locks.ReloadLogLevelsOnHangup(*configPath, levels, logger)
+    }
+    if *metricsAddr != "" {
+        if _, err := locks.ServeMetrics(*metricsAddr, logger); err != nil {
+            fmt.Println("err : ", err)
+            os.Exit(1)
+        }
+    }
+    if *tracePath != "" {
+        exporter, err := raft.NewFileExporter(*tracePath)
+        if err != nil {
+            fmt.Println("err : ", err)
+            os.Exit(1)
+        }
+        raft.SetSpanExporter(exporter)
+    }
+    if *join != "" {
+        fmt.Println("Launching worker server at ", *join, " to join a worker cluster")
+        trans, err := raft.NewTCPTransport(*join, nil, 2, time.Second, nil)
+        if err != nil {
+            fmt.Println("err : ", err)
+            os.Exit(1)
+        }
+        fsms := locks.CreateWorkers(1, conf.Masters, []raft.ServerAddress{raft.ServerAddress(*join)}, []*raft.NetworkTransport{trans}, logger)
+        cluster, err := conf.JoinCluster(fsms[0], trans)
+        if err != nil {
+            fmt.Println("err : ", err)
+            os.Exit(1)
+        }
+        c := make(chan os.Signal, 1)
+        signal.Notify(c, os.Interrupt)
+        <-c
+        cluster.Shutdown()
         return
     }
-    masterIP := args[0]
-    workerIP := args[1]
-    workerAddrs := eval.GenerateWorkerServerList(workerIP)
+    if *index < 0 || *index >= len(conf.Workers) {
+        fmt.Printf("bad -cluster %d: config file %s lists %d worker clusters\n", *index, *configPath, len(conf.Workers))
+        os.Exit(1)
+    }
+    workerAddrs := conf.Workers[*index]
     fmt.Println("Launching worker cluster at ", workerAddrs)
-    masterAddrs := eval.GenerateMasterServerList(masterIP)
     transports := make([]*raft.NetworkTransport, len(workerAddrs))
     for i := range workerAddrs {
         trans, err := raft.NewTCPTransport(string(workerAddrs[i]), nil, 2, time.Second, nil)
         if err != nil {
             fmt.Println("err : ", err)
+            os.Exit(1)
         }
         transports[i] = trans
     }
-    locks.MakeCluster(3, locks.CreateWorkers(len(workerAddrs), masterAddrs, workerAddrs, transports), workerAddrs, transports)
+    cluster, err := conf.StartCluster(locks.CreateWorkers(len(workerAddrs), conf.Masters, workerAddrs, transports, logger), workerAddrs, transports)
+    if err != nil {
+        fmt.Println("err : ", err)
+        os.Exit(1)
+    }
     c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
+    cluster.Shutdown()
 }
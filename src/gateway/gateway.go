@@ -0,0 +1,454 @@
+package gateway
+
+import(
+    "locks"
+    "raft"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strings"
+    "sync"
+    "time"
+)
+
+/* Interval between attempts while long-polling for a held lock. */
+const acquirePollInterval = 100 * time.Millisecond
+
+/* Upper bound on how long a single acquire request may block. */
+const maxAcquireWait = 60 * time.Second
+
+/* Exposes the lock service over HTTP with JSON bodies. Each HTTP client opens
+   its own session, which owns a LockClient with its own transport, so locks
+   acquired through one session are held by a distinct client address. */
+type Gateway struct {
+    /* Location of master servers. */
+    masterServers   []raft.ServerAddress
+    /* IP address to bind session transports to. */
+    bindIP          string
+    /* Sessions not kept alive within this duration are closed. */
+    sessionTTL      time.Duration
+    /* Client used for requests that don't need a session. */
+    admin           *locks.LockClient
+    adminLock       sync.Mutex
+    /* Open sessions by session ID. */
+    sessions        map[string]*gatewaySession
+    sessionsLock    sync.Mutex
+    stopCh          chan bool
+    logger          raft.Logger
+}
+
+type gatewaySession struct {
+    id              string
+    trans           *raft.NetworkTransport
+    client          *locks.LockClient
+    /* Serializes calls into client, which is not safe for concurrent use. */
+    clientLock      sync.Mutex
+    lastContact     time.Time
+    closed          bool
+}
+
+/* Request and response bodies. */
+
+type LockRequest struct {
+    Lock        locks.Lock          `json:"lock"`
+    Sequencer   locks.Sequencer     `json:"sequencer,omitempty"`
+    /* Milliseconds to wait for a held lock; 0 fails immediately. */
+    WaitMillis  int                 `json:"wait_ms,omitempty"`
+}
+
+type DomainRequest struct {
+    Domain      locks.Domain        `json:"domain"`
+}
+
+type SessionResponse struct {
+    Session     string              `json:"session"`
+    TTLMillis   int64               `json:"ttl_ms"`
+}
+
+type AcquireResponse struct {
+    Sequencer   locks.Sequencer     `json:"sequencer"`
+}
+
+type ValidateResponse struct {
+    Valid       bool                `json:"valid"`
+}
+
+type ListResponse struct {
+    Locks       []locks.Lock        `json:"locks"`
+    Domains     []locks.Domain      `json:"domains"`
+}
+
+type ErrorResponse struct {
+    Error       string              `json:"error"`
+    Code        locks.ErrorCode     `json:"code"`
+    Retryable   bool                `json:"retryable"`
+}
+
+/* Create gateway. bindIP is the address session transports listen on and must
+   be reachable from the worker clusters. Logger may be nil, in which case the
+   default logger is used. */
+func CreateGateway(masterServers []raft.ServerAddress, bindIP string, sessionTTL time.Duration, logger raft.Logger) (*Gateway, error) {
+    if logger == nil {
+        logger = raft.DefaultLogger()
+    }
+    trans, err := raft.NewTCPTransport(bindIP + ":0", nil, 2, time.Second, nil)
+    if err != nil {
+        return nil, err
+    }
+    admin, err := locks.CreateLockClient(trans, masterServers, logger)
+    if err != nil {
+        trans.Close()
+        return nil, err
+    }
+    g := &Gateway{
+        masterServers:  masterServers,
+        bindIP:         bindIP,
+        sessionTTL:     sessionTTL,
+        admin:          admin,
+        sessions:       make(map[string]*gatewaySession),
+        stopCh:         make(chan bool, 1),
+        logger:         logger,
+    }
+    go g.expireSessionsLoop()
+    return g, nil
+}
+
+/* Close every open session and stop the gateway. */
+func (g *Gateway) Shutdown() {
+    g.stopCh <- true
+    g.sessionsLock.Lock()
+    for id, s := range g.sessions {
+        s.close()
+        delete(g.sessions, id)
+    }
+    g.sessionsLock.Unlock()
+}
+
+/* Routes:
+     POST   /v1/create                  {"lock"}
+     POST   /v1/delete                  {"lock"}
+     POST   /v1/domain                  {"domain"}
+     POST   /v1/list                    {"domain"}
+     POST   /v1/sessions
+     DELETE /v1/sessions/<id>
+     POST   /v1/sessions/<id>/keepalive
+     POST   /v1/sessions/<id>/acquire   {"lock", "wait_ms"}
+     POST   /v1/sessions/<id>/release   {"lock"}
+     POST   /v1/sessions/<id>/validate  {"lock", "sequencer"} */
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    path := strings.Trim(r.URL.Path, "/")
+    parts := strings.Split(path, "/")
+    if len(parts) < 2 || parts[0] != "v1" {
+        writeError(w, http.StatusNotFound, errors.New("unknown path"))
+        return
+    }
+    if parts[1] == "sessions" {
+        g.routeSession(w, r, parts[2:])
+        return
+    }
+    if len(parts) != 2 || r.Method != http.MethodPost {
+        writeError(w, http.StatusNotFound, errors.New("unknown path"))
+        return
+    }
+    switch parts[1] {
+        case "create":
+            var req LockRequest
+            if !readRequest(w, r, &req) {
+                return
+            }
+            g.adminLock.Lock()
+            err := g.admin.CreateLock(req.Lock)
+            g.adminLock.Unlock()
+            writeResult(w, struct{}{}, err)
+        case "delete":
+            var req LockRequest
+            if !readRequest(w, r, &req) {
+                return
+            }
+            g.adminLock.Lock()
+            err := g.admin.DeleteLock(req.Lock)
+            g.adminLock.Unlock()
+            writeResult(w, struct{}{}, err)
+        case "domain":
+            var req DomainRequest
+            if !readRequest(w, r, &req) {
+                return
+            }
+            g.adminLock.Lock()
+            err := g.admin.CreateDomain(req.Domain)
+            g.adminLock.Unlock()
+            writeResult(w, struct{}{}, err)
+        case "list":
+            var req DomainRequest
+            if !readRequest(w, r, &req) {
+                return
+            }
+            g.adminLock.Lock()
+            lockList, domainList, err := g.admin.ListDomain(req.Domain)
+            g.adminLock.Unlock()
+            writeResult(w, ListResponse{lockList, domainList}, err)
+        default:
+            writeError(w, http.StatusNotFound, errors.New("unknown path"))
+    }
+}
+
+func (g *Gateway) routeSession(w http.ResponseWriter, r *http.Request, parts []string) {
+    if len(parts) == 0 {
+        if r.Method != http.MethodPost {
+            writeError(w, http.StatusMethodNotAllowed, errors.New("use POST to open a session"))
+            return
+        }
+        s, err := g.openSession()
+        if err != nil {
+            writeError(w, http.StatusServiceUnavailable, err)
+            return
+        }
+        writeJSON(w, http.StatusOK, SessionResponse{s.id, int64(g.sessionTTL / time.Millisecond)})
+        return
+    }
+    s := g.findSession(parts[0])
+    if s == nil {
+        writeError(w, http.StatusNotFound, errors.New("no such session"))
+        return
+    }
+    if len(parts) == 1 {
+        if r.Method != http.MethodDelete {
+            writeError(w, http.StatusMethodNotAllowed, errors.New("use DELETE to close a session"))
+            return
+        }
+        g.closeSession(s.id)
+        writeJSON(w, http.StatusOK, struct{}{})
+        return
+    }
+    if len(parts) != 2 || r.Method != http.MethodPost {
+        writeError(w, http.StatusNotFound, errors.New("unknown path"))
+        return
+    }
+    switch parts[1] {
+        case "keepalive":
+            writeJSON(w, http.StatusOK, SessionResponse{s.id, int64(g.sessionTTL / time.Millisecond)})
+        case "acquire":
+            var req LockRequest
+            if !readRequest(w, r, &req) {
+                return
+            }
+            seq, err := g.acquire(s, req.Lock, time.Duration(req.WaitMillis) * time.Millisecond, r)
+            writeResult(w, AcquireResponse{seq}, err)
+        case "release":
+            var req LockRequest
+            if !readRequest(w, r, &req) {
+                return
+            }
+            s.clientLock.Lock()
+            err := s.client.ReleaseLock(req.Lock)
+            s.clientLock.Unlock()
+            writeResult(w, struct{}{}, err)
+        case "validate":
+            var req LockRequest
+            if !readRequest(w, r, &req) {
+                return
+            }
+            s.clientLock.Lock()
+            valid, err := s.client.ValidateLock(req.Lock, req.Sequencer)
+            s.clientLock.Unlock()
+            writeResult(w, ValidateResponse{valid}, err)
+        default:
+            writeError(w, http.StatusNotFound, errors.New("unknown path"))
+    }
+}
+
+/* Session management. */
+
+func (g *Gateway) openSession() (*gatewaySession, error) {
+    idBytes := make([]byte, 16)
+    if _, err := rand.Read(idBytes); err != nil {
+        return nil, err
+    }
+    trans, err := raft.NewTCPTransport(g.bindIP + ":0", nil, 2, time.Second, nil)
+    if err != nil {
+        return nil, err
+    }
+    client, err := locks.CreateLockClient(trans, g.masterServers, g.logger)
+    if err != nil {
+        trans.Close()
+        return nil, err
+    }
+    s := &gatewaySession{
+        id:             hex.EncodeToString(idBytes),
+        trans:          trans,
+        client:         client,
+        lastContact:    time.Now(),
+    }
+    g.sessionsLock.Lock()
+    g.sessions[s.id] = s
+    g.sessionsLock.Unlock()
+    return s, nil
+}
+
+/* Finds a session and records contact, so every request doubles as a keep-alive. */
+func (g *Gateway) findSession(id string) *gatewaySession {
+    g.sessionsLock.Lock()
+    defer g.sessionsLock.Unlock()
+    s, ok := g.sessions[id]
+    if !ok {
+        return nil
+    }
+    s.lastContact = time.Now()
+    return s
+}
+
+/* Records contact with a session that is still in use. */
+func (g *Gateway) touchSession(s *gatewaySession) {
+    g.sessionsLock.Lock()
+    s.lastContact = time.Now()
+    g.sessionsLock.Unlock()
+}
+
+func (g *Gateway) closeSession(id string) {
+    g.sessionsLock.Lock()
+    s, ok := g.sessions[id]
+    delete(g.sessions, id)
+    g.sessionsLock.Unlock()
+    if ok {
+        s.close()
+    }
+}
+
+/* Close sessions whose HTTP client stopped sending keep-alives. Closing the
+   lock client ends its raft sessions, so workers release its locks. */
+func (g *Gateway) expireSessionsLoop() {
+    for {
+        select {
+            case <-time.After(g.sessionTTL / 2):
+            case <-g.stopCh:
+                return
+        }
+        g.expireSessions(time.Now())
+    }
+}
+
+/* Close sessions last contacted more than a TTL before now. Sessions are
+   removed in the same critical section that finds them, so one touched in the
+   meantime is never closed. */
+func (g *Gateway) expireSessions(now time.Time) {
+    expired := make([]*gatewaySession, 0)
+    g.sessionsLock.Lock()
+    for id, s := range g.sessions {
+        if now.Sub(s.lastContact) > g.sessionTTL {
+            expired = append(expired, s)
+            delete(g.sessions, id)
+        }
+    }
+    g.sessionsLock.Unlock()
+    for _, s := range expired {
+        g.logger.Named("gateway").Info("expiring session", "session", s.id)
+        s.close()
+    }
+}
+
+func (s *gatewaySession) close() {
+    s.clientLock.Lock()
+    defer s.clientLock.Unlock()
+    if s.closed {
+        return
+    }
+    s.closed = true
+    s.client.DestroyLockClient()
+    s.trans.Close()
+}
+
+/* Acquire lock for session, polling while it is held by someone else until
+   wait elapses or the HTTP client goes away. Each attempt counts as contact,
+   so a long poll keeps its session, and the lock it wins, alive. */
+func (g *Gateway) acquire(s *gatewaySession, l locks.Lock, wait time.Duration, r *http.Request) (locks.Sequencer, error) {
+    attempt := func() (locks.Sequencer, error) {
+        s.clientLock.Lock()
+        defer s.clientLock.Unlock()
+        if s.closed {
+            return -1, errSessionClosed
+        }
+        seq, err := s.client.AcquireLock(l)
+        g.touchSession(s)
+        return seq, err
+    }
+    return pollAcquire(r.Context(), attempt, wait)
+}
+
+var errSessionClosed = errors.New("session closed")
+
+/* Calls attempt until it returns anything but ErrLockHeld, wait (at most
+   maxAcquireWait) elapses, or ctx is done. */
+func pollAcquire(ctx context.Context, attempt func() (locks.Sequencer, error), wait time.Duration) (locks.Sequencer, error) {
+    if wait > maxAcquireWait {
+        wait = maxAcquireWait
+    }
+    deadline := time.Now().Add(wait)
+    for {
+        seq, err := attempt()
+        if err == nil || !errors.Is(err, locks.ErrLockHeld) || time.Now().After(deadline) {
+            return seq, err
+        }
+        select {
+            case <-time.After(acquirePollInterval):
+            case <-ctx.Done():
+                return -1, ctx.Err()
+        }
+    }
+}
+
+/* JSON helpers. */
+
+func readRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+    if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+        writeError(w, http.StatusBadRequest, err)
+        return false
+    }
+    return true
+}
+
+func writeResult(w http.ResponseWriter, v interface{}, err error) {
+    if err != nil {
+        writeError(w, statusForError(err), err)
+        return
+    }
+    writeJSON(w, http.StatusOK, v)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+    response := ErrorResponse{Error: err.Error()}
+    var lockErr *locks.LockError
+    if errors.As(err, &lockErr) {
+        response.Code = lockErr.Code
+        response.Retryable = lockErr.Retryable
+    }
+    writeJSON(w, status, response)
+}
+
+func statusForError(err error) int {
+    var lockErr *locks.LockError
+    if !errors.As(err, &lockErr) {
+        return http.StatusInternalServerError
+    }
+    switch lockErr.Code {
+        case locks.CodeLockDoesntExist, locks.CodeDomainDoesntExist:
+            return http.StatusNotFound
+        case locks.CodeLockExists, locks.CodeDomainExists, locks.CodeLockHeld, locks.CodeLockRecalcitrant,
+             locks.CodeLockNotHeld, locks.CodeBadClientRelease:
+            return http.StatusConflict
+        case locks.CodeEmptyPath, locks.CodeNoIntermediateDomain, locks.CodeInvalidRequest:
+            return http.StatusBadRequest
+        case locks.CodeTransport, locks.CodeNotApplied, locks.CodeNoPlacement, locks.CodeNoServersForId,
+             locks.CodeCannotLocateLock:
+            return http.StatusServiceUnavailable
+    }
+    return http.StatusInternalServerError
+}
@@ -0,0 +1,182 @@
+package gateway
+
+import(
+    "locks"
+    "raft"
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+    "time"
+)
+
+func testGateway(t *testing.T, ttl time.Duration) *Gateway {
+    /* Sessions are only opened and closed here, so masters are never asked. */
+    g, err := CreateGateway([]raft.ServerAddress{"127.0.0.1:1"}, "127.0.0.1", ttl, raft.NopLogger())
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(g.Shutdown)
+    return g
+}
+
+func serve(g *Gateway, method string, path string, body string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    g.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+    return w
+}
+
+func TestSessionLifecycle(t *testing.T) {
+    g := testGateway(t, time.Minute)
+    w := serve(g, http.MethodPost, "/v1/sessions", "")
+    var opened SessionResponse
+    if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&opened) != nil {
+        t.Fatalf("open session: got %d %s", w.Code, w.Body)
+    }
+    if opened.Session == "" || opened.TTLMillis != 60000 {
+        t.Fatalf("got session %+v", opened)
+    }
+    if w := serve(g, http.MethodPost, "/v1/sessions/" + opened.Session + "/keepalive", ""); w.Code != http.StatusOK {
+        t.Fatalf("keepalive: got %d %s", w.Code, w.Body)
+    }
+    s := g.sessions[opened.Session]
+    if w := serve(g, http.MethodDelete, "/v1/sessions/" + opened.Session, ""); w.Code != http.StatusOK {
+        t.Fatalf("close session: got %d %s", w.Code, w.Body)
+    }
+    if !s.closed || len(g.sessions) != 0 {
+        t.Fatalf("session left open")
+    }
+    if w := serve(g, http.MethodPost, "/v1/sessions/" + opened.Session + "/keepalive", ""); w.Code != http.StatusNotFound {
+        t.Fatalf("keepalive after close: got %d, want %d", w.Code, http.StatusNotFound)
+    }
+}
+
+func TestBadRequests(t *testing.T) {
+    g := testGateway(t, time.Minute)
+    s, err := g.openSession()
+    if err != nil {
+        t.Fatal(err)
+    }
+    tests := []struct {
+        method  string
+        path    string
+        body    string
+        status  int
+    }{
+        {http.MethodGet, "/v2/create", "", http.StatusNotFound},
+        {http.MethodGet, "/v1/create", "", http.StatusNotFound},
+        {http.MethodPost, "/v1/rename", "{}", http.StatusNotFound},
+        {http.MethodPost, "/v1/create", "not json", http.StatusBadRequest},
+        {http.MethodGet, "/v1/sessions", "", http.StatusMethodNotAllowed},
+        {http.MethodPost, "/v1/sessions/" + s.id, "", http.StatusMethodNotAllowed},
+        {http.MethodPost, "/v1/sessions/" + s.id + "/steal", "{}", http.StatusNotFound},
+        {http.MethodPost, "/v1/sessions/" + s.id + "/acquire", "{", http.StatusBadRequest},
+        {http.MethodPost, "/v1/sessions/unknown/acquire", "{}", http.StatusNotFound},
+    }
+    for _, test := range tests {
+        if w := serve(g, test.method, test.path, test.body); w.Code != test.status {
+            t.Errorf("%s %s: got %d, want %d", test.method, test.path, w.Code, test.status)
+        }
+    }
+}
+
+func TestExpireSessions(t *testing.T) {
+    g := testGateway(t, time.Minute)
+    idle, err := g.openSession()
+    if err != nil {
+        t.Fatal(err)
+    }
+    busy, err := g.openSession()
+    if err != nil {
+        t.Fatal(err)
+    }
+    idle.lastContact = time.Now().Add(-2 * time.Minute)
+    busy.lastContact = time.Now().Add(-2 * time.Minute)
+    g.touchSession(busy)
+    g.expireSessions(time.Now())
+    if !idle.closed || g.findSession(idle.id) != nil {
+        t.Fatalf("idle session not expired")
+    }
+    if busy.closed || g.findSession(busy.id) != busy {
+        t.Fatalf("session touched within TTL expired")
+    }
+    /* A closed session refuses to acquire. */
+    request := httptest.NewRequest(http.MethodPost, "/", nil)
+    if _, err := g.acquire(idle, "/a", time.Second, request); err != errSessionClosed {
+        t.Fatalf("acquire on expired session: got %v", err)
+    }
+}
+
+func TestPollAcquire(t *testing.T) {
+    attempts := 0
+    heldFor := func(n int) func() (locks.Sequencer, error) {
+        attempts = 0
+        return func() (locks.Sequencer, error) {
+            attempts++
+            if attempts <= n {
+                return -1, locks.ErrLockHeld
+            }
+            return 7, nil
+        }
+    }
+    if seq, err := pollAcquire(context.Background(), heldFor(2), time.Second); seq != 7 || err != nil || attempts != 3 {
+        t.Fatalf("got %d, %v after %d attempts, want 7 after 3", seq, err, attempts)
+    }
+    if _, err := pollAcquire(context.Background(), heldFor(100), 0); !errors.Is(err, locks.ErrLockHeld) || attempts != 1 {
+        t.Fatalf("without wait: got %v after %d attempts", err, attempts)
+    }
+    failing := func() (locks.Sequencer, error) {
+        attempts++
+        return -1, locks.ErrLockDoesntExist
+    }
+    attempts = 0
+    if _, err := pollAcquire(context.Background(), failing, time.Second); err != locks.ErrLockDoesntExist || attempts != 1 {
+        t.Fatalf("other errors should end the poll, got %v after %d attempts", err, attempts)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    if _, err := pollAcquire(ctx, heldFor(100), time.Second); err != context.Canceled || attempts != 1 {
+        t.Fatalf("gone client: got %v after %d attempts", err, attempts)
+    }
+}
+
+func TestErrorStatus(t *testing.T) {
+    tests := []struct {
+        err     error
+        status  int
+    }{
+        {locks.ErrLockDoesntExist, http.StatusNotFound},
+        {locks.ErrDomainDoesntExist, http.StatusNotFound},
+        {locks.ErrLockHeld, http.StatusConflict},
+        {locks.ErrBadClientRelease, http.StatusConflict},
+        {locks.ErrEmptyPath, http.StatusBadRequest},
+        {locks.ErrInvalidRequest, http.StatusBadRequest},
+        {locks.ErrNotApplied, http.StatusServiceUnavailable},
+        {locks.ErrTransport, http.StatusServiceUnavailable},
+        {locks.ErrInvalidResponse, http.StatusInternalServerError},
+        {errSessionClosed, http.StatusInternalServerError},
+    }
+    for _, test := range tests {
+        w := httptest.NewRecorder()
+        writeResult(w, struct{}{}, test.err)
+        var response ErrorResponse
+        if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+            t.Fatal(err)
+        }
+        if w.Code != test.status || response.Error != test.err.Error() {
+            t.Errorf("%v: got %d %q, want %d", test.err, w.Code, response.Error, test.status)
+        }
+        var lockErr *locks.LockError
+        if errors.As(test.err, &lockErr) && (response.Code != lockErr.Code || response.Retryable != lockErr.Retryable) {
+            t.Errorf("%v: got code %d retryable %v", test.err, response.Code, response.Retryable)
+        }
+    }
+    w := httptest.NewRecorder()
+    writeResult(w, ValidateResponse{true}, nil)
+    if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"valid":true}` {
+        t.Fatalf("got %d %s", w.Code, w.Body)
+    }
+}
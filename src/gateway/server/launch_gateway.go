@@ -0,0 +1,48 @@
+package main
+
+import(
+    "gateway"
+    "eval"
+    "raft"
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+)
+
+func main() {
+    args := os.Args[1:]
+    if len(args) < 3 {
+        fmt.Println("Required 3 arguments: master IP addr, gateway IP addr, HTTP port, and optionally session TTL in seconds")
+        return
+    }
+    masterIP := args[0]
+    gatewayIP := args[1]
+    port, err := strconv.Atoi(args[2])
+    if err != nil {
+        fmt.Println("bad HTTP port: ", err)
+        return
+    }
+    sessionTTL := 30 * time.Second
+    if len(args) > 3 {
+        seconds, err := strconv.Atoi(args[3])
+        if err != nil || seconds <= 0 {
+            fmt.Println("bad session TTL: ", args[3])
+            return
+        }
+        sessionTTL = time.Duration(seconds) * time.Second
+    }
+    masterAddrs := eval.GenerateMasterServerList(masterIP)
+    g, err := gateway.CreateGateway(masterAddrs, gatewayIP, sessionTTL, raft.DefaultLogger())
+    if err != nil {
+        fmt.Println("err creating gateway: ", err)
+        return
+    }
+    defer g.Shutdown()
+    addr := gatewayIP + ":" + strconv.Itoa(port)
+    fmt.Println("Gateway listening at ", addr)
+    if err := http.ListenAndServe(addr, g); err != nil {
+        fmt.Println("err : ", err)
+    }
+}
@@ -0,0 +1,840 @@
+package main
+
+import(
+    "locks"
+    "raft"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/* Contents of the config file, by default ~/.lockctl.json:
+   {"masters": ["10.0.0.1:50000", "10.0.0.1:50001", "10.0.0.1:50002"], "bind": "10.0.0.5"} */
+type config struct {
+    /* Addresses of the master servers. */
+    Masters     []raft.ServerAddress    `json:"masters"`
+    /* IP address the client transport listens on. */
+    Bind        string                  `json:"bind"`
+}
+
+type command struct {
+    usage       string
+    run         func(lc *locks.LockClient, args []string) (interface{}, error)
+}
+
+var commands = map[string]command{
+    "create":   {"create <lock>", runCreate},
+    "delete":   {"delete <lock>", runDelete},
+    "acquire":  {"acquire [-hold duration] <lock>", runAcquire},
+    "validate": {"validate <lock> <sequencer>", runValidate},
+    "mkdomain": {"mkdomain <domain>", runMkdomain},
+    "ls":       {"ls [domain]", runLs},
+    "info":     {"info <lock>", runInfo},
+    "locate":   {"locate <lock>", runLocate},
+    "cluster":  {"cluster status | cluster {groups,locks,rebalance} [-domain d] [-group id]", runCluster},
+    "move-locks":   {"move-locks [-wait] <group> <lock>...", runMoveLocks},
+    "move-domain":  {"move-domain [-wait] <group> <domain>", runMoveDomain},
+    "move-status":  {"move-status [-wait] <move-id>", runMoveStatus},
+    "pool":         {"pool ls | pool add|enable|disable|remove <addr>,<addr>,...", runPool},
+    "drain":        {"drain <group>", runDrain},
+    "members":      {"members add|remove <group> <addr>", runMembers},
+    "masters":      {"masters ls | masters add|remove <addr>", runMasters},
+    "placement":    {"placement ls | placement set [-pin id] [-allow id,...] [-exclude id,...] [-hash] <domain> | placement clear <domain>", runPlacement},
+}
+
+/* Where results are written. Library logs go to stderr, and only if
+   verbose, to keep results (especially JSON) parseable. */
+var out io.Writer = os.Stdout
+
+var jsonOutput bool
+
+func main() {
+    flags := flag.NewFlagSet("lockctl", flag.ExitOnError)
+    configPath := flags.String("config", defaultConfigPath(), "path to config file")
+    masters := flags.String("masters", "", "comma separated master addresses, overrides config file")
+    bind := flags.String("bind", "", "IP address for client transport, overrides config file")
+    flags.BoolVar(&jsonOutput, "json", false, "print results as JSON")
+    verbose := flags.Bool("v", false, "print lock client debug output")
+    tracePath := flags.String("trace", "", "file to append spans of the request to, as JSON lines")
+    flags.Usage = func() { usage(flags) }
+    flags.Parse(os.Args[1:])
+    args := flags.Args()
+    if len(args) == 0 {
+        usage(flags)
+        os.Exit(2)
+    }
+    cmd, ok := commands[args[0]]
+    if !ok {
+        fmt.Fprintln(os.Stderr, "unknown command: ", args[0])
+        usage(flags)
+        os.Exit(2)
+    }
+
+    conf, err := loadConfig(*configPath, *masters, *bind)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: ", err)
+        os.Exit(1)
+    }
+    logger := raft.NopLogger()
+    if *verbose {
+        levels, _ := raft.NewLogLevels("debug")
+        logger = raft.NewLogger(os.Stderr, levels)
+    }
+    if *tracePath != "" {
+        exporter, err := raft.NewFileExporter(*tracePath)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "error: ", err)
+            os.Exit(1)
+        }
+        raft.SetSpanExporter(exporter)
+    }
+    trans, err := raft.NewTCPTransport(conf.Bind + ":0", nil, 2, time.Second, ioutil.Discard)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: ", err)
+        os.Exit(1)
+    }
+    lc, err := locks.CreateLockClient(trans, conf.Masters, logger)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "error: ", err)
+        os.Exit(1)
+    }
+    result, err := cmd.run(lc, args[1:])
+    lc.DestroyLockClient()
+    trans.Close()
+    if err != nil {
+        printError(err, cmd.usage)
+        os.Exit(1)
+    }
+    printResult(result)
+}
+
+func usage(flags *flag.FlagSet) {
+    fmt.Fprintln(os.Stderr, "usage: lockctl [flags] <command> [args]")
+    fmt.Fprintln(os.Stderr, "")
+    fmt.Fprintln(os.Stderr, "commands:")
+    names := []string{"create", "delete", "acquire", "validate", "mkdomain", "ls", "info", "locate", "cluster", "move-locks", "move-domain", "move-status", "placement", "pool", "drain", "members", "masters"}
+    for _, name := range names {
+        fmt.Fprintln(os.Stderr, "  " + commands[name].usage)
+    }
+    fmt.Fprintln(os.Stderr, "")
+    fmt.Fprintln(os.Stderr, "flags:")
+    flags.PrintDefaults()
+}
+
+func defaultConfigPath() string {
+    if path := os.Getenv("LOCKCTL_CONFIG"); path != "" {
+        return path
+    }
+    home, err := os.UserHomeDir()
+    if err != nil {
+        return ".lockctl.json"
+    }
+    return filepath.Join(home, ".lockctl.json")
+}
+
+/* Load config file, then apply overrides from flags. A missing config file is
+   fine as long as masters are given on the command line. */
+func loadConfig(path string, masters string, bind string) (config, error) {
+    conf := config{Bind: "127.0.0.1"}
+    data, err := ioutil.ReadFile(path)
+    if err == nil {
+        if err := json.Unmarshal(data, &conf); err != nil {
+            return conf, fmt.Errorf("bad config file %s: %v", path, err)
+        }
+    } else if !os.IsNotExist(err) {
+        return conf, err
+    }
+    if masters != "" {
+        conf.Masters = make([]raft.ServerAddress, 0)
+        for _, addr := range strings.Split(masters, ",") {
+            conf.Masters = append(conf.Masters, raft.ServerAddress(strings.TrimSpace(addr)))
+        }
+    }
+    if bind != "" {
+        conf.Bind = bind
+    }
+    if len(conf.Masters) == 0 {
+        return conf, fmt.Errorf("no master addresses; set \"masters\" in %s or use -masters", path)
+    }
+    return conf, nil
+}
+
+/* Results. */
+
+type okResult struct {
+    Message     string      `json:"message"`
+}
+
+type acquireResult struct {
+    Lock        locks.Lock      `json:"lock"`
+    Sequencer   locks.Sequencer `json:"sequencer"`
+}
+
+type validateResult struct {
+    Lock        locks.Lock      `json:"lock"`
+    Valid       bool            `json:"valid"`
+}
+
+type lsResult struct {
+    Domain      locks.Domain    `json:"domain"`
+    Locks       []locks.Lock    `json:"locks"`
+    Domains     []locks.Domain  `json:"domains"`
+}
+
+type infoResult struct {
+    Lock            locks.Lock              `json:"lock"`
+    ReplicaId       locks.ReplicaGroupId    `json:"replica_group"`
+    Held            bool                    `json:"held"`
+    Client          raft.ServerAddress      `json:"client,omitempty"`
+    Sequencer       locks.Sequencer         `json:"sequencer"`
+    Recalcitrant    bool                    `json:"recalcitrant"`
+    Disabled        bool                    `json:"disabled"`
+}
+
+type locateResult struct {
+    Lock        locks.Lock              `json:"lock"`
+    ReplicaId   locks.ReplicaGroupId    `json:"replica_group"`
+    ServerAddrs []raft.ServerAddress    `json:"servers"`
+}
+
+type groupResult struct {
+    ReplicaId   locks.ReplicaGroupId    `json:"replica_group"`
+    ServerAddrs []raft.ServerAddress    `json:"servers"`
+    NumLocks    int                     `json:"num_locks"`
+}
+
+type clusterResult struct {
+    Masters     []raft.ServerAddress    `json:"masters"`
+    Groups      []groupResult           `json:"groups"`
+}
+
+type groupStatsResult []locks.GroupStats
+
+type lockStatsResult []locks.LockStats
+
+type rebalanceResult locks.RebalanceStatusResponse
+
+type moveResult locks.MoveProgressResponse
+
+type placementResult []locks.DomainPolicy
+
+type poolResult locks.RecruitPoolResponse
+
+func printResult(result interface{}) {
+    if jsonOutput {
+        enc := json.NewEncoder(out)
+        enc.SetIndent("", "  ")
+        enc.Encode(result)
+        return
+    }
+    switch r := result.(type) {
+        case okResult:
+            fmt.Fprintln(out, r.Message)
+        case acquireResult:
+            fmt.Fprintf(out, "acquired %s, sequencer %d\n", r.Lock, r.Sequencer)
+        case validateResult:
+            if r.Valid {
+                fmt.Fprintf(out, "%s: valid\n", r.Lock)
+            } else {
+                fmt.Fprintf(out, "%s: not valid\n", r.Lock)
+            }
+        case lsResult:
+            for _, d := range r.Domains {
+                fmt.Fprintln(out, string(d) + "/")
+            }
+            for _, l := range r.Locks {
+                fmt.Fprintln(out, string(l))
+            }
+        case infoResult:
+            fmt.Fprintf(out, "lock:          %s\n", r.Lock)
+            fmt.Fprintf(out, "replica group: %d\n", r.ReplicaId)
+            fmt.Fprintf(out, "held:          %t\n", r.Held)
+            if r.Held {
+                fmt.Fprintf(out, "client:        %s\n", r.Client)
+            }
+            fmt.Fprintf(out, "sequencer:     %d\n", r.Sequencer)
+            fmt.Fprintf(out, "recalcitrant:  %t\n", r.Recalcitrant)
+            fmt.Fprintf(out, "disabled:      %t\n", r.Disabled)
+        case locateResult:
+            fmt.Fprintf(out, "%s: replica group %d at %s\n", r.Lock, r.ReplicaId, joinAddrs(r.ServerAddrs))
+        case clusterResult:
+            fmt.Fprintf(out, "masters: %s\n", joinAddrs(r.Masters))
+            fmt.Fprintf(out, "%-8s %-8s %s\n", "GROUP", "LOCKS", "SERVERS")
+            for _, g := range r.Groups {
+                fmt.Fprintf(out, "%-8d %-8d %s\n", g.ReplicaId, g.NumLocks, joinAddrs(g.ServerAddrs))
+            }
+        case groupStatsResult:
+            fmt.Fprintf(out, "%-8s %-8s %-12s %-9s %-8s %-8s %-12s %-8s %-12s %-9s %s\n", "GROUP", "LOCKS", "FREQ", "SESSIONS", "HELD", "QUEUE", "LATENCY", "HEALTHY", "REBALANCING", "DRAINING", "DOMAINS")
+            for _, g := range r {
+                draining := fmt.Sprint(g.Draining)
+                if g.DrainStalled {
+                    draining = "stalled"
+                }
+                fmt.Fprintf(out, "%-8d %-8d %-12.2f %-9d %-8d %-8d %-12s %-8t %-12t %-9s %s\n", g.ReplicaId, g.NumLocks, g.AvgFreq, g.Load.NumSessions, g.Load.NumHeld, g.Load.QueueDepth, g.Load.ApplyLatency, g.Healthy, g.Rebalancing, draining, joinDomains(g.Domains))
+            }
+        case lockStatsResult:
+            fmt.Fprintf(out, "%-8s %-12s %-12s %s\n", "GROUP", "FREQ", "MOVING-TO", "LOCK")
+            for _, l := range r {
+                dest := "-"
+                if l.Recalcitrant {
+                    dest = describeDestination(l.Destination)
+                }
+                fmt.Fprintf(out, "%-8d %-12.2f %-12s %s\n", l.ReplicaId, l.AvgFreq, dest, l.Lock)
+            }
+        case moveResult:
+            state := "in progress"
+            if r.Done {
+                state = "done"
+            }
+            fmt.Fprintf(out, "move %d to group %d: %s\n", r.MoveId, r.Target, state)
+            fmt.Fprintf(out, "  landed:    %d\n", len(r.Landed))
+            printLockList("  waiting:  ", r.Waiting)
+            printLockList("  in flight:", r.InFlight)
+            printLockList("  elsewhere:", r.Elsewhere)
+            printLockList("  deleted:  ", r.Deleted)
+        case poolResult:
+            fmt.Fprintf(out, "%d worker clusters can be recruited\n", r.Spare)
+            fmt.Fprintf(out, "%-10s %-8s %s\n", "AVAILABLE", "RETIRED", "SERVERS")
+            for _, c := range r.Clusters {
+                fmt.Fprintf(out, "%-10t %-8t %s\n", c.Available, c.Retired, joinAddrs(c.ServerAddrs))
+            }
+        case placementResult:
+            fmt.Fprintf(out, "%-24s %-8s %-16s %s\n", "DOMAIN", "MODE", "ALLOWED", "EXCLUDED")
+            for _, p := range r {
+                mode := "load"
+                if p.Policy.Hashed {
+                    mode = "hash"
+                }
+                fmt.Fprintf(out, "%-24s %-8s %-16s %s\n", p.Domain, mode, joinGroups(p.Policy.Allowed), joinGroups(p.Policy.Excluded))
+            }
+        case rebalanceResult:
+            groups := make([]string, 0)
+            for _, g := range r.RebalancingGroups {
+                groups = append(groups, strconv.Itoa(int(g)))
+            }
+            fmt.Fprintf(out, "rebalancing groups: %s\n", strings.Join(groups, ", "))
+            fmt.Fprintf(out, "%-8s %-12s %s\n", "GROUP", "MOVING-TO", "RECALCITRANT LOCK")
+            for _, l := range r.RecalcitrantLocks {
+                fmt.Fprintf(out, "%-8d %-12s %s\n", l.ReplicaId, describeDestination(l.Destination), l.Lock)
+            }
+            if len(r.Transfers) > 0 {
+                fmt.Fprintf(out, "%-8s %-8s %-8s %-10s %s\n", "TRANSFER", "FROM", "TO", "STATE", "LOCKS")
+                for _, t := range r.Transfers {
+                    fmt.Fprintf(out, "%-8d %-8d %-8d %-10s %d\n", t.Id, t.From, t.To, t.State, len(t.Locks))
+                }
+            }
+    }
+}
+
+func printError(err error, usage string) {
+    var lockErr *locks.LockError
+    isLockErr := errors.As(err, &lockErr)
+    if jsonOutput {
+        response := struct {
+            Error       string          `json:"error"`
+            Code        locks.ErrorCode `json:"code,omitempty"`
+            Retryable   bool            `json:"retryable"`
+        }{Error: err.Error()}
+        if isLockErr {
+            response.Code = lockErr.Code
+            response.Retryable = lockErr.Retryable
+        }
+        enc := json.NewEncoder(out)
+        enc.SetIndent("", "  ")
+        enc.Encode(response)
+        return
+    }
+    fmt.Fprintln(os.Stderr, "error: ", err)
+    if errors.Is(err, errUsage) {
+        fmt.Fprintln(os.Stderr, "usage: lockctl " + usage)
+    } else if isLockErr && lockErr.Retryable {
+        fmt.Fprintln(os.Stderr, "(retryable)")
+    }
+}
+
+func joinAddrs(addrs []raft.ServerAddress) string {
+    strs := make([]string, 0)
+    for _, addr := range addrs {
+        strs = append(strs, string(addr))
+    }
+    return strings.Join(strs, ", ")
+}
+
+func printLockList(label string, lockList []locks.Lock) {
+    names := make([]string, 0)
+    for _, l := range lockList {
+        names = append(names, string(l))
+    }
+    fmt.Fprintf(out, "%s %d %s\n", label, len(lockList), strings.Join(names, " "))
+}
+
+func joinGroups(groups []locks.ReplicaGroupId) string {
+    if len(groups) == 0 {
+        return "-"
+    }
+    strs := make([]string, 0)
+    for _, g := range groups {
+        strs = append(strs, strconv.Itoa(int(g)))
+    }
+    return strings.Join(strs, ",")
+}
+
+func parseGroups(s string) ([]locks.ReplicaGroupId, error) {
+    groups := make([]locks.ReplicaGroupId, 0)
+    if s == "" {
+        return groups, nil
+    }
+    for _, str := range strings.Split(s, ",") {
+        id, err := strconv.Atoi(strings.TrimSpace(str))
+        if err != nil {
+            return nil, fmt.Errorf("bad replica group %q", str)
+        }
+        groups = append(groups, locks.ReplicaGroupId(id))
+    }
+    return groups, nil
+}
+
+func joinDomains(domains []locks.Domain) string {
+    strs := make([]string, 0)
+    for _, d := range domains {
+        strs = append(strs, string(d))
+    }
+    return strings.Join(strs, ", ")
+}
+
+func describeDestination(dest locks.ReplicaGroupId) string {
+    if dest == locks.NO_WORKER {
+        return "(deleted)"
+    }
+    return strconv.Itoa(int(dest))
+}
+
+var errUsage = errors.New("wrong number of arguments")
+
+/* Commands. */
+
+func runCreate(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) != 1 {
+        return nil, errUsage
+    }
+    if err := lc.CreateLock(locks.Lock(args[0])); err != nil {
+        return nil, err
+    }
+    return okResult{"created lock " + args[0]}, nil
+}
+
+func runDelete(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) != 1 {
+        return nil, errUsage
+    }
+    if err := lc.DeleteLock(locks.Lock(args[0])); err != nil {
+        return nil, err
+    }
+    return okResult{"deleted lock " + args[0]}, nil
+}
+
+/* Acquires lock and holds it until interrupted or the hold duration elapses,
+   then releases it. Locks are owned by this process's client address, which
+   changes with every run, so there is no separate release command. */
+func runAcquire(lc *locks.LockClient, args []string) (interface{}, error) {
+    flags := flag.NewFlagSet("acquire", flag.ContinueOnError)
+    hold := flags.Duration("hold", 0, "release after this long; 0 holds until interrupted")
+    if err := flags.Parse(args); err != nil {
+        return nil, errUsage
+    }
+    if flags.NArg() != 1 {
+        return nil, errUsage
+    }
+    l := locks.Lock(flags.Arg(0))
+    revoked := make(chan bool, 1)
+    lc.SetRevocationHandler(func(revokedLock locks.Lock, deadline time.Time, forced bool) {
+        if revokedLock != l {
+            return
+        }
+        if forced {
+            fmt.Fprintln(os.Stderr, "lock", string(l), "was taken away")
+        } else {
+            fmt.Fprintln(os.Stderr, "asked to release lock", string(l))
+        }
+        select {
+            case revoked <- forced:
+            default:
+        }
+    })
+    seq, err := lc.AcquireLock(l)
+    if err != nil {
+        return nil, err
+    }
+    printResult(acquireResult{l, seq})
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, os.Interrupt)
+    var timeout <-chan time.Time
+    if *hold > 0 {
+        timeout = time.After(*hold)
+    }
+    select {
+        case <-c:
+        case <-timeout:
+        case forced := <-revoked:
+            if forced {
+                return okResult{"lost lock " + string(l)}, nil
+            }
+    }
+    if err := lc.ReleaseLock(l); err != nil {
+        return nil, err
+    }
+    return okResult{"released lock " + string(l)}, nil
+}
+
+func runValidate(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) != 2 {
+        return nil, errUsage
+    }
+    seq, err := strconv.Atoi(args[1])
+    if err != nil {
+        return nil, fmt.Errorf("bad sequencer %q", args[1])
+    }
+    valid, err := lc.ValidateLock(locks.Lock(args[0]), locks.Sequencer(seq))
+    if err != nil {
+        return nil, err
+    }
+    return validateResult{locks.Lock(args[0]), valid}, nil
+}
+
+func runMkdomain(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) != 1 {
+        return nil, errUsage
+    }
+    if err := lc.CreateDomain(locks.Domain(args[0])); err != nil {
+        return nil, err
+    }
+    return okResult{"created domain " + args[0]}, nil
+}
+
+func runLs(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) > 1 {
+        return nil, errUsage
+    }
+    d := locks.Domain("/")
+    if len(args) == 1 {
+        d = locks.Domain(args[0])
+    }
+    lockList, domainList, err := lc.ListDomain(d)
+    if err != nil {
+        return nil, err
+    }
+    return lsResult{d, lockList, domainList}, nil
+}
+
+func runInfo(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) != 1 {
+        return nil, errUsage
+    }
+    l := locks.Lock(args[0])
+    replicaID, _, err := lc.LocateLock(l)
+    if err != nil {
+        return nil, err
+    }
+    info, err := lc.LockInfo(l)
+    if err != nil {
+        return nil, err
+    }
+    return infoResult{l, replicaID, info.Held, info.Client, info.SeqNo, info.Recalcitrant, info.Disabled}, nil
+}
+
+func runLocate(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) != 1 {
+        return nil, errUsage
+    }
+    l := locks.Lock(args[0])
+    replicaID, servers, err := lc.LocateLock(l)
+    if err != nil {
+        return nil, err
+    }
+    return locateResult{l, replicaID, servers}, nil
+}
+
+func runCluster(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) == 0 {
+        return nil, errUsage
+    }
+    if args[0] == "status" {
+        if len(args) != 1 {
+            return nil, errUsage
+        }
+        status, err := lc.ClusterStatus()
+        if err != nil {
+            return nil, err
+        }
+        result := clusterResult{status.MasterCluster, make([]groupResult, 0)}
+        for _, g := range status.Groups {
+            result.Groups = append(result.Groups, groupResult{g.ReplicaId, g.ServerAddrs, g.NumLocks})
+        }
+        return result, nil
+    }
+    flags := flag.NewFlagSet("cluster", flag.ContinueOnError)
+    domain := flags.String("domain", "", "only show this domain and its subdomains")
+    group := flags.Int("group", int(locks.AnyGroup), "only show this replica group")
+    if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 0 {
+        return nil, errUsage
+    }
+    d := locks.Domain(*domain)
+    replicaGroup := locks.ReplicaGroupId(*group)
+    switch args[0] {
+        case "groups":
+            groups, err := lc.GroupStats(d, replicaGroup)
+            if err != nil {
+                return nil, err
+            }
+            return groupStatsResult(groups), nil
+        case "locks":
+            lockStats, err := lc.LockStats(d, replicaGroup)
+            if err != nil {
+                return nil, err
+            }
+            return lockStatsResult(lockStats), nil
+        case "rebalance":
+            status, err := lc.RebalanceStatus(d, replicaGroup)
+            if err != nil {
+                return nil, err
+            }
+            return rebalanceResult(status), nil
+    }
+    return nil, errUsage
+}
+
+/* Interval between progress polls while waiting for a move. */
+const movePollInterval = time.Second
+
+func runMoveLocks(lc *locks.LockClient, args []string) (interface{}, error) {
+    flags := flag.NewFlagSet("move-locks", flag.ContinueOnError)
+    wait := flags.Bool("wait", false, "wait until every lock has landed")
+    if err := flags.Parse(args); err != nil || flags.NArg() < 2 {
+        return nil, errUsage
+    }
+    target, err := strconv.Atoi(flags.Arg(0))
+    if err != nil {
+        return nil, fmt.Errorf("bad replica group %q", flags.Arg(0))
+    }
+    lockList := make([]locks.Lock, 0)
+    for _, l := range flags.Args()[1:] {
+        lockList = append(lockList, locks.Lock(l))
+    }
+    moveId, err := lc.MoveLocks(lockList, locks.ReplicaGroupId(target))
+    if err != nil {
+        return nil, err
+    }
+    return moveStatus(lc, moveId, *wait)
+}
+
+func runMoveDomain(lc *locks.LockClient, args []string) (interface{}, error) {
+    flags := flag.NewFlagSet("move-domain", flag.ContinueOnError)
+    wait := flags.Bool("wait", false, "wait until every lock has landed")
+    if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+        return nil, errUsage
+    }
+    target, err := strconv.Atoi(flags.Arg(0))
+    if err != nil {
+        return nil, fmt.Errorf("bad replica group %q", flags.Arg(0))
+    }
+    moveId, err := lc.MoveDomain(locks.Domain(flags.Arg(1)), locks.ReplicaGroupId(target))
+    if err != nil {
+        return nil, err
+    }
+    return moveStatus(lc, moveId, *wait)
+}
+
+func runMoveStatus(lc *locks.LockClient, args []string) (interface{}, error) {
+    flags := flag.NewFlagSet("move-status", flag.ContinueOnError)
+    wait := flags.Bool("wait", false, "wait until every lock has landed")
+    if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+        return nil, errUsage
+    }
+    moveId, err := strconv.Atoi(flags.Arg(0))
+    if err != nil {
+        return nil, fmt.Errorf("bad move ID %q", flags.Arg(0))
+    }
+    return moveStatus(lc, moveId, *wait)
+}
+
+/* Report progress of a move, polling until done if wait is set. */
+func moveStatus(lc *locks.LockClient, moveId int, wait bool) (interface{}, error) {
+    for {
+        progress, err := lc.MoveProgress(moveId)
+        if err != nil {
+            return nil, err
+        }
+        if !wait || progress.Done {
+            return moveResult(progress), nil
+        }
+        if !jsonOutput {
+            fmt.Fprintf(out, "move %d: %d landed, %d waiting for release, %d in flight\n", moveId, len(progress.Landed), len(progress.Waiting), len(progress.InFlight))
+        }
+        time.Sleep(movePollInterval)
+    }
+}
+
+func runPlacement(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) == 0 {
+        return nil, errUsage
+    }
+    switch args[0] {
+        case "ls":
+            if len(args) != 1 {
+                return nil, errUsage
+            }
+            policies, err := lc.PlacementPolicies()
+            if err != nil {
+                return nil, err
+            }
+            return placementResult(policies), nil
+        case "clear":
+            if len(args) != 2 {
+                return nil, errUsage
+            }
+            if _, err := lc.SetPlacementPolicy(locks.Domain(args[1]), locks.PlacementPolicy{}); err != nil {
+                return nil, err
+            }
+            return okResult{"cleared placement policy for " + args[1]}, nil
+        case "set":
+            flags := flag.NewFlagSet("placement set", flag.ContinueOnError)
+            pin := flags.Int("pin", int(locks.AnyGroup), "pin domain to this replica group")
+            allow := flags.String("allow", "", "comma separated replica groups domain may be placed at")
+            exclude := flags.String("exclude", "", "comma separated replica groups domain may not be placed at")
+            hashed := flags.Bool("hash", false, "spread locks over domain's groups by consistent hashing")
+            if err := flags.Parse(args[1:]); err != nil || flags.NArg() != 1 {
+                return nil, errUsage
+            }
+            allowed, err := parseGroups(*allow)
+            if err != nil {
+                return nil, err
+            }
+            excluded, err := parseGroups(*exclude)
+            if err != nil {
+                return nil, err
+            }
+            policy := locks.PlacementPolicy{Allowed: allowed, Excluded: excluded, Hashed: *hashed}
+            if *pin != int(locks.AnyGroup) {
+                if len(allowed) > 0 {
+                    return nil, errors.New("use either -pin or -allow")
+                }
+                policy.Allowed = locks.PinnedPolicy(locks.ReplicaGroupId(*pin)).Allowed
+            }
+            if len(policy.Allowed) == 0 && len(policy.Excluded) == 0 && !policy.Hashed {
+                return nil, errUsage
+            }
+            moveId, err := lc.SetPlacementPolicy(locks.Domain(flags.Arg(0)), policy)
+            if err != nil {
+                return nil, err
+            }
+            if moveId >= 0 {
+                return okResult{fmt.Sprintf("set placement policy for %s; moving violating locks as move %d", flags.Arg(0), moveId)}, nil
+            }
+            return okResult{"set placement policy for " + flags.Arg(0)}, nil
+    }
+    return nil, errUsage
+}
+
+func runPool(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) == 1 && args[0] == "ls" {
+        pool, err := lc.RecruitPool()
+        if err != nil {
+            return nil, err
+        }
+        return poolResult(pool), nil
+    }
+    if len(args) != 2 {
+        return nil, errUsage
+    }
+    addrs := make([]raft.ServerAddress, 0)
+    for _, addr := range strings.Split(args[1], ",") {
+        addrs = append(addrs, raft.ServerAddress(strings.TrimSpace(addr)))
+    }
+    var err error
+    switch args[0] {
+        case "add":
+            err = lc.AddWorkerCluster(addrs)
+        case "enable":
+            err = lc.SetWorkerClusterAvailable(addrs, true)
+        case "disable":
+            err = lc.SetWorkerClusterAvailable(addrs, false)
+        case "remove":
+            err = lc.RemoveWorkerCluster(addrs)
+        default:
+            return nil, errUsage
+    }
+    if err != nil {
+        return nil, err
+    }
+    return okResult{args[0] + " " + joinAddrs(addrs)}, nil
+}
+
+func runDrain(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) != 1 {
+        return nil, errUsage
+    }
+    group, err := strconv.Atoi(args[0])
+    if err != nil {
+        return nil, errUsage
+    }
+    response, err := lc.DrainGroup(locks.ReplicaGroupId(group))
+    if err != nil {
+        return nil, err
+    }
+    if response.Stalled {
+        return okResult{"draining group " + args[0] + ", stalled: some locks have no group to move to and none is left to recruit"}, nil
+    }
+    return okResult{"draining group " + args[0]}, nil
+}
+
+func runMembers(lc *locks.LockClient, args []string) (interface{}, error) {
+    if len(args) != 3 {
+        return nil, errUsage
+    }
+    group, err := strconv.Atoi(args[1])
+    if err != nil {
+        return nil, errUsage
+    }
+    addr := raft.ServerAddress(args[2])
+    var serverAddrs []raft.ServerAddress
+    switch args[0] {
+        case "add":
+            serverAddrs, err = lc.AddGroupServer(locks.ReplicaGroupId(group), addr)
+        case "remove":
+            serverAddrs, err = lc.RemoveGroupServer(locks.ReplicaGroupId(group), addr)
+        default:
+            return nil, errUsage
+    }
+    if err != nil {
+        return nil, err
+    }
+    return okResult{"group " + args[1] + " servers: " + joinAddrs(serverAddrs)}, nil
+}
+
+func runMasters(lc *locks.LockClient, args []string) (interface{}, error) {
+    var masters []raft.ServerAddress
+    var err error
+    switch {
+        case len(args) == 1 && args[0] == "ls":
+            masters, err = lc.RefreshMasters()
+        case len(args) == 2 && args[0] == "add":
+            masters, err = lc.AddMasterServer(raft.ServerAddress(args[1]))
+        case len(args) == 2 && args[0] == "remove":
+            masters, err = lc.RemoveMasterServer(raft.ServerAddress(args[1]))
+        default:
+            return nil, errUsage
+    }
+    if err != nil {
+        return nil, err
+    }
+    return okResult{"master servers: " + joinAddrs(masters)}, nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import(
+    "locks"
+    "raft"
+    "bytes"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+)
+
+/* Capture results printed by f, as text or JSON. */
+func captureOutput(asJSON bool, f func()) string {
+    var b bytes.Buffer
+    defer func() { out, jsonOutput = os.Stdout, false }()
+    out = &b
+    jsonOutput = asJSON
+    f()
+    return b.String()
+}
+
+func TestPrintResultText(t *testing.T) {
+    tests := []struct {
+        result  interface{}
+        want    string
+    }{
+        {okResult{"created lock /a"}, "created lock /a\n"},
+        {acquireResult{"/a", 3}, "acquired /a, sequencer 3\n"},
+        {validateResult{"/a", false}, "/a: not valid\n"},
+        {lsResult{"/", []locks.Lock{"/l"}, []locks.Domain{"/d"}}, "/d/\n/l\n"},
+        {locateResult{"/a", 2, []raft.ServerAddress{"h:1", "h:2"}}, "/a: replica group 2 at h:1, h:2\n"},
+        {moveResult{MoveId: 4, Target: 1, Landed: []locks.Lock{"/a"}, Waiting: []locks.Lock{"/b", "/c"}},
+            "move 4 to group 1: in progress\n  landed:    1\n  waiting:   2 /b /c\n  in flight: 0 \n  elsewhere: 0 \n  deleted:   0 \n"},
+        {lockStatsResult{{Lock: "/a", ReplicaId: 1, AvgFreq: 0.5, Recalcitrant: true, Destination: locks.NO_WORKER}},
+            "GROUP    FREQ         MOVING-TO    LOCK\n1        0.50         (deleted)    /a\n"},
+        {clusterResult{[]raft.ServerAddress{"m:1"}, []groupResult{{0, []raft.ServerAddress{"w:1"}, 5}}},
+            "masters: m:1\nGROUP    LOCKS    SERVERS\n0        5        w:1\n"},
+    }
+    for _, test := range tests {
+        if got := captureOutput(false, func() { printResult(test.result) }); got != test.want {
+            t.Errorf("%T: got\n%q\nwant\n%q", test.result, got, test.want)
+        }
+    }
+}
+
+func TestPrintResultJSON(t *testing.T) {
+    got := captureOutput(true, func() { printResult(acquireResult{"/a", 3}) })
+    var decoded acquireResult
+    if err := json.Unmarshal([]byte(got), &decoded); err != nil || decoded != (acquireResult{"/a", 3}) {
+        t.Fatalf("got %q, %v", got, err)
+    }
+    got = captureOutput(true, func() { printError(locks.ErrLockHeld, "") })
+    var response struct {
+        Error       string
+        Code        locks.ErrorCode
+        Retryable   bool
+    }
+    if err := json.Unmarshal([]byte(got), &response); err != nil {
+        t.Fatal(err)
+    }
+    if response.Error != locks.ErrLockHeld.Message || response.Code != locks.CodeLockHeld || !response.Retryable {
+        t.Fatalf("got %+v", response)
+    }
+    got = captureOutput(true, func() { printError(errors.New("bad config"), "") })
+    if strings.Contains(got, "code") {
+        t.Fatalf("non lock error should have no code, got %s", got)
+    }
+}
+
+func TestLoadConfig(t *testing.T) {
+    dir, err := ioutil.TempDir("", "lockctl")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    path := filepath.Join(dir, "lockctl.json")
+    ioutil.WriteFile(path, []byte(`{"masters": ["m:1", "m:2"], "bind": "10.0.0.5"}`), 0644)
+
+    conf, err := loadConfig(path, "", "")
+    if err != nil || !reflect.DeepEqual(conf, config{[]raft.ServerAddress{"m:1", "m:2"}, "10.0.0.5"}) {
+        t.Fatalf("from file: got %+v, %v", conf, err)
+    }
+    conf, err = loadConfig(path, "n:1, n:2", "10.0.0.6")
+    if err != nil || !reflect.DeepEqual(conf, config{[]raft.ServerAddress{"n:1", "n:2"}, "10.0.0.6"}) {
+        t.Fatalf("flags should override file: got %+v, %v", conf, err)
+    }
+    missing := filepath.Join(dir, "missing.json")
+    conf, err = loadConfig(missing, "n:1", "")
+    if err != nil || conf.Bind != "127.0.0.1" {
+        t.Fatalf("missing file with masters flag: got %+v, %v", conf, err)
+    }
+    if _, err := loadConfig(missing, "", ""); err == nil {
+        t.Fatalf("no masters anywhere accepted")
+    }
+    ioutil.WriteFile(path, []byte(`{"masters": `), 0644)
+    if _, err := loadConfig(path, "n:1", ""); err == nil {
+        t.Fatalf("bad config file accepted")
+    }
+}
+
+func TestParseGroups(t *testing.T) {
+    groups, err := parseGroups("1, 2,3")
+    if err != nil || !reflect.DeepEqual(groups, []locks.ReplicaGroupId{1, 2, 3}) {
+        t.Fatalf("got %v, %v", groups, err)
+    }
+    if groups, err := parseGroups(""); err != nil || len(groups) != 0 {
+        t.Fatalf("empty list: got %v, %v", groups, err)
+    }
+    if _, err := parseGroups("1,x"); err == nil {
+        t.Fatalf("bad group accepted")
+    }
+    if joinGroups(nil) != "-" || joinGroups([]locks.ReplicaGroupId{1, 2}) != "1,2" {
+        t.Fatalf("joinGroups round trip failed")
+    }
+}
+
+/* Bad arguments are rejected before the client is used, so no cluster is needed. */
+func TestCommandArguments(t *testing.T) {
+    tests := []struct {
+        command string
+        args    []string
+        usage   bool
+    }{
+        {"create", nil, true},
+        {"delete", []string{"/a", "/b"}, true},
+        {"acquire", []string{"-hold"}, true},
+        {"acquire", []string{"-hold", "1s"}, true},
+        {"validate", []string{"/a"}, true},
+        {"validate", []string{"/a", "seq"}, false},
+        {"ls", []string{"/a", "/b"}, true},
+        {"cluster", nil, true},
+        {"cluster", []string{"status", "extra"}, true},
+        {"cluster", []string{"groups", "-domain"}, true},
+        {"cluster", []string{"shards"}, true},
+        {"move-locks", []string{"1"}, true},
+        {"move-locks", []string{"one", "/a"}, false},
+        {"move-domain", []string{"-wait", "1"}, true},
+        {"move-status", []string{"first"}, false},
+        {"placement", []string{"set", "/d"}, true},
+        {"placement", []string{"set", "-pin", "1", "-allow", "2", "/d"}, false},
+        {"placement", []string{"set", "-exclude", "x", "/d"}, false},
+        {"placement", []string{"clear"}, true},
+        {"pool", []string{"grow", "h:1"}, true},
+        {"drain", []string{"first"}, true},
+        {"members", []string{"swap", "1", "h:1"}, true},
+        {"masters", []string{"add"}, true},
+    }
+    for _, test := range tests {
+        result, err := commands[test.command].run(nil, test.args)
+        if err == nil || result != nil || errors.Is(err, errUsage) != test.usage {
+            t.Errorf("%s %v: got %v, %v", test.command, test.args, result, err)
+        }
+    }
+    if _, ok := commands["release"]; ok {
+        t.Errorf("release can't work across runs, but is a command")
+    }
+}
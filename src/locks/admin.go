@@ -0,0 +1,338 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+)
+
+/* Read-only admin commands exposing the master's view of placement and load.
+   Every query can be restricted to a domain (including its subdomains) and to
+   a single replica group; the empty domain and AnyGroup match everything. */
+
+/* Matches every replica group in admin queries. */
+const AnyGroup = NO_WORKER
+
+type GroupStats struct {
+    ReplicaId       ReplicaGroupId
+    ServerAddrs     []raft.ServerAddress
+    /* Number of locks stored at group. */
+    NumLocks        int
+    /* Exponentially weighted access frequency reported for group. */
+    AvgFreq         float64
+    LastUpdate      time.Time
+    /* True if locks are currently being moved off group. */
+    Rebalancing     bool
+    /* Latest load reported by group. */
+    Load            WorkerLoad
+    /* True if group is being emptied for removal. */
+    Draining        bool
+    /* True if draining some of group's locks waits for a group to move them
+       to, as none is left to recruit. */
+    DrainStalled    bool
+    /* False if group stopped answering health probes. */
+    Healthy         bool
+    /* Time health last changed; zero if it never has. */
+    HealthChanged   time.Time
+    /* Domains where new locks may be placed at group. */
+    Domains         []Domain
+}
+
+type GroupStatsResponse struct {
+    Groups  []GroupStats
+    Err     *LockError
+}
+
+type LockStats struct {
+    Lock            Lock
+    ReplicaId       ReplicaGroupId
+    AvgFreq         float64
+    LastUpdate      time.Time
+    /* True if lock is waiting to be released before it can move. */
+    Recalcitrant    bool
+    /* Group lock moves to once released; NO_WORKER if it will be deleted. */
+    Destination     ReplicaGroupId
+}
+
+type LockStatsResponse struct {
+    Locks   []LockStats
+    Err     *LockError
+}
+
+type RecalcitrantLock struct {
+    Lock            Lock
+    ReplicaId       ReplicaGroupId
+    /* Group lock moves to once released; NO_WORKER if it will be deleted. */
+    Destination     ReplicaGroupId
+    /* Time release will be forced; zero if it won't be. */
+    RevokeDeadline  time.Time
+}
+
+type RebalanceStatusResponse struct {
+    /* Groups with locks currently being moved off. */
+    RebalancingGroups   []ReplicaGroupId
+    /* Held locks waiting for release before moving or being deleted. */
+    RecalcitrantLocks   []RecalcitrantLock
+    /* Transfers of locks between groups that haven't finished. */
+    Transfers           []Transfer
+    Err                 *LockError
+}
+
+/* Master side. */
+
+func parseAdminFilter(args map[string]string) (Domain, ReplicaGroupId, bool) {
+    d := Domain(args[DomainArgKey])
+    if len(d) > 0 && string(d[0]) != "/" {
+        d = "/" + d
+    }
+    group := AnyGroup
+    if groupStr, ok := args[GroupArgKey]; ok {
+        id, err := strconv.Atoi(groupStr)
+        if err != nil {
+            return d, group, false
+        }
+        group = ReplicaGroupId(id)
+    }
+    return d, group, true
+}
+
+/* True if domain is d or a subdomain of d. The empty domain matches all. */
+func inDomain(domain Domain, d Domain) bool {
+    if d == "" || d == "/" || domain == d {
+        return true
+    }
+    return strings.HasPrefix(string(domain), string(d) + "/")
+}
+
+func matchesGroup(replicaGroup ReplicaGroupId, group ReplicaGroupId) bool {
+    return group == AnyGroup || replicaGroup == group
+}
+
+/* Assumes FSM already locked. */
+func (m *MasterFSM) sortedGroups() []ReplicaGroupId {
+    ids := make([]int, 0)
+    for id := range m.ClusterMap {
+        ids = append(ids, int(id))
+    }
+    sort.Ints(ids)
+    groups := make([]ReplicaGroupId, 0)
+    for _, id := range ids {
+        groups = append(groups, ReplicaGroupId(id))
+    }
+    return groups
+}
+
+/* Assumes FSM already locked. */
+func (m *MasterFSM) sortedLocks() []Lock {
+    names := make([]string, 0)
+    for l := range m.LockMap {
+        names = append(names, string(l))
+    }
+    sort.Strings(names)
+    lockList := make([]Lock, 0)
+    for _, l := range names {
+        lockList = append(lockList, Lock(l))
+    }
+    return lockList
+}
+
+func (m *MasterFSM) groupStats(d Domain, group ReplicaGroupId) GroupStatsResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    /* Find domains placed at each group. */
+    domainNames := make([]string, 0)
+    for domain := range m.DomainPlacementMap {
+        domainNames = append(domainNames, string(domain))
+    }
+    sort.Strings(domainNames)
+    groupDomains := make(map[ReplicaGroupId][]Domain)
+    for _, name := range domainNames {
+        domain := Domain(name)
+        if !inDomain(domain, d) {
+            continue
+        }
+        for _, replicaGroup := range m.DomainPlacementMap[domain] {
+            groupDomains[replicaGroup] = append(groupDomains[replicaGroup], domain)
+        }
+    }
+    /* With a domain filter, also count groups still holding locks from it. */
+    groupLocks := make(map[ReplicaGroupId]bool)
+    for l, replicaGroup := range m.LockMap {
+        if inDomain(getParentDomain(string(l)), d) {
+            groupLocks[replicaGroup] = true
+        }
+    }
+    response := GroupStatsResponse{make([]GroupStats, 0), Success}
+    for _, replicaGroup := range m.sortedGroups() {
+        if !matchesGroup(replicaGroup, group) {
+            continue
+        }
+        if _, ok := groupDomains[replicaGroup]; !ok && !groupLocks[replicaGroup] && d != "" {
+            continue
+        }
+        stats := GroupStats{
+            ReplicaId:      replicaGroup,
+            ServerAddrs:    m.ClusterMap[replicaGroup],
+            NumLocks:       m.NumLocksHeld[replicaGroup],
+            AvgFreq:        m.GroupFreqStatsMap[replicaGroup].AvgFreq,
+            LastUpdate:     m.GroupFreqStatsMap[replicaGroup].LastUpdate,
+            Rebalancing:    m.RebalancingInProgress[replicaGroup],
+            Load:           m.groupLoad(replicaGroup),
+            Draining:       m.DrainingGroups[replicaGroup],
+            DrainStalled:   m.stalledLocks(replicaGroup) > 0,
+            Healthy:        m.isHealthy(replicaGroup),
+            HealthChanged:  m.GroupHealthMap[replicaGroup].Since,
+            Domains:        groupDomains[replicaGroup],
+        }
+        if stats.Domains == nil {
+            stats.Domains = make([]Domain, 0)
+        }
+        response.Groups = append(response.Groups, stats)
+    }
+    return response
+}
+
+func (m *MasterFSM) lockStats(d Domain, group ReplicaGroupId) LockStatsResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    response := LockStatsResponse{make([]LockStats, 0), Success}
+    for _, l := range m.sortedLocks() {
+        replicaGroup := m.LockMap[l]
+        if !matchesGroup(replicaGroup, group) || !inDomain(getParentDomain(string(l)), d) {
+            continue
+        }
+        dest, recalcitrant := m.RecalcitrantDestMap[l]
+        if !recalcitrant {
+            dest = replicaGroup
+        }
+        stats := LockStats{
+            Lock:           l,
+            ReplicaId:      replicaGroup,
+            AvgFreq:        m.LockFreqStatsMap[l].AvgFreq,
+            LastUpdate:     m.LockFreqStatsMap[l].LastUpdate,
+            Recalcitrant:   recalcitrant,
+            Destination:    dest,
+        }
+        response.Locks = append(response.Locks, stats)
+    }
+    return response
+}
+
+func (m *MasterFSM) rebalanceStatus(d Domain, group ReplicaGroupId) RebalanceStatusResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    response := RebalanceStatusResponse{make([]ReplicaGroupId, 0), make([]RecalcitrantLock, 0), make([]Transfer, 0), Success}
+    for _, replicaGroup := range m.sortedGroups() {
+        if m.RebalancingInProgress[replicaGroup] && matchesGroup(replicaGroup, group) {
+            response.RebalancingGroups = append(response.RebalancingGroups, replicaGroup)
+        }
+    }
+    for _, l := range m.sortedLocks() {
+        dest, ok := m.RecalcitrantDestMap[l]
+        if !ok || !inDomain(getParentDomain(string(l)), d) {
+            continue
+        }
+        replicaGroup := m.LockMap[l]
+        if !matchesGroup(replicaGroup, group) && !matchesGroup(dest, group) {
+            continue
+        }
+        response.RecalcitrantLocks = append(response.RecalcitrantLocks, RecalcitrantLock{l, replicaGroup, dest, m.RevokeDeadlineMap[l]})
+    }
+    for _, t := range m.sortedTransfers() {
+        if !matchesGroup(t.From, group) && !matchesGroup(t.To, group) {
+            continue
+        }
+        /* With a domain filter, show only transfers moving locks from it, and
+           only those locks. */
+        if d != "" {
+            t.Locks = locksInDomain(t.Locks, d)
+            if len(t.Locks) == 0 {
+                continue
+            }
+            t.Recalcitrant = locksInDomain(t.Recalcitrant, d)
+            if t.States != nil {
+                states := make(map[Lock]MigratedLock)
+                for l, state := range t.States {
+                    if inDomain(getParentDomain(string(l)), d) {
+                        states[l] = state
+                    }
+                }
+                t.States = states
+            }
+        }
+        response.Transfers = append(response.Transfers, t)
+    }
+    return response
+}
+
+func locksInDomain(lockList []Lock, d Domain) []Lock {
+    filtered := make([]Lock, 0)
+    for _, l := range lockList {
+        if inDomain(getParentDomain(string(l)), d) {
+            filtered = append(filtered, l)
+        }
+    }
+    return filtered
+}
+
+/* Client side. */
+
+/* Send an admin command to the master cluster and decode the response into
+   response. Returns the error carried in the response, if any. */
+func (lc *LockClient) adminRequest(args map[string]string, response interface{}, responseErr func() *LockError) error {
+    defer lc.startSpan(args[FunctionKey], "group", args[GroupArgKey], "domain", args[DomainArgKey])()
+    data, err := json.Marshal(args)
+    if err != nil {
+        return err
+    }
+    resp := raft.ClientResponse{}
+    send_err := lc.sendToMasters(data, &resp)
+    if req_err := requestError(send_err, &resp); req_err != nil {
+        return req_err
+    }
+    unmarshal_err := json.Unmarshal(resp.ResponseData, response)
+    if unmarshal_err != nil {
+        lc.logger.Warn("invalid response", "op", args[FunctionKey], "error", unmarshal_err)
+        return ErrInvalidResponse
+    }
+    if err := responseErr(); err != nil {
+        return err
+    }
+    return nil
+}
+
+func adminFilterArgs(function string, d Domain, group ReplicaGroupId) map[string]string {
+    args := make(map[string]string)
+    args[FunctionKey] = function
+    if d != "" {
+        args[DomainArgKey] = string(d)
+    }
+    if group != AnyGroup {
+        args[GroupArgKey] = strconv.Itoa(int(group))
+    }
+    return args
+}
+
+/* Returns placement and load for each replica group. */
+func (lc *LockClient) GroupStats(d Domain, group ReplicaGroupId) ([]GroupStats, error) {
+    var response GroupStatsResponse
+    err := lc.adminRequest(adminFilterArgs(GroupStatsCommand, d, group), &response, func() *LockError { return response.Err })
+    return response.Groups, err
+}
+
+/* Returns location and access frequency for each lock. */
+func (lc *LockClient) LockStats(d Domain, group ReplicaGroupId) ([]LockStats, error) {
+    var response LockStatsResponse
+    err := lc.adminRequest(adminFilterArgs(LockStatsCommand, d, group), &response, func() *LockError { return response.Err })
+    return response.Locks, err
+}
+
+/* Returns groups being rebalanced and locks waiting on release to move. */
+func (lc *LockClient) RebalanceStatus(d Domain, group ReplicaGroupId) (RebalanceStatusResponse, error) {
+    var response RebalanceStatusResponse
+    err := lc.adminRequest(adminFilterArgs(RebalanceStatusCommand, d, group), &response, func() *LockError { return response.Err })
+    return response, err
+}
@@ -0,0 +1,125 @@
+package locks
+
+import(
+    "reflect"
+    "testing"
+)
+
+func TestParseAdminFilter(t *testing.T) {
+    d, group, ok := parseAdminFilter(map[string]string{DomainArgKey: "a", GroupArgKey: "1"})
+    if !ok || d != "/a" || group != 1 {
+        t.Fatalf("got %q, %d, %v", d, group, ok)
+    }
+    if d, group, ok := parseAdminFilter(map[string]string{}); !ok || d != "" || group != AnyGroup {
+        t.Fatalf("no filter: got %q, %d, %v", d, group, ok)
+    }
+    if _, _, ok := parseAdminFilter(map[string]string{GroupArgKey: "one"}); ok {
+        t.Fatalf("bad group accepted")
+    }
+}
+
+func TestGroupStats(t *testing.T) {
+    m := testMaster()
+    groups := m.groupStats("", AnyGroup).Groups
+    if len(groups) != 2 {
+        t.Fatalf("got %d groups, want 2", len(groups))
+    }
+    g0, g1 := groups[0], groups[1]
+    if g0.ReplicaId != 0 || g0.NumLocks != 1 || g0.AvgFreq != 2.5 || !g0.Healthy || g0.Draining || g0.Rebalancing {
+        t.Fatalf("group 0: got %+v", g0)
+    }
+    if g0.Load.QueueDepth != 3 || g0.Load.NumLocks != 1 || !reflect.DeepEqual(g0.Domains, []Domain{"/", "/a"}) {
+        t.Fatalf("group 0 load or domains: got %+v", g0)
+    }
+    if g1.ReplicaId != 1 || g1.NumLocks != 2 || g1.Healthy || !g1.Draining || !g1.Rebalancing || !reflect.DeepEqual(g1.Domains, []Domain{"/a", "/b"}) {
+        t.Fatalf("group 1: got %+v", g1)
+    }
+
+    tests := []struct {
+        d       Domain
+        group   ReplicaGroupId
+        want    map[ReplicaGroupId][]Domain
+    }{
+        {"", 1, map[ReplicaGroupId][]Domain{1: {"/a", "/b"}}},
+        {"/a", AnyGroup, map[ReplicaGroupId][]Domain{0: {"/a"}, 1: {"/a"}}},
+        {"/b", AnyGroup, map[ReplicaGroupId][]Domain{1: {"/b"}}},
+        {"/c", AnyGroup, map[ReplicaGroupId][]Domain{}},
+    }
+    for _, test := range tests {
+        got := make(map[ReplicaGroupId][]Domain)
+        for _, g := range m.groupStats(test.d, test.group).Groups {
+            got[g.ReplicaId] = g.Domains
+        }
+        if !reflect.DeepEqual(got, test.want) {
+            t.Errorf("%q, group %d: got %v, want %v", test.d, test.group, got, test.want)
+        }
+    }
+
+    /* A group still holding locks of a domain placed elsewhere is shown. */
+    m.DomainPlacementMap["/b"] = []ReplicaGroupId{0}
+    got := m.groupStats("/b", AnyGroup).Groups
+    if len(got) != 2 || len(got[1].Domains) != 0 {
+        t.Fatalf("group with leftover locks: got %+v", got)
+    }
+}
+
+func TestLockStats(t *testing.T) {
+    m := testMaster()
+    want := []LockStats{
+        {Lock: "/a/l1", ReplicaId: 0, AvgFreq: 2.5, LastUpdate: testTime(100), Destination: 0},
+        {Lock: "/a/l2", ReplicaId: 1, AvgFreq: 0.5, LastUpdate: testTime(90), Recalcitrant: true, Destination: 0},
+        {Lock: "/b/l3", ReplicaId: 1, Destination: 1},
+    }
+    if got := m.lockStats("", AnyGroup).Locks; !reflect.DeepEqual(got, want) {
+        t.Fatalf("got %+v, want %+v", got, want)
+    }
+    if got := m.lockStats("/a", 1).Locks; !reflect.DeepEqual(got, want[1:2]) {
+        t.Fatalf("/a at group 1: got %+v", got)
+    }
+    if got := m.lockStats("/", 0).Locks; !reflect.DeepEqual(got, want[:1]) {
+        t.Fatalf("group 0: got %+v", got)
+    }
+    if got := m.lockStats("/a/l1", AnyGroup).Locks; len(got) != 0 {
+        t.Fatalf("lock name is not a domain, got %+v", got)
+    }
+}
+
+func TestRebalanceStatus(t *testing.T) {
+    m := testMaster()
+    status := m.rebalanceStatus("", AnyGroup)
+    if !reflect.DeepEqual(status.RebalancingGroups, []ReplicaGroupId{1}) {
+        t.Fatalf("got rebalancing groups %v", status.RebalancingGroups)
+    }
+    recalcitrant := RecalcitrantLock{"/a/l2", 1, 0, testTime(130)}
+    if !reflect.DeepEqual(status.RecalcitrantLocks, []RecalcitrantLock{recalcitrant}) {
+        t.Fatalf("got recalcitrant locks %+v", status.RecalcitrantLocks)
+    }
+    if !reflect.DeepEqual(status.Transfers, []Transfer{m.TransferMap[4]}) {
+        t.Fatalf("got transfers %+v", status.Transfers)
+    }
+
+    status = m.rebalanceStatus("", 0)
+    if len(status.RebalancingGroups) != 0 || len(status.RecalcitrantLocks) != 1 || len(status.Transfers) != 1 {
+        t.Fatalf("group 0 is destination of both, got %+v", status)
+    }
+
+    /* Transfers show only their locks in the domain. */
+    status = m.rebalanceStatus("/b", AnyGroup)
+    if len(status.RecalcitrantLocks) != 0 || len(status.Transfers) != 1 {
+        t.Fatalf("/b: got %+v", status)
+    }
+    transfer := status.Transfers[0]
+    if !reflect.DeepEqual(transfer.Locks, []Lock{"/b/l3"}) || len(transfer.Recalcitrant) != 0 || len(transfer.States) != 1 {
+        t.Fatalf("/b: got transfer %+v", transfer)
+    }
+    transfer = m.rebalanceStatus("/a", AnyGroup).Transfers[0]
+    if !reflect.DeepEqual(transfer.Locks, []Lock{"/a/l2"}) || !reflect.DeepEqual(transfer.Recalcitrant, []Lock{"/a/l2"}) || len(transfer.States) != 0 {
+        t.Fatalf("/a: got transfer %+v", transfer)
+    }
+    if status := m.rebalanceStatus("/c", AnyGroup); len(status.Transfers) != 0 {
+        t.Fatalf("/c: got transfers %+v", status.Transfers)
+    }
+    if len(m.TransferMap[4].Locks) != 2 || len(m.TransferMap[4].States) != 1 {
+        t.Fatalf("filtering changed stored transfer: %+v", m.TransferMap[4])
+    }
+}
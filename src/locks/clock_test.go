@@ -0,0 +1,91 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "testing"
+    "time"
+)
+
+func TestAdvanceClock(t *testing.T) {
+    tests := []struct {
+        name    string
+        stamp   time.Time
+        want    time.Time
+    }{
+        {"later stamp", testTime(105), testTime(105)},
+        {"earlier stamp from new leader", testTime(103), testTime(104)},
+        {"same stamp", testTime(104), testTime(104)},
+        {"no stamp", time.Time{}, testTime(104)},
+    }
+    for _, test := range tests {
+        clock := testTime(104)
+        advanceClock(&clock, test.stamp)
+        if !clock.Equal(test.want) {
+            t.Errorf("%s: got %v, want %v", test.name, clock, test.want)
+        }
+    }
+}
+
+/* Log entry for command args, stamped by the leader at stamp. */
+func stampedLog(t *testing.T, index uint64, args map[string]string, stamp time.Time) *raft.Log {
+    data, err := json.Marshal(args)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return &raft.Log{Index: index, Term: 1, Type: raft.LogCommand, Data: data, AppendedAt: stamp}
+}
+
+/* Replicas apply entries at different times, but their state depends only on
+   the stamps. */
+func TestReplicasApplyingSameLogAgree(t *testing.T) {
+    acquire := func(l Lock, client raft.ServerAddress) map[string]string {
+        return map[string]string{FunctionKey: AcquireLockCommand, LockArgKey: string(l), ClientAddrKey: string(client)}
+    }
+    release := func(l Lock, client raft.ServerAddress) map[string]string {
+        return map[string]string{FunctionKey: ReleaseLockCommand, LockArgKey: string(l), ClientAddrKey: string(client)}
+    }
+    workerLog := []*raft.Log{
+        stampedLog(t, 1, release("/a/l1", "c:1"), testTime(104).Add(50 * time.Millisecond)),
+        stampedLog(t, 2, acquire("/a/l1", "c:3"), testTime(104).Add(100 * time.Millisecond)),
+        /* Starts a new frequency period. */
+        stampedLog(t, 3, acquire("/a/l1", "c:3"), testTime(105)),
+        /* Stamped earlier by a new leader, and not stamped at all. */
+        stampedLog(t, 4, release("/a/l1", "c:3"), testTime(104).Add(900 * time.Millisecond)),
+        stampedLog(t, 5, acquire("/a/l1", "c:4"), time.Time{}),
+    }
+    masterLog := []*raft.Log{
+        stampedLog(t, 1, map[string]string{FunctionKey: FrequencyUpdateCommand, LockArrayKey: lock_array_to_string([]Lock{"/a/l1"}), CountArrayKey: int_array_to_string([]int{6})}, testTime(121)),
+        stampedLog(t, 2, map[string]string{FunctionKey: FrequencyUpdateCommand, LockArrayKey: lock_array_to_string([]Lock{"/a/l1"}), CountArrayKey: int_array_to_string([]int{2})}, testTime(123)),
+    }
+
+    workers := []*WorkerFSM{testWorker(), testWorker()}
+    masters := []*MasterFSM{testMaster(), testMaster()}
+    for i, w := range workers {
+        w.logger = raft.NopLogger()
+        for _, log := range workerLog {
+            w.Apply(log)
+            time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+        }
+    }
+    for i, m := range masters {
+        for _, log := range masterLog {
+            m.Apply(log)
+            time.Sleep(time.Duration(i) * 10 * time.Millisecond)
+        }
+    }
+
+    compareState(t, workerState(workers[1]), workerState(workers[0]))
+    compareState(t, masterState(masters[1]), masterState(masters[0]))
+    w := workers[0]
+    if !w.Clock.Equal(testTime(105)) || !w.PeriodStart.Equal(testTime(105)) {
+        t.Fatalf("got clock %v, period start %v, want both %v", w.Clock, w.PeriodStart, testTime(105))
+    }
+    if state := w.LockStateMap["/a/l1"]; state.FreqCount != 3 || state.Client != "c:4" {
+        t.Fatalf("got %+v, want 3 accesses in new period, held by c:4", state)
+    }
+    m := masters[0]
+    if stats := m.LockFreqStatsMap["/a/l1"]; !stats.LastUpdate.Equal(testTime(123)) || !m.Clock.Equal(testTime(123)) {
+        t.Fatalf("got stats %+v, clock %v, want both at %v", stats, m.Clock, testTime(123))
+    }
+}
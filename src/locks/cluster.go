@@ -5,14 +5,33 @@ import(
 	"raft"
 	"io/ioutil"
 	"time"
-	"log"
-	"os"
+	"path/filepath"
+	"strings"
 )
 
-// Starts up a new cluster.
-func MakeCluster(n int, fsms []raft.FSM, addrs []raft.ServerAddress, transports []*raft.NetworkTransport) *cluster {
-    conf := raft.DefaultConfig()
-    bootstrap := true
+// Starts up a new cluster that keeps its logs in memory.
+func MakeCluster(n int, fsms []raft.FSM, addrs []raft.ServerAddress, transports []*raft.NetworkTransport) (*cluster, error) {
+    return MakeClusterWithDataDir(n, fsms, addrs, transports, "")
+}
+
+// Starts up a new cluster. If dataDir is set, each server keeps its log,
+// stable state and snapshots in its own directory under dataDir, so they
+// survive a restart; otherwise logs are kept in memory. A server that finds
+// existing state rejoins its cluster instead of bootstrapping it again.
+func MakeClusterWithDataDir(n int, fsms []raft.FSM, addrs []raft.ServerAddress, transports []*raft.NetworkTransport, dataDir string) (*cluster, error) {
+    return makeCluster(n, fsms, addrs, transports, dataDir, raft.DefaultConfig(), true)
+}
+
+// Raft ID of the server at addr.
+func serverID(addr raft.ServerAddress) raft.ServerID {
+	return raft.ServerID(fmt.Sprintf("server-%s", addr))
+}
+
+// Starts servers with the given config. Without bootstrap, servers with no
+// existing state wait to be added to a running cluster by its leader. If a
+// server can't be started, the servers already started are shut down and
+// the error is returned.
+func makeCluster(n int, fsms []raft.FSM, addrs []raft.ServerAddress, transports []*raft.NetworkTransport, dataDir string, conf *raft.Config, bootstrap bool) (*cluster, error) {
 
 	c := &cluster{
 		conf:          conf,
@@ -25,24 +44,49 @@ func MakeCluster(n int, fsms []raft.FSM, addrs []raft.ServerAddress, transports
 
 	// Setup the stores and transports
 	for i := 0; i < n; i++ {
-		dir, err := ioutil.TempDir("", "raft")
-		if err != nil {
-			fmt.Println("[ERR] err: %v ", err)
-		}
+        trans := transports[i]
+        addr := trans.LocalAddr()
+		localID := serverID(addr)
+		logger := fsmLogger(fsms[i])
 
-		store := raft.NewInmemStore()
+		var dir string
+		var store interface {
+			raft.LogStore
+			raft.StableStore
+		}
+		var err error
+		if dataDir != "" {
+			dir = filepath.Join(dataDir, strings.Replace(string(localID), ":", "_", -1))
+			store, err = raft.NewFileStore(dir)
+			if err != nil {
+				logger.Error("NewFileStore failed", "error", err)
+				c.Shutdown()
+				return nil, fmt.Errorf("server %s: opening store: %v", addr, err)
+			}
+		} else {
+			dir, err = ioutil.TempDir("", "raft")
+			if err != nil {
+				logger.Error("creating snapshot directory failed", "error", err)
+				c.Shutdown()
+				return nil, fmt.Errorf("server %s: creating snapshot directory: %v", addr, err)
+			}
+			store = raft.NewInmemStore()
+		}
 		c.dirs = append(c.dirs, dir)
+		c.logs = append(c.logs, store)
 		c.stores = append(c.stores, store)
         c.fsms = append(c.fsms, fsms[i])
 
 
 	    snap, err := raft.NewFileSnapshotStore(dir, 3, nil)
+		if err != nil {
+			logger.Error("NewFileSnapshotStore failed", "error", err)
+			c.Shutdown()
+			return nil, fmt.Errorf("server %s: opening snapshot store: %v", addr, err)
+		}
 		c.snaps = append(c.snaps, snap)
 
-        trans := transports[i]
-        addr := trans.LocalAddr()
         c.trans = append(c.trans, trans)
-		localID := raft.ServerID(fmt.Sprintf("server-%s", addr))
 		configuration.Servers = append(configuration.Servers, raft.Server{
 			Suffrage: raft.Voter,
 			ID:       localID,
@@ -53,37 +97,95 @@ func MakeCluster(n int, fsms []raft.FSM, addrs []raft.ServerAddress, transports
 	// Create all the rafts
 	c.startTime = time.Now()
 	for i := 0; i < n; i++ {
-		logs := c.stores[i]
+		logs := c.logs[i]
 		store := c.stores[i]
 		snap := c.snaps[i]
 		trans := c.trans[i]
 
+		logger := fsmLogger(c.fsms[i])
+
 		peerConf := conf
 		peerConf.LocalID = configuration.Servers[i].ID
-        peerConf.Logger = log.New(os.Stdout, string(peerConf.LocalID) + " : ", log.Lmicroseconds)
+        peerConf.Logger = raft.NewStdLogAdapter(logger.Named("raft"))
 
-		if bootstrap {
+		existing, err := raft.HasExistingState(logs, store, snap)
+		if err != nil {
+			logger.Error("HasExistingState failed", "error", err)
+			c.Shutdown()
+			return nil, fmt.Errorf("server %s: reading existing state: %v", trans.LocalAddr(), err)
+		}
+		if existing {
+			logger.Info("rejoining cluster with existing state")
+		} else if bootstrap {
 			err := raft.BootstrapCluster(peerConf, logs, store, snap, trans, configuration)
 			if err != nil {
-				fmt.Println("[ERR] BootstrapCluster failed: %v", err)
+				logger.Error("BootstrapCluster failed", "error", err)
+				c.Shutdown()
+				return nil, fmt.Errorf("server %s: bootstrapping cluster: %v", trans.LocalAddr(), err)
 			}
 		}
 
 		raft, err := raft.NewRaft(peerConf, c.fsms[i], logs, store, snap, trans)
 		if err != nil {
-		    fmt.Println("[ERR] NewRaft failed: %v", err)
+			logger.Error("NewRaft failed", "error", err)
+			c.Shutdown()
+			return nil, fmt.Errorf("server %s: starting raft: %v", trans.LocalAddr(), err)
 		}
 
+		if w, ok := c.fsms[i].(*WorkerFSM); ok {
+			w.attachRaft(raft)
+		}
+		if m, ok := c.fsms[i].(*MasterFSM); ok {
+			m.attachRaft(raft)
+		}
 		raft.AddVoter(peerConf.LocalID, trans.LocalAddr(), 0, 0)
 		c.rafts = append(c.rafts, raft)
 	}
 
-    return c
+    return c, nil
+}
+
+// Stops every server in the cluster and closes its transports and stores, so a cluster
+// started with a data directory can be restarted from it.
+func (c *cluster) Shutdown() {
+	for i, r := range c.rafts {
+		if r == nil {
+			continue
+		}
+		if err := r.Shutdown().Error(); err != nil {
+			fsmLogger(c.fsms[i]).Error("Shutdown failed", "error", err)
+		}
+		if m, ok := c.fsms[i].(*MasterFSM); ok {
+			m.detachRaft()
+		}
+	}
+	for _, trans := range c.trans {
+		if closer, ok := trans.(raft.WithClose); ok {
+			closer.Close()
+		}
+	}
+	for _, logs := range c.logs {
+		if store, ok := logs.(*raft.FileStore); ok {
+			store.Close()
+		}
+	}
+}
+
+// Logger of the master or worker a server runs.
+func fsmLogger(fsm raft.FSM) raft.Logger {
+	if w, ok := fsm.(*WorkerFSM); ok && w.logger != nil {
+		return w.logger
+	}
+	if m, ok := fsm.(*MasterFSM); ok && m.logger != nil {
+		return m.logger
+	}
+	return raft.DefaultLogger()
 }
 
 type cluster struct {
 	dirs             []string
-	stores           []*raft.InmemStore
+	logs             []raft.LogStore
+	stores           []raft.StableStore
 	fsms             []raft.FSM
 	snaps            []*raft.FileSnapshotStore
 	trans            []raft.Transport
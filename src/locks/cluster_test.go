@@ -0,0 +1,113 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+func TestMakeClusterFailsWithoutStore(t *testing.T) {
+    dir, err := ioutil.TempDir("", "locks")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+    /* Data directory is a file, so no server directory can be made in it. */
+    dataDir := filepath.Join(dir, "data")
+    if err := ioutil.WriteFile(dataDir, nil, 0644); err != nil {
+        t.Fatal(err)
+    }
+    trans, err := raft.NewTCPTransport("127.0.0.1:0", nil, 2, time.Second, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer trans.Close()
+    fsm := &WorkerFSM{logger: raft.NopLogger()}
+    c, err := makeCluster(1, []raft.FSM{fsm}, []raft.ServerAddress{trans.LocalAddr()}, []*raft.NetworkTransport{trans}, dataDir, raft.DefaultConfig(), true)
+    if err == nil || c != nil {
+        t.Fatalf("cluster started without a store: %v", c)
+    }
+    if fsm.raft != nil {
+        t.Fatalf("raft attached to worker after failed start")
+    }
+}
+
+/* Leader of cluster's servers, and its index, once one is elected. */
+func waitForLeader(t *testing.T, c *cluster) (*raft.Raft, int) {
+    for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+        for i, r := range c.rafts {
+            if r.State() == raft.Leader {
+                return r, i
+            }
+        }
+    }
+    t.Fatalf("no leader elected")
+    return nil, -1
+}
+
+func applyCommand(t *testing.T, r *raft.Raft, args map[string]string) {
+    command, err := json.Marshal(args)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := r.Apply(command, 5 * time.Second).Error(); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestClusterRestartsFromDataDir(t *testing.T) {
+    dataDir, err := ioutil.TempDir("", "locks")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dataDir)
+    transports := make([]*raft.NetworkTransport, 3)
+    addrs := make([]raft.ServerAddress, 3)
+    for i := range transports {
+        transports[i] = testTransport(t)
+        addrs[i] = transports[i].LocalAddr()
+    }
+    c, err := MakeClusterWithDataDir(3, CreateWorkers(3, nil, addrs, transports, raft.NopLogger()), addrs, transports, dataDir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    leader, _ := waitForLeader(t, c)
+    applyCommand(t, leader, map[string]string{FunctionKey: ClaimLocksCommand, LockArrayKey: lock_array_to_string([]Lock{"/a/l1", "/a/l2"})})
+    applyCommand(t, leader, map[string]string{FunctionKey: AcquireLockCommand, LockArgKey: "/a/l1", ClientAddrKey: "c:1"})
+    lastIndex := leader.LastIndex()
+    c.Shutdown()
+
+    /* Same servers, at the same addresses. */
+    for i := range transports {
+        if transports[i], err = raft.NewTCPTransport(string(addrs[i]), nil, 2, time.Second, nil); err != nil {
+            t.Fatal(err)
+        }
+    }
+    fsms := CreateWorkers(3, nil, addrs, transports, raft.NopLogger())
+    c, err = MakeClusterWithDataDir(3, fsms, addrs, transports, dataDir)
+    if err != nil {
+        t.Fatalf("restart: %v", err)
+    }
+    defer c.Shutdown()
+    leader, i := waitForLeader(t, c)
+    if err := leader.Barrier(5 * time.Second).Error(); err != nil {
+        t.Fatal(err)
+    }
+    /* A bootstrapped cluster would start its log afresh. */
+    if leader.LastIndex() <= lastIndex {
+        t.Fatalf("log restarted at %d, was at %d", leader.LastIndex(), lastIndex)
+    }
+    w := fsms[i].(*WorkerFSM)
+    w.FsmLock.RLock()
+    defer w.FsmLock.RUnlock()
+    if state := w.LockStateMap["/a/l1"]; !state.Held || state.Client != "c:1" || w.SequencerMap["/a/l1"] != 1 {
+        t.Fatalf("held lock lost: %+v, seq %d", state, w.SequencerMap["/a/l1"])
+    }
+    if state, ok := w.LockStateMap["/a/l2"]; !ok || state.Held {
+        t.Fatalf("free lock lost: %+v, %v", state, ok)
+    }
+}
@@ -0,0 +1,272 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "net"
+    "os"
+    "os/signal"
+    "strconv"
+    "strings"
+    "syscall"
+    "time"
+)
+
+/* Configuration file read by the master and worker launchers, e.g.
+   {
+     "masters": ["10.0.0.1:50000", "10.0.0.1:50001", "10.0.0.1:50002"],
+     "workers": [["10.0.0.2:50000", "10.0.0.2:50001", "10.0.0.2:50002"],
+                 ["10.0.0.3:50000", "10.0.0.3:50001", "10.0.0.3:50002"]],
+     "data_dir": "/var/lib/locks",
+     "raft": {"heartbeat_timeout": "1s", "election_timeout": "1s"},
+     "rebalance": {"max_freq": 2, "min_freq": 0.01, "ideal_freq": 1, "max_inactive_periods": 3},
+     "log": "info,rebalance=trace"
+   }
+   The first worker cluster is the master's initial replica group and the rest
+   form its recruit pool. Omitted settings keep their defaults. */
+type ServerConfig struct {
+    /* Addresses of the master servers. */
+    Masters     []raft.ServerAddress        `json:"masters"`
+    /* Addresses of the servers of each worker cluster. */
+    Workers     [][]raft.ServerAddress      `json:"workers"`
+    /* If set, number of servers every cluster must have; otherwise each
+       cluster may have 1, 3, 5 or 7. */
+    ClusterSize int                         `json:"cluster_size"`
+    /* Directory servers keep their logs and snapshots in; empty keeps logs
+       in memory. */
+    DataDir     string                      `json:"data_dir"`
+    Raft        RaftTimeouts                `json:"raft"`
+    Rebalance   RebalanceConfig             `json:"rebalance"`
+    /* Levels to log at: a default level, then name=level overrides for
+       loggers such as master, worker, client, session, raft or rebalance. */
+    Log         string                      `json:"log"`
+}
+
+type RaftTimeouts struct {
+    Heartbeat   Duration    `json:"heartbeat_timeout"`
+    Election    Duration    `json:"election_timeout"`
+    Commit      Duration    `json:"commit_timeout"`
+    LeaderLease Duration    `json:"leader_lease_timeout"`
+}
+
+type RebalanceConfig struct {
+    /* Never rebalance locks automatically. */
+    Static              bool        `json:"static"`
+    MaxFreq             float64     `json:"max_freq"`
+    MinFreq             float64     `json:"min_freq"`
+    IdealFreq           float64     `json:"ideal_freq"`
+    MaxInactivePeriods  int         `json:"max_inactive_periods"`
+    /* Split worker clusters that reach these limits; zero for no limit. */
+    MaxLocks            int         `json:"max_locks"`
+    MaxSessions         int         `json:"max_sessions"`
+    MaxHeld             int         `json:"max_held"`
+    MaxQueue            int         `json:"max_queue"`
+    MaxApplyLatency     Duration    `json:"max_apply_latency"`
+    /* Move held locks with their holder instead of waiting for release. */
+    LiveMigration       bool        `json:"live_migration"`
+    /* Force release of held locks that must move after this long; zero never
+       forces. */
+    RevokeAfter         Duration    `json:"revoke_after"`
+}
+
+/* Duration written in config files as a string such as "500ms". */
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("duration must be a string such as \"500ms\"")
+    }
+    parsed, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    *d = Duration(parsed)
+    return nil
+}
+
+/* Configuration used for settings a file leaves out. */
+func DefaultServerConfig() ServerConfig {
+    raftConf := raft.DefaultConfig()
+    return ServerConfig{
+        Raft: RaftTimeouts{
+            Heartbeat:      Duration(raftConf.HeartbeatTimeout),
+            Election:       Duration(raftConf.ElectionTimeout),
+            Commit:         Duration(raftConf.CommitTimeout),
+            LeaderLease:    Duration(raftConf.LeaderLeaseTimeout),
+        },
+        Rebalance: RebalanceConfig{
+            MaxFreq:            2,
+            MinFreq:            0.01,
+            IdealFreq:          1,
+            MaxInactivePeriods: 3,
+        },
+        Log: "info",
+    }
+}
+
+/* Read and validate config file. */
+func LoadServerConfig(path string) (ServerConfig, error) {
+    conf := DefaultServerConfig()
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return conf, err
+    }
+    if err := json.Unmarshal(data, &conf); err != nil {
+        return conf, fmt.Errorf("bad config file %s: %v", path, err)
+    }
+    if err := conf.Validate(); err != nil {
+        return conf, fmt.Errorf("bad config file %s: %v", path, err)
+    }
+    return conf, nil
+}
+
+/* Check every setting, reporting all problems at once. */
+func (c ServerConfig) Validate() error {
+    problems := make([]string, 0)
+    if c.ClusterSize != 0 && !allowedClusterSize(c.ClusterSize) {
+        problems = append(problems, fmt.Sprintf("cluster_size must be 1, 3, 5 or 7, got %d", c.ClusterSize))
+    }
+    seen := make(map[raft.ServerAddress]string)
+    checkCluster := func(name string, addrs []raft.ServerAddress) {
+        if allowedClusterSize(c.ClusterSize) && len(addrs) != c.ClusterSize {
+            problems = append(problems, fmt.Sprintf("%s: need %d servers, got %d", name, c.ClusterSize, len(addrs)))
+        } else if !allowedClusterSize(len(addrs)) {
+            problems = append(problems, fmt.Sprintf("%s: need 1, 3, 5 or 7 servers, got %d", name, len(addrs)))
+        }
+        for _, addr := range addrs {
+            if err := checkAddress(addr); err != nil {
+                problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+            } else if other, ok := seen[addr]; ok {
+                problems = append(problems, fmt.Sprintf("%s: %s is already used by %s", name, addr, other))
+            }
+            seen[addr] = name
+        }
+    }
+    checkCluster("masters", c.Masters)
+    if len(c.Workers) == 0 {
+        problems = append(problems, "workers: need at least one worker cluster")
+    }
+    for i, addrs := range c.Workers {
+        checkCluster("workers[" + strconv.Itoa(i) + "]", addrs)
+    }
+    raftConf := c.RaftConfig()
+    raftConf.LocalID = "config"
+    if err := raft.ValidateConfig(raftConf); err != nil {
+        problems = append(problems, "raft: " + err.Error())
+    }
+    r := c.Rebalance
+    if !r.Static {
+        if r.MinFreq < 0 || r.MinFreq >= r.IdealFreq || r.IdealFreq >= r.MaxFreq {
+            problems = append(problems, fmt.Sprintf("rebalance: need 0 <= min_freq < ideal_freq < max_freq, got %v, %v, %v", r.MinFreq, r.IdealFreq, r.MaxFreq))
+        }
+        if r.MaxInactivePeriods < 1 {
+            problems = append(problems, fmt.Sprintf("rebalance: max_inactive_periods must be positive, got %d", r.MaxInactivePeriods))
+        }
+    }
+    if r.MaxLocks < 0 || r.MaxSessions < 0 || r.MaxHeld < 0 || r.MaxQueue < 0 || r.MaxApplyLatency < 0 {
+        problems = append(problems, "rebalance: limits can't be negative")
+    }
+    if r.RevokeAfter < 0 {
+        problems = append(problems, "rebalance: revoke_after can't be negative")
+    }
+    if _, err := raft.NewLogLevels(c.Log); err != nil {
+        problems = append(problems, "log: " + err.Error())
+    }
+    if len(problems) == 1 {
+        return errors.New(problems[0])
+    }
+    if len(problems) > 1 {
+        return fmt.Errorf("%d problems:\n  %s", len(problems), strings.Join(problems, "\n  "))
+    }
+    return nil
+}
+
+func checkAddress(addr raft.ServerAddress) error {
+    host, port, err := net.SplitHostPort(string(addr))
+    if err != nil {
+        return fmt.Errorf("bad address %q: %v", addr, err)
+    }
+    if host == "" {
+        return fmt.Errorf("bad address %q: missing host", addr)
+    }
+    if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+        return fmt.Errorf("bad address %q: bad port", addr)
+    }
+    return nil
+}
+
+/* Raft configuration for servers, with the configured timeouts. */
+func (c ServerConfig) RaftConfig() *raft.Config {
+    conf := raft.DefaultConfig()
+    conf.HeartbeatTimeout = time.Duration(c.Raft.Heartbeat)
+    conf.ElectionTimeout = time.Duration(c.Raft.Election)
+    conf.CommitTimeout = time.Duration(c.Raft.Commit)
+    conf.LeaderLeaseTimeout = time.Duration(c.Raft.LeaderLease)
+    return conf
+}
+
+/* Rebalance policy masters use. */
+func (c ServerConfig) RebalancePolicy() RebalancePolicy {
+    if c.Rebalance.Static {
+        return StaticPolicy{}
+    }
+    policy := NewFrequencyPolicy(c.Rebalance.MaxFreq, c.Rebalance.MinFreq, c.Rebalance.IdealFreq, c.Rebalance.MaxInactivePeriods)
+    policy.Limits = WorkerLoad{
+        NumLocks:       c.Rebalance.MaxLocks,
+        NumSessions:    c.Rebalance.MaxSessions,
+        NumHeld:        c.Rebalance.MaxHeld,
+        QueueDepth:     c.Rebalance.MaxQueue,
+        ApplyLatency:   time.Duration(c.Rebalance.MaxApplyLatency),
+    }
+    return policy
+}
+
+/* Levels servers log at. */
+func (c ServerConfig) LogLevels() *raft.LogLevels {
+    levels, err := raft.NewLogLevels(c.Log)
+    if err != nil {
+        levels, _ = raft.NewLogLevels("")
+    }
+    return levels
+}
+
+/* On SIGHUP, read the log setting from config file again and apply it to
+   levels, so e.g. rebalance tracing can be turned on in a running server. */
+func ReloadLogLevelsOnHangup(path string, levels *raft.LogLevels, logger raft.Logger) {
+    c := make(chan os.Signal, 1)
+    signal.Notify(c, syscall.SIGHUP)
+    go func() {
+        for range c {
+            conf, err := LoadServerConfig(path)
+            if err == nil {
+                err = levels.Set(conf.Log)
+            }
+            if err != nil {
+                logger.Error("reloading log levels failed", "error", err)
+                continue
+            }
+            logger.Info("reloaded log levels", "log", levels)
+        }
+    }()
+}
+
+/* Start a cluster of the given servers with the configured raft timeouts and
+   data directory. Fails if any server can't be started. */
+func (c ServerConfig) StartCluster(fsms []raft.FSM, addrs []raft.ServerAddress, transports []*raft.NetworkTransport) (*cluster, error) {
+    return makeCluster(len(addrs), fsms, addrs, transports, c.DataDir, c.RaftConfig(), true)
+}
+
+/* Start a single server that waits to be added to a running cluster, e.g. to
+   replace a dead server of a worker cluster. */
+func (c ServerConfig) JoinCluster(fsm raft.FSM, transport *raft.NetworkTransport) (*cluster, error) {
+    addrs := []raft.ServerAddress{transport.LocalAddr()}
+    return makeCluster(1, []raft.FSM{fsm}, addrs, []*raft.NetworkTransport{transport}, c.DataDir, c.RaftConfig(), false)
+}
@@ -0,0 +1,89 @@
+package locks
+
+import(
+    "raft"
+    "strings"
+    "testing"
+    "time"
+)
+
+func validConfig() ServerConfig {
+    conf := DefaultServerConfig()
+    conf.Masters = []raft.ServerAddress{"10.0.0.1:50000", "10.0.0.1:50001", "10.0.0.1:50002"}
+    conf.Workers = [][]raft.ServerAddress{
+        {"10.0.0.2:50000", "10.0.0.2:50001", "10.0.0.2:50002"},
+        {"10.0.0.3:50000"},
+    }
+    return conf
+}
+
+func TestValidateAcceptsValidConfig(t *testing.T) {
+    if err := validConfig().Validate(); err != nil {
+        t.Fatalf("valid config rejected: %v", err)
+    }
+}
+
+func TestValidateRejectsEachProblem(t *testing.T) {
+    tests := []struct {
+        name    string
+        change  func(c *ServerConfig)
+        want    string
+    }{
+        {"bad cluster size", func(c *ServerConfig) { c.ClusterSize = 4 }, "cluster_size must be 1, 3, 5 or 7, got 4"},
+        {"cluster not of required size", func(c *ServerConfig) { c.ClusterSize = 3 }, "workers[1]: need 3 servers, got 1"},
+        {"even cluster", func(c *ServerConfig) { c.Masters = c.Masters[:2] }, "masters: need 1, 3, 5 or 7 servers, got 2"},
+        {"no workers", func(c *ServerConfig) { c.Workers = nil }, "workers: need at least one worker cluster"},
+        {"duplicate address", func(c *ServerConfig) { c.Workers[1][0] = "10.0.0.1:50001" }, "workers[1]: 10.0.0.1:50001 is already used by masters"},
+        {"missing port", func(c *ServerConfig) { c.Workers[1][0] = "10.0.0.3" }, `workers[1]: bad address "10.0.0.3"`},
+        {"bad port", func(c *ServerConfig) { c.Workers[1][0] = "10.0.0.3:70000" }, `workers[1]: bad address "10.0.0.3:70000": bad port`},
+        {"missing host", func(c *ServerConfig) { c.Workers[1][0] = ":50000" }, `workers[1]: bad address ":50000": missing host`},
+        {"bad raft timeout", func(c *ServerConfig) { c.Raft.Heartbeat = Duration(time.Millisecond) }, "raft: "},
+        {"frequencies out of order", func(c *ServerConfig) { c.Rebalance.IdealFreq = 5 }, "rebalance: need 0 <= min_freq < ideal_freq < max_freq, got 0.01, 5, 2"},
+        {"negative min frequency", func(c *ServerConfig) { c.Rebalance.MinFreq = -1 }, "rebalance: need 0 <= min_freq"},
+        {"no inactive periods", func(c *ServerConfig) { c.Rebalance.MaxInactivePeriods = 0 }, "rebalance: max_inactive_periods must be positive, got 0"},
+        {"negative limit", func(c *ServerConfig) { c.Rebalance.MaxHeld = -1 }, "rebalance: limits can't be negative"},
+        {"negative revoke after", func(c *ServerConfig) { c.Rebalance.RevokeAfter = -1 }, "rebalance: revoke_after can't be negative"},
+        {"bad log level", func(c *ServerConfig) { c.Log = "loud" }, "log: "},
+    }
+    for _, test := range tests {
+        conf := validConfig()
+        test.change(&conf)
+        err := conf.Validate()
+        if err == nil {
+            t.Errorf("%s: accepted", test.name)
+            continue
+        }
+        if msg := err.Error(); !strings.HasPrefix(msg, test.want) || strings.Contains(msg, "\n") {
+            t.Errorf("%s: got %q, want a single problem starting %q", test.name, msg, test.want)
+        }
+    }
+}
+
+func TestValidateStaticSkipsFrequencies(t *testing.T) {
+    conf := validConfig()
+    conf.Rebalance.Static = true
+    conf.Rebalance.IdealFreq = 5
+    conf.Rebalance.MaxInactivePeriods = 0
+    if err := conf.Validate(); err != nil {
+        t.Fatalf("static rebalancing needs no frequencies, got %v", err)
+    }
+}
+
+func TestValidateListsEveryProblem(t *testing.T) {
+    conf := validConfig()
+    conf.ClusterSize = 4
+    conf.Log = "loud"
+    err := conf.Validate()
+    if err == nil {
+        t.Fatalf("accepted")
+    }
+    lines := strings.Split(err.Error(), "\n")
+    if len(lines) != 3 || lines[0] != "2 problems:" {
+        t.Fatalf("got %q", err.Error())
+    }
+    for _, line := range lines[1:] {
+        if !strings.HasPrefix(line, "  ") {
+            t.Fatalf("problem %q not indented", line)
+        }
+    }
+}
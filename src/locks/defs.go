@@ -12,6 +12,10 @@ const ReleaseLockCommand string = "RelaseLock"
 const CreateDomainCommand string = "CreateDomainLock" 
 const LocateLockCommand string = "LocateLock" 
 const ValidateLockCommand string = "ValidateLock"
+const ListDomainCommand string = "ListDomain"
+const LockInfoCommand string = "LockInfo"
+const ClusterStatusCommand string = "ClusterStatus"
+const DomainRingCommand string = "DomainRing"
 const ReleaseForClientCommand string = "rel-client"
 const FunctionKey string = "function"
 const LockArgKey string = "lock"
@@ -21,24 +25,81 @@ const ClientAddrKey string = "client-addr"
 const LockArrayKey string = "lock-arr"
 const LockArray2Key string = "lock-arr2"
 const CountArrayKey string = "count-arr"
+const LoadKey string = "load"
 const TransactionIDKey string = "trans"
 const OldGroupKey string = "old-group"
 const NewGroupKey string = "new-group"
+const GroupArgKey string = "group"
+const MoveIdKey string = "move-id"
+const AllowedGroupsKey string = "allowed"
+const ExcludedGroupsKey string = "excluded"
+const HashedKey string = "hashed"
+const ServerAddrsKey string = "addrs"
+const AvailableKey string = "available"
+const HealthyKey string = "healthy"
+const TransferIdKey string = "transfer-id"
+const TransferStateKey string = "transfer-state"
+const StatesKey string = "states"
+const DeadlineKey string = "deadline"
+const ForcedKey string = "forced"
+const ServerAddrKey string = "addr"
+const PolicyKey string = "policy"
+const SettingsKey string = "settings"
+
+/* Admin RPCs */
+const GroupStatsCommand string = "admin-group-stats"
+const LockStatsCommand string = "admin-lock-stats"
+const RebalanceStatusCommand string = "admin-rebalance-status"
+const MoveLocksCommand string = "admin-move-locks"
+const MoveDomainCommand string = "admin-move-domain"
+const MoveProgressCommand string = "admin-move-progress"
+const SetPlacementPolicyCommand string = "admin-set-placement"
+const PlacementPoliciesCommand string = "admin-placement-policies"
+const AddWorkersCommand string = "admin-add-workers"
+const SetWorkersAvailableCommand string = "admin-set-workers-available"
+const RemoveWorkersCommand string = "admin-remove-workers"
+const RecruitPoolCommand string = "admin-recruit-pool"
+const DrainGroupCommand string = "admin-drain-group"
+const AddGroupServerCommand string = "admin-add-group-server"
+const RemoveGroupServerCommand string = "admin-remove-group-server"
+const AddMasterCommand string = "admin-add-master"
+const RemoveMasterCommand string = "admin-remove-master"
+
+/* Master -> Master RPCs */
+const GroupHealthCommand string = "group-health"
+const MasterMembersCommand string = "master-members"
+const RebalancePolicyCommand string = "rebalance-policy"
+const TransferSettingsCommand string = "transfer-settings"
 
 /* Master -> Worker RPCs */
 const ClaimLocksCommand string = "add-lock"
 const TransferCommand string = "transfer"
 const DisownLocksCommand string = "disown"
+const HealthCheckCommand string = "health"
+const MigrateCommand string = "migrate"
+const RevokeLockCommand string = "revoke"
+const InventoryCommand string = "inventory"
+const AddServerCommand string = "add-server"
+const RemoveServerCommand string = "remove-server"
+const SetMasterClusterCommand string = "master-cluster"
+const KeepLocksCommand string = "keep"
 
 /* Worker -> Master RPCs */
 const ReleasedRecalcitrantCommand string = "rel-recal"
 const FrequencyUpdateCommand string = "freq-update"
 
+/* Worker or Client -> Master RPCs */
+const MastersCommand string = "masters"
+
+/* Worker -> Client events */
+const RevocationEventCommand string = "revocation"
+const LockMovedEventCommand string = "moved"
+
 /* Master responses to RPCs */
-const TransferLockGroupCommand string = "transfer-group"
-const TransferRecalCommand string = "transfer-recal"
+const TransferStepCommand string = "transfer-step"
 const DeleteLockNotAcquiredCommand string = "delete-not-acq"
 const DeleteRecalLockCommand string = "delete-recal"
+const GroupMembersCommand string = "group-members"
 
 /* Return on lock acquires to let user validate that it still holds lock. */
 type Sequencer int
@@ -56,28 +117,58 @@ type Domain string
 type LocateLockResponse struct {
     ReplicaId ReplicaGroupId
     ServerAddrs []raft.ServerAddress
-    ErrMessage string 
+    Err *LockError
 }
 
 type CreateDomainResponse struct {
-    ErrMessage string
+    Err *LockError
+}
+
+type ListDomainResponse struct {
+    Locks []Lock
+    Domains []Domain
+    Err *LockError
+}
+
+type LockInfoResponse struct {
+    Held bool
+    Client raft.ServerAddress
+    SeqNo Sequencer
+    Recalcitrant bool
+    Disabled bool
+    Err *LockError
+}
+
+type GroupStatus struct {
+    ReplicaId ReplicaGroupId
+    ServerAddrs []raft.ServerAddress
+    NumLocks int
+}
+
+type ClusterStatusResponse struct {
+    MasterCluster []raft.ServerAddress
+    Groups []GroupStatus
+    Err *LockError
 }
 
 type CreateLockResponse struct {
-    ErrMessage string
+    Err *LockError
 }
 
 type DeleteLockResponse struct {
-    ErrMessage string
+    Err *LockError
 }
 
 type AcquireLockResponse struct {
     SeqNo Sequencer
-    ErrMessage string
+    Err *LockError
+    /* Set with ErrLockMoved to where the lock went. */
+    MovedTo *LockForward
 }
 
 type ReleaseLockResponse struct {
-    ErrMessage string
+    Err *LockError
+    MovedTo *LockForward
 }
 
 type TransferResponse struct {
@@ -86,22 +177,42 @@ type TransferResponse struct {
 
 type ValidateLockResponse struct {
     Success bool
-    ErrMessage string
+    Err *LockError
+    MovedTo *LockForward
 }
 
+/* Errors returned in responses. A nil error means the request succeeded. */
 var(
-    Success = ""
-    ErrLockExists = "lock already exists"
-    ErrLockDoesntExist = "lock doesn't exist"
-    ErrNoIntermediateDomain = "no intermediate domain"
-    ErrNoPlacement = "no valid placement found"
-    ErrDomainExists = "domain already exists"
-    ErrEmptyPath = "cannot use empty path"
-    ErrLockHeld = "lock is currently held"
-    ErrLockRecalcitrant = "lock is recalcitrant"
-    ErrLockNotHeld = "lock is not currently held"
-    ErrBadClientRelease = "lock was not acquired by client trying to release it"
-    ErrNoServersForId = "can't find servers associated with replica id"
-    ErrCannotLocateLock = "cannot locate lock"
-    ErrInvalidRequest = "request not formatted correctly"
+    Success *LockError = nil
+    ErrLockExists = &LockError{Code: CodeLockExists, Message: "lock already exists"}
+    ErrLockDoesntExist = &LockError{Code: CodeLockDoesntExist, Message: "lock doesn't exist"}
+    ErrNoIntermediateDomain = &LockError{Code: CodeNoIntermediateDomain, Message: "no intermediate domain"}
+    ErrNoPlacement = &LockError{Code: CodeNoPlacement, Message: "no valid placement found", Retryable: true}
+    ErrDomainExists = &LockError{Code: CodeDomainExists, Message: "domain already exists"}
+    ErrDomainDoesntExist = &LockError{Code: CodeDomainDoesntExist, Message: "domain doesn't exist"}
+    ErrEmptyPath = &LockError{Code: CodeEmptyPath, Message: "cannot use empty path"}
+    ErrLockHeld = &LockError{Code: CodeLockHeld, Message: "lock is currently held", Retryable: true}
+    ErrLockRecalcitrant = &LockError{Code: CodeLockRecalcitrant, Message: "lock is recalcitrant", Retryable: true}
+    ErrLockNotHeld = &LockError{Code: CodeLockNotHeld, Message: "lock is not currently held"}
+    ErrBadClientRelease = &LockError{Code: CodeBadClientRelease, Message: "lock was not acquired by client trying to release it"}
+    ErrNoServersForId = &LockError{Code: CodeNoServersForId, Message: "can't find servers associated with replica id", Retryable: true}
+    ErrCannotLocateLock = &LockError{Code: CodeCannotLocateLock, Message: "cannot locate lock", Retryable: true}
+    ErrInvalidRequest = &LockError{Code: CodeInvalidRequest, Message: "request not formatted correctly"}
+    ErrInvalidResponse = &LockError{Code: CodeInvalidResponse, Message: "response not formatted correctly"}
+    ErrNotApplied = &LockError{Code: CodeNotApplied, Message: "request was not applied by cluster", Retryable: true}
+    ErrNoSuchGroup = &LockError{Code: CodeNoSuchGroup, Message: "replica group doesn't exist"}
+    ErrRebalanceInProgress = &LockError{Code: CodeRebalanceInProgress, Message: "replica group is being rebalanced", Retryable: true}
+    ErrNoSuchMove = &LockError{Code: CodeNoSuchMove, Message: "move doesn't exist"}
+    ErrPlacementPolicy = &LockError{Code: CodePlacementPolicy, Message: "placement policy forbids replica group"}
+    ErrTransport = &LockError{Code: CodeTransport, Message: "cannot reach cluster", Retryable: true}
+    ErrWorkersExist = &LockError{Code: CodeWorkersExist, Message: "worker cluster already in pool or serving"}
+    ErrNoSuchWorkers = &LockError{Code: CodeNoSuchWorkers, Message: "worker cluster not waiting in pool"}
+    ErrGroupUnhealthy = &LockError{Code: CodeGroupUnhealthy, Message: "replica group is unhealthy", Retryable: true}
+    ErrGroupDraining = &LockError{Code: CodeGroupDraining, Message: "replica group is draining"}
+    ErrLockMoved = &LockError{Code: CodeLockMoved, Message: "lock moved to another replica group", Retryable: true}
+    ErrLockMoving = &LockError{Code: CodeLockMoving, Message: "lock is being migrated", Retryable: true}
+    ErrGroupSize = &LockError{Code: CodeGroupSize, Message: "replica group would have too few or too many servers"}
+    ErrServerInUse = &LockError{Code: CodeServerInUse, Message: "server already belongs to a cluster"}
+    ErrNoSuchServer = &LockError{Code: CodeNoSuchServer, Message: "server doesn't belong to replica group"}
+    ErrMembershipChange = &LockError{Code: CodeMembershipChange, Message: "replica group couldn't change its servers", Retryable: true}
 )
@@ -0,0 +1,219 @@
+package locks
+
+import(
+    "sort"
+    "strconv"
+)
+
+/* Admin command emptying a replica group so its cluster can be taken down for
+   maintenance. A draining group takes no new locks. Each load check moves its
+   locks to the least loaded group allowed for their domain, recruiting a new
+   group if there is none; held locks follow once released. When nothing is
+   stored at or bound for the group it is removed from the master's maps. Its
+   cluster is not returned to the recruit pool. A drain stalls while some of
+   the group's locks have no group to go to and none is left to recruit;
+   GroupStats reports it until a group is added or a policy changed. */
+
+type DrainResponse struct {
+    /* True if some locks have nowhere to go yet. */
+    Stalled bool
+    Err     *LockError
+}
+
+/* Master side. */
+
+func (m *MasterFSM) drainGroup(replicaGroup ReplicaGroupId) ([]func() [][]byte, DrainResponse) {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if !m.isUsableGroup(replicaGroup) {
+        if m.DrainingGroups[replicaGroup] {
+            return []func() [][]byte{}, DrainResponse{Err: ErrGroupDraining}
+        }
+        return []func() [][]byte{}, DrainResponse{Err: ErrNoSuchGroup}
+    }
+    /* Refuse if a domain's policy allows no other group. */
+    for _, policy := range m.PlacementPolicyMap {
+        if !containsGroup(policy.Allowed, replicaGroup) {
+            continue
+        }
+        elsewhere := false
+        for _, allowed := range policy.Allowed {
+            elsewhere = elsewhere || (allowed != replicaGroup && m.isUsableGroup(allowed) && policy.allows(allowed))
+        }
+        if !elsewhere {
+            return []func() [][]byte{}, DrainResponse{Err: ErrPlacementPolicy}
+        }
+    }
+    m.DrainingGroups[replicaGroup] = true
+    m.rebalanceLogger().Info("draining group", "group", replicaGroup, "locks", m.NumLocksHeld[replicaGroup])
+    m.finishDrains()
+    callbacks := m.applyRebalancePlan(m.drainPlan())
+    return callbacks, DrainResponse{m.stalledLocks(replicaGroup) > 0, Success}
+}
+
+/* Where each lock at draining group should move, by destination. Locks with
+   no other group to go to are under NewGroup. Held locks and locks in hashed
+   domains whose ring has other groups are left out. Assumes FSM already
+   locked. */
+func (m *MasterFSM) drainTargets(replicaGroup ReplicaGroupId, usable []ReplicaGroupId) map[ReplicaGroupId][]Lock {
+    moves := make(map[ReplicaGroupId][]Lock)
+    for _, l := range m.sortedLocks() {
+        if m.LockMap[l] != replicaGroup {
+            continue
+        }
+        if _, recalcitrant := m.RecalcitrantDestMap[l]; recalcitrant {
+            continue
+        }
+        d := getParentDomain(string(l))
+        if m.isHashed(d) {
+            if len(m.ringGroups(d)) == 0 {
+                moves[NewGroup] = append(moves[NewGroup], l)
+            }
+            continue
+        }
+        target, err := m.choosePlacement(d, m.DomainPlacementMap[d])
+        if err != nil {
+            target, err = m.choosePlacement(d, usable)
+        }
+        if err != nil {
+            target = NewGroup
+        }
+        moves[target] = append(moves[target], l)
+    }
+    return moves
+}
+
+/* Groups that can take locks, in ID order. Assumes FSM already locked. */
+func (m *MasterFSM) usableGroups() []ReplicaGroupId {
+    usable := make([]ReplicaGroupId, 0)
+    for _, replicaGroup := range m.sortedGroups() {
+        if m.isUsableGroup(replicaGroup) {
+            usable = append(usable, replicaGroup)
+        }
+    }
+    return usable
+}
+
+/* Number of locks at draining group that have no group to move to and none
+   to recruit; 0 if group isn't draining. Assumes FSM already locked. */
+func (m *MasterFSM) stalledLocks(replicaGroup ReplicaGroupId) int {
+    if !m.DrainingGroups[replicaGroup] || m.spareGroups() > 0 {
+        return 0
+    }
+    return len(m.drainTargets(replicaGroup, m.usableGroups())[NewGroup])
+}
+
+/* Transfers moving locks off draining groups, one per destination. Locks in
+   hashed domains move with their ring, which leaves out draining groups, unless
+   the ring would be empty. Held locks and groups already moving locks wait for
+   a later check. Assumes FSM already locked. */
+func (m *MasterFSM) drainPlan() []LockTransfer {
+    usable := m.usableGroups()
+    plan := make([]LockTransfer, 0)
+    for _, replicaGroup := range m.sortedGroups() {
+        if !m.DrainingGroups[replicaGroup] || m.RebalancingInProgress[replicaGroup] {
+            continue
+        }
+        moves := m.drainTargets(replicaGroup, usable)
+        m.logDrainStall(replicaGroup, len(moves[NewGroup]))
+        targets := make([]int, 0)
+        for target := range moves {
+            targets = append(targets, int(target))
+        }
+        sort.Ints(targets)
+        for _, target := range groupIds(targets) {
+            plan = append(plan, LockTransfer{replicaGroup, target, moves[target]})
+        }
+    }
+    return plan
+}
+
+/* Warn once when a drain stalls for lack of groups, and note when it goes on.
+   Assumes FSM already locked. */
+func (m *MasterFSM) logDrainStall(replicaGroup ReplicaGroupId, homeless int) {
+    stalled := homeless > 0 && m.spareGroups() == 0
+    if stalled == m.stalledDrains[replicaGroup] {
+        return
+    }
+    if stalled {
+        if m.stalledDrains == nil {
+            m.stalledDrains = make(map[ReplicaGroupId]bool)
+        }
+        m.rebalanceLogger().Warn("drain stalled, no group to move locks to and none to recruit", "group", replicaGroup, "locks", homeless)
+        m.stalledDrains[replicaGroup] = true
+    } else {
+        m.rebalanceLogger().Info("drain no longer stalled", "group", replicaGroup)
+        delete(m.stalledDrains, replicaGroup)
+    }
+}
+
+/* Remove draining groups that no longer store any locks, aren't the
+   destination of a held lock and have no transfer in progress. Assumes FSM
+   already locked. */
+func (m *MasterFSM) finishDrains() {
+    for _, replicaGroup := range m.sortedGroups() {
+        if !m.DrainingGroups[replicaGroup] || m.NumLocksHeld[replicaGroup] > 0 || m.inTransfer(replicaGroup) {
+            continue
+        }
+        inUse := false
+        for l, storedAt := range m.LockMap {
+            inUse = inUse || storedAt == replicaGroup || m.RecalcitrantDestMap[l] == replicaGroup
+        }
+        if !inUse {
+            m.rebalanceLogger().Info("removed drained group", "group", replicaGroup)
+            delete(m.stalledDrains, replicaGroup)
+            m.removeGroup(replicaGroup)
+        }
+    }
+}
+
+/* Forget every reference to replica group. Assumes FSM already locked. */
+func (m *MasterFSM) removeGroup(replicaGroup ReplicaGroupId) {
+    delete(m.ClusterMap, replicaGroup)
+    delete(m.NumLocksHeld, replicaGroup)
+    delete(m.GroupFreqStatsMap, replicaGroup)
+    delete(m.GroupLoadMap, replicaGroup)
+    delete(m.GroupHealthMap, replicaGroup)
+    delete(m.RebalancingInProgress, replicaGroup)
+    delete(m.DrainingGroups, replicaGroup)
+    for d, replicaGroups := range m.DomainPlacementMap {
+        m.DomainPlacementMap[d] = withoutGroup(replicaGroups, replicaGroup)
+    }
+    for d, policy := range m.PlacementPolicyMap {
+        policy.Allowed = withoutGroup(policy.Allowed, replicaGroup)
+        policy.Excluded = withoutGroup(policy.Excluded, replicaGroup)
+        if policy.isEmpty() {
+            delete(m.PlacementPolicyMap, d)
+        } else {
+            m.PlacementPolicyMap[d] = policy
+        }
+    }
+}
+
+func withoutGroup(replicaGroups []ReplicaGroupId, replicaGroup ReplicaGroupId) []ReplicaGroupId {
+    if !containsGroup(replicaGroups, replicaGroup) {
+        return replicaGroups
+    }
+    remaining := make([]ReplicaGroupId, 0)
+    for _, g := range replicaGroups {
+        if g != replicaGroup {
+            remaining = append(remaining, g)
+        }
+    }
+    return remaining
+}
+
+/* Client side. */
+
+/* Stop placing locks at replica group, move all of its locks elsewhere and
+   then remove it. Returns once draining has started, with Stalled set if some
+   locks have nowhere to go yet; GroupStats reports the group as draining
+   until it is gone. */
+func (lc *LockClient) DrainGroup(replicaGroup ReplicaGroupId) (DrainResponse, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = DrainGroupCommand
+    args[GroupArgKey] = strconv.Itoa(int(replicaGroup))
+    var response DrainResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    return response, err
+}
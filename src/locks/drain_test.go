@@ -0,0 +1,87 @@
+package locks
+
+import(
+    "raft"
+    "testing"
+    "time"
+)
+
+/* Master with a single group storing two locks and an empty recruit pool. */
+func singleGroupMaster() *MasterFSM {
+    m := testMaster()
+    m.LockMap = map[Lock]ReplicaGroupId{"/a/l1": 0, "/a/l2": 0}
+    m.ClusterMap = map[ReplicaGroupId][]raft.ServerAddress{0: workerAddrs("w0", 3)}
+    m.DomainPlacementMap = map[Domain][]ReplicaGroupId{"/": {0}, "/a": {0}}
+    m.NumLocksHeld = map[ReplicaGroupId]int{0: 2}
+    m.NextReplicaGroupId = 1
+    m.RecruitAddrs = []RecruitInfo{{Addrs: workerAddrs("w0", 3)}}
+    m.RecalcitrantDestMap = make(map[Lock]ReplicaGroupId)
+    m.RebalancingInProgress = make(map[ReplicaGroupId]bool)
+    m.GroupHealthMap = make(map[ReplicaGroupId]GroupHealth)
+    m.DrainingGroups = make(map[ReplicaGroupId]bool)
+    m.RevokeDeadlineMap = make(map[Lock]time.Time)
+    m.TransferMap = make(map[int]Transfer)
+    m.PlacementPolicyMap = make(map[Domain]PlacementPolicy)
+    m.MoveMap = make(map[int]LockMove)
+    return m
+}
+
+func groupStatsOf(t *testing.T, m *MasterFSM, replicaGroup ReplicaGroupId) GroupStats {
+    response := m.groupStats("", replicaGroup)
+    if response.Err != nil || len(response.Groups) != 1 {
+        t.Fatalf("no stats for group %v: %+v", replicaGroup, response)
+    }
+    return response.Groups[0]
+}
+
+func TestDrainStallsWithoutGroupToMoveTo(t *testing.T) {
+    m := singleGroupMaster()
+    callbacks, response := m.drainGroup(0)
+    if response.Err != nil || !response.Stalled || len(callbacks) != 0 {
+        t.Fatalf("drain of only group should start stalled, got %+v and %d callbacks", response, len(callbacks))
+    }
+    if stats := groupStatsOf(t, m, 0); !stats.Draining || !stats.DrainStalled {
+        t.Fatalf("stats should report stalled drain, got %+v", stats)
+    }
+    if !m.stalledDrains[0] {
+        t.Fatalf("stall not logged")
+    }
+    if _, response := m.drainGroup(0); response.Err != ErrGroupDraining {
+        t.Fatalf("draining again should fail, got %v", response.Err)
+    }
+
+    /* A cluster to recruit lets the drain go on. */
+    if response := m.addWorkers(workerAddrs("w1", 3)); response.Err != nil {
+        t.Fatal(response.Err)
+    }
+    if stats := groupStatsOf(t, m, 0); !stats.Draining || stats.DrainStalled {
+        t.Fatalf("drain with a spare group shouldn't be stalled, got %+v", stats)
+    }
+    plan := m.drainPlan()
+    if len(plan) != 1 || plan[0].To != NewGroup || len(plan[0].Locks) != 2 {
+        t.Fatalf("expected moving both locks to a new group, got %v", plan)
+    }
+    if m.stalledDrains[0] {
+        t.Fatalf("end of stall not noted")
+    }
+}
+
+func TestDrainNotStalledWithOtherGroup(t *testing.T) {
+    m := singleGroupMaster()
+    m.ClusterMap[1] = workerAddrs("w1", 3)
+    m.DomainPlacementMap["/a"] = []ReplicaGroupId{0, 1}
+    m.NextReplicaGroupId = 2
+    m.RecruitAddrs = append(m.RecruitAddrs, RecruitInfo{Addrs: workerAddrs("w1", 3)})
+    plan := m.drainPlan()
+    if len(plan) != 0 {
+        t.Fatalf("nothing draining, but planned %v", plan)
+    }
+    m.DrainingGroups[0] = true
+    if stalled := m.stalledLocks(0); stalled != 0 {
+        t.Fatalf("%d locks stalled with group 1 to move to", stalled)
+    }
+    plan = m.drainPlan()
+    if len(plan) != 1 || plan[0].From != 0 || plan[0].To != 1 || len(plan[0].Locks) != 2 {
+        t.Fatalf("expected moving both locks to group 1, got %v", plan)
+    }
+}
@@ -0,0 +1,120 @@
+package locks
+
+import(
+    "raft"
+    "errors"
+    "fmt"
+)
+
+/* Identifies the kind of failure carried in a response. */
+type ErrorCode int
+
+/* Codes are sent over the wire, so new ones go at the end. */
+const(
+    CodeOK ErrorCode = iota
+    CodeLockExists
+    CodeLockDoesntExist
+    CodeNoIntermediateDomain
+    CodeNoPlacement
+    CodeDomainExists
+    CodeEmptyPath
+    CodeLockHeld
+    CodeLockRecalcitrant
+    CodeLockNotHeld
+    CodeBadClientRelease
+    CodeNoServersForId
+    CodeCannotLocateLock
+    CodeInvalidRequest
+    CodeInvalidResponse
+    CodeNotApplied
+    CodeTransport
+    CodeDomainDoesntExist
+    CodeNoSuchGroup
+    CodeRebalanceInProgress
+    CodeNoSuchMove
+    CodePlacementPolicy
+    CodeWorkersExist
+    CodeNoSuchWorkers
+    CodeGroupUnhealthy
+    CodeGroupDraining
+    CodeLockMoved
+    CodeLockMoving
+    CodeGroupSize
+    CodeServerInUse
+    CodeNoSuchServer
+    CodeMembershipChange
+)
+
+/* Error returned by the lock service. Sent over the wire inside responses, so
+   the code and retryability survive the trip from worker or master to client. */
+type LockError struct {
+    /* Kind of failure, compared by errors.Is. */
+    Code        ErrorCode
+    /* Human readable description. */
+    Message     string
+    /* True if the same request may succeed if sent again later. */
+    Retryable   bool
+    /* Underlying error for transport failures; never sent over the wire. */
+    cause       error
+}
+
+func (e *LockError) Error() string {
+    if e == nil {
+        return ""
+    }
+    if e.cause != nil {
+        return fmt.Sprintf("%s: %v", e.Message, e.cause)
+    }
+    return e.Message
+}
+
+/* Two lock errors match if they have the same code, regardless of message. */
+func (e *LockError) Is(target error) bool {
+    t, ok := target.(*LockError)
+    if !ok || e == nil || t == nil {
+        return false
+    }
+    return e.Code == t.Code
+}
+
+func (e *LockError) Unwrap() error {
+    if e == nil {
+        return nil
+    }
+    return e.cause
+}
+
+/* Returns true if err is a lock error that is safe to retry. */
+func IsRetryable(err error) bool {
+    var lockErr *LockError
+    if errors.As(err, &lockErr) {
+        return lockErr.Retryable
+    }
+    return false
+}
+
+/* Wraps a failure to reach a cluster. Transport errors are always retryable. */
+func transportError(cause error) *LockError {
+    return &LockError{Code: CodeTransport, Message: ErrTransport.Message, Retryable: true, cause: cause}
+}
+
+/* Returns err as a lock error, treating any other error as a transport failure. */
+func asLockError(err error) *LockError {
+    var lockErr *LockError
+    if errors.As(err, &lockErr) {
+        return lockErr
+    }
+    return transportError(err)
+}
+
+/* Classifies the result of sending a request to a cluster. Returns nil if the
+   request was delivered and applied. */
+func requestError(sendErr error, resp *raft.ClientResponse) error {
+    if sendErr != nil {
+        return transportError(sendErr)
+    }
+    if !resp.Success {
+        return ErrNotApplied
+    }
+    return nil
+}
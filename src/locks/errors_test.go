@@ -0,0 +1,139 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "testing"
+)
+
+func TestLockErrorIsMatchesCode(t *testing.T) {
+    withMessage := &LockError{Code: CodeLockHeld, Message: "held by c:1"}
+    if !errors.Is(withMessage, ErrLockHeld) {
+        t.Fatalf("errors with same code should match")
+    }
+    if errors.Is(withMessage, ErrLockNotHeld) {
+        t.Fatalf("errors with different codes shouldn't match")
+    }
+    wrapped := fmt.Errorf("acquire /a: %w", withMessage)
+    if !errors.Is(wrapped, ErrLockHeld) {
+        t.Fatalf("wrapped error should match its code")
+    }
+    var nilErr *LockError
+    if nilErr.Is(ErrLockHeld) || withMessage.Is(nilErr) {
+        t.Fatalf("nil lock error shouldn't match")
+    }
+    if withMessage.Is(errors.New(ErrLockHeld.Message)) {
+        t.Fatalf("lock error shouldn't match other error types")
+    }
+}
+
+func TestLockErrorUnwrap(t *testing.T) {
+    cause := errors.New("connection refused")
+    err := transportError(cause)
+    if !errors.Is(err, cause) {
+        t.Fatalf("transport error should unwrap to its cause")
+    }
+    if !errors.Is(err, ErrTransport) {
+        t.Fatalf("transport error should match ErrTransport")
+    }
+    if err.Error() != "cannot reach cluster: connection refused" {
+        t.Fatalf("bad message: %q", err.Error())
+    }
+    if ErrLockHeld.Unwrap() != nil {
+        t.Fatalf("error without cause should unwrap to nil")
+    }
+    var nilErr *LockError
+    if nilErr.Unwrap() != nil || nilErr.Error() != "" {
+        t.Fatalf("nil lock error should unwrap to nil and have no message")
+    }
+}
+
+func TestIsRetryable(t *testing.T) {
+    tests := []struct {
+        err       error
+        retryable bool
+    }{
+        {nil, false},
+        {errors.New("other"), false},
+        {ErrLockHeld, true},
+        {ErrLockExists, false},
+        {transportError(errors.New("timeout")), true},
+        {fmt.Errorf("wrapped: %w", ErrNotApplied), true},
+        {fmt.Errorf("wrapped: %w", ErrInvalidRequest), false},
+    }
+    for _, test := range tests {
+        if got := IsRetryable(test.err); got != test.retryable {
+            t.Errorf("IsRetryable(%v) = %v, want %v", test.err, got, test.retryable)
+        }
+    }
+}
+
+func TestAsLockError(t *testing.T) {
+    if err := asLockError(ErrLockMoved); err != ErrLockMoved {
+        t.Fatalf("lock error should be returned as is, got %v", err)
+    }
+    cause := errors.New("eof")
+    err := asLockError(cause)
+    if !errors.Is(err, ErrTransport) || !err.Retryable || err.Unwrap() != cause {
+        t.Fatalf("other errors should become transport errors, got %#v", err)
+    }
+}
+
+func TestRequestError(t *testing.T) {
+    sendErr := errors.New("no leader")
+    if err := requestError(sendErr, &raft.ClientResponse{}); !errors.Is(err, ErrTransport) || !errors.Is(err, sendErr) {
+        t.Fatalf("send failure should be a transport error, got %v", err)
+    }
+    if err := requestError(nil, &raft.ClientResponse{Success: false}); err != ErrNotApplied {
+        t.Fatalf("unsuccessful response should be ErrNotApplied, got %v", err)
+    }
+    if err := requestError(nil, &raft.ClientResponse{Success: true}); err != nil {
+        t.Fatalf("successful response should have no error, got %v", err)
+    }
+}
+
+func TestLockErrorWireFormat(t *testing.T) {
+    resp := AcquireLockResponse{Err: transportError(errors.New("local only"))}
+    data, err := json.Marshal(resp)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var decoded AcquireLockResponse
+    if err := json.Unmarshal(data, &decoded); err != nil {
+        t.Fatal(err)
+    }
+    if !errors.Is(decoded.Err, ErrTransport) || !decoded.Err.Retryable || decoded.Err.Message != ErrTransport.Message {
+        t.Fatalf("code, message and retryability should survive the wire, got %#v", decoded.Err)
+    }
+    if decoded.Err.Unwrap() != nil {
+        t.Fatalf("cause shouldn't be sent over the wire")
+    }
+    data, _ = json.Marshal(AcquireLockResponse{Err: Success})
+    decoded = AcquireLockResponse{Err: ErrLockHeld}
+    json.Unmarshal(data, &decoded)
+    if decoded.Err != nil {
+        t.Fatalf("success should decode to nil error, got %v", decoded.Err)
+    }
+}
+
+/* Clients compare codes by value, so codes already sent keep their values. */
+func TestErrorCodesKeepWireValues(t *testing.T) {
+    codes := []ErrorCode{
+        CodeOK, CodeLockExists, CodeLockDoesntExist, CodeNoIntermediateDomain,
+        CodeNoPlacement, CodeDomainExists, CodeEmptyPath, CodeLockHeld,
+        CodeLockRecalcitrant, CodeLockNotHeld, CodeBadClientRelease,
+        CodeNoServersForId, CodeCannotLocateLock, CodeInvalidRequest,
+        CodeInvalidResponse, CodeNotApplied, CodeTransport, CodeDomainDoesntExist,
+        CodeNoSuchGroup, CodeRebalanceInProgress, CodeNoSuchMove, CodePlacementPolicy,
+        CodeWorkersExist, CodeNoSuchWorkers, CodeGroupUnhealthy, CodeGroupDraining,
+        CodeLockMoved, CodeLockMoving, CodeGroupSize, CodeServerInUse,
+        CodeNoSuchServer, CodeMembershipChange,
+    }
+    for want, code := range codes {
+        if int(code) != want {
+            t.Errorf("got code %d, want %d", code, want)
+        }
+    }
+}
@@ -0,0 +1,246 @@
+package locks
+
+import(
+    "hash/fnv"
+    "sort"
+    "strconv"
+)
+
+/* Consistent hashing for domains whose placement policy is Hashed. Locks in
+   such a domain are stored at the group owning the hash of their name on a
+   ring built from the domain's groups, so adding or removing a group only
+   moves the locks in its slice of the ring. Clients can fetch a domain's ring
+   with DomainRing and find where a lock most likely lives with HashOwner. */
+
+/* Points each replica group gets on the ring. */
+const ringPointsPerGroup = 64
+
+type hashRing struct {
+    points  []uint64
+    owners  map[uint64]ReplicaGroupId
+}
+
+type DomainRingResponse struct {
+    /* True if domain places locks by consistent hashing. */
+    Hashed  bool
+    /* Groups on the domain's ring, in ID order. */
+    Groups  []GroupStatus
+    Err     *LockError
+}
+
+/* FNV-1a of s, mixed with murmur3's finalizer. FNV alone leaves the short,
+   similar names of a group's points close together on the ring, so groups
+   would own very uneven slices of it. */
+func hashString(s string) uint64 {
+    h := fnv.New64a()
+    h.Write([]byte(s))
+    x := h.Sum64()
+    x ^= x >> 33
+    x *= 0xff51afd7ed558ccd
+    x ^= x >> 33
+    x *= 0xc4ceb9fe1a85ec53
+    x ^= x >> 33
+    return x
+}
+
+func newHashRing(replicaGroups []ReplicaGroupId) hashRing {
+    ring := hashRing{make([]uint64, 0), make(map[uint64]ReplicaGroupId)}
+    for _, replicaGroup := range replicaGroups {
+        for i := 0; i < ringPointsPerGroup; i++ {
+            ring.addPoint(hashString(strconv.Itoa(int(replicaGroup)) + "-" + strconv.Itoa(i)), replicaGroup)
+        }
+    }
+    sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+    return ring
+}
+
+/* Give point to group. Collisions go to the lower ID so every ring agrees,
+   whatever order groups are added in. Points must be sorted afterwards. */
+func (r *hashRing) addPoint(point uint64, replicaGroup ReplicaGroupId) {
+    if owner, ok := r.owners[point]; ok {
+        if replicaGroup < owner {
+            r.owners[point] = replicaGroup
+        }
+        return
+    }
+    r.points = append(r.points, point)
+    r.owners[point] = replicaGroup
+}
+
+/* Group owning lock; NO_WORKER if ring is empty. */
+func (r hashRing) owner(l Lock) ReplicaGroupId {
+    if len(r.points) == 0 {
+        return NO_WORKER
+    }
+    h := hashString(string(l))
+    i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+    if i == len(r.points) {
+        i = 0
+    }
+    return r.owners[r.points[i]]
+}
+
+/* Group that owns lock on a ring of replica groups; NO_WORKER if there are no
+   groups. */
+func HashOwner(l Lock, replicaGroups []ReplicaGroupId) ReplicaGroupId {
+    return newHashRing(replicaGroups).owner(l)
+}
+
+/* Master side. */
+
+/* True if domain places locks by consistent hashing. Assumes FSM already locked. */
+func (m *MasterFSM) isHashed(d Domain) bool {
+    return m.PlacementPolicyMap[d].Hashed
+}
+
+/* Groups on domain's ring: its usable, allowed groups in ID order.
+   Assumes FSM already locked. */
+func (m *MasterFSM) ringGroups(d Domain) []ReplicaGroupId {
+    ids := make([]int, 0)
+    seen := make(map[ReplicaGroupId]bool)
+    for _, replicaGroup := range m.DomainPlacementMap[d] {
+        if !seen[replicaGroup] && m.isUsableGroup(replicaGroup) && m.placementAllowed(d, replicaGroup) {
+            ids = append(ids, int(replicaGroup))
+        }
+        seen[replicaGroup] = true
+    }
+    sort.Ints(ids)
+    return groupIds(ids)
+}
+
+func groupIds(ids []int) []ReplicaGroupId {
+    replicaGroups := make([]ReplicaGroupId, 0)
+    for _, id := range ids {
+        replicaGroups = append(replicaGroups, ReplicaGroupId(id))
+    }
+    return replicaGroups
+}
+
+/* True if group stores locks from a hashed domain. Assumes FSM already locked. */
+func (m *MasterFSM) servesHashedDomain(replicaGroup ReplicaGroupId) bool {
+    for d, replicaGroups := range m.DomainPlacementMap {
+        if m.isHashed(d) && containsGroup(replicaGroups, replicaGroup) {
+            return true
+        }
+    }
+    return false
+}
+
+/* Put new group on the ring of every hashed domain served by old group, so it
+   takes over a slice of their locks. Assumes FSM already locked. */
+func (m *MasterFSM) joinHashRings(oldReplicaGroup ReplicaGroupId, newReplicaGroup ReplicaGroupId) {
+    for d, replicaGroups := range m.DomainPlacementMap {
+        if m.isHashed(d) && containsGroup(replicaGroups, oldReplicaGroup) && !containsGroup(replicaGroups, newReplicaGroup) {
+            m.DomainPlacementMap[d] = append(replicaGroups, newReplicaGroup)
+        }
+    }
+}
+
+/* Transfers moving locks in hashed domains to the group owning them on their
+   domain's ring. Held locks and locks at or bound for groups that are moving
+   locks or unhealthy wait for a later check. Assumes FSM already locked. */
+func (m *MasterFSM) rehashPlan() []LockTransfer {
+    rings := make(map[Domain]hashRing)
+    moves := make(map[ReplicaGroupId]map[ReplicaGroupId][]Lock)
+    for _, l := range m.sortedLocks() {
+        d := getParentDomain(string(l))
+        if !m.isHashed(d) {
+            continue
+        }
+        if _, recalcitrant := m.RecalcitrantDestMap[l]; recalcitrant {
+            continue
+        }
+        ring, ok := rings[d]
+        if !ok {
+            ring = newHashRing(m.ringGroups(d))
+            rings[d] = ring
+        }
+        replicaGroup := m.LockMap[l]
+        owner := ring.owner(l)
+        if owner == NO_WORKER || owner == replicaGroup || m.RebalancingInProgress[replicaGroup] || m.RebalancingInProgress[owner] || !m.isHealthy(replicaGroup) || !m.isHealthy(owner) {
+            continue
+        }
+        if _, ok := moves[replicaGroup]; !ok {
+            moves[replicaGroup] = make(map[ReplicaGroupId][]Lock)
+        }
+        moves[replicaGroup][owner] = append(moves[replicaGroup][owner], l)
+    }
+    sources := make([]int, 0)
+    for replicaGroup := range moves {
+        sources = append(sources, int(replicaGroup))
+    }
+    sort.Ints(sources)
+    plan := make([]LockTransfer, 0)
+    for _, source := range groupIds(sources) {
+        targets := make([]int, 0)
+        for owner := range moves[source] {
+            targets = append(targets, int(owner))
+        }
+        sort.Ints(targets)
+        for _, target := range groupIds(targets) {
+            plan = append(plan, LockTransfer{source, target, moves[source][target]})
+        }
+    }
+    return plan
+}
+
+func (m *MasterFSM) domainRing(d Domain) DomainRingResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    if len(d) > 0 && string(d[0]) != "/" {
+        d = "/" + d
+    }
+    if _, ok := m.DomainPlacementMap[d]; !ok {
+        return DomainRingResponse{Err: ErrDomainDoesntExist}
+    }
+    response := DomainRingResponse{m.isHashed(d), make([]GroupStatus, 0), Success}
+    if !response.Hashed {
+        return response
+    }
+    for _, replicaGroup := range m.ringGroups(d) {
+        response.Groups = append(response.Groups, GroupStatus{replicaGroup, m.ClusterMap[replicaGroup], m.NumLocksHeld[replicaGroup]})
+    }
+    return response
+}
+
+/* Client side. */
+
+/* Returns the consistent hash ring of a domain, which is empty unless the
+   domain places locks by hashing. */
+func (lc *LockClient) DomainRing(d Domain) (DomainRingResponse, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = DomainRingCommand
+    args[DomainArgKey] = string(d)
+    var response DomainRingResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    if err != nil {
+        return response, err
+    }
+    if len(d) > 0 && string(d[0]) != "/" {
+        d = "/" + d
+    }
+    lc.rings[d] = response
+    return response, nil
+}
+
+/* Guess where lock is stored from its domain's ring, fetching the ring on
+   first use. Returns false if domain isn't hashed. */
+func (lc *LockClient) guessLocation(l Lock) (ReplicaGroupId, bool) {
+    d := getParentDomain(string(l))
+    ring, ok := lc.rings[d]
+    if !ok {
+        var err error
+        if ring, err = lc.DomainRing(d); err != nil {
+            return NO_WORKER, false
+        }
+    }
+    if !ring.Hashed || len(ring.Groups) == 0 {
+        return NO_WORKER, false
+    }
+    replicaGroups := make([]ReplicaGroupId, 0)
+    for _, group := range ring.Groups {
+        replicaGroups = append(replicaGroups, group.ReplicaId)
+        lc.replicaServers[group.ReplicaId] = group.ServerAddrs
+    }
+    return HashOwner(l, replicaGroups), true
+}
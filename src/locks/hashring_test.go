@@ -0,0 +1,97 @@
+package locks
+
+import(
+    "fmt"
+    "testing"
+)
+
+func testLocks(n int) []Lock {
+    lockArr := make([]Lock, n)
+    for i := range lockArr {
+        lockArr[i] = Lock(fmt.Sprintf("/d/lock-%d", i))
+    }
+    return lockArr
+}
+
+func TestHashRingOwnerIgnoresGroupOrder(t *testing.T) {
+    tests := []struct {
+        name    string
+        orders  [][]ReplicaGroupId
+    }{
+        {"one group", [][]ReplicaGroupId{{3}, {3, 3}}},
+        {"two groups", [][]ReplicaGroupId{{0, 1}, {1, 0}}},
+        {"three groups", [][]ReplicaGroupId{{0, 1, 2}, {2, 1, 0}, {1, 2, 0}, {0, 2, 1, 2}}},
+        {"sparse IDs", [][]ReplicaGroupId{{4, 9, 17, 30}, {30, 17, 9, 4}}},
+    }
+    for _, test := range tests {
+        want := newHashRing(test.orders[0])
+        for _, order := range test.orders[1:] {
+            ring := newHashRing(order)
+            for _, l := range testLocks(1000) {
+                if ring.owner(l) != want.owner(l) {
+                    t.Fatalf("%s: %v and %v disagree on owner of %s", test.name, test.orders[0], order, l)
+                }
+                if HashOwner(l, order) != want.owner(l) {
+                    t.Fatalf("%s: HashOwner disagrees with ring", test.name)
+                }
+            }
+        }
+    }
+}
+
+func TestHashRingEmpty(t *testing.T) {
+    for _, replicaGroups := range [][]ReplicaGroupId{nil, {}} {
+        if owner := newHashRing(replicaGroups).owner("/d/l"); owner != NO_WORKER {
+            t.Fatalf("empty ring owner should be NO_WORKER, got %v", owner)
+        }
+        if owner := HashOwner("/d/l", replicaGroups); owner != NO_WORKER {
+            t.Fatalf("HashOwner on no groups should be NO_WORKER, got %v", owner)
+        }
+    }
+}
+
+func TestHashRingAddingGroupMovesItsShare(t *testing.T) {
+    tests := []struct {
+        before  []ReplicaGroupId
+        added   ReplicaGroupId
+    }{
+        {[]ReplicaGroupId{0}, 1},
+        {[]ReplicaGroupId{0, 1, 2}, 3},
+        {[]ReplicaGroupId{0, 1, 2, 3}, 4},
+        {[]ReplicaGroupId{2, 5, 7, 8, 11, 12, 13}, 6},
+    }
+    lockArr := testLocks(10000)
+    for _, test := range tests {
+        before := newHashRing(test.before)
+        after := newHashRing(append(append([]ReplicaGroupId{}, test.before...), test.added))
+        moved := 0
+        for _, l := range lockArr {
+            if owner := after.owner(l); owner != before.owner(l) {
+                if owner != test.added {
+                    t.Fatalf("%s moved from %v to %v, not to added group %v", l, before.owner(l), owner, test.added)
+                }
+                moved++
+            }
+        }
+        share := 1 / float64(len(test.before) + 1)
+        fraction := float64(moved) / float64(len(lockArr))
+        if fraction < share / 2 || fraction > share * 3 / 2 {
+            t.Errorf("adding group %v to %v moved %.3f of locks, want about %.3f", test.added, test.before, fraction, share)
+        }
+    }
+}
+
+func TestHashRingCollisionsGoToLowerGroup(t *testing.T) {
+    for _, order := range [][]ReplicaGroupId{{5, 2}, {2, 5}, {5, 2, 7}} {
+        ring := hashRing{make([]uint64, 0), make(map[uint64]ReplicaGroupId)}
+        for _, replicaGroup := range order {
+            ring.addPoint(42, replicaGroup)
+        }
+        if len(ring.points) != 1 {
+            t.Fatalf("colliding point added %d times", len(ring.points))
+        }
+        if owner := ring.owners[42]; owner != 2 {
+            t.Fatalf("collision between %v went to %v, want 2", order, owner)
+        }
+    }
+}
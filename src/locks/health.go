@@ -0,0 +1,159 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "strconv"
+    "time"
+)
+
+/* The master leader probes every replica group periodically. A group that
+   fails HealthFailureThreshold probes in a row is marked unhealthy through the
+   master log, and marked healthy again once a probe succeeds. New locks and
+   moved locks are not placed at unhealthy groups. */
+
+/* Time between health probes of each group. */
+var HealthProbeInterval time.Duration = time.Second
+
+/* Time to wait for a group to answer a probe. */
+var HealthProbeTimeout time.Duration = 3 * time.Second
+
+/* Consecutive failed probes before group is marked unhealthy. */
+var HealthFailureThreshold = 3
+
+type GroupHealth struct {
+    Healthy     bool
+    /* Time health last changed. */
+    Since       time.Time
+}
+
+type HealthCheckResponse struct {
+    Err     *LockError
+}
+
+/* Master side. */
+
+/* Attach raft instance running this FSM and start probing workers, resuming
+   transfers, forcing overdue revocations and reconciling with workers
+   whenever it is leader, until detachRaft. */
+func (m *MasterFSM) attachRaft(r *raft.Raft) {
+    if r == nil {
+        return
+    }
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if m.raft == nil {
+        m.stop = make(chan struct{})
+        go m.healthProbeLoop(r, m.stop)
+        go m.transferResumeLoop(r, m.stop)
+        go m.revocationLoop(r, m.stop)
+        go m.reconcileLoop(r, m.stop)
+        go m.masterSyncLoop(r, m.stop)
+    }
+    m.raft = r
+}
+
+/* Stop the loops started by attachRaft, once the server running this FSM has
+   shut down. */
+func (m *MasterFSM) detachRaft() {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if m.raft == nil {
+        return
+    }
+    close(m.stop)
+    m.raft = nil
+}
+
+/* Assumes FSM already locked. */
+func (m *MasterFSM) isHealthy(replicaGroup ReplicaGroupId) bool {
+    health, ok := m.GroupHealthMap[replicaGroup]
+    return !ok || health.Healthy
+}
+
+func (m *MasterFSM) setGroupHealth(replicaGroup ReplicaGroupId, healthy bool) {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if _, ok := m.ClusterMap[replicaGroup]; !ok || m.isHealthy(replicaGroup) == healthy {
+        return
+    }
+    m.GroupHealthMap[replicaGroup] = GroupHealth{healthy, m.Clock}
+}
+
+func (m *MasterFSM) healthProbeLoop(r *raft.Raft, stop chan struct{}) {
+    failures := make(map[ReplicaGroupId]int)
+    ticker := time.NewTicker(HealthProbeInterval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-stop:
+                return
+            case <-ticker.C:
+        }
+        if r.State() != raft.Leader {
+            /* New leader starts counting from scratch. */
+            failures = make(map[ReplicaGroupId]int)
+            continue
+        }
+        m.FsmLock.RLock()
+        groups := make(map[ReplicaGroupId][]raft.ServerAddress)
+        recorded := make(map[ReplicaGroupId]bool)
+        for replicaGroup, addrs := range m.ClusterMap {
+            groups[replicaGroup] = addrs
+            recorded[replicaGroup] = m.isHealthy(replicaGroup)
+        }
+        m.FsmLock.RUnlock()
+
+        results := make(map[ReplicaGroupId]chan bool)
+        for replicaGroup, addrs := range groups {
+            results[replicaGroup] = probeGroup(addrs)
+        }
+        for replicaGroup, result := range results {
+            if <-result {
+                failures[replicaGroup] = 0
+            } else {
+                failures[replicaGroup]++
+            }
+            healthy := failures[replicaGroup] < HealthFailureThreshold
+            if healthy != recorded[replicaGroup] {
+                args := make(map[string]string)
+                args[FunctionKey] = GroupHealthCommand
+                args[GroupArgKey] = strconv.Itoa(int(replicaGroup))
+                args[HealthyKey] = strconv.FormatBool(healthy)
+                command, json_err := json.Marshal(args)
+                if json_err != nil {
+                    continue
+                }
+                r.ApplyCommand(command, raft.NoTrace)
+            }
+        }
+    }
+}
+
+/* Send a health check to group. The channel receives true if the group
+   answers within HealthProbeTimeout. */
+func probeGroup(addrs []raft.ServerAddress) chan bool {
+    result := make(chan bool, 1)
+    answered := make(chan bool, 1)
+    go func() {
+        args := make(map[string]string)
+        args[FunctionKey] = HealthCheckCommand
+        command, json_err := json.Marshal(args)
+        if json_err != nil {
+            answered <- false
+            return
+        }
+        resp := raft.ClientResponse{}
+        send_err := raft.SendSingletonRequestToCluster(addrs, command, &resp)
+        answered <- requestError(send_err, &resp) == nil
+    }()
+    go func() {
+        select {
+            case ok := <-answered:
+                result <- ok
+            case <-time.After(HealthProbeTimeout):
+                result <- false
+        }
+    }()
+    return result
+}
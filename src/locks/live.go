@@ -0,0 +1,263 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "errors"
+    "strconv"
+    "time"
+)
+
+/* Live migration moves held locks along with everything else. Instead of
+   leaving held locks behind until released, the old group freezes each lock
+   and hands its full state (holder and sequencer) to the master, which passes
+   it to the new group. Once the move commits, the old group keeps a forward
+   to the new group, and clients that ask it about the lock are redirected.
+   The holder keeps the lock throughout; only a release sent while the lock is
+   frozen has to be retried. The new group tells the holder the lock arrived,
+   and the holder opens a session there, so the lock is still released if the
+   holder goes away. */
+
+/* Whether masters created from now on move held locks live instead of waiting
+   for release. The master leader's setting is written into the master log
+   (see TransferSettings), so masters started with different settings agree. */
+var LiveMigration = false
+
+/* Times client follows a lock to another group, or waits for a frozen lock,
+   before giving up on a request. */
+const maxLockRedirects = 5
+
+/* Time client waits before retrying a request on a frozen lock. */
+var MigrationRetryInterval time.Duration = 100 * time.Millisecond
+
+/* State of a lock carried from one group to another. Flags describing the
+   lock's part in a move at the old group (disabled, migrating, recalcitrant)
+   are not carried; the new group starts the lock afresh. */
+type MigratedLock struct {
+    Held            bool
+    Client          raft.ServerAddress
+    SeqNo           Sequencer
+    /* Accesses in the current and last reporting period, so the lock's
+       frequency isn't lost by moving. */
+    FreqCount       int
+    SaveFreqCount   int
+}
+
+/* Where a lock went, kept by the group it left. */
+type LockForward struct {
+    ReplicaId   ReplicaGroupId
+    ServerAddrs []raft.ServerAddress
+}
+
+type MigrateResponse struct {
+    States  map[Lock]MigratedLock
+    Err     *LockError
+}
+
+/* Worker side. */
+
+/* Freeze locks and return their state. Repeating it returns the same state.
+   Locks not stored here are left out. */
+func (w *WorkerFSM) migrateLocks(lock_arr []Lock) MigrateResponse {
+    w.FsmLock.Lock()
+    defer w.FsmLock.Unlock()
+    states := make(map[Lock]MigratedLock)
+    for _, l := range lock_arr {
+        state, ok := w.LockStateMap[l]
+        if !ok {
+            continue
+        }
+        state.Migrating = true
+        state.Disabled = true
+        w.LockStateMap[l] = state
+        states[l] = MigratedLock{state.Held, state.Client, w.SequencerMap[l], state.FreqCount, state.SaveFreqCount}
+    }
+    return MigrateResponse{states, Success}
+}
+
+/* Callback telling client that locks it holds arrived here, so it opens a
+   session with this group. Until the client does, the leader keeps a session
+   for it as if it had, which ends and releases the locks unless kept alive;
+   so a holder that goes away before hearing of the move doesn't keep them
+   forever. */
+func (w *WorkerFSM) holderMovedAlert(client raft.ServerAddress, lock_arr []Lock, here LockForward) func() [][]byte {
+    return func() [][]byte {
+        logger := w.logger.Named("rebalance").With("client", client, "locks", len(lock_arr))
+        endSession, json_err := endSessionCommand(client)
+        if json_err != nil {
+            return [][]byte{}
+        }
+        w.FsmLock.RLock()
+        r := w.raft
+        w.FsmLock.RUnlock()
+        if r != nil {
+            r.KeepClientSession(client, endSession)
+        }
+        args := make(map[string]string)
+        args[FunctionKey] = LockMovedEventCommand
+        args[LockArrayKey] = lock_array_to_string(lock_arr)
+        args[GroupArgKey] = strconv.Itoa(int(here.ReplicaId))
+        args[ServerAddrsKey] = addr_array_to_string(here.ServerAddrs)
+        send, json_err := clientEventSender(client, args)
+        if json_err != nil {
+            return [][]byte{}
+        }
+        go sendClientEvent(send, time.Time{}, logger)
+        return [][]byte{}
+    }
+}
+
+/* Where lock migrated to, or nil if it didn't. Assumes FSM already locked. */
+func (w *WorkerFSM) forwardOf(l Lock) *LockForward {
+    if forward, ok := w.ForwardMap[l]; ok {
+        return &forward
+    }
+    return nil
+}
+
+/* Master side. */
+
+/* Ask replica group to freeze locks and return their state. */
+func (m *MasterFSM) askWorkerToMigrateLocks(replicaGroup ReplicaGroupId, locksToMove []Lock, trace raft.TraceContext) (map[Lock]MigratedLock, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = MigrateCommand
+    args[LockArrayKey] = lock_array_to_string(locksToMove)
+    resp := raft.ClientResponse{}
+    if err := m.genericClusterRequest(replicaGroup, args, &resp, trace); err != nil {
+        return nil, err
+    }
+    var response MigrateResponse
+    if unmarshal_err := json.Unmarshal(resp.ResponseData, &response); unmarshal_err != nil {
+        return nil, ErrNotApplied
+    }
+    if response.Err != nil {
+        return nil, response.Err
+    }
+    return response.States, nil
+}
+
+/* Client side. */
+
+/* Response from a replica group to a request about a single lock. */
+type lockResponse interface {
+    lockErr() *LockError
+    forward() *LockForward
+}
+
+func (r *AcquireLockResponse) lockErr() *LockError { return r.Err }
+func (r *AcquireLockResponse) forward() *LockForward { return r.MovedTo }
+func (r *ReleaseLockResponse) lockErr() *LockError { return r.Err }
+func (r *ReleaseLockResponse) forward() *LockForward { return r.MovedTo }
+func (r *ValidateLockResponse) lockErr() *LockError { return r.Err }
+func (r *ValidateLockResponse) forward() *LockForward { return r.MovedTo }
+
+/* Open a session with the group that locks this client holds moved to, as
+   told by a moved event, so the group releases them if the client goes away. */
+func (lc *LockClient) followMovedLocks(args map[string]string) error {
+    group, err := strconv.Atoi(args[GroupArgKey])
+    if err != nil {
+        return ErrInvalidRequest
+    }
+    id := ReplicaGroupId(group)
+    lc.followLock.Lock()
+    defer lc.followLock.Unlock()
+    if lc.followSessions[id] != nil {
+        return nil
+    }
+    endSession, err := endSessionCommand(lc.trans.LocalAddr())
+    if err != nil {
+        return err
+    }
+    session, err := raft.CreateClientSession(lc.trans, string_to_addr_array(args[ServerAddrsKey]), endSession, lc.logger.With("group", id))
+    if err != nil {
+        lc.logger.Warn("can't open session with group locks moved to", "group", id, "error", err)
+        return err
+    }
+    lc.logger.Debug("following held locks", "group", id, "locks", args[LockArrayKey])
+    lc.followSessions[id] = session
+    return nil
+}
+
+/* Find group storing lock, asking the master if it isn't known or guessable. */
+func (lc *LockClient) findLock(l Lock) (ReplicaGroupId, error) {
+    if replicaID, ok := lc.locks[l]; ok {
+        countLocateLookup("hit")
+        return replicaID, nil
+    }
+    if replicaID, ok := lc.guessLocation(l); ok {
+        countLocateLookup("ring")
+        lc.locks[l] = replicaID
+        return replicaID, nil
+    }
+    countLocateLookup("miss")
+    lc.logger.Debug("locating lock", "lock", l)
+    return lc.askMasterToLocate(l)
+}
+
+/* Send request about lock to the group storing it and parse the reply into
+   response. Follows the lock if it migrated to another group, waits while it
+   is frozen for migration, and looks it up again once if the group doesn't
+   have it or can't be reached. Returns the error in the final response. */
+func (lc *LockClient) sendLockRequest(l Lock, data []byte, response lockResponse) error {
+    replicaID, err := lc.findLock(l)
+    if err != nil {
+        return err
+    }
+    relocated := false
+    for attempt := 0; ; attempt++ {
+        session, session_err := lc.getSessionForId(replicaID)
+        if session_err != nil {
+            return session_err
+        }
+        resp := raft.ClientResponse{}
+        endSend := lc.startSpan("send", "group", replicaID)
+        send_err := session.SendRequestWithTrace(data, &resp, lc.trace)
+        endSend()
+        if send_err != nil && !relocated {
+            /* Group's servers may have changed; ask master for them. */
+            countClientRetry("unreachable")
+            lc.logger.Debug("replica group unreachable, relocating lock", "lock", l, "group", replicaID, "error", send_err)
+            relocated = true
+            lc.forgetGroupServers(replicaID)
+            delete(lc.rings, getParentDomain(string(l)))
+            if replicaID, err = lc.askMasterToLocate(l); err != nil {
+                return err
+            }
+            continue
+        }
+        if req_err := requestError(send_err, &resp); req_err != nil {
+            return req_err
+        }
+        if unmarshal_err := json.Unmarshal(resp.ResponseData, response); unmarshal_err != nil {
+            lc.logger.Warn("invalid response", "lock", l, "group", replicaID, "error", unmarshal_err)
+            return ErrInvalidResponse
+        }
+        lockErr := response.lockErr()
+        switch {
+            case lockErr == nil:
+                return nil
+            case errors.Is(lockErr, ErrLockMoved) && response.forward() != nil && attempt < maxLockRedirects:
+                countClientRetry("moved")
+                forward := response.forward()
+                delete(lc.rings, getParentDomain(string(l)))
+                replicaID = forward.ReplicaId
+                lc.locks[l] = replicaID
+                lc.replicaServers[replicaID] = forward.ServerAddrs
+            case errors.Is(lockErr, ErrLockMoving) && attempt < maxLockRedirects:
+                countClientRetry("moving")
+                time.Sleep(MigrationRetryInterval)
+            case (errors.Is(lockErr, ErrLockDoesntExist) || errors.Is(lockErr, ErrLockMoved)) && !relocated:
+                /* Need to look up location again. */
+                countClientRetry("relocate")
+                relocated = true
+                delete(lc.locks, l)
+                delete(lc.rings, getParentDomain(string(l)))
+                lc.logger.Debug("relocating lock", "lock", l, "group", replicaID, "error", lockErr)
+                if replicaID, err = lc.askMasterToLocate(l); err != nil {
+                    return err
+                }
+            default:
+                return lockErr
+        }
+    }
+}
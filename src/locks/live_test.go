@@ -0,0 +1,274 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "errors"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestMigrateLocks(t *testing.T) {
+    w := testWorker()
+    response := w.migrateLocks([]Lock{"/a/l1", "/b/l3", "/a/l9"})
+    want := map[Lock]MigratedLock{
+        "/a/l1": {Held: true, Client: "c:1", SeqNo: 3, FreqCount: 4, SaveFreqCount: 2},
+        "/b/l3": {SeqNo: 9},
+    }
+    if response.Err != nil || !reflect.DeepEqual(response.States, want) {
+        t.Fatalf("got %+v, want %+v", response, want)
+    }
+    if state := w.LockStateMap["/a/l1"]; !state.Migrating || !state.Disabled || !state.Held {
+        t.Fatalf("migrated lock should be frozen but still held, got %+v", state)
+    }
+    /* Repeating returns the same state. */
+    if again := w.migrateLocks([]Lock{"/a/l1", "/b/l3"}); !reflect.DeepEqual(again.States, want) {
+        t.Fatalf("repeat: got %+v, want %+v", again.States, want)
+    }
+}
+
+func TestClaimLocksWithStates(t *testing.T) {
+    w := &WorkerFSM{
+        LockStateMap:   map[Lock]lockState{"/a/l1": {Held: true, Client: "c:9"}},
+        SequencerMap:   map[Lock]Sequencer{"/a/l1": 20},
+        ForwardMap:     map[Lock]LockForward{"/a/l2": {1, nil}},
+        Sessions:       make(map[raft.ServerAddress]bool),
+        logger:         raft.NopLogger(),
+    }
+    states := map[Lock]MigratedLock{
+        "/a/l1": {Held: true, Client: "c:1", SeqNo: 3},
+        "/a/l2": {Held: true, Client: "c:2", SeqNo: 5, FreqCount: 4, SaveFreqCount: 2},
+        "/a/l3": {Held: true, Client: "c:1", SeqNo: 7},
+        "/a/l4": {SeqNo: 1},
+    }
+    here := &LockForward{2, []raft.ServerAddress{"w2:1"}}
+    callbacks := w.claimLocks([]Lock{"/a/l1", "/a/l2", "/a/l3", "/a/l4", "/a/l5"}, states, here)
+
+    /* A lock already here is left alone. */
+    if state := w.LockStateMap["/a/l1"]; state.Client != "c:9" || w.SequencerMap["/a/l1"] != 20 {
+        t.Fatalf("claim replaced lock in use: %+v", state)
+    }
+    want := lockState{Held: true, Client: "c:2", FreqCount: 4, SaveFreqCount: 2}
+    if state := w.LockStateMap["/a/l2"]; state != want || w.SequencerMap["/a/l2"] != 5 {
+        t.Fatalf("got %+v, seq %d, want %+v, seq 5", state, w.SequencerMap["/a/l2"], want)
+    }
+    if _, ok := w.ForwardMap["/a/l2"]; ok {
+        t.Fatalf("forward kept for lock moved back")
+    }
+    if state := w.LockStateMap["/a/l5"]; state.Held || w.SequencerMap["/a/l5"] != 0 {
+        t.Fatalf("lock without state should start free, got %+v", state)
+    }
+    if !w.Sessions["c:1"] || !w.Sessions["c:2"] {
+        t.Fatalf("holders not recorded: %v", w.Sessions)
+    }
+    /* One alert for each holder of locks that arrived held. */
+    if len(callbacks) != 2 {
+        t.Fatalf("got %d callbacks, want 2", len(callbacks))
+    }
+    if callbacks := w.claimLocks([]Lock{"/a/l6"}, map[Lock]MigratedLock{"/a/l6": {Held: true, Client: "c:1"}}, nil); len(callbacks) != 0 {
+        t.Fatalf("alert sent without knowing where locks are")
+    }
+}
+
+func TestHolderMovedAlert(t *testing.T) {
+    client := testTransport(t)
+    defer client.Close()
+    events := make(chan map[string]string, 1)
+    serveResponses(client, func(req *raft.ClientRequest) interface{} {
+        args := make(map[string]string)
+        json.Unmarshal(req.Entries[0].Data, &args)
+        events <- args
+        return nil
+    })
+    w := &WorkerFSM{logger: raft.NopLogger()}
+    here := LockForward{2, []raft.ServerAddress{"w2:1", "w2:2"}}
+    w.holderMovedAlert(client.LocalAddr(), []Lock{"/a/l1", "/a/l3"}, here)()
+    select {
+        case args := <-events:
+            if args[FunctionKey] != LockMovedEventCommand || args[GroupArgKey] != "2" || args[ServerAddrsKey] != addr_array_to_string(here.ServerAddrs) || args[LockArrayKey] != lock_array_to_string([]Lock{"/a/l1", "/a/l3"}) {
+                t.Fatalf("got event %v", args)
+            }
+        case <-time.After(5 * time.Second):
+            t.Fatalf("no event sent to holder")
+    }
+}
+
+func TestClientFollowsMovedLocks(t *testing.T) {
+    group := testTransport(t)
+    defer group.Close()
+    serveResponses(group, func(*raft.ClientRequest) interface{} { return nil })
+    trans := testTransport(t)
+    lc, _ := CreateLockClient(trans, nil, raft.NopLogger())
+    defer trans.Close()
+    defer lc.DestroyLockClient()
+
+    args := map[string]string{
+        FunctionKey:    LockMovedEventCommand,
+        LockArrayKey:   lock_array_to_string([]Lock{"/a/l1"}),
+        GroupArgKey:    "2",
+        ServerAddrsKey: addr_array_to_string([]raft.ServerAddress{group.LocalAddr()}),
+    }
+    send, err := clientEventSender(trans.LocalAddr(), args)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := send(); err != nil {
+        t.Fatalf("moved event not answered: %v", err)
+    }
+    lc.followLock.Lock()
+    session := lc.followSessions[2]
+    lc.followLock.Unlock()
+    if session == nil {
+        t.Fatalf("no session opened with group locks moved to")
+    }
+    /* Hearing of another move to the same group keeps the session. */
+    if err := send(); err != nil {
+        t.Fatal(err)
+    }
+    lc.followLock.Lock()
+    if len(lc.followSessions) != 1 || lc.followSessions[2] != session {
+        t.Fatalf("got sessions %v", lc.followSessions)
+    }
+    lc.followLock.Unlock()
+
+    /* A group that can't be reached makes the worker send again. */
+    args[GroupArgKey] = "3"
+    args[ServerAddrsKey] = string(closedAddr(t))
+    send, _ = clientEventSender(trans.LocalAddr(), args)
+    err = send()
+    lc.followLock.Lock()
+    defer lc.followLock.Unlock()
+    if err == nil || lc.followSessions[3] != nil {
+        t.Fatalf("unreachable group answered as followed: %v", err)
+    }
+}
+
+func TestForwards(t *testing.T) {
+    w := testWorker()
+    w.logger = raft.NopLogger()
+    forward := LockForward{2, []raft.ServerAddress{"w2:1"}}
+    w.disownLocks([]Lock{"/a/l1"}, &forward)
+    w.disownLocks([]Lock{"/a/l2"}, nil)
+    if _, ok := w.ForwardMap["/a/l2"]; ok {
+        t.Fatalf("forward left for lock that didn't move")
+    }
+    if response, _ := w.tryAcquireLock("/a/l1", "c:3"); response.Err != ErrLockMoved || !reflect.DeepEqual(response.MovedTo, &forward) {
+        t.Fatalf("acquire: got %+v", response)
+    }
+    if response, _ := w.releaseLock("/a/l1", "c:1"); response.Err != ErrLockMoved || !reflect.DeepEqual(response.MovedTo, &forward) {
+        t.Fatalf("release: got %+v", response)
+    }
+    if response := w.validateLock("/a/l1", 3); response.Err != ErrLockMoved || !reflect.DeepEqual(response.MovedTo, &forward) {
+        t.Fatalf("validate: got %+v", response)
+    }
+    if response, _ := w.tryAcquireLock("/a/l2", "c:3"); response.Err != ErrLockDoesntExist {
+        t.Fatalf("acquire lock without forward: got %+v", response)
+    }
+
+    /* Frozen locks stay held, but can't be released until they land. */
+    w.LockStateMap["/b/l5"] = lockState{Held: true, Client: "c:1"}
+    w.migrateLocks([]Lock{"/b/l5"})
+    if response, _ := w.releaseLock("/b/l5", "c:1"); response.Err != ErrLockMoving {
+        t.Fatalf("release of frozen lock: got %+v", response)
+    }
+    if response, _ := w.tryAcquireLock("/b/l5", "c:2"); response.Err != ErrLockHeld {
+        t.Fatalf("acquire of frozen lock: got %+v", response)
+    }
+}
+
+/* Client of fake groups, knowing where lock l is. */
+func fakeGroupClient(t *testing.T, l Lock, group ReplicaGroupId, addr raft.ServerAddress) *LockClient {
+    trans := testTransport(t)
+    lc, _ := CreateLockClient(trans, nil, raft.NopLogger())
+    t.Cleanup(func() {
+        lc.DestroyLockClient()
+        trans.Close()
+    })
+    lc.locks[l] = group
+    lc.replicaServers[group] = []raft.ServerAddress{addr}
+    return lc
+}
+
+/* Group answering requests with responses in turn, repeating the last. */
+func fakeGroup(t *testing.T, responses ...interface{}) (*raft.NetworkTransport, *int) {
+    trans := testTransport(t)
+    t.Cleanup(func() { trans.Close() })
+    requests := 0
+    serveResponses(trans, func(req *raft.ClientRequest) interface{} {
+        if len(req.Entries) == 0 {
+            return nil
+        }
+        requests++
+        if requests > len(responses) {
+            return responses[len(responses) - 1]
+        }
+        return responses[requests - 1]
+    })
+    return trans, &requests
+}
+
+func TestSendLockRequestFollowsMovedLock(t *testing.T) {
+    newGroup, newRequests := fakeGroup(t, ValidateLockResponse{true, Success, nil})
+    forward := &LockForward{2, []raft.ServerAddress{newGroup.LocalAddr()}}
+    oldGroup, oldRequests := fakeGroup(t, ValidateLockResponse{false, ErrLockMoved, forward})
+    lc := fakeGroupClient(t, "/a/l1", 1, oldGroup.LocalAddr())
+    if valid, err := lc.ValidateLock("/a/l1", 3); !valid || err != nil {
+        t.Fatalf("got %v, %v", valid, err)
+    }
+    if *oldRequests != 1 || *newRequests != 1 {
+        t.Fatalf("sent %d to old group and %d to new, want 1 each", *oldRequests, *newRequests)
+    }
+    if lc.locks["/a/l1"] != 2 || !reflect.DeepEqual(lc.replicaServers[2], forward.ServerAddrs) {
+        t.Fatalf("new location not remembered: %v, %v", lc.locks, lc.replicaServers)
+    }
+    /* Later requests go straight to the new group. */
+    lc.ValidateLock("/a/l1", 3)
+    if *oldRequests != 1 || *newRequests != 2 {
+        t.Fatalf("sent %d to old group and %d to new after move", *oldRequests, *newRequests)
+    }
+}
+
+func TestSendLockRequestGivesUpFollowing(t *testing.T) {
+    defer func(interval time.Duration) { MigrationRetryInterval = interval }(MigrationRetryInterval)
+    MigrationRetryInterval = time.Millisecond
+
+    /* A lock forwarded again and again is followed only so far. */
+    group := testTransport(t)
+    defer group.Close()
+    forward := &LockForward{1, []raft.ServerAddress{group.LocalAddr()}}
+    requests := 0
+    serveResponses(group, func(req *raft.ClientRequest) interface{} {
+        if len(req.Entries) == 0 {
+            return nil
+        }
+        requests++
+        return ReleaseLockResponse{ErrLockMoved, forward}
+    })
+    lc := fakeGroupClient(t, "/a/l1", 1, group.LocalAddr())
+    lc.masterServers = []raft.ServerAddress{closedAddr(t)}
+    if err := lc.ReleaseLock("/a/l1"); err == nil {
+        t.Fatalf("endless forwards should fail")
+    }
+    if requests != maxLockRedirects + 1 {
+        t.Fatalf("sent %d requests, want %d", requests, maxLockRedirects + 1)
+    }
+}
+
+func TestSendLockRequestWaitsForFrozenLock(t *testing.T) {
+    defer func(interval time.Duration) { MigrationRetryInterval = interval }(MigrationRetryInterval)
+    MigrationRetryInterval = time.Millisecond
+
+    moving := ReleaseLockResponse{ErrLockMoving, nil}
+    group, requests := fakeGroup(t, moving, moving, ReleaseLockResponse{Success, nil})
+    lc := fakeGroupClient(t, "/a/l1", 1, group.LocalAddr())
+    if err := lc.ReleaseLock("/a/l1"); err != nil || *requests != 3 {
+        t.Fatalf("got %v after %d requests, want success after 3", err, *requests)
+    }
+
+    frozen, requests := fakeGroup(t, moving)
+    lc = fakeGroupClient(t, "/a/l1", 1, frozen.LocalAddr())
+    if err := lc.ReleaseLock("/a/l1"); !errors.Is(err, ErrLockMoving) || *requests != maxLockRedirects + 1 {
+        t.Fatalf("got %v after %d requests, want %v after %d", err, *requests, ErrLockMoving, maxLockRedirects + 1)
+    }
+}
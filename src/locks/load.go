@@ -0,0 +1,70 @@
+package locks
+
+import(
+    "raft"
+    "time"
+)
+
+/* Load on a replica group besides access frequency, measured by the worker
+   leader each period and sent to the master with its frequency counts. */
+type WorkerLoad struct {
+    /* Number of locks stored at group. */
+    NumLocks        int
+    /* Clients with open sessions at group. */
+    NumSessions     int
+    /* Number of locks currently held. */
+    NumHeld         int
+    /* Committed commands waiting to be applied. */
+    QueueDepth      int
+    /* Average time to apply a command over the last period. */
+    ApplyLatency    time.Duration
+}
+
+/* Worker side. */
+
+func (w *WorkerFSM) attachRaft(r *raft.Raft) {
+    w.FsmLock.Lock()
+    defer w.FsmLock.Unlock()
+    w.raft = r
+}
+
+func (w *WorkerFSM) recordApplyLatency(start time.Time) {
+    w.FsmLock.Lock()
+    defer w.FsmLock.Unlock()
+    w.applyTime += time.Since(start)
+    w.applyCount++
+}
+
+/* Measure load and start a new latency period. Assumes FSM already locked. */
+func (w *WorkerFSM) currentLoad() WorkerLoad {
+    load := WorkerLoad{NumLocks: len(w.LockStateMap), NumSessions: len(w.Sessions)}
+    recalcitrant := 0
+    for _, state := range w.LockStateMap {
+        if state.Held {
+            load.NumHeld++
+        }
+        if state.Recalcitrant {
+            recalcitrant++
+        }
+    }
+    w.recordLoad(load, recalcitrant)
+    if w.raft != nil {
+        load.QueueDepth = int(w.raft.ApplyBacklog())
+    }
+    if w.applyCount > 0 {
+        load.ApplyLatency = w.applyTime / time.Duration(w.applyCount)
+    }
+    w.applyTime = 0
+    w.applyCount = 0
+    return load
+}
+
+/* Master side. */
+
+/* Latest load reported by group, with lock count kept current by the master
+   as locks move. Assumes FSM already locked. */
+func (m *MasterFSM) groupLoad(replicaGroup ReplicaGroupId) WorkerLoad {
+    load := m.GroupLoadMap[replicaGroup]
+    load.NumLocks = m.NumLocksHeld[replicaGroup]
+    return load
+}
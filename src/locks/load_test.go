@@ -0,0 +1,119 @@
+package locks
+
+import(
+    "raft"
+    "io"
+    "testing"
+    "time"
+)
+
+/* FSM that applies nothing until released, so committed entries queue up. */
+type blockedFSM struct {
+    release chan struct{}
+}
+
+func (f *blockedFSM) Apply(*raft.Log) (interface{}, []func() [][]byte) {
+    <-f.release
+    return nil, nil
+}
+
+func (f *blockedFSM) Snapshot() (raft.FSMSnapshot, error) {
+    return nil, ErrNotApplied
+}
+
+func (f *blockedFSM) Restore(io.ReadCloser) error {
+    return nil
+}
+
+/* Single server raft running fsm, leader once returned. */
+func singleRaft(t *testing.T, fsm raft.FSM) *raft.Raft {
+    conf := raft.DefaultConfig()
+    conf.LocalID = "r"
+    conf.HeartbeatTimeout = 50 * time.Millisecond
+    conf.ElectionTimeout = 50 * time.Millisecond
+    conf.LeaderLeaseTimeout = 50 * time.Millisecond
+    conf.Logger = raft.NewStdLogAdapter(raft.NopLogger())
+    addr, trans := raft.NewInmemTransport("")
+    logs, snaps := raft.NewInmemStore(), raft.NewInmemSnapshotStore()
+    configuration := raft.Configuration{Servers: []raft.Server{{Suffrage: raft.Voter, ID: conf.LocalID, Address: addr}}}
+    if err := raft.BootstrapCluster(conf, logs, logs, snaps, trans, configuration); err != nil {
+        t.Fatal(err)
+    }
+    r, err := raft.NewRaft(conf, fsm, logs, logs, snaps, trans)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { r.Shutdown().Error() })
+    for deadline := time.Now().Add(5 * time.Second); r.State() != raft.Leader; time.Sleep(10 * time.Millisecond) {
+        if time.Now().After(deadline) {
+            t.Fatalf("no leader")
+        }
+    }
+    return r
+}
+
+func TestCurrentLoad(t *testing.T) {
+    w := testWorker()
+    w.applyTime = 30 * time.Millisecond
+    w.applyCount = 3
+    want := WorkerLoad{NumLocks: 3, NumSessions: 2, NumHeld: 2, ApplyLatency: 10 * time.Millisecond}
+    if got := w.currentLoad(); got != want {
+        t.Fatalf("got %+v, want %+v", got, want)
+    }
+    /* Latency is measured afresh each period. */
+    if got := w.currentLoad(); got.ApplyLatency != 0 || w.applyCount != 0 || w.applyTime != 0 {
+        t.Fatalf("latency not reset: got %+v", got)
+    }
+    w.recordApplyLatency(time.Now().Add(-time.Millisecond))
+    if got := w.currentLoad(); got.ApplyLatency < time.Millisecond {
+        t.Fatalf("got latency %v, want at least 1ms", got.ApplyLatency)
+    }
+}
+
+func TestCurrentLoadQueueDepth(t *testing.T) {
+    fsm := &blockedFSM{make(chan struct{})}
+    w := testWorker()
+    w.attachRaft(singleRaft(t, fsm))
+
+    /* Enough entries to back up past the raft's apply channel. Apply blocks
+       once the leader is stuck handing entries to the FSM. */
+    applied := make(chan error, 300)
+    for i := 0; i < 300; i++ {
+        go func() { applied <- w.raft.Apply([]byte("x"), 0).Error() }()
+    }
+    depth := 0
+    for deadline := time.Now().Add(5 * time.Second); depth == 0 && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+        depth = w.currentLoad().QueueDepth
+    }
+    if depth == 0 {
+        t.Fatalf("no queue while apply is blocked")
+    }
+
+    close(fsm.release)
+    for i := 0; i < 300; i++ {
+        if err := <-applied; err != nil {
+            t.Fatal(err)
+        }
+    }
+    if got := w.currentLoad().QueueDepth; got != 0 {
+        t.Fatalf("got queue depth %d after applying everything, want 0", got)
+    }
+}
+
+func TestGroupLoad(t *testing.T) {
+    m := testMaster()
+    /* Lock count follows the master's own view, not the last report. */
+    m.NumLocksHeld[0] = 4
+    want := m.GroupLoadMap[0]
+    want.NumLocks = 4
+    if got := m.groupLoad(0); got != want {
+        t.Fatalf("got %+v, want %+v", got, want)
+    }
+    if m.GroupLoadMap[0].NumLocks != 1 {
+        t.Fatalf("groupLoad changed reported load")
+    }
+    /* A group that has not reported yet still has its locks counted. */
+    if got := m.groupLoad(1); got != (WorkerLoad{NumLocks: 2}) {
+        t.Fatalf("group 1: got %+v", got)
+    }
+}
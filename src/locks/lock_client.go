@@ -2,10 +2,10 @@ package locks
 
 import (
     "raft"
-    "fmt"
-    "errors"
     "encoding/json"
     "strconv"
+    "sync"
+    "time"
 )
 
 type LockClient struct {
@@ -19,21 +19,53 @@ type LockClient struct {
     sessions        map[ReplicaGroupId]*raft.Session
     /* Location of all servers in a replica group. */
     replicaServers  map[ReplicaGroupId][]raft.ServerAddress
+    /* Consistent hash rings of domains, used to guess where locks live. A
+       domain's ring is fetched again once a request finds it stale: the
+       lock moved, isn't where the ring says, or its group can't be reached. */
+    rings           map[Domain]DomainRingResponse
+    /* Sessions with groups that locks held by this client moved to, opened
+       when told of the move; kept apart from sessions, which only the
+       client's caller uses. */
+    followSessions  map[ReplicaGroupId]*raft.Session
+    followLock      sync.Mutex
+    /* Called when asked to release a lock. */
+    revocationHandler   RevocationHandler
+    handlerLock         sync.Mutex
+    logger              raft.Logger
+    /* Trace of request in progress, sent with requests it makes. */
+    trace               raft.TraceContext
 }
 
-/* Create lock client. */
-func CreateLockClient(trans *raft.NetworkTransport, masterServers []raft.ServerAddress) (*LockClient, error) {
+/* Create lock client. Logger may be nil, in which case the default logger is
+   used. */
+func CreateLockClient(trans *raft.NetworkTransport, masterServers []raft.ServerAddress, logger raft.Logger) (*LockClient, error) {
+    if logger == nil {
+        logger = raft.DefaultLogger()
+    }
+    logger = logger.Named("client")
+    if trans != nil {
+        logger = logger.With("client", trans.LocalAddr())
+    }
     lc := &LockClient {
         trans:          trans,
         masterServers:  masterServers,
         locks:          make(map[Lock]ReplicaGroupId),
         sessions:       make(map[ReplicaGroupId]*raft.Session),
         replicaServers: make(map[ReplicaGroupId][]raft.ServerAddress),
+        rings:          make(map[Domain]DomainRingResponse),
+        followSessions: make(map[ReplicaGroupId]*raft.Session),
+        logger:         logger,
+    }
+    if trans != nil {
+        lc.listenForEvents()
     }
     return lc, nil
 }
 
 func (lc *LockClient) DestroyLockClient() error {
+    if lc.trans != nil {
+        lc.stopListening()
+    }
     /* Release any acquired locks. */
     /* Close client sessions. */
     for _, s := range(lc.sessions) {
@@ -41,6 +73,13 @@ func (lc *LockClient) DestroyLockClient() error {
             return err
         }
     }
+    lc.followLock.Lock()
+    defer lc.followLock.Unlock()
+    for _, s := range(lc.followSessions) {
+        if err := s.CloseClientSession(); err != nil {
+            return err
+        }
+    }
     return nil
 }
 
@@ -52,6 +91,8 @@ type ClientRPC struct {
 /* Worker Requests */
 
 func (lc *LockClient) AcquireLock(l Lock) (Sequencer, error) {
+    defer measureClientRequest(AcquireLockCommand, time.Now())
+    defer lc.startSpan(AcquireLockCommand, "lock", l)()
     args := make(map[string]string)
     args[FunctionKey] = AcquireLockCommand
     args[LockArgKey] = string(l)
@@ -60,74 +101,19 @@ func (lc *LockClient) AcquireLock(l Lock) (Sequencer, error) {
     if err != nil {
         return -1, err
     }
-    replicaID, ok := lc.locks[l]
-    if !ok {
-        fmt.Println("LOCK-CLIENT: must locate lock ", string(l))
-        new_id, lookup_err := lc.askMasterToLocate(l)
-        fmt.Println("LOCK-CLIENT: learned lock at ", new_id)
-        replicaID = new_id
-        if lookup_err != nil {
-            fmt.Println("LOCK-CLIENT: error with lookup ", string(l))
-            return -1, errors.New(ErrCannotLocateLock)
-        } else {
-            lc.locks[l] = replicaID
-        }
-    }
-    session, session_err := lc.getSessionForId(replicaID)
-    if session_err != nil {
-        return -1, session_err
-    }
-    resp := raft.ClientResponse{}
-    send_err := session.SendRequest(data, &resp)
-    if send_err != nil || !resp.Success {
-        return -1, send_err    
-    }
-    /* Parse name to get domain. */
     /* If know where lock is stored, open/find connection to contact directly. */
     /* Otherwise, use locate to ask master where stored, then open/find connection. */
     /* Acquire lock and return sequencer. */
     var response AcquireLockResponse
-    unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
-    if unmarshal_err != nil {
-        fmt.Println("LOCK-CLIENT: error unmarshalling acquire for ", l)
-    }
-    if response.ErrMessage != "" {
-        if response.ErrMessage == ErrLockDoesntExist {
-            /* Need to look up location again */
-            delete(lc.locks, l)
-            fmt.Println("LOCK-CLIENT: must locate lock ", string(l))
-            new_id, lookup_err := lc.askMasterToLocate(l)
-            replicaID = new_id
-            if lookup_err != nil {
-                fmt.Println("LOCK-CLIENT: error with lookup ", string(l))
-                return -1, errors.New(ErrCannotLocateLock)
-            } else {
-                lc.locks[l] = replicaID
-                fmt.Println("LOCK-CLIENT: lookup succeeded", string(l))
-            }
-            session, session_err := lc.getSessionForId(replicaID)
-            if session_err != nil {
-                return -1, session_err
-            }
-            resp := raft.ClientResponse{}
-            send_err := session.SendRequest(data, &resp)
-            if send_err != nil || !resp.Success {
-                fmt.Println("send request error!")
-                return -1, send_err
-            }
-            unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
-            if unmarshal_err != nil {
-                fmt.Println("LOCK-CLIENT: error unmarshalling acquire")
-                fmt.Println(unmarshal_err)
-             }
-             return response.SeqNo, nil
-        }
-        return response.SeqNo, errors.New(response.ErrMessage)
+    if err := lc.sendLockRequest(l, data, &response); err != nil {
+        return -1, err
     }
     return response.SeqNo, nil
 }
 
 func (lc *LockClient) ReleaseLock(l Lock) error {
+    defer measureClientRequest(ReleaseLockCommand, time.Now())
+    defer lc.startSpan(ReleaseLockCommand, "lock", l)()
     args := make(map[string]string)
     args[FunctionKey] = ReleaseLockCommand
     args[LockArgKey] = string(l)
@@ -136,44 +122,15 @@ func (lc *LockClient) ReleaseLock(l Lock) error {
     if err != nil {
         return err
     }
-    replicaID, ok := lc.locks[l]
-    if !ok {
-        fmt.Println("LOCK-CLIENT: must locate lock ", string(l))
-        new_id, lookup_err := lc.askMasterToLocate(l)
-        replicaID = new_id
-        if lookup_err != nil {
-            fmt.Println("LOCK-CLIENT: error with lookup for ", string(l))
-        } else {
-            lc.locks[l] = replicaID
-        }
-    }
-    session, session_err := lc.getSessionForId(replicaID)
-    if session_err != nil {
-        return session_err
-    }
-    resp := raft.ClientResponse{}
-    send_err := session.SendRequest(data, &resp)
-    if send_err != nil || !resp.Success {
-        return send_err
-    }
-    /* Parse name to get domain. */
-    /* If know where lock is stored, open/find connection to contact directly. */
-    /* Otherwise, use locate to ask master where stored, then open/find connection. */
-    /* Release lock and return sequencer. */
     var response ReleaseLockResponse
-    unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
-    if unmarshal_err != nil {
-        fmt.Println("LOCK-CLIENT: error unmarshalling release for ", l)
-    }
-    if response.ErrMessage != "" {
-        return errors.New(response.ErrMessage)
-    }
-    return nil
+    return lc.sendLockRequest(l, data, &response)
 }
 
 /* Master Requests */
 
 func (lc *LockClient) CreateLock(l Lock) (error) {
+    defer measureClientRequest(CreateLockCommand, time.Now())
+    defer lc.startSpan(CreateLockCommand, "lock", l)()
     args := make(map[string]string)
     args[FunctionKey] = CreateLockCommand
     args[LockArgKey] = string(l)
@@ -182,24 +139,27 @@ func (lc *LockClient) CreateLock(l Lock) (error) {
         return err
     }
     resp := raft.ClientResponse{}
-    send_err := raft.SendSingletonRequestToCluster(lc.masterServers, data, &resp)
-    if send_err != nil || !resp.Success {
-        return send_err
+    send_err := lc.sendToMasters(data, &resp)
+    if req_err := requestError(send_err, &resp); req_err != nil {
+        return req_err
     }
     /* Contact master to create lock entry (master then contacts replica group). */
     /* Return false if lock already existed. */
     var response CreateLockResponse
     unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
     if unmarshal_err != nil {
-        fmt.Println("LOCK-CLIENT: error unmarshalling create")
+        lc.logger.Warn("invalid response", "op", CreateLockCommand, "error", unmarshal_err)
+        return ErrInvalidResponse
     }
-    if response.ErrMessage != "" {
-        return errors.New(response.ErrMessage)
+    if response.Err != nil {
+        return response.Err
     }
     return nil
 }
 
 func (lc *LockClient) DeleteLock(l Lock) (error) {
+    defer measureClientRequest(DeleteLockCommand, time.Now())
+    defer lc.startSpan(DeleteLockCommand, "lock", l)()
     args := make(map[string]string)
     args[FunctionKey] = DeleteLockCommand
     args[LockArgKey] = string(l)
@@ -208,22 +168,25 @@ func (lc *LockClient) DeleteLock(l Lock) (error) {
         return err
     }
     resp := raft.ClientResponse{}
-    send_err := raft.SendSingletonRequestToCluster(lc.masterServers, data, &resp)
-    if send_err != nil || !resp.Success {
-        return send_err
+    send_err := lc.sendToMasters(data, &resp)
+    if req_err := requestError(send_err, &resp); req_err != nil {
+        return req_err
     }
     var response DeleteLockResponse
     unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
     if unmarshal_err != nil {
-        fmt.Println("LOCK-CLIENT: error unmarshalling delete")
+        lc.logger.Warn("invalid response", "op", DeleteLockCommand, "error", unmarshal_err)
+        return ErrInvalidResponse
     }
-    if response.ErrMessage != "" {
-        return errors.New(response.ErrMessage)
+    if response.Err != nil {
+        return response.Err
     }
     return nil
 }
 
 func (lc *LockClient) ValidateLock(l Lock, s Sequencer) (bool, error) {
+    defer measureClientRequest(ValidateLockCommand, time.Now())
+    defer lc.startSpan(ValidateLockCommand, "lock", l)()
     args := make(map[string]string)
     args[FunctionKey] = ValidateLockCommand 
     args[LockArgKey] = string(l)
@@ -232,39 +195,16 @@ func (lc *LockClient) ValidateLock(l Lock, s Sequencer) (bool, error) {
     if err != nil {
         return false, err
     }
-    replicaID, ok := lc.locks[l]
-    if !ok {
-        fmt.Println("LOCK-CLIENT: must locate lock ", string(l))
-        new_id, lookup_err := lc.askMasterToLocate(l)
-        replicaID = new_id
-        if lookup_err != nil {
-            fmt.Println("LOCK-CLIENT: error with lookup for ", string(l))
-        } else {
-            lc.locks[l] = replicaID
-        }
-    }
-    session, session_err := lc.getSessionForId(replicaID)
-    if session_err != nil {
-        return false, session_err
-    }
-    resp := raft.ClientResponse{}
-    send_err := session.SendRequest(data, &resp)
-    if send_err != nil || !resp.Success {
-        return false, send_err
-    }
     var response ValidateLockResponse
-    unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
-    if unmarshal_err != nil {
-        fmt.Println("LOCK-CLIENT: error unmarshalling release")
-        fmt.Println(unmarshal_err)
-    }
-    if response.ErrMessage != "" {
-        return false, errors.New(response.ErrMessage)
+    if err := lc.sendLockRequest(l, data, &response); err != nil {
+        return false, err
     }
     return response.Success, nil
 }
 
 func (lc *LockClient) CreateDomain(d Domain) (error) {
+    defer measureClientRequest(CreateDomainCommand, time.Now())
+    defer lc.startSpan(CreateDomainCommand, "domain", d)()
     args := make(map[string]string)
     args[FunctionKey] = CreateDomainCommand
     args[DomainArgKey] = string(d)
@@ -273,26 +213,119 @@ func (lc *LockClient) CreateDomain(d Domain) (error) {
         return err
     }
     resp := raft.ClientResponse{}
-    send_err := raft.SendSingletonRequestToCluster(lc.masterServers, data, &resp)
-    if send_err != nil || !resp.Success {
-        return send_err
+    send_err := lc.sendToMasters(data, &resp)
+    if req_err := requestError(send_err, &resp); req_err != nil {
+        return req_err
     }
     /* Contact master to create domain (master then contacts replica group). */
     /* Return false if domain already exists. */
     var response CreateDomainResponse
     unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
     if unmarshal_err != nil {
-        fmt.Println("LOCK-CLIENT: error unmarshalling")
+        lc.logger.Warn("invalid response", "op", CreateDomainCommand, "error", unmarshal_err)
+        return ErrInvalidResponse
     }
-    if response.ErrMessage != "" {
-        return errors.New(response.ErrMessage)
+    if response.Err != nil {
+        return response.Err
     }
     return nil
 }
 
+func (lc *LockClient) ListDomain(d Domain) ([]Lock, []Domain, error) {
+    defer measureClientRequest(ListDomainCommand, time.Now())
+    defer lc.startSpan(ListDomainCommand, "domain", d)()
+    args := make(map[string]string)
+    args[FunctionKey] = ListDomainCommand
+    args[DomainArgKey] = string(d)
+    data, err := json.Marshal(args)
+    if err != nil {
+        return nil, nil, err
+    }
+    resp := raft.ClientResponse{}
+    send_err := lc.sendToMasters(data, &resp)
+    if req_err := requestError(send_err, &resp); req_err != nil {
+        return nil, nil, req_err
+    }
+    /* Ask master for locks and subdomains directly inside domain. */
+    var response ListDomainResponse
+    unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
+    if unmarshal_err != nil {
+        lc.logger.Warn("invalid response", "op", ListDomainCommand, "error", unmarshal_err)
+        return nil, nil, ErrInvalidResponse
+    }
+    if response.Err != nil {
+        return nil, nil, response.Err
+    }
+    return response.Locks, response.Domains, nil
+}
+
+/* Returns the replica group storing a lock and the servers in that group. */
+func (lc *LockClient) LocateLock(l Lock) (ReplicaGroupId, []raft.ServerAddress, error) {
+    defer measureClientRequest(LocateLockCommand, time.Now())
+    defer lc.startSpan(LocateLockCommand, "lock", l)()
+    replicaID, err := lc.askMasterToLocate(l)
+    if err != nil {
+        return replicaID, nil, err
+    }
+    return replicaID, lc.replicaServers[replicaID], nil
+}
+
+/* Returns the state of a lock as seen by the replica group storing it. */
+func (lc *LockClient) LockInfo(l Lock) (LockInfoResponse, error) {
+    defer measureClientRequest(LockInfoCommand, time.Now())
+    defer lc.startSpan(LockInfoCommand, "lock", l)()
+    args := make(map[string]string)
+    args[FunctionKey] = LockInfoCommand
+    args[LockArgKey] = string(l)
+    data, err := json.Marshal(args)
+    if err != nil {
+        return LockInfoResponse{}, err
+    }
+    replicaID, ok := lc.locks[l]
+    if !ok {
+        new_id, lookup_err := lc.askMasterToLocate(l)
+        if lookup_err != nil {
+            return LockInfoResponse{}, lookup_err
+        }
+        replicaID = new_id
+    }
+    session, session_err := lc.getSessionForId(replicaID)
+    if session_err != nil {
+        return LockInfoResponse{}, session_err
+    }
+    resp := raft.ClientResponse{}
+    send_err := session.SendRequestWithTrace(data, &resp, lc.trace)
+    if req_err := requestError(send_err, &resp); req_err != nil {
+        return LockInfoResponse{}, req_err
+    }
+    var response LockInfoResponse
+    unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
+    if unmarshal_err != nil {
+        lc.logger.Warn("invalid response", "op", LockInfoCommand, "error", unmarshal_err)
+        return LockInfoResponse{}, ErrInvalidResponse
+    }
+    if response.Err != nil {
+        /* Cached location may be stale. */
+        delete(lc.locks, l)
+        return LockInfoResponse{}, response.Err
+    }
+    return response, nil
+}
+
+/* Returns the master's view of the replica groups. */
+func (lc *LockClient) ClusterStatus() (ClusterStatusResponse, error) {
+    defer measureClientRequest(ClusterStatusCommand, time.Now())
+    var response ClusterStatusResponse
+    if err := lc.adminRequest(adminFilterArgs(ClusterStatusCommand, "", AnyGroup), &response, func() *LockError { return response.Err }); err != nil {
+        return ClusterStatusResponse{}, err
+    }
+    return response, nil
+}
+
 /* Helper functions. */
 
 func (lc *LockClient) askMasterToLocate(l Lock) (ReplicaGroupId, error) {
+    defer lc.startSpan("locate", "lock", l)()
     args := make(map[string]string)
     args[FunctionKey] = LocateLockCommand
     args[LockArgKey] = string(l)
@@ -301,9 +334,9 @@ func (lc *LockClient) askMasterToLocate(l Lock) (ReplicaGroupId, error) {
         return -1, err
     }
     resp := raft.ClientResponse{}
-    send_err := raft.SendSingletonRequestToCluster(lc.masterServers, data, &resp)
-    if send_err != nil || !resp.Success {
-        return -1, send_err
+    send_err := lc.sendToMasters(data, &resp)
+    if req_err := requestError(send_err, &resp); req_err != nil {
+        return -1, req_err
     }
     /* Ask master for location of lock, return replica group ID. */
     /* Master should return the server addresses of the replica group. */
@@ -312,17 +345,40 @@ func (lc *LockClient) askMasterToLocate(l Lock) (ReplicaGroupId, error) {
     var located LocateLockResponse
     unmarshal_err := json.Unmarshal(resp.ResponseData, &located)
     if unmarshal_err != nil {
-        fmt.Println("LOCK-CLIENT: error unmarshalling")
+        lc.logger.Warn("invalid response", "op", LocateLockCommand, "error", unmarshal_err)
+        return -1, ErrInvalidResponse
     }
-    //TODO CHECK FOR ERR FIRST
-    if located.ErrMessage != "" {
-        return located.ReplicaId, errors.New(located.ErrMessage)
+    if located.Err != nil {
+        return located.ReplicaId, located.Err
     }
     lc.locks[l] = located.ReplicaId
+    if !sameAddrs(lc.replicaServers[located.ReplicaId], located.ServerAddrs) {
+        /* Group's servers changed since the session was opened. */
+        lc.forgetGroupServers(located.ReplicaId)
+    }
     lc.replicaServers[located.ReplicaId] = located.ServerAddrs
     return located.ReplicaId, nil
 }
 
+/* Forget the servers of and session with replica group so they are looked up
+   again, e.g. after the group's servers changed. */
+func (lc *LockClient) forgetGroupServers(id ReplicaGroupId) {
+    if s := lc.sessions[id]; s != nil {
+        s.CloseClientSession()
+    }
+    delete(lc.sessions, id)
+    delete(lc.replicaServers, id)
+}
+
+/* Command a replica group applies when client's session with it ends,
+   releasing the locks client holds there. */
+func endSessionCommand(client raft.ServerAddress) ([]byte, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = ReleaseForClientCommand
+    args[ClientAddrKey] = string(client)
+    return json.Marshal(args)
+}
+
 func (lc *LockClient) getSessionForId(id ReplicaGroupId) (*raft.Session, error) {
     /* Return existing client session or create new client session for replica group ID. */
     existing := lc.sessions[id]
@@ -331,17 +387,14 @@ func (lc *LockClient) getSessionForId(id ReplicaGroupId) (*raft.Session, error)
     }
     server_addrs, ok := lc.replicaServers[id]
     if !ok {
-        return nil, errors.New(ErrNoServersForId)
+        return nil, ErrNoServersForId
     }
 
-    args := make(map[string]string)
-    args[FunctionKey] = ReleaseForClientCommand
-    args[ClientAddrKey] = string(lc.trans.LocalAddr())
-    endSessionCommand, err := json.Marshal(args)
+    endSession, err := endSessionCommand(lc.trans.LocalAddr())
     if err != nil {
         return nil, err
     }
-    new_session, err := raft.CreateClientSession(lc.trans, server_addrs, endSessionCommand)
+    new_session, err := raft.CreateClientSession(lc.trans, server_addrs, endSession, lc.logger.With("group", id))
     lc.sessions[id] = new_session
     /* Return error if don't have server addresses for replica group ID. */
     return new_session, err
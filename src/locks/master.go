@@ -30,14 +30,6 @@ type MasterFSM struct {
     RecruitAddrs        []RecruitInfo
     /* Whether to recruit clusters locally - true for testing. */
     RecruitClustersLocally  bool
-    /* Threshold at which to split. */
-    MaxFreq         float64
-    /* Threshold at which to join. */
-    MinFreq         float64
-    /* Ideal frequency of accesses at worker cluster. */
-    IdealFreq       float64
-    /* Max number of inactivi periods before join. */
-    MaxInactivePeriods  int
     /* Eventual destinations of recalcitrant locks. */
     RecalcitrantDestMap map[Lock]ReplicaGroupId
     /* Rebalances in progress */
@@ -46,42 +38,106 @@ type MasterFSM struct {
     LockFreqStatsMap          map[Lock]FreqStats
     /* Map of replica group to average frequency accessed. */
     GroupFreqStatsMap       map[ReplicaGroupId]FreqStats
+    /* Latest load reported by each replica group. */
+    GroupLoadMap            map[ReplicaGroupId]WorkerLoad
+    /* Health of replica groups as last probed; groups not present are healthy. */
+    GroupHealthMap          map[ReplicaGroupId]GroupHealth
+    /* Groups being emptied for removal; no new locks are placed there. */
+    DrainingGroups          map[ReplicaGroupId]bool
+    /* Times by which holders of recalcitrant locks must release them. */
+    RevokeDeadlineMap       map[Lock]time.Time
+    /* Lock transfers in progress, by transfer ID. */
+    TransferMap             map[int]Transfer
+    /* Next transfer ID. */
+    NextTransferId          int
+    /* Time of latest log entry applied, used instead of local clock so every
+       master computes the same frequencies and rebalance decisions. */
+    Clock                   time.Time
+    /* Placement constraints for domains. */
+    PlacementPolicyMap      map[Domain]PlacementPolicy
+    /* Manual moves requested through admin commands, by move ID. */
+    MoveMap                 map[int]LockMove
+    /* Next manual move ID. */
+    NextMoveId              int
+    /* Rebalance policy every master plans with, as last written by a leader. */
+    Policy                  PolicySpec
+    /* How every master moves locks, as last written by a leader. */
+    Settings                TransferSettings
     /* Map of worker sessions. */
     WorkerSessionMap        map[ReplicaGroupId]*raft.Session
     SessionLock             sync.RWMutex
     Trans                   *raft.NetworkTransport
+    /* Decides when and where to move locks as load changes; decoded from
+       Policy. */
+    policy                  RebalancePolicy
+    /* Policy this master was created with, written into the log while it is
+       leader. Not replicated. */
+    configuredPolicy        RebalancePolicy
+    /* Transfer settings this master was created with, written into the log
+       while it is leader. Not replicated. */
+    configuredSettings      TransferSettings
+    /* Raft instance running this FSM, used to probe worker health and resume
+       transfers as leader. */
+    raft                    *raft.Raft
+    /* Draining groups last logged as stalled. Not replicated. */
+    stalledDrains           map[ReplicaGroupId]bool
+    /* Closed when the server running this FSM shuts down, stopping the loops
+       attachRaft started. */
+    stop                    chan struct{}
+    /* Transfers with a step running on this master. */
+    stepping                map[int]bool
+    stepLock                sync.Mutex
+    /* Where this master logs, and the logger given to workers it recruits
+       locally. Not replicated. */
+    logger                  raft.Logger
+    workerLogger            raft.Logger
+    /* Raft term of latest log entry applied, added to rebalance logs. */
+    term                    uint64
+    /* Trace of log entry being applied; callbacks send their requests under
+       it. */
+    trace                   raft.TraceContext
 }
 
 type FreqStats struct {
     /* Exponentially weighted moving average of frequency of accesses over period. */
-    avgFreq        float64
+    AvgFreq     float64
     /* Time last updated. */
-    lastUpdate  time.Time
-
+    LastUpdate  time.Time
 }
 
 type RecruitInfo struct {
-    addrs                   []raft.ServerAddress
-    shouldRecruitLocally    bool
+    Addrs                   []raft.ServerAddress
+    ShouldRecruitLocally    bool
+    /* True if cluster may not be recruited until marked available again. */
+    Unavailable             bool
 }
 
 var PERIOD time.Duration = 200 * time.Millisecond
 
-const WEIGHT = 0.2
+/* Weight of newest period in moving average of access frequency. */
+var WEIGHT float64 = 0.2
 
 const STABILIZE_FACTOR = 10
 
 const IDEAL_FACTOR = 1 
 
-const numClusterServers = 3
-
 const NO_WORKER = ReplicaGroupId(-1)
 
 type MasterSnapshot struct{
     json    []byte
 }
 
-func CreateMasters (n int, clusterAddrs []raft.ServerAddress, recruitList [][]raft.ServerAddress, maxFreq float64, minFreq float64, idealFreq float64, maxInactivePeriods int, recruitClustersLocally bool, transports []*raft.NetworkTransport) ([]raft.FSM) {
+/* Create masters that rebalance with the default FrequencyPolicy. Logger may
+   be nil, in which case the default logger is used. */
+func CreateMasters (n int, clusterAddrs []raft.ServerAddress, recruitList [][]raft.ServerAddress, maxFreq float64, minFreq float64, idealFreq float64, maxInactivePeriods int, recruitClustersLocally bool, transports []*raft.NetworkTransport, logger raft.Logger) ([]raft.FSM) {
+    policy := NewFrequencyPolicy(maxFreq, minFreq, idealFreq, maxInactivePeriods)
+    return CreateMastersWithPolicy(n, clusterAddrs, recruitList, policy, recruitClustersLocally, transports, logger)
+}
+
+func CreateMastersWithPolicy (n int, clusterAddrs []raft.ServerAddress, recruitList [][]raft.ServerAddress, policy RebalancePolicy, recruitClustersLocally bool, transports []*raft.NetworkTransport, logger raft.Logger) ([]raft.FSM) {
+    if logger == nil {
+        logger = raft.DefaultLogger()
+    }
     masters := make([]*MasterFSM, n)
     for i := range(masters) {
         masters[i] = &MasterFSM {
@@ -93,29 +149,37 @@ func CreateMasters (n int, clusterAddrs []raft.ServerAddress, recruitList [][]ra
             MasterCluster:      clusterAddrs,
             RecruitAddrs:       make([]RecruitInfo, 0),
             RecruitClustersLocally: recruitClustersLocally,
-            MaxFreq:            maxFreq,
-            MinFreq:            minFreq,
-            IdealFreq:          idealFreq,
-            MaxInactivePeriods: maxInactivePeriods,
             RecalcitrantDestMap: make(map[Lock]ReplicaGroupId),
             RebalancingInProgress: make(map[ReplicaGroupId]bool),
             LockFreqStatsMap:         make(map[Lock]FreqStats),
             GroupFreqStatsMap:      make(map[ReplicaGroupId]FreqStats),
+            GroupLoadMap:           make(map[ReplicaGroupId]WorkerLoad),
+            GroupHealthMap:         make(map[ReplicaGroupId]GroupHealth),
+            DrainingGroups:         make(map[ReplicaGroupId]bool),
+            TransferMap:            make(map[int]Transfer),
+            RevokeDeadlineMap:      make(map[Lock]time.Time),
+            NextTransferId:         0,
+            PlacementPolicyMap:     make(map[Domain]PlacementPolicy),
+            MoveMap:                make(map[int]LockMove),
+            NextMoveId:             0,
             WorkerSessionMap:       make(map[ReplicaGroupId]*raft.Session),
             Trans:                  transports[i],
+            configuredPolicy:       policy,
+            configuredSettings:     TransferSettings{Live: LiveMigration, RevokeAfter: RevocationDeadline},
+            logger:                 logger.Named("master").With("server", transports[i].LocalAddr()),
+            workerLogger:           logger,
         }
         for _,addrs := range recruitList {
-            elem := RecruitInfo{addrs: addrs, shouldRecruitLocally: recruitClustersLocally}
+            elem := RecruitInfo{Addrs: addrs, ShouldRecruitLocally: recruitClustersLocally}
             masters[i].RecruitAddrs = append(masters[i].RecruitAddrs, elem)
         }
     }
     if n <= 0 {
-        //fmt.Println("MASTER: Cannot have number of masters <= 0")
+        logger.Error("cannot create masters", "count", n)
     }
-    err := recruitInitialCluster(masters, recruitList[0], recruitClustersLocally)
+    err := recruitInitialCluster(masters, recruitList[0], recruitClustersLocally, logger)
     if err != nil {
-        //TODO
-        //fmt.Println(err)
+        logger.Error("recruiting initial cluster failed", "error", err)
     }
     fsms := make([]raft.FSM, n)
     for i, m := range(masters) {
@@ -125,15 +189,32 @@ func CreateMasters (n int, clusterAddrs []raft.ServerAddress, recruitList [][]ra
     return fsms
 }
 
-func (m *MasterFSM) Apply(log *raft.Log) (interface{}, []func() [][]byte) {
+/* Logger for transfers, splits and drains, so they can be traced on their own
+   with a "rebalance=trace" level. Assumes FSM already locked. */
+func (m *MasterFSM) rebalanceLogger() raft.Logger {
+    return m.logger.Named("rebalance").With("term", m.term)
+}
+
+func (m *MasterFSM) Apply(log *raft.Log) (result interface{}, callbacks []func() [][]byte) {
     /* Interpret log to find command. Call appropriate function. */
 
+    m.FsmLock.Lock()
+    advanceClock(&m.Clock, log.AppendedAt)
+    m.term = log.Term
+    m.trace = log.Trace
+    m.FsmLock.Unlock()
     args := make(map[string]string)
     err := json.Unmarshal(log.Data, &args)
     if err != nil {
-        //fmt.Println("MASTER: error in apply: ", err)
+        m.logger.Warn("invalid command", "term", log.Term, "index", log.Index, "error", err)
     }
     function := args[FunctionKey]
+    m.logger.Trace("applying command", "op", function, "term", log.Term, "index", log.Index)
+    span := startApplySpan("master", log, function, args, m.Trans)
+    defer span.End()
+    defer func() {
+        m.recordApply(function, result)
+    }()
     switch function {
         case CreateLockCommand:
             l := Lock(args[LockArgKey])
@@ -151,6 +232,143 @@ func (m *MasterFSM) Apply(log *raft.Log) (interface{}, []func() [][]byte) {
             l := Lock(args[LockArgKey])
             response := m.findLock(l)
             return response, []func()[][]byte{}
+        case ClusterStatusCommand:
+            response := m.clusterStatus()
+            return response, []func()[][]byte{}
+        case GroupStatsCommand:
+            d, group, ok := parseAdminFilter(args)
+            if !ok {
+                return GroupStatsResponse{nil, ErrInvalidRequest}, []func()[][]byte{}
+            }
+            response := m.groupStats(d, group)
+            return response, []func()[][]byte{}
+        case LockStatsCommand:
+            d, group, ok := parseAdminFilter(args)
+            if !ok {
+                return LockStatsResponse{nil, ErrInvalidRequest}, []func()[][]byte{}
+            }
+            response := m.lockStats(d, group)
+            return response, []func()[][]byte{}
+        case RebalanceStatusCommand:
+            d, group, ok := parseAdminFilter(args)
+            if !ok {
+                return RebalanceStatusResponse{Err: ErrInvalidRequest}, []func()[][]byte{}
+            }
+            response := m.rebalanceStatus(d, group)
+            return response, []func()[][]byte{}
+        case MoveLocksCommand:
+            newGroup, err := strconv.Atoi(args[NewGroupKey])
+            if err != nil {
+                return MoveLocksResponse{-1, ErrInvalidRequest}, []func()[][]byte{}
+            }
+            lockArr := string_to_lock_array(args[LockArrayKey])
+            callback, response := m.moveLocks(lockArr, ReplicaGroupId(newGroup))
+            return response, callback
+        case MoveDomainCommand:
+            newGroup, err := strconv.Atoi(args[NewGroupKey])
+            if err != nil {
+                return MoveLocksResponse{-1, ErrInvalidRequest}, []func()[][]byte{}
+            }
+            d := Domain(args[DomainArgKey])
+            callback, response := m.moveDomain(d, ReplicaGroupId(newGroup))
+            return response, callback
+        case MoveProgressCommand:
+            moveId, err := strconv.Atoi(args[MoveIdKey])
+            if err != nil {
+                return MoveProgressResponse{MoveId: -1, Err: ErrInvalidRequest}, []func()[][]byte{}
+            }
+            response := m.moveProgress(moveId)
+            return response, []func()[][]byte{}
+        case SetPlacementPolicyCommand:
+            d := Domain(args[DomainArgKey])
+            policy := PlacementPolicy{
+                Allowed:    string_to_group_array(args[AllowedGroupsKey]),
+                Excluded:   string_to_group_array(args[ExcludedGroupsKey]),
+                Hashed:     args[HashedKey] == "true",
+            }
+            callback, response := m.setPlacementPolicy(d, policy)
+            return response, callback
+        case PlacementPoliciesCommand:
+            response := m.placementPolicies()
+            return response, []func()[][]byte{}
+        case ListDomainCommand:
+            d := Domain(args[DomainArgKey])
+            response := m.listDomain(d)
+            return response, []func()[][]byte{}
+        case GroupHealthCommand:
+            group, err1 := strconv.Atoi(args[GroupArgKey])
+            healthy, err2 := strconv.ParseBool(args[HealthyKey])
+            if err1 != nil || err2 != nil {
+                return nil, []func()[][]byte{}
+            }
+            m.setGroupHealth(ReplicaGroupId(group), healthy)
+            return nil, []func()[][]byte{}
+        case AddWorkersCommand:
+            response := m.addWorkers(string_to_addr_array(args[ServerAddrsKey]))
+            return response, []func()[][]byte{}
+        case SetWorkersAvailableCommand:
+            available, err := strconv.ParseBool(args[AvailableKey])
+            if err != nil {
+                return PoolResponse{ErrInvalidRequest}, []func()[][]byte{}
+            }
+            response := m.setWorkersAvailable(string_to_addr_array(args[ServerAddrsKey]), available)
+            return response, []func()[][]byte{}
+        case RemoveWorkersCommand:
+            response := m.removeWorkers(string_to_addr_array(args[ServerAddrsKey]))
+            return response, []func()[][]byte{}
+        case RecruitPoolCommand:
+            response := m.recruitPool()
+            return response, []func()[][]byte{}
+        case DrainGroupCommand:
+            group, err := strconv.Atoi(args[GroupArgKey])
+            if err != nil {
+                return DrainResponse{Err: ErrInvalidRequest}, []func()[][]byte{}
+            }
+            callback, response := m.drainGroup(ReplicaGroupId(group))
+            return response, callback
+        case AddGroupServerCommand, RemoveGroupServerCommand:
+            group, err := strconv.Atoi(args[GroupArgKey])
+            if err != nil {
+                return MembershipResponse{nil, ErrInvalidRequest}, []func()[][]byte{}
+            }
+            add := function == AddGroupServerCommand
+            callback, response := m.changeGroupMembership(ReplicaGroupId(group), raft.ServerAddress(args[ServerAddrKey]), add)
+            return response, callback
+        case AddMasterCommand, RemoveMasterCommand:
+            add := function == AddMasterCommand
+            callback, response := m.changeMasterMembership(raft.ServerAddress(args[ServerAddrKey]), add)
+            return response, callback
+        case MasterMembersCommand:
+            response := m.setMasterMembers(string_to_addr_array(args[ServerAddrsKey]))
+            return response, []func()[][]byte{}
+        case RebalancePolicyCommand:
+            var spec PolicySpec
+            if err := json.Unmarshal([]byte(args[PolicyKey]), &spec); err != nil {
+                return PolicyResponse{ErrInvalidRequest}, []func()[][]byte{}
+            }
+            response := m.setRebalancePolicy(spec)
+            return response, []func()[][]byte{}
+        case TransferSettingsCommand:
+            var settings TransferSettings
+            if err := json.Unmarshal([]byte(args[SettingsKey]), &settings); err != nil {
+                return TransferSettingsResponse{ErrInvalidRequest}, []func()[][]byte{}
+            }
+            response := m.setTransferSettings(settings)
+            return response, []func()[][]byte{}
+        case MastersCommand:
+            response := m.masters()
+            return response, []func()[][]byte{}
+        case GroupMembersCommand:
+            group, err := strconv.Atoi(args[GroupArgKey])
+            if err != nil {
+                return MembershipResponse{nil, ErrInvalidRequest}, []func()[][]byte{}
+            }
+            response := m.setGroupMembers(ReplicaGroupId(group), string_to_addr_array(args[ServerAddrsKey]))
+            return response, []func()[][]byte{}
+        case DomainRingCommand:
+            d := Domain(args[DomainArgKey])
+            response := m.domainRing(d)
+            return response, []func()[][]byte{}
         case ReleasedRecalcitrantCommand:
             l := Lock(args[LockArgKey])
             callback := m.handleReleasedRecalcitrant(l)
@@ -161,33 +379,26 @@ func (m *MasterFSM) Apply(log *raft.Log) (interface{}, []func() [][]byte) {
             return nil, []func()[][]byte{}
         case DeleteRecalLockCommand:
             l := Lock(args[LockArgKey])
-            m.markLockForDeletion(l)
+            m.markLockForDeletion(l, string_to_time(args[DeadlineKey]))
             return nil, []func()[][]byte{}
         case FrequencyUpdateCommand:
             lockArr := string_to_lock_array(args[LockArrayKey])
             countArr := string_to_int_array(args[CountArrayKey])
-            callback := m.updateFrequencies(lockArr, countArr)
+            load, hasLoad := string_to_load(args[LoadKey])
+            callback := m.updateFrequencies(lockArr, countArr, load, hasLoad)
             return nil, callback
-        case TransferLockGroupCommand:
-            oldGroup, err1 := strconv.Atoi(args[OldGroupKey])
-            newGroup, err2 := strconv.Atoi(args[NewGroupKey])
+        case TransferStepCommand:
+            id, err1 := strconv.Atoi(args[TransferIdKey])
+            state, err2 := strconv.Atoi(args[TransferStateKey])
             if err1 != nil || err2 != nil {
-                //fmt.Println("MASTER: group IDs can't be converted to ints")
                 return nil, []func()[][]byte{}
             }
-            lockArr := string_to_lock_array(args[LockArrayKey])
             recalArr := string_to_lock_array(args[LockArray2Key])
-            callback := m.initialLockGroupTransfer(ReplicaGroupId(oldGroup), ReplicaGroupId(newGroup), lockArr, recalArr)
-            return nil, callback
-        case TransferRecalCommand:
-            oldGroup, err1 := strconv.Atoi(args[OldGroupKey])
-            newGroup, err2 := strconv.Atoi(args[NewGroupKey])
-            if err1 != nil || err2 != nil {
-                //fmt.Println("MASTER: group IDs can't be converted to ints")
-                return nil, []func()[][]byte{}
+            states := make(map[Lock]MigratedLock)
+            if statesStr, ok := args[StatesKey]; ok {
+                json.Unmarshal([]byte(statesStr), &states)
             }
-            l := Lock(args[LockArgKey])
-            callback := m.singleRecalcitrantLockTransfer(ReplicaGroupId(oldGroup), ReplicaGroupId(newGroup), l)
+            callback := m.advanceTransfer(id, TransferState(state), recalArr, states, string_to_time(args[DeadlineKey]))
             return nil, callback
         }
 
@@ -220,13 +431,54 @@ func (m *MasterFSM) Restore(i io.ReadCloser) error {
     m.NextReplicaGroupId = snapshotRestored.NextReplicaGroupId
     m.MasterCluster = snapshotRestored.MasterCluster
     m.RecruitAddrs = snapshotRestored.RecruitAddrs
-    m.MaxFreq = snapshotRestored.MaxFreq
-    m.MinFreq = snapshotRestored.MinFreq
-    m.IdealFreq = snapshotRestored.IdealFreq
-    m.MaxInactivePeriods = snapshotRestored.MaxInactivePeriods
+    m.RecruitClustersLocally = snapshotRestored.RecruitClustersLocally
     m.RecalcitrantDestMap = snapshotRestored.RecalcitrantDestMap
+    m.RebalancingInProgress = snapshotRestored.RebalancingInProgress
+    if m.RebalancingInProgress == nil {
+        m.RebalancingInProgress = make(map[ReplicaGroupId]bool)
+    }
     m.LockFreqStatsMap = snapshotRestored.LockFreqStatsMap
     m.GroupFreqStatsMap = snapshotRestored.GroupFreqStatsMap
+    m.GroupLoadMap = snapshotRestored.GroupLoadMap
+    if m.GroupLoadMap == nil {
+        m.GroupLoadMap = make(map[ReplicaGroupId]WorkerLoad)
+    }
+    m.GroupHealthMap = snapshotRestored.GroupHealthMap
+    if m.GroupHealthMap == nil {
+        m.GroupHealthMap = make(map[ReplicaGroupId]GroupHealth)
+    }
+    m.DrainingGroups = snapshotRestored.DrainingGroups
+    if m.DrainingGroups == nil {
+        m.DrainingGroups = make(map[ReplicaGroupId]bool)
+    }
+    m.TransferMap = snapshotRestored.TransferMap
+    if m.TransferMap == nil {
+        m.TransferMap = make(map[int]Transfer)
+    }
+    m.NextTransferId = snapshotRestored.NextTransferId
+    m.Clock = snapshotRestored.Clock
+    m.RevokeDeadlineMap = snapshotRestored.RevokeDeadlineMap
+    if m.RevokeDeadlineMap == nil {
+        m.RevokeDeadlineMap = make(map[Lock]time.Time)
+    }
+    m.PlacementPolicyMap = snapshotRestored.PlacementPolicyMap
+    if m.PlacementPolicyMap == nil {
+        m.PlacementPolicyMap = make(map[Domain]PlacementPolicy)
+    }
+    m.MoveMap = snapshotRestored.MoveMap
+    m.NextMoveId = snapshotRestored.NextMoveId
+    if m.MoveMap == nil {
+        m.MoveMap = make(map[int]LockMove)
+    }
+    /* Snapshots from before policies were replicated have none; the leader
+       writes its own. */
+    m.Policy = snapshotRestored.Policy
+    m.policy, err = m.Policy.policy()
+    if err != nil {
+        m.logger.Warn("dropping rebalance policy from snapshot", "policy", m.Policy.Name, "error", err)
+        m.Policy = PolicySpec{}
+    }
+    m.Settings = snapshotRestored.Settings
     m.FsmLock.Unlock()
     return nil
 }
@@ -247,21 +499,27 @@ func (s MasterSnapshot) Release() {
 
 func (m *MasterFSM) convertToJSON() ([]byte, error) {
     m.FsmLock.Lock()
-    b, err := json.Marshal(m)
+    b, err := encodeSnapshot(m)
     m.FsmLock.Unlock()
     return b, err
 }
 
 func convertFromJSONMaster(byte_arr []byte) (MasterFSM, error) {
     var m MasterFSM
-    err := json.Unmarshal(byte_arr, &m)
-    return m, err
+    version, state, err := decodeSnapshot(byte_arr)
+    if err != nil {
+        return m, err
+    }
+    if err = json.Unmarshal(state, &m); err != nil {
+        return m, err
+    }
+    migrateMasterSnapshot(&m, version)
+    return m, nil
 }
 
 func (m *MasterFSM) createLock(l Lock) ([]func() [][]byte, CreateLockResponse) {
     m.FsmLock.Lock()
     defer m.FsmLock.Unlock()
-    //fmt.Println("MASTER: master creating lock with name ", string(l))
     if len(string(l)) == 0 {
         return []func() [][]byte{}, CreateLockResponse{ErrEmptyPath}
     }
@@ -273,20 +531,29 @@ func (m *MasterFSM) createLock(l Lock) ([]func() [][]byte, CreateLockResponse) {
     if _, ok := m.LockMap[l]; ok {
         return []func() [][]byte{}, CreateLockResponse{ErrLockExists}
     }
-    replicaGroup, err := m.choosePlacement(replicaGroups)
-    if err != "" {
+    var replicaGroup ReplicaGroupId
+    var err *LockError
+    if m.isHashed(domain) {
+        if replicaGroup = newHashRing(m.ringGroups(domain)).owner(l); replicaGroup == NO_WORKER || !m.isHealthy(replicaGroup) {
+            err = ErrNoPlacement
+        }
+    } else {
+        replicaGroup, err = m.choosePlacement(domain, replicaGroups)
+    }
+    if err != nil {
         return []func() [][]byte{}, CreateLockResponse{err}
     }
-    //fmt.Println("MASTER: put lock ", string(l), " in domain", string(domain))
+    m.logger.Debug("placed lock", "lock", l, "group", replicaGroup, "term", m.term)
     m.NumLocksHeld[replicaGroup]++
     m.LockMap[l] = replicaGroup
-    m.LockFreqStatsMap[l] = FreqStats{lastUpdate: time.Now(), avgFreq: 1}
+    m.LockFreqStatsMap[l] = FreqStats{LastUpdate: m.Clock, AvgFreq: 1}
 
     /* Trigger rebalancing if number of locks held by replica group >= rebalance threshold. */
     rebalanceCallbacks := m.loadBalanceCheck()
 
+    trace := m.trace
     f := func() [][]byte {
-            m.askWorkerToClaimLocks(replicaGroup, []Lock{l})
+            m.askWorkerToClaimLocks(replicaGroup, []Lock{l}, nil, nil, trace)
             var commands [][]byte
             for _, callback := range rebalanceCallbacks {
                 commands = callback()
@@ -302,32 +569,37 @@ func (m *MasterFSM) createLock(l Lock) ([]func() [][]byte, CreateLockResponse) {
 }
 
 func (m *MasterFSM) loadBalanceCheck() []func()[][]byte {
-    /* Trigger rebalancing if number of locks held by replica group >= rebalance threshold. */
-    var rebalanceCallbacks []func() [][]byte = nil
-    overworkedWorker := m.findOverworkedWorker()
-    if overworkedWorker != NO_WORKER {
-        rebalanceCallbacks = m.shedLoad(overworkedWorker)
-    } else {
-        underworkedWorker := m.findUnderworkedWorker()
-        if underworkedWorker != NO_WORKER {
-            rebalanceCallbacks = m.retireWorker(underworkedWorker)
-        }
+    /* Remove drained groups, move locks in hashed domains to their owners on
+       the ring and off draining groups, then ask rebalance policy which locks
+       to move and start moving them. */
+    m.finishDrains()
+    if plan := m.rehashPlan(); len(plan) > 0 {
+        return m.applyRebalancePlan(plan)
     }
-    return rebalanceCallbacks
+    if plan := m.drainPlan(); len(plan) > 0 {
+        return m.applyRebalancePlan(plan)
+    }
+    if m.policy == nil {
+        return nil
+    }
+    return m.applyRebalancePlan(m.policy.Plan(&masterLoadView{m}))
 }
 
 func (m *MasterFSM) deleteLock(l Lock) ([]func() [][]byte, DeleteLockResponse) {
     m.FsmLock.Lock()
     defer m.FsmLock.Unlock()
-    //fmt.Println("MASTER: master deleting lock ", string(l))
     replicaGroup, ok := m.LockMap[l]
     if !ok {
         return []func() [][]byte{}, DeleteLockResponse{ErrLockDoesntExist}
     }
+    trace := m.trace
     triggerDelete := func()[][]byte {
-        //fmt.Println("MASTER: delete lock " + l)
         delete_func := func() [][]byte {
-            recalcitrantLocks := m.initiateTransfer(replicaGroup, []Lock{l})
+            deadline := m.newRevocationDeadline()
+            recalcitrantLocks, err := m.initiateTransfer(replicaGroup, []Lock{l}, deadline, trace)
+            if err != nil {
+                return [][]byte{}
+            }
             args := make(map[string]string)
             if len(recalcitrantLocks) == 0 {
                 /* Lock is not acquired, can be safely deleted. */
@@ -335,11 +607,12 @@ func (m *MasterFSM) deleteLock(l Lock) ([]func() [][]byte, DeleteLockResponse) {
             } else {
                 /* Lock is acquired, mark as recalcitrant and wait for release to delete. */
                 args[FunctionKey] = DeleteRecalLockCommand
+                args[DeadlineKey] = time_to_string(deadline)
             }
             args[LockArgKey] = string(l)
             command, json_err := json.Marshal(args)
             if json_err != nil {
-                //fmt.Println("MASTER: json error")
+                return [][]byte{}
             }
             return [][]byte{command}
         }
@@ -353,7 +626,6 @@ func (m *MasterFSM) deleteLock(l Lock) ([]func() [][]byte, DeleteLockResponse) {
 func (m *MasterFSM) createLockDomain(d Domain) CreateDomainResponse {
     m.FsmLock.Lock()
     defer m.FsmLock.Unlock()
-    //fmt.Println("MASTER: master creating domain ", string(d))
     if len(string(d)) == 0 {
         return CreateDomainResponse{ErrEmptyPath}
     }
@@ -371,12 +643,12 @@ func (m *MasterFSM) createLockDomain(d Domain) CreateDomainResponse {
     if _, ok := m.DomainPlacementMap[d]; ok {
         return CreateDomainResponse{ErrDomainExists}
     }
-    replicaGroup, err := m.choosePlacement(replicaGroups)
-    if err != "" {
+    replicaGroup, err := m.choosePlacement(d, replicaGroups)
+    if err != nil {
         return CreateDomainResponse{err}
     }
     m.DomainPlacementMap[d] = []ReplicaGroupId{replicaGroup}
-    return CreateDomainResponse{""}
+    return CreateDomainResponse{Success}
 }
 
 func (m *MasterFSM) findLock(l Lock) (LocateLockResponse) {
@@ -386,10 +658,64 @@ func (m *MasterFSM) findLock(l Lock) (LocateLockResponse) {
     if !ok {
         return LocateLockResponse{-1, nil, ErrLockDoesntExist}
     }
-    response := LocateLockResponse{replicaGroup, m.ClusterMap[replicaGroup], ""}
+    response := LocateLockResponse{replicaGroup, m.ClusterMap[replicaGroup], Success}
     return response 
 }
 
+/* Reports the replica groups the master knows about, ordered by ID. */
+func (m *MasterFSM) clusterStatus() ClusterStatusResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    ids := make([]int, 0)
+    for id := range m.ClusterMap {
+        ids = append(ids, int(id))
+    }
+    sort.Ints(ids)
+    response := ClusterStatusResponse{m.MasterCluster, make([]GroupStatus, 0), Success}
+    for _, id := range ids {
+        replicaGroup := ReplicaGroupId(id)
+        response.Groups = append(response.Groups, GroupStatus{replicaGroup, m.ClusterMap[replicaGroup], m.NumLocksHeld[replicaGroup]})
+    }
+    return response
+}
+
+/* Lists the locks and subdomains directly inside a domain, sorted by name. */
+func (m *MasterFSM) listDomain(d Domain) ListDomainResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    if len(string(d)) == 0 {
+        return ListDomainResponse{nil, nil, ErrEmptyPath}
+    }
+    if string(d[0]) != "/" {
+        d = "/" + d
+    }
+    if _, ok := m.DomainPlacementMap[d]; !ok {
+        return ListDomainResponse{nil, nil, ErrDomainDoesntExist}
+    }
+    lockNames := make([]string, 0)
+    for l := range m.LockMap {
+        if getParentDomain(string(l)) == d {
+            lockNames = append(lockNames, string(l))
+        }
+    }
+    domainNames := make([]string, 0)
+    for child := range m.DomainPlacementMap {
+        if child != "/" && getParentDomain(string(child)) == d {
+            domainNames = append(domainNames, string(child))
+        }
+    }
+    sort.Strings(lockNames)
+    sort.Strings(domainNames)
+    response := ListDomainResponse{make([]Lock, 0), make([]Domain, 0), Success}
+    for _, l := range lockNames {
+        response.Locks = append(response.Locks, Lock(l))
+    }
+    for _, child := range domainNames {
+        response.Domains = append(response.Domains, Domain(child))
+    }
+    return response
+}
+
 func getParentDomain(path string) Domain {
     split := strings.Split(path, "/")
     /* Set root as parent of all directories */
@@ -405,29 +731,39 @@ func getParentDomain(path string) Domain {
     return Domain("/" + strings.Join(slice, "/"))
 }
 
-func (m *MasterFSM) choosePlacement(replicaGroups []ReplicaGroupId) (ReplicaGroupId, string) {
+/* Choose least loaded of healthy replica groups that domain's placement policy allows. */
+func (m *MasterFSM) choosePlacement(d Domain, replicaGroups []ReplicaGroupId) (ReplicaGroupId, *LockError) {
+    healthy := make([]ReplicaGroupId, 0)
+    for _, replicaGroup := range m.placementCandidates(d, replicaGroups) {
+        if m.isHealthy(replicaGroup) && !m.DrainingGroups[replicaGroup] {
+            healthy = append(healthy, replicaGroup)
+        }
+    }
+    replicaGroups = healthy
     if len(replicaGroups) == 0 {
         return -1, ErrNoPlacement
     }
     chosen := replicaGroups[0]
-    minLoad := m.GroupFreqStatsMap[chosen].avgFreq
+    minLoad := m.placementLoad(chosen)
     for _, replicaGroup := range(replicaGroups) {
-        if minLoad > m.GroupFreqStatsMap[chosen].avgFreq {
+        if load := m.placementLoad(replicaGroup); minLoad > load {
             chosen = replicaGroup
-            minLoad = m.GroupFreqStatsMap[replicaGroup].avgFreq
+            minLoad = load
         }
     }
-    return chosen, "" 
+    return chosen, nil
 }
 
-func recruitInitialCluster(masters []*MasterFSM, workerAddrs []raft.ServerAddress, recruit_locally bool) (error) {
+func recruitInitialCluster(masters []*MasterFSM, workerAddrs []raft.ServerAddress, recruit_locally bool, logger raft.Logger) (error) {
     if recruit_locally {
         transports := make([]*raft.NetworkTransport, len(workerAddrs))
         for i := range workerAddrs {
             trans,_ := raft.NewTCPTransport(string(workerAddrs[i]), nil, 2, time.Second, nil)
             transports[i] = trans
         }
-        MakeCluster(numClusterServers, CreateWorkers(len(workerAddrs), masters[0].MasterCluster, workerAddrs, transports), workerAddrs, transports)
+        if _, err := MakeCluster(len(workerAddrs), CreateWorkers(len(workerAddrs), masters[0].MasterCluster, workerAddrs, transports, logger), workerAddrs, transports); err != nil {
+            return err
+        }
     }
     id := masters[0].NextReplicaGroupId
     for i := range(masters) {
@@ -452,8 +788,9 @@ func (m *MasterFSM) deleteLockNotAcquired(l Lock) []func() [][]byte {
     /* Check if should split or join */
     rebalanceCallbacks := m.loadBalanceCheck()
 
+    trace := m.trace
     f := func() [][]byte {
-        m.askWorkerToDisownLocks(replicaGroup, []Lock{l})
+        m.askWorkerToDisownLocks(replicaGroup, []Lock{l}, nil, trace)
         var commandList [][]byte
         for _,rebalanceCallback := range rebalanceCallbacks {
             commands := rebalanceCallback()
@@ -469,177 +806,68 @@ func (m *MasterFSM) deleteLockNotAcquired(l Lock) []func() [][]byte {
     return []func()[][]byte{f}//callbacks
 }
 
-func (m* MasterFSM) markLockForDeletion(l Lock) {
+func (m* MasterFSM) markLockForDeletion(l Lock, deadline time.Time) {
     m.FsmLock.Lock()
     defer m.FsmLock.Unlock()
     m.RecalcitrantDestMap[l] = -1
-}
-
-func (m *MasterFSM) shedLoad(replicaGroup ReplicaGroupId) []func() [][]byte {
-    locksToMove := m.getLocksToShedLoadToIdeal(replicaGroup)
-    redistributeCallbacks := m.tryRedistributeLocks(replicaGroup, locksToMove)
-    if redistributeCallbacks != nil {
-        return redistributeCallbacks
-    }
-    locksToMove = m.getLocksToSplitEvenly(replicaGroup)
-    if (int(m.NextReplicaGroupId) < len(m.RecruitAddrs)) {
-        return m.splitToNewWorker(replicaGroup, locksToMove)
-    }
-    return []func()[][]byte{}
-}
-
-func (m *MasterFSM) tryRedistributeLocks(replicaGroup ReplicaGroupId, locksToRedistribute []Lock) []func() [][]byte {
-    // TODO: in future, split between multiple clusters, don't just dump on 1 random cluster
-
-    redistributeMap := make(map[ReplicaGroupId][]Lock)
-    anticipatedAdditionalLoad := make(map[ReplicaGroupId]float64)
-    for _, l := range locksToRedistribute {
-        newReplicaGroup := m.getWorkerToTakeLock(l, replicaGroup, anticipatedAdditionalLoad)
-        if newReplicaGroup == NO_WORKER {
-            /* abort if no other worker to join with. */
-            return nil 
-        }
-        if _,ok := redistributeMap[newReplicaGroup]; !ok {
-            redistributeMap[newReplicaGroup] = make([]Lock, 0)
-        }
-        anticipatedAdditionalLoad[newReplicaGroup] += m.LockFreqStatsMap[l].avgFreq
-        redistributeMap[newReplicaGroup] = append(redistributeMap[newReplicaGroup], l)
-    }
-
-    rebalancingFuncs := make([]func()[][]byte, 0)
-
-    //fmt.Println("redistributing locks for: ", replicaGroup)
-    m.RebalancingInProgress[replicaGroup] = true
-
-
-    for newReplicaGroup := range redistributeMap {
-        locksToMove := redistributeMap[newReplicaGroup]
-        m.patchReferencesToOldWorker(replicaGroup, newReplicaGroup, locksToMove)
-
-        rebalancingFunc := func() [][]byte {
-            /* Initiate rebalancing and find recalcitrant locks. */
-            recalcitrantLocks := m.initiateTransfer(replicaGroup, locksToMove)
-
-            recalcitrantLocksList := make([]Lock, 0)
-            for l := range(recalcitrantLocks) {
-                recalcitrantLocksList = append(recalcitrantLocksList, l)
-            }
-
-            /* Using set of recalcitrant locks, determine locks that can be moved. */
-            locksCanMove := make([]Lock, 0)
-            for _, currLock := range(locksToMove) {
-                if _, ok := recalcitrantLocks[currLock]; !ok {
-                    locksCanMove = append(locksCanMove, currLock)
-                }
-            }
-
-            /* Ask new replica group to claim set of locks that can be moved. */
-            m.askWorkerToClaimLocks(newReplicaGroup, locksCanMove)
-
-            /* Tell master to transfer ownership of locks from old group to new group. */
-            args := make(map[string]string)
-            args[FunctionKey] = TransferLockGroupCommand
-            args[LockArrayKey] = lock_array_to_string(locksCanMove)
-            args[LockArray2Key] = lock_array_to_string(recalcitrantLocksList)
-            args[OldGroupKey] = strconv.Itoa(int(replicaGroup))
-            args[NewGroupKey] = strconv.Itoa(int(newReplicaGroup))
-            command, json_err := json.Marshal(args)
-            if json_err != nil {
-                //fmt.Println("MASTER: json error")
-            }
-            return [][]byte{command}
-        }
-
-        rebalancingFuncs = append(rebalancingFuncs, rebalancingFunc)
-
-    }
-    return rebalancingFuncs 
+    m.setRevocationDeadline(l, deadline)
 }
 
 func (m *MasterFSM) splitToNewWorker(replicaGroup ReplicaGroupId, locksToMove []Lock) ([]func() [][]byte) {
-    //fmt.Println("MASTER: SPLITTING LOAD")
-    //fmt.Println("is rebalancing in progress for ", replicaGroup, ": ", m.RebalancingInProgress[replicaGroup])
     /* Update state in preparation for adding new cluster. */
-    //fmt.Println("next replica group id: ", m.NextReplicaGroupId)
-    workerAddrs := m.RecruitAddrs[m.NextReplicaGroupId].addrs
-    shouldMakeNewCluster := m.RecruitAddrs[m.NextReplicaGroupId].shouldRecruitLocally
     newReplicaGroup := m.NextReplicaGroupId
+    /* Only move locks whose domain may be placed at new group. */
+    allowedLocks := make([]Lock, 0)
+    for _, l := range locksToMove {
+        if m.placementAllowed(getParentDomain(string(l)), newReplicaGroup) {
+            allowedLocks = append(allowedLocks, l)
+        }
+    }
+    locksToMove = allowedLocks
+    /* A group serving hashed domains recruits even with no locks to hand
+       over, since the new group takes a slice of their rings. */
+    recruitOnly := len(locksToMove) == 0 && m.servesHashedDomain(replicaGroup)
+    if len(locksToMove) == 0 && !recruitOnly {
+        return []func() [][]byte{}
+    }
+    recruit, ok := m.nextRecruit()
+    if !ok {
+        return []func() [][]byte{}
+    }
+    workerAddrs := recruit.Addrs
+    shouldMakeNewCluster := recruit.ShouldRecruitLocally
     m.ClusterMap[newReplicaGroup] = workerAddrs
     m.NumLocksHeld[newReplicaGroup] = 0
     m.NextReplicaGroupId++
-    m.RebalancingInProgress[replicaGroup] = true
+    m.rebalanceLogger().Info("recruited replica group", "group", newReplicaGroup, "from", replicaGroup, "servers", workerAddrs, "locks", len(locksToMove))
+    m.joinHashRings(replicaGroup, newReplicaGroup)
+    transferId := -1
+    if !recruitOnly {
+        m.RebalancingInProgress[replicaGroup] = true
+        transferId = m.planTransfer(replicaGroup, newReplicaGroup, locksToMove, false, TransferPlanned)
+    }
     rebalancing_func := func() [][]byte {
-        /* Initiate rebalancing and find recalcitrant locks. */
-        recalcitrantLocks := m.initiateTransfer(replicaGroup, locksToMove)
-
-        recalcitrantLocksList := make([]Lock, 0)
-        for l := range(recalcitrantLocks) {
-            recalcitrantLocksList = append(recalcitrantLocksList, l)
-        }
-
         /* Recruit new replica group to store rebalanced locks. */
-        //fmt.Println("recruit addr list = ", m.RecruitAddrs, ", next replica group id (after ++) = ", m.NextReplicaGroupId)
         if (shouldMakeNewCluster) {
             transports := make([]*raft.NetworkTransport, len(workerAddrs))
                 for i := range workerAddrs {
                     trans,_ := raft.NewTCPTransport(string(workerAddrs[i]), nil, 2, time.Second, nil)
                     transports[i] = trans
                 }
-            MakeCluster(numClusterServers, CreateWorkers(len(workerAddrs), m.MasterCluster, workerAddrs, transports), workerAddrs, transports)
-        }
-
-        /* Using set of recalcitrant locks, determine locks that can be moved. */
-        locksCanMove := make([]Lock, 0)
-        for _, currLock := range(locksToMove) {
-            if _, ok := recalcitrantLocks[currLock]; !ok {
-                locksCanMove = append(locksCanMove, currLock)
+            if _, err := MakeCluster(len(workerAddrs), CreateWorkers(len(workerAddrs), m.MasterCluster, workerAddrs, transports, m.workerLogger), workerAddrs, transports); err != nil {
+                /* The transfer is resumed once the group can be reached. */
+                m.rebalanceLogger().Error("starting recruited group failed", "group", newReplicaGroup, "error", err)
             }
         }
-
-        /* Ask new replica group to claim set of locks that can be moved. */
-        m.askWorkerToClaimLocks(newReplicaGroup, locksCanMove)
-
-        /* Tell master to transfer ownership of locks from old group to new group. */
-        args := make(map[string]string)
-        args[FunctionKey] = TransferLockGroupCommand
-        args[LockArrayKey] = lock_array_to_string(locksCanMove)
-        args[LockArray2Key] = lock_array_to_string(recalcitrantLocksList)
-        args[OldGroupKey] = strconv.Itoa(int(replicaGroup))
-        args[NewGroupKey] = strconv.Itoa(int(newReplicaGroup))
-        command, json_err := json.Marshal(args)
-        if json_err != nil {
-            //fmt.Println("MASTER: json error")
+        if recruitOnly {
+            return [][]byte{}
         }
-        return [][]byte{command}
+        return m.runTransferStep(transferId)
     }
-    //fmt.Println("afterwards....")
 
     return []func() [][]byte{rebalancing_func}
 }
 
-// can return NO_WORKER if not a good candidate
-func (m *MasterFSM) getWorkerToTakeLock(l Lock, replicaGroup ReplicaGroupId, anticipatedAdditionalLoad map[ReplicaGroupId]float64) ReplicaGroupId {
-    lockFreq := m.LockFreqStatsMap[l].avgFreq
-    candidates := make(map[ReplicaGroupId]bool)
-    d := getParentDomain(string(l))
-    domainGroups := m.DomainPlacementMap[d]
-    for _, domainGroup := range domainGroups {
-        if domainGroup != replicaGroup && !m.RebalancingInProgress[domainGroup] && (m.GroupFreqStatsMap[domainGroup].avgFreq + anticipatedAdditionalLoad[domainGroup] + lockFreq) < m.calcMaxFreq() {
-            candidates[domainGroup] = true
-        }
-    }
-    candidateList := make([]ReplicaGroupId, 0)
-    for candidate := range candidates {
-        candidateList = append(candidateList, candidate)
-    }
-    if len(candidateList) == 0 {
-        //fmt.Println("No viable worker to transfer locks to.")
-        return NO_WORKER
-    }
-    newReplicaGroup,_ := m.choosePlacement(candidateList)
-    return newReplicaGroup
-}
-
 func (m *MasterFSM) patchReferencesToOldWorker(oldReplicaGroup ReplicaGroupId, newReplicaGroup ReplicaGroupId, locksToMove []Lock) {
     remainingDomains := make(map[Domain]bool)
     locksToMoveMap := make(map[Lock]bool)
@@ -659,7 +887,6 @@ func (m *MasterFSM) patchReferencesToOldWorker(oldReplicaGroup ReplicaGroupId, n
         }
         shouldAppend := false
         for i := 0; i < len(groups); i++ {
-            //fmt.Println("i=", i, ", groups=", groups)
             if groups[i] == oldReplicaGroup || groups[i] == newReplicaGroup {
                 if i == len(groups) - 1 {
                     groups = groups[:i]
@@ -681,150 +908,115 @@ func (m *MasterFSM) patchReferencesToOldWorker(oldReplicaGroup ReplicaGroupId, n
             m.RecalcitrantDestMap[l] = newReplicaGroup
         }
     }
-    // Update group freq stats map
+    m.moveGroupFreqStats(oldReplicaGroup, newReplicaGroup, locksToMove)
+}
+
+/* Shift the frequency of moving locks from old group to new group. */
+func (m *MasterFSM) moveGroupFreqStats(oldReplicaGroup ReplicaGroupId, newReplicaGroup ReplicaGroupId, locksToMove []Lock) {
     newGroupFreq := m.GroupFreqStatsMap[newReplicaGroup]
     oldGroupFreq := m.GroupFreqStatsMap[oldReplicaGroup]
     for _,l := range locksToMove {
-        newGroupFreq.avgFreq += m.LockFreqStatsMap[l].avgFreq
-        oldGroupFreq.avgFreq -= m.LockFreqStatsMap[l].avgFreq
+        newGroupFreq.AvgFreq += m.LockFreqStatsMap[l].AvgFreq
+        oldGroupFreq.AvgFreq -= m.LockFreqStatsMap[l].AvgFreq
     }
     m.GroupFreqStatsMap[newReplicaGroup] = newGroupFreq
     m.GroupFreqStatsMap[oldReplicaGroup] = oldGroupFreq
 }
 
-func (m *MasterFSM) retireWorker(replicaGroup ReplicaGroupId) []func() [][]byte {
-    //fmt.Println("*** checking to retire worker")
-    locksToMove := m.getLocksToConsolidate(replicaGroup)
-    retireCallbacks := m.tryRedistributeLocks(replicaGroup, locksToMove)
-    if retireCallbacks != nil {
-        //fmt.Println("****RETIRING WORKER: ", replicaGroup)
-        return retireCallbacks
-    }
-    return []func() [][]byte{}
-}
-
 func (m *MasterFSM) checkForFullyRetiredWorker(replicaGroup ReplicaGroupId) {
-    if m.NumLocksHeld[replicaGroup] == 0 {
+    /* Drained groups are removed rather than retired. */
+    if m.NumLocksHeld[replicaGroup] == 0 && !m.DrainingGroups[replicaGroup] {
         serverAddrs := m.ClusterMap[replicaGroup]
         // leave old cluster map entry to allow for some cleanup
         //delete(m.NumLocksHeld, replicaGroup)
         //delete(m.RebalancingInProgress, replicaGroup)
         //delete(m.GroupFreqStatsMap, replicaGroup)
         m.RebalancingInProgress[replicaGroup] = true
-        m.RecruitAddrs = append(m.RecruitAddrs, RecruitInfo{addrs: serverAddrs, shouldRecruitLocally: false})
+        m.returnToPool(serverAddrs)
     }
 }
 
 
-func (m *MasterFSM) genericClusterRequest(replicaGroup ReplicaGroupId, args map[string]string, resp *raft.ClientResponse) {
+/* Send command belonging to trace to replica group, returning an error unless
+   it was applied. */
+func (m *MasterFSM) genericClusterRequest(replicaGroup ReplicaGroupId, args map[string]string, resp *raft.ClientResponse, trace raft.TraceContext) error {
     command, json_err := json.Marshal(args)
     if json_err != nil {
-        //fmt.Println("MASTER: JSON ERROR")
+        return ErrInvalidRequest
     }
     m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
     m.SessionLock.Lock()
     defer m.SessionLock.Unlock()
-    // TODO: USE SESSION
     session, ok := m.WorkerSessionMap[replicaGroup]
-    var err error = nil
     if !ok {
-        session, err = raft.CreateClientSession(m.Trans, m.ClusterMap[replicaGroup], nil)
+        var err error
+        session, err = raft.CreateClientSession(m.Trans, m.ClusterMap[replicaGroup], nil, m.logger.With("group", replicaGroup))
+        if err != nil {
+            return transportError(err)
+        }
         m.WorkerSessionMap[replicaGroup] = session
     }
-    if err != nil {
-        return
-    }
-    send_err := session.SendRequest(command, resp)
-    m.FsmLock.RUnlock()
-    if send_err != nil {
-       //fmt.Println("MASTER: send err ", send_err)
-    }
+    send_err := session.SendRequestWithTrace(command, resp, trace)
+    return requestError(send_err, resp)
 }
 
-func (m *MasterFSM) initiateTransfer(replicaGroup ReplicaGroupId, locksToMove []Lock) map[Lock]int {
-    /* Send RPC to worker with locks_to_move */
+/* Ask replica group to disable locks. Held locks are returned as recalcitrant
+   and stay enabled until released; their holders are asked to release them
+   by deadline. */
+func (m *MasterFSM) initiateTransfer(replicaGroup ReplicaGroupId, locksToMove []Lock, deadline time.Time, trace raft.TraceContext) (map[Lock]int, error) {
     args := make(map[string]string)
     args[FunctionKey] = TransferCommand
     args[LockArrayKey] = lock_array_to_string(locksToMove)
+    args[DeadlineKey] = time_to_string(deadline)
     resp := raft.ClientResponse{}
-    m.genericClusterRequest(replicaGroup, args, &resp)
-    var response TransferResponse
-    unmarshal_err := json.Unmarshal(resp.ResponseData, &response)
-    if unmarshal_err != nil {
-        //fmt.Println("MASTER: error unmarshalling")
-    }
-    return response.RecalcitrantLocks
-}
-
-func (m *MasterFSM) calcMaxFreq() float64 {
-    if (int(m.NextReplicaGroupId) == len(m.RecruitAddrs)) {
-        return STABILIZE_FACTOR * m.getTotalFreq() / float64(len(m.ClusterMap))
+    if err := m.genericClusterRequest(replicaGroup, args, &resp, trace); err != nil {
+        return nil, err
     }
-    return m.MaxFreq
-}
-
-func (m *MasterFSM) findOverworkedWorker() ReplicaGroupId {
-    for replicaGroup := range m.NumLocksHeld/*m.GroupFreqStatsMap*/ {
-        // TODO: replace with real tracking
-        //fmt.Println("check rep group ",  replicaGroup)
-        if m.GroupFreqStatsMap[replicaGroup].avgFreq >= m.calcMaxFreq() {
-            //fmt.Println("overthreshold but rebalancing")
-            if _, ok := m.RebalancingInProgress[replicaGroup]; !ok {
-                //fmt.Println("found overworked: ", replicaGroup)
-                return replicaGroup
-            }
-        }
-    }
-    return NO_WORKER
-}
-
-func (m *MasterFSM) findUnderworkedWorker() ReplicaGroupId {
-    for replicaGroup := range m.NumLocksHeld/*m.GroupFreqStatsMap*/ {
-        // TODO: replace with real tracking
-        if m.GroupFreqStatsMap[replicaGroup].avgFreq <= m.MinFreq && time.Since(m.GroupFreqStatsMap[replicaGroup].lastUpdate) / PERIOD >= time.Duration(m.MaxInactivePeriods) {
-            //fmt.Println("num locks held = ", m.NumLocksHeld[replicaGroup])
-            if _, ok := m.RebalancingInProgress[replicaGroup]; !ok {
-                //fmt.Println("reporting underworked at ", replicaGroup)
-                return replicaGroup
-            }
-        }
-    }
-    return NO_WORKER
-}
-
-func (m *MasterFSM) getTotalFreq() float64 {
-    total := 0.0
-    for _, freq := range m.GroupFreqStatsMap {
-        total += freq.avgFreq
+    var response TransferResponse
+    if unmarshal_err := json.Unmarshal(resp.ResponseData, &response); unmarshal_err != nil {
+        return nil, ErrNotApplied
     }
-    return total
+    return response.RecalcitrantLocks, nil
 }
 
-
-
-func (m *MasterFSM) askWorkerToClaimLocks(replicaGroup ReplicaGroupId, movingLocks []Lock) {
-    /* Send RPC to worker with locks to claim. */
-    //fmt.Println("MASTER: ask worker to claim locks\n")
+/* Ask replica group to claim locks, with their state if migrated live. Here
+   is where the group is, passed on to holders of locks that arrive held, or
+   nil if no lock does. */
+func (m *MasterFSM) askWorkerToClaimLocks(replicaGroup ReplicaGroupId, movingLocks []Lock, states map[Lock]MigratedLock, here *LockForward, trace raft.TraceContext) error {
     args := make(map[string]string)
     args[FunctionKey] = ClaimLocksCommand
     args[LockArrayKey] = lock_array_to_string(movingLocks)
-    m.genericClusterRequest(replicaGroup, args, &raft.ClientResponse{})
-    // TODO: do we need the claimed locks anywhere?
+    if len(states) > 0 {
+        statesJSON, json_err := json.Marshal(states)
+        if json_err != nil {
+            return ErrInvalidRequest
+        }
+        args[StatesKey] = string(statesJSON)
+    }
+    if here != nil {
+        args[GroupArgKey] = strconv.Itoa(int(here.ReplicaId))
+        args[ServerAddrsKey] = addr_array_to_string(here.ServerAddrs)
+    }
+    return m.genericClusterRequest(replicaGroup, args, &raft.ClientResponse{}, trace)
 }
 
-func (m *MasterFSM) askWorkerToDisownLocks(replicaGroup ReplicaGroupId, movingLocks []Lock) {
-    /* Send RPC to worker with locks to claim. */
-    //fmt.Println("MASTER: ask worker to disown locks")
+/* Ask replica group to disown locks, leaving a forward to where they went
+   unless forward is nil. */
+func (m *MasterFSM) askWorkerToDisownLocks(replicaGroup ReplicaGroupId, movingLocks []Lock, forward *LockForward, trace raft.TraceContext) error {
     args := make(map[string]string)
     args[FunctionKey] = DisownLocksCommand
     args[LockArrayKey] = lock_array_to_string(movingLocks)
-    m.genericClusterRequest(replicaGroup, args, &raft.ClientResponse{}) 
+    if forward != nil {
+        args[GroupArgKey] = strconv.Itoa(int(forward.ReplicaId))
+        args[ServerAddrsKey] = addr_array_to_string(forward.ServerAddrs)
+    }
+    return m.genericClusterRequest(replicaGroup, args, &raft.ClientResponse{}, trace)
 }
 
-/* Transfer ownership of locks in master and tell old replica group to disown locks. Should only be called after new replica group owns locks. */
-func (m *MasterFSM) initialLockGroupTransfer(oldGroupId ReplicaGroupId, newGroupId ReplicaGroupId, movingLocks []Lock, recalcitrantLocks []Lock) []func() [][]byte {
-    m.FsmLock.Lock()
-    defer m.FsmLock.Unlock()
+/* Transfer ownership of locks in master. Should only be called after new
+   replica group owns locks. Assumes FSM already locked. */
+func (m *MasterFSM) commitLockGroupTransfer(oldGroupId ReplicaGroupId, newGroupId ReplicaGroupId, movingLocks []Lock, recalcitrantLocks []Lock) {
     /* Update master state to show that locks have moved. */
     m.NumLocksHeld[oldGroupId] -= len(movingLocks)
     for _, l := range(movingLocks) {
@@ -863,7 +1055,9 @@ func (m *MasterFSM) initialLockGroupTransfer(oldGroupId ReplicaGroupId, newGroup
     }
     /* For moving domains, add newGroupId to domainPlacementMap. If an old group no longer holds a domain, remove it from that entry in the domainPlacementMap. */
     for d := range(movingDomains) {
-        m.DomainPlacementMap[d] = append(m.DomainPlacementMap[d], newGroupId)
+        if !containsGroup(m.DomainPlacementMap[d], newGroupId) {
+            m.DomainPlacementMap[d] = append(m.DomainPlacementMap[d], newGroupId)
+        }
         if _, ok := remainingDomains[d]; !ok {
             i := 0
             for i < len(m.DomainPlacementMap[d]) {
@@ -882,106 +1076,38 @@ func (m *MasterFSM) initialLockGroupTransfer(oldGroupId ReplicaGroupId, newGroup
 
     /* No longer rebalancing */
     if _, ok := m.RebalancingInProgress[oldGroupId]; ok {
-        //fmt.Println("DONE REBAL FOR ", oldGroupId)
         delete(m.RebalancingInProgress, oldGroupId)
     }
+}
 
-    /* Ask old replica group to disown locks being moved. */
-    f := func() [][]byte {
-        m.askWorkerToDisownLocks(oldGroupId, movingLocks)
-        return [][]byte{}
+func containsGroup(groups []ReplicaGroupId, replicaGroup ReplicaGroupId) bool {
+    for _, g := range groups {
+        if g == replicaGroup {
+            return true
+        }
     }
-    return []func() [][]byte{f}
+    return false
 }
 
-func (m *MasterFSM) singleRecalcitrantLockTransfer(oldGroupId ReplicaGroupId, newGroupId ReplicaGroupId, l Lock) []func() [][]byte {
-    m.FsmLock.Lock()
-    m.FsmLock.Unlock()
-    /* Update state for transferring recalcitrant lock. */
+/* Transfer ownership of released recalcitrant lock in master. Assumes FSM
+   already locked. */
+func (m *MasterFSM) commitRecalcitrantTransfer(oldGroupId ReplicaGroupId, newGroupId ReplicaGroupId, l Lock) {
     m.LockMap[l] = newGroupId
     m.NumLocksHeld[newGroupId]++
     m.NumLocksHeld[oldGroupId]--
     m.checkForFullyRetiredWorker(oldGroupId)
-
-    /* Ask worker to disown lock now that transferred. */
-    f := func() [][]byte {
-        m.askWorkerToDisownLocks(oldGroupId, []Lock{l})
-        return [][]byte{}
-    }
-
-    return []func() [][]byte{f}
-}
-
-// Lexicographically split evenly based on frequency of access
-func (m *MasterFSM) getLocksToSplitEvenly(replicaGroup ReplicaGroupId) ([]Lock) {
-    /* Find all domains for locks in replica group. */
-    locks := make([]string, 0)
-    for l := range(m.LockMap) {
-        if m.LockMap[l] == replicaGroup {
-            locks = append(locks, string(l))
-        }
-    }
-    sort.Strings(locks)
-
-    totFreq := m.GroupFreqStatsMap[replicaGroup].avgFreq
-    currSplitFreq := 0.0
-    splitLocks := make([]Lock, 0)
-    for _,l := range(locks) {
-        if currSplitFreq >= totFreq / 2.0 {
-            return splitLocks
-        }
-        currSplitFreq += m.LockFreqStatsMap[Lock(l)].avgFreq
-        splitLocks = append(splitLocks, Lock(l))
-    }
-    //fmt.Println("MASTER: error in splitting locks")
-    return splitLocks
-}
-
-func (m *MasterFSM) getLocksToShedLoadToIdeal(replicaGroup ReplicaGroupId) ([]Lock) {
-    /* Find all domains for locks in replica group. */
-    locks := make([]string, 0)
-    for l := range(m.LockMap) {
-        if m.LockMap[l] == replicaGroup {
-            locks = append(locks, string(l))
-        }
-    }
-    sort.Strings(locks)
-
-    idealFreq := m.IdealFreq
-    if (int(m.NextReplicaGroupId) == len(m.RecruitAddrs)) {
-        idealFreq = (m.getTotalFreq() / float64(len(m.ClusterMap))) * (IDEAL_FACTOR);
-    }
-
-    goalFreq := m.GroupFreqStatsMap[replicaGroup].avgFreq - idealFreq
-    currSplitFreq := 0.0
-    splitLocks := make([]Lock, 0)
-    for _,l := range(locks) {
-        if currSplitFreq >= goalFreq {
-            return splitLocks
-        }
-        currSplitFreq += m.LockFreqStatsMap[Lock(l)].avgFreq
-        splitLocks = append(splitLocks, Lock(l))
-    }
-    //fmt.Println("MASTER: error in splitting locks")
-    return splitLocks
-}
-
-func (m * MasterFSM) getLocksToConsolidate(replicaGroup ReplicaGroupId) ([]Lock) {
-    locks := make([]Lock, 0)
-    for l := range(m.LockMap) {
-        if m.LockMap[l] == replicaGroup {
-            locks = append(locks, l)
-        }
-    }
-    return locks
 }
 
 func (m *MasterFSM) handleReleasedRecalcitrant(l Lock) []func() [][]byte {
    /* Find replica group to place lock into, remove recalcitrant lock entry in map. */
    m.FsmLock.Lock()
    defer m.FsmLock.Unlock()
-   //m.FsmLock.RLock()
-   newReplicaGroup := m.RecalcitrantDestMap[l]
+   delete(m.RevokeDeadlineMap, l)
+   newReplicaGroup, ok := m.RecalcitrantDestMap[l]
+   if !ok {
+        /* Released before its transfer was committed. */
+        return m.splitReleasedFromTransfer(l)
+   }
    delete(m.RecalcitrantDestMap, l)
    /* Check if should delete lock. */
    if newReplicaGroup == NO_WORKER {
@@ -990,65 +1116,52 @@ func (m *MasterFSM) handleReleasedRecalcitrant(l Lock) []func() [][]byte {
         m.checkForFullyRetiredWorker(replicaGroup)
         delete(m.LockMap, l)
         delete(m.LockFreqStatsMap, l)
+        trace := m.trace
         f := func() [][]byte {
-            m.askWorkerToDisownLocks(replicaGroup, []Lock{l})
+            m.askWorkerToDisownLocks(replicaGroup, []Lock{l}, nil, trace)
             return [][]byte{}
         }
         return []func() [][]byte{f}
    }
-   //m.FsmLock.RUnlock()
 
-   sendLockFunc := func() [][]byte {
-       m.FsmLock.RLock()
-       //fmt.Println("MASTER: send ", l, " to ", newReplicaGroup, " at ", m.ClusterMap[newReplicaGroup])
-       m.FsmLock.RUnlock()
-       m.askWorkerToClaimLocks(newReplicaGroup, []Lock{l})
-
-       /* Tell master to transfer ownership of locks. */
-       args := make(map[string]string)
-       args[FunctionKey] = TransferRecalCommand
-       args[LockArgKey] = string(l)
-       args[OldGroupKey] = strconv.Itoa(int(m.LockMap[l]))
-       args[NewGroupKey] = strconv.Itoa(int(newReplicaGroup))
-       command, json_err := json.Marshal(args)
-       if json_err != nil {
-           //fmt.Println("MASTER: json error")
-       }
-       return [][]byte{command}
+   /* Lock is already disabled at its old group. */
+   id := m.planTransfer(m.LockMap[l], newReplicaGroup, []Lock{l}, true, TransferDisabled)
+   f := func() [][]byte {
+       return m.runTransferStep(id)
    }
-
-   return []func() [][]byte{sendLockFunc}
+   return []func() [][]byte{f}
 }
 
-func (m *MasterFSM) updateFrequencies(lockArr []Lock, countArr []int)[]func()[][]byte {
+func (m *MasterFSM) updateFrequencies(lockArr []Lock, countArr []int, load WorkerLoad, hasLoad bool)[]func()[][]byte {
     m.FsmLock.Lock()
     defer m.FsmLock.Unlock()
-    currTime := time.Now()
-    //fmt.Println("Update freqs")
+    currTime := m.Clock
     sumFreq := 0.0
     for i := range lockArr {
         /* Calculate new exponentially weighted moving average. */
         if m.RebalancingInProgress[m.LockMap[lockArr[i]]] {
-            newStats := FreqStats{avgFreq: m.LockFreqStatsMap[lockArr[i]].avgFreq, lastUpdate: currTime}
+            newStats := FreqStats{AvgFreq: m.LockFreqStatsMap[lockArr[i]].AvgFreq, LastUpdate: currTime}
             m.LockFreqStatsMap[lockArr[i]] = newStats
             continue
         }
         stats := m.LockFreqStatsMap[lockArr[i]]
-        numPeriodsElapsed := float64(time.Since(stats.lastUpdate) / PERIOD)
+        numPeriodsElapsed := float64(currTime.Sub(stats.LastUpdate) / PERIOD)
         newFreq := float64(countArr[i]) / numPeriodsElapsed
-        currAvgFreq := stats.avgFreq
+        currAvgFreq := stats.AvgFreq
         for i := 0; i < int(numPeriodsElapsed); i++ {
             currAvgFreq = (newFreq * WEIGHT * numPeriodsElapsed) + (currAvgFreq * (1 - WEIGHT))
         }
-        //fmt.Println("frequency of ", lockArr[i], " is ", currAvgFreq)
+        m.logger.Trace("updated lock frequency", "lock", lockArr[i], "freq", currAvgFreq)
         sumFreq += currAvgFreq
-        newStats := FreqStats{avgFreq: currAvgFreq, lastUpdate: currTime}
+        newStats := FreqStats{AvgFreq: currAvgFreq, LastUpdate: currTime}
         m.LockFreqStatsMap[lockArr[i]] = newStats
     }
     // assume update from single worker
     if len(lockArr) > 0 {
-        m.GroupFreqStatsMap[m.LockMap[lockArr[0]]] = FreqStats{avgFreq: sumFreq, lastUpdate: currTime}
+        m.GroupFreqStatsMap[m.LockMap[lockArr[0]]] = FreqStats{AvgFreq: sumFreq, LastUpdate: currTime}
+        if hasLoad {
+            m.GroupLoadMap[m.LockMap[lockArr[0]]] = load
+        }
     }
-    //fmt.Println("Returned from update freqs")
     return m.loadBalanceCheck()
 }
@@ -0,0 +1,290 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "time"
+)
+
+/* Admin commands changing the master's own servers. The master leader makes
+   the change through raft and records the new servers in MasterCluster,
+   which it then pushes to every replica group. While leader, it also keeps
+   MasterCluster in step with raft's configuration, in case a leader was
+   removed or replaced before recording a change, and pushes MasterCluster to
+   replica groups that may have missed it. Clients and workers that can't
+   reach the master ask each master they know for the current servers. A new
+   master server must already be running, started with the same config as
+   the others to join rather than bootstrap. */
+
+/* Time between checks that MasterCluster and replica groups are up to date. */
+var MasterSyncInterval time.Duration = 2 * time.Second
+
+type MastersResponse struct {
+    MasterCluster   []raft.ServerAddress
+    Err             *LockError
+}
+
+/* Ask each of the known masters in turn for the current master servers. */
+func askForMasters(known []raft.ServerAddress) ([]raft.ServerAddress, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = MastersCommand
+    data, err := json.Marshal(args)
+    if err != nil {
+        return nil, err
+    }
+    var lastErr error = ErrNoServersForId
+    for _, addr := range known {
+        resp := raft.ClientResponse{}
+        send_err := raft.SendSingletonRequestToCluster([]raft.ServerAddress{addr}, data, &resp)
+        if req_err := requestError(send_err, &resp); req_err != nil {
+            lastErr = req_err
+            continue
+        }
+        var response MastersResponse
+        if unmarshal_err := json.Unmarshal(resp.ResponseData, &response); unmarshal_err != nil || response.Err != nil || len(response.MasterCluster) == 0 {
+            lastErr = ErrInvalidResponse
+            continue
+        }
+        return response.MasterCluster, nil
+    }
+    return nil, lastErr
+}
+
+/* Worker side. */
+
+func (w *WorkerFSM) setMasterCluster(masters []raft.ServerAddress) {
+    w.FsmLock.Lock()
+    defer w.FsmLock.Unlock()
+    if len(masters) == 0 {
+        return
+    }
+    w.MasterCluster = masters
+    w.SessionLock.Lock()
+    w.MasterSession = nil
+    w.SessionLock.Unlock()
+}
+
+/* Ask known masters for the current ones and, if they changed, record them
+   through raft. Only works on the leader. Returns true if they changed. */
+func (w *WorkerFSM) refreshMasters() bool {
+    w.FsmLock.RLock()
+    known := w.MasterCluster
+    r := w.raft
+    w.FsmLock.RUnlock()
+    masters, err := askForMasters(known)
+    if err != nil || sameAddrs(masters, known) || r == nil {
+        return false
+    }
+    args := make(map[string]string)
+    args[FunctionKey] = SetMasterClusterCommand
+    args[ServerAddrsKey] = addr_array_to_string(masters)
+    command, json_err := json.Marshal(args)
+    if json_err != nil {
+        return false
+    }
+    return r.Apply(command, MembershipTimeout).Error() == nil
+}
+
+/* Master side. */
+
+func (m *MasterFSM) masters() MastersResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    return MastersResponse{m.MasterCluster, Success}
+}
+
+/* Check change to master servers, then have raft make it and record the new
+   servers. */
+func (m *MasterFSM) changeMasterMembership(addr raft.ServerAddress, add bool) ([]func() [][]byte, *MembershipResponse) {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    response := &MembershipResponse{m.MasterCluster, Success}
+    if checkAddress(addr) != nil {
+        response.Err = ErrInvalidRequest
+        return []func() [][]byte{}, response
+    }
+    if add {
+        if m.serverInUse(addr) {
+            response.Err = ErrServerInUse
+            return []func() [][]byte{}, response
+        }
+        if len(m.MasterCluster) + 1 > MaxGroupSize {
+            response.Err = ErrGroupSize
+            return []func() [][]byte{}, response
+        }
+    } else {
+        if !containsAddr(m.MasterCluster, addr) {
+            response.Err = ErrNoSuchServer
+            return []func() [][]byte{}, response
+        }
+        if len(m.MasterCluster) - 1 < 1 {
+            response.Err = ErrGroupSize
+            return []func() [][]byte{}, response
+        }
+    }
+    r := m.raft
+    f := func() [][]byte {
+        var future raft.IndexFuture
+        if add {
+            future = r.AddVoter(serverID(addr), addr, 0, MembershipTimeout)
+        } else {
+            future = r.RemoveServer(serverID(addr), 0, MembershipTimeout)
+        }
+        if err := future.Error(); err != nil {
+            response.Err = membershipError(err)
+            return [][]byte{}
+        }
+        masters, err := configuredServers(r)
+        if err != nil {
+            response.Err = membershipError(err)
+            return [][]byte{}
+        }
+        response.ServerAddrs = masters
+        command, json_err := masterMembersCommand(masters)
+        if json_err != nil {
+            return [][]byte{}
+        }
+        return [][]byte{command}
+    }
+    return []func() [][]byte{f}, response
+}
+
+func (m *MasterFSM) setMasterMembers(masters []raft.ServerAddress) MembershipResponse {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if len(masters) == 0 {
+        return MembershipResponse{m.MasterCluster, ErrInvalidRequest}
+    }
+    m.MasterCluster = masters
+    return MembershipResponse{masters, Success}
+}
+
+func masterMembersCommand(masters []raft.ServerAddress) ([]byte, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = MasterMembersCommand
+    args[ServerAddrsKey] = addr_array_to_string(masters)
+    return json.Marshal(args)
+}
+
+/* While leader, record raft's servers in MasterCluster and this master's
+   rebalance policy and transfer settings in Policy and Settings if they
+   differ, and push MasterCluster to each replica group once per term of
+   leadership and after every change. */
+func (m *MasterFSM) masterSyncLoop(r *raft.Raft, stop chan struct{}) {
+    pushed := make(map[ReplicaGroupId][]raft.ServerAddress)
+    caughtUp := false
+    ticker := time.NewTicker(MasterSyncInterval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-stop:
+                return
+            case <-ticker.C:
+        }
+        if r.State() != raft.Leader {
+            pushed = make(map[ReplicaGroupId][]raft.ServerAddress)
+            caughtUp = false
+            continue
+        }
+        if !caughtUp {
+            /* MasterCluster is only current once earlier entries are applied. */
+            if r.Barrier(MasterSyncInterval).Error() != nil {
+                continue
+            }
+            caughtUp = true
+        }
+        configured, err := configuredServers(r)
+        if err != nil {
+            continue
+        }
+        m.FsmLock.RLock()
+        masters := m.MasterCluster
+        groups := m.sortedGroups()
+        policy := m.Policy
+        settings := m.Settings
+        m.FsmLock.RUnlock()
+        if spec, err := specOf(m.configuredPolicy); err == nil && !spec.equal(policy) {
+            command, json_err := rebalancePolicyCommand(spec)
+            if json_err == nil {
+                r.Apply(command, MasterSyncInterval)
+            }
+        }
+        if settings != m.configuredSettings {
+            command, json_err := transferSettingsCommand(m.configuredSettings)
+            if json_err == nil {
+                r.Apply(command, MasterSyncInterval)
+            }
+        }
+        if !sameAddrs(configured, masters) {
+            command, json_err := masterMembersCommand(configured)
+            if json_err != nil || r.Apply(command, MasterSyncInterval).Error() != nil {
+                continue
+            }
+            masters = configured
+        }
+        for _, replicaGroup := range groups {
+            if !sameAddrs(pushed[replicaGroup], masters) && m.pushMasterCluster(replicaGroup, masters) == nil {
+                pushed[replicaGroup] = masters
+            }
+        }
+    }
+}
+
+func (m *MasterFSM) pushMasterCluster(replicaGroup ReplicaGroupId, masters []raft.ServerAddress) error {
+    args := make(map[string]string)
+    args[FunctionKey] = SetMasterClusterCommand
+    args[ServerAddrsKey] = addr_array_to_string(masters)
+    return m.genericClusterRequest(replicaGroup, args, &raft.ClientResponse{}, raft.NoTrace)
+}
+
+/* Client side. */
+
+/* Send request to master cluster. If it can't be reached, ask each known
+   master for the current servers and, if they changed, try again. */
+func (lc *LockClient) sendToMasters(data []byte, resp *raft.ClientResponse) error {
+    send_err := raft.SendSingletonRequestToClusterWithTrace(lc.masterServers, data, resp, lc.trace)
+    if send_err != nil && lc.refreshMasters() {
+        countClientRetry("masters_changed")
+        send_err = raft.SendSingletonRequestToClusterWithTrace(lc.masterServers, data, resp, lc.trace)
+    }
+    return send_err
+}
+
+/* Returns true if the known master servers changed. */
+func (lc *LockClient) refreshMasters() bool {
+    known := lc.masterServers
+    masters, err := lc.RefreshMasters()
+    return err == nil && !sameAddrs(masters, known)
+}
+
+/* Ask any reachable master for the current master servers. */
+func (lc *LockClient) RefreshMasters() ([]raft.ServerAddress, error) {
+    masters, err := askForMasters(lc.masterServers)
+    if err != nil {
+        return lc.masterServers, err
+    }
+    lc.masterServers = masters
+    return masters, nil
+}
+
+func (lc *LockClient) masterMembershipRequest(function string, addr raft.ServerAddress) ([]raft.ServerAddress, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = function
+    args[ServerAddrKey] = string(addr)
+    var response MembershipResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    if err == nil && len(response.ServerAddrs) > 0 {
+        lc.masterServers = response.ServerAddrs
+    }
+    return response.ServerAddrs, err
+}
+
+/* Add running server to the master cluster. Returns the master servers. */
+func (lc *LockClient) AddMasterServer(addr raft.ServerAddress) ([]raft.ServerAddress, error) {
+    return lc.masterMembershipRequest(AddMasterCommand, addr)
+}
+
+/* Remove server from the master cluster. Returns the master servers. */
+func (lc *LockClient) RemoveMasterServer(addr raft.ServerAddress) ([]raft.ServerAddress, error) {
+    return lc.masterMembershipRequest(RemoveMasterCommand, addr)
+}
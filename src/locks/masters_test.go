@@ -0,0 +1,114 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func testTransport(t *testing.T) *raft.NetworkTransport {
+    trans, err := raft.NewTCPTransport("127.0.0.1:0", nil, 2, time.Second, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return trans
+}
+
+/* Address nothing listens on. */
+func closedAddr(t *testing.T) raft.ServerAddress {
+    trans := testTransport(t)
+    addr := trans.LocalAddr()
+    trans.Close()
+    return addr
+}
+
+/* Have master at trans answer every request with response. */
+/* Answer every request sent to trans with what respond returns for it. */
+func serveResponses(trans *raft.NetworkTransport, respond func(req *raft.ClientRequest) interface{}) {
+    go func() {
+        for rpc := range trans.Consumer() {
+            req, _ := rpc.Command.(*raft.ClientRequest)
+            data, _ := json.Marshal(respond(req))
+            rpc.Respond(&raft.ClientResponse{Success: true, ResponseData: data}, nil)
+        }
+    }()
+}
+
+func serveMasters(trans *raft.NetworkTransport, response MastersResponse) {
+    serveResponses(trans, func(*raft.ClientRequest) interface{} { return response })
+}
+
+func fakeMaster(t *testing.T, response MastersResponse) *raft.NetworkTransport {
+    trans := testTransport(t)
+    serveMasters(trans, response)
+    return trans
+}
+
+func TestAskForMastersTriesEachKnownMaster(t *testing.T) {
+    current := []raft.ServerAddress{"m:4", "m:5", "m:6"}
+    master := fakeMaster(t, MastersResponse{current, Success})
+    defer master.Close()
+    masters, err := askForMasters([]raft.ServerAddress{closedAddr(t), master.LocalAddr()})
+    if err != nil || !reflect.DeepEqual(masters, current) {
+        t.Fatalf("got %v, %v, want %v", masters, err, current)
+    }
+    if _, err := askForMasters([]raft.ServerAddress{closedAddr(t)}); err == nil {
+        t.Fatalf("no master reachable, but got an answer")
+    }
+
+    confused := fakeMaster(t, MastersResponse{nil, Success})
+    defer confused.Close()
+    if _, err := askForMasters([]raft.ServerAddress{confused.LocalAddr()}); err != ErrInvalidResponse {
+        t.Fatalf("empty master list accepted: %v", err)
+    }
+}
+
+func TestClientRefreshesMasters(t *testing.T) {
+    master := testTransport(t)
+    defer master.Close()
+    current := []raft.ServerAddress{master.LocalAddr(), "m:5", "m:6"}
+    serveMasters(master, MastersResponse{current, Success})
+    lc := &LockClient{masterServers: []raft.ServerAddress{closedAddr(t), master.LocalAddr()}}
+    if !lc.refreshMasters() || !reflect.DeepEqual(lc.masterServers, current) {
+        t.Fatalf("masters not refreshed: %v", lc.masterServers)
+    }
+    if lc.refreshMasters() || !reflect.DeepEqual(lc.masterServers, current) {
+        t.Fatalf("refresh reported a change when masters are the same")
+    }
+    lc.masterServers = []raft.ServerAddress{closedAddr(t)}
+    if lc.refreshMasters() || len(lc.masterServers) != 1 {
+        t.Fatalf("unreachable masters replaced: %v", lc.masterServers)
+    }
+}
+
+func TestWorkerSetMasterCluster(t *testing.T) {
+    w := testWorker()
+    w.MasterSession = &raft.Session{}
+    w.setMasterCluster(nil)
+    if len(w.MasterCluster) != 3 || w.MasterSession == nil {
+        t.Fatalf("empty master list recorded")
+    }
+    current := []raft.ServerAddress{"m:4", "m:5", "m:6"}
+    w.setMasterCluster(current)
+    if !reflect.DeepEqual(w.MasterCluster, current) || w.MasterSession != nil {
+        t.Fatalf("masters not recorded or old session kept: %v", w.MasterCluster)
+    }
+}
+
+func TestMasterMembersCommand(t *testing.T) {
+    m := testMaster()
+    current := []raft.ServerAddress{"m:1", "m:2", "m:4"}
+    command, err := masterMembersCommand(current)
+    if err != nil {
+        t.Fatal(err)
+    }
+    response, _ := m.Apply(&raft.Log{Data: command})
+    if response.(MembershipResponse).Err != nil || !reflect.DeepEqual(m.MasterCluster, current) || !reflect.DeepEqual(m.masters().MasterCluster, current) {
+        t.Fatalf("masters not recorded: %v, %v", response, m.MasterCluster)
+    }
+    if response := m.setMasterMembers(nil); response.Err != ErrInvalidRequest || !reflect.DeepEqual(m.MasterCluster, current) {
+        t.Fatalf("empty master list recorded: %v", m.MasterCluster)
+    }
+}
@@ -0,0 +1,238 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "strconv"
+    "time"
+)
+
+/* Admin commands changing the servers of a replica group, e.g. to replace a
+   dead server. Master checks the change against its own view, asks the
+   group's leader to make it through raft, and then records the group's new
+   servers in ClusterMap, where clients and master's own requests find them.
+   Clusters start with 1, 3, 5 or 7 servers. Membership changes one server at
+   a time, so a replacement is added before the dead server is removed and a
+   group may briefly have an even number of servers. A new server must already
+   be running, started to join rather than bootstrap (see
+   ServerConfig.JoinCluster). */
+
+/* Most servers a replica group may have. */
+const MaxGroupSize = 7
+
+/* Time a leader waits for a membership change to be committed. */
+var MembershipTimeout time.Duration = 10 * time.Second
+
+type MembershipResponse struct {
+    /* Servers of the replica group after the change. */
+    ServerAddrs     []raft.ServerAddress
+    Err             *LockError
+}
+
+/* True if a cluster may start with n servers. Raft tolerates the failure of a
+   minority, so an even size tolerates no more failures than the odd size
+   below it. */
+func allowedClusterSize(n int) bool {
+    return n >= 1 && n <= MaxGroupSize && n % 2 == 1
+}
+
+func containsAddr(addrs []raft.ServerAddress, addr raft.ServerAddress) bool {
+    for _, a := range addrs {
+        if a == addr {
+            return true
+        }
+    }
+    return false
+}
+
+/* Failure reported by raft while changing its configuration. */
+func membershipError(err error) *LockError {
+    return &LockError{Code: CodeMembershipChange, Message: ErrMembershipChange.Message + ": " + err.Error(), Retryable: true}
+}
+
+/* Addresses of the voters in raft's latest configuration. */
+func configuredServers(r *raft.Raft) ([]raft.ServerAddress, error) {
+    future := r.GetConfiguration()
+    if err := future.Error(); err != nil {
+        return nil, err
+    }
+    servers := make([]raft.ServerAddress, 0)
+    for _, server := range future.Configuration().Servers {
+        if server.Suffrage == raft.Voter {
+            servers = append(servers, server.Address)
+        }
+    }
+    return servers, nil
+}
+
+/* Worker side. */
+
+/* Have raft add or remove server. Only the leader can, so the change is made
+   in a callback; the response carries its outcome. */
+func (w *WorkerFSM) changeMembership(addr raft.ServerAddress, add bool) ([]func() [][]byte, *MembershipResponse) {
+    response := &MembershipResponse{Err: Success}
+    f := func() [][]byte {
+        w.FsmLock.RLock()
+        r := w.raft
+        w.FsmLock.RUnlock()
+        var future raft.IndexFuture
+        if add {
+            future = r.AddVoter(serverID(addr), addr, 0, MembershipTimeout)
+        } else {
+            future = r.RemoveServer(serverID(addr), 0, MembershipTimeout)
+        }
+        if err := future.Error(); err != nil {
+            response.Err = membershipError(err)
+            return [][]byte{}
+        }
+        serverAddrs, err := configuredServers(r)
+        if err != nil {
+            response.Err = membershipError(err)
+            return [][]byte{}
+        }
+        response.ServerAddrs = serverAddrs
+        return [][]byte{}
+    }
+    return []func() [][]byte{f}, response
+}
+
+/* Master side. */
+
+/* Check membership change against master's view, then have replica group make
+   it and record the group's new servers. Server being added must not belong
+   to any other cluster master knows of. */
+func (m *MasterFSM) changeGroupMembership(replicaGroup ReplicaGroupId, addr raft.ServerAddress, add bool) ([]func() [][]byte, *MembershipResponse) {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    response := &MembershipResponse{Err: Success}
+    serverAddrs, ok := m.ClusterMap[replicaGroup]
+    if !ok {
+        response.Err = ErrNoSuchGroup
+        return []func() [][]byte{}, response
+    }
+    response.ServerAddrs = serverAddrs
+    if checkAddress(addr) != nil {
+        response.Err = ErrInvalidRequest
+        return []func() [][]byte{}, response
+    }
+    if add {
+        if m.serverInUse(addr) {
+            response.Err = ErrServerInUse
+            return []func() [][]byte{}, response
+        }
+        if len(serverAddrs) + 1 > MaxGroupSize {
+            response.Err = ErrGroupSize
+            return []func() [][]byte{}, response
+        }
+    } else {
+        if !containsAddr(serverAddrs, addr) {
+            response.Err = ErrNoSuchServer
+            return []func() [][]byte{}, response
+        }
+        if len(serverAddrs) - 1 < 1 {
+            response.Err = ErrGroupSize
+            return []func() [][]byte{}, response
+        }
+    }
+    f := func() [][]byte {
+        newAddrs, err := m.askWorkerToChangeMembership(replicaGroup, addr, add)
+        if err != nil {
+            response.Err = asLockError(err)
+            return [][]byte{}
+        }
+        args := make(map[string]string)
+        args[FunctionKey] = GroupMembersCommand
+        args[GroupArgKey] = strconv.Itoa(int(replicaGroup))
+        args[ServerAddrsKey] = addr_array_to_string(newAddrs)
+        command, json_err := json.Marshal(args)
+        if json_err != nil {
+            return [][]byte{}
+        }
+        return [][]byte{command}
+    }
+    return []func() [][]byte{f}, response
+}
+
+/* True if server belongs to a master, replica group or waiting cluster.
+   Assumes FSM already locked. */
+func (m *MasterFSM) serverInUse(addr raft.ServerAddress) bool {
+    if containsAddr(m.MasterCluster, addr) {
+        return true
+    }
+    for _, serverAddrs := range m.ClusterMap {
+        if containsAddr(serverAddrs, addr) {
+            return true
+        }
+    }
+    for i := int(m.NextReplicaGroupId); i < len(m.RecruitAddrs); i++ {
+        if containsAddr(m.RecruitAddrs[i].Addrs, addr) {
+            return true
+        }
+    }
+    return false
+}
+
+/* Record servers of replica group after a membership change. The cached
+   session to the group is dropped so the next request uses them. */
+func (m *MasterFSM) setGroupMembers(replicaGroup ReplicaGroupId, serverAddrs []raft.ServerAddress) MembershipResponse {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if _, ok := m.ClusterMap[replicaGroup]; !ok {
+        return MembershipResponse{nil, ErrNoSuchGroup}
+    }
+    if len(serverAddrs) == 0 {
+        return MembershipResponse{m.ClusterMap[replicaGroup], ErrInvalidRequest}
+    }
+    m.ClusterMap[replicaGroup] = serverAddrs
+    m.SessionLock.Lock()
+    delete(m.WorkerSessionMap, replicaGroup)
+    m.SessionLock.Unlock()
+    return MembershipResponse{serverAddrs, Success}
+}
+
+func (m *MasterFSM) askWorkerToChangeMembership(replicaGroup ReplicaGroupId, addr raft.ServerAddress, add bool) ([]raft.ServerAddress, error) {
+    args := make(map[string]string)
+    if add {
+        args[FunctionKey] = AddServerCommand
+    } else {
+        args[FunctionKey] = RemoveServerCommand
+    }
+    args[ServerAddrKey] = string(addr)
+    resp := raft.ClientResponse{}
+    if err := m.genericClusterRequest(replicaGroup, args, &resp, raft.NoTrace); err != nil {
+        return nil, err
+    }
+    var response MembershipResponse
+    if unmarshal_err := json.Unmarshal(resp.ResponseData, &response); unmarshal_err != nil {
+        return nil, ErrNotApplied
+    }
+    if response.Err != nil {
+        return nil, response.Err
+    }
+    return response.ServerAddrs, nil
+}
+
+/* Client side. */
+
+func (lc *LockClient) membershipRequest(function string, replicaGroup ReplicaGroupId, addr raft.ServerAddress) ([]raft.ServerAddress, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = function
+    args[GroupArgKey] = strconv.Itoa(int(replicaGroup))
+    args[ServerAddrKey] = string(addr)
+    var response MembershipResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    if err == nil {
+        lc.forgetGroupServers(replicaGroup)
+    }
+    return response.ServerAddrs, err
+}
+
+/* Add running server to replica group. Returns the group's servers. */
+func (lc *LockClient) AddGroupServer(replicaGroup ReplicaGroupId, addr raft.ServerAddress) ([]raft.ServerAddress, error) {
+    return lc.membershipRequest(AddGroupServerCommand, replicaGroup, addr)
+}
+
+/* Remove server from replica group. Returns the group's servers. */
+func (lc *LockClient) RemoveGroupServer(replicaGroup ReplicaGroupId, addr raft.ServerAddress) ([]raft.ServerAddress, error) {
+    return lc.membershipRequest(RemoveGroupServerCommand, replicaGroup, addr)
+}
@@ -0,0 +1,78 @@
+package locks
+
+import(
+    "raft"
+    "reflect"
+    "testing"
+)
+
+func TestAllowedClusterSize(t *testing.T) {
+    for n := -1; n <= MaxGroupSize + 2; n++ {
+        want := n == 1 || n == 3 || n == 5 || n == 7
+        if allowedClusterSize(n) != want {
+            t.Errorf("allowedClusterSize(%d) = %v", n, !want)
+        }
+    }
+}
+
+func TestChangeGroupMembershipChecks(t *testing.T) {
+    tests := []struct {
+        name    string
+        group   ReplicaGroupId
+        addr    raft.ServerAddress
+        add     bool
+        err     *LockError
+    }{
+        {"unknown group", 7, "w9:1", true, ErrNoSuchGroup},
+        {"bad address", 0, "w9", true, ErrInvalidRequest},
+        {"add master", 0, "m:1", true, ErrServerInUse},
+        {"add server of other group", 0, "w1:2", true, ErrServerInUse},
+        {"add waiting server", 0, "w3:1", true, ErrServerInUse},
+        {"add new server", 0, "w9:1", true, Success},
+        {"remove unknown server", 0, "w9:1", false, ErrNoSuchServer},
+        {"remove server", 0, "w0:2", false, Success},
+    }
+    for _, test := range tests {
+        m := poolMaster()
+        callbacks, response := m.changeGroupMembership(test.group, test.addr, test.add)
+        if response.Err != test.err {
+            t.Errorf("%s: got %v, want %v", test.name, response.Err, test.err)
+        }
+        if (test.err == Success) != (len(callbacks) == 1) {
+            t.Errorf("%s: got %d callbacks", test.name, len(callbacks))
+        }
+    }
+}
+
+func TestChangeGroupMembershipKeepsGroupSize(t *testing.T) {
+    m := poolMaster()
+    m.ClusterMap[0] = workerAddrs("w0", MaxGroupSize)
+    if _, response := m.changeGroupMembership(0, "w9:1", true); response.Err != ErrGroupSize {
+        t.Fatalf("group grew past %d servers: %v", MaxGroupSize, response.Err)
+    }
+    m.ClusterMap[0] = workerAddrs("w0", 1)
+    if _, response := m.changeGroupMembership(0, "w0:1", false); response.Err != ErrGroupSize {
+        t.Fatalf("last server removed: %v", response.Err)
+    }
+}
+
+func TestSetGroupMembers(t *testing.T) {
+    m := poolMaster()
+    m.WorkerSessionMap = map[ReplicaGroupId]*raft.Session{0: {}, 1: {}}
+    if response := m.setGroupMembers(7, workerAddrs("w9", 3)); response.Err != ErrNoSuchGroup {
+        t.Fatalf("unknown group: got %v", response.Err)
+    }
+    if response := m.setGroupMembers(0, nil); response.Err != ErrInvalidRequest || !sameAddrs(m.ClusterMap[0], workerAddrs("w0", 3)) {
+        t.Fatalf("group emptied: %v, %v", response.Err, m.ClusterMap[0])
+    }
+    servers := []raft.ServerAddress{"w0:1", "w0:3", "w9:1"}
+    if response := m.setGroupMembers(0, servers); response.Err != nil || !reflect.DeepEqual(m.ClusterMap[0], servers) {
+        t.Fatalf("servers not recorded: %v, %v", response.Err, m.ClusterMap[0])
+    }
+    if _, ok := m.WorkerSessionMap[0]; ok {
+        t.Fatalf("session to old servers kept")
+    }
+    if _, ok := m.WorkerSessionMap[1]; !ok {
+        t.Fatalf("session to other group dropped")
+    }
+}
@@ -0,0 +1,283 @@
+package locks
+
+import(
+    "raft"
+    "fmt"
+    "io"
+    "net"
+    "net/http"
+    "reflect"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/armon/go-metrics"
+)
+
+/* Metrics emitted through go-metrics, next to raft's own. Masters and workers
+   count only while leader, so a process running a whole cluster reports each
+   event once. Times are in milliseconds.
+     locks.master.op, locks.worker.op      commands applied, by op and result
+     locks.master.locks, .groups, .recalcitrant_locks
+     locks.worker.locks, .held_locks, .sessions, .recalcitrant_locks
+     locks.master.rebalance.started, .completed
+     locks.master.transfer.duration        planned to disowned, in FSM time
+     locks.client.request                  latency, by op
+     locks.client.retries                  by reason
+     locks.client.locate_cache             lookups, by result (hit, ring, miss) */
+
+/* Sink keeping running totals of every metric, written out in Prometheus text
+   format. Counters and samples never reset; samples are reported as summaries
+   with a count and sum. */
+type PrometheusSink struct {
+    lock        sync.Mutex
+    gauges      map[string]*promSeries
+    counters    map[string]*promSeries
+    summaries   map[string]*promSeries
+}
+
+type promSeries struct {
+    name    string
+    labels  string
+    value   float64
+    count   uint64
+}
+
+func NewPrometheusSink() *PrometheusSink {
+    return &PrometheusSink{
+        gauges:     make(map[string]*promSeries),
+        counters:   make(map[string]*promSeries),
+        summaries:  make(map[string]*promSeries),
+    }
+}
+
+/* Send go-metrics from the whole process to a new Prometheus sink and serve it
+   at http://addr/metrics. Returns an error, leaving metrics as they were, if
+   addr can't be listened on. Logger may be nil, in which case the default
+   logger is used. */
+func ServeMetrics(addr string, logger raft.Logger) (*PrometheusSink, error) {
+    if logger == nil {
+        logger = raft.DefaultLogger()
+    }
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        return nil, err
+    }
+    sink := NewPrometheusSink()
+    conf := metrics.DefaultConfig("")
+    conf.EnableHostname = false
+    if _, err := metrics.NewGlobal(conf, sink); err != nil {
+        listener.Close()
+        return nil, err
+    }
+    mux := http.NewServeMux()
+    mux.Handle("/metrics", sink)
+    server := &http.Server{Handler: mux}
+    go func() {
+        if err := server.Serve(listener); err != nil {
+            logger.Error("metrics server stopped", "addr", listener.Addr(), "error", err)
+        }
+    }()
+    return sink, nil
+}
+
+func (s *PrometheusSink) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    s.WriteTo(w)
+}
+
+/* Write every metric in Prometheus text format, sorted by name. */
+func (s *PrometheusSink) WriteTo(w io.Writer) (int64, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    var b strings.Builder
+    writeFamily := func(kind string, series map[string]*promSeries, write func(*promSeries)) {
+        byName := make(map[string][]*promSeries)
+        for _, ps := range series {
+            byName[ps.name] = append(byName[ps.name], ps)
+        }
+        names := make([]string, 0)
+        for name := range byName {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            family := byName[name]
+            sort.Slice(family, func(i, j int) bool { return family[i].labels < family[j].labels })
+            fmt.Fprintf(&b, "# TYPE %s %s\n", name, kind)
+            for _, ps := range family {
+                write(ps)
+            }
+        }
+    }
+    writeFamily("gauge", s.gauges, func(ps *promSeries) {
+        fmt.Fprintf(&b, "%s%s %g\n", ps.name, ps.labels, ps.value)
+    })
+    writeFamily("counter", s.counters, func(ps *promSeries) {
+        fmt.Fprintf(&b, "%s%s %g\n", ps.name, ps.labels, ps.value)
+    })
+    writeFamily("summary", s.summaries, func(ps *promSeries) {
+        fmt.Fprintf(&b, "%s_sum%s %g\n", ps.name, ps.labels, ps.value)
+        fmt.Fprintf(&b, "%s_count%s %d\n", ps.name, ps.labels, ps.count)
+    })
+    n, err := io.WriteString(w, b.String())
+    return int64(n), err
+}
+
+func (s *PrometheusSink) series(m map[string]*promSeries, key []string, labels []metrics.Label) *promSeries {
+    name := promName(strings.Join(key, "_"))
+    labelStr := promLabels(labels)
+    id := name + labelStr
+    ps, ok := m[id]
+    if !ok {
+        ps = &promSeries{name: name, labels: labelStr}
+        m[id] = ps
+    }
+    return ps
+}
+
+func (s *PrometheusSink) SetGauge(key []string, val float32) {
+    s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *PrometheusSink) SetGaugeWithLabels(key []string, val float32, labels []metrics.Label) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.series(s.gauges, key, labels).value = float64(val)
+}
+
+/* Key/value pairs have no Prometheus equivalent; kept as gauges. */
+func (s *PrometheusSink) EmitKey(key []string, val float32) {
+    s.SetGaugeWithLabels(key, val, nil)
+}
+
+func (s *PrometheusSink) IncrCounter(key []string, val float32) {
+    s.IncrCounterWithLabels(key, val, nil)
+}
+
+func (s *PrometheusSink) IncrCounterWithLabels(key []string, val float32, labels []metrics.Label) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.series(s.counters, key, labels).value += float64(val)
+}
+
+func (s *PrometheusSink) AddSample(key []string, val float32) {
+    s.AddSampleWithLabels(key, val, nil)
+}
+
+func (s *PrometheusSink) AddSampleWithLabels(key []string, val float32, labels []metrics.Label) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    ps := s.series(s.summaries, key, labels)
+    ps.value += float64(val)
+    ps.count++
+}
+
+/* Replace characters Prometheus doesn't allow in names. */
+func promName(name string) string {
+    return strings.Map(func(r rune) rune {
+        if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' || r == ':' {
+            return r
+        }
+        return '_'
+    }, name)
+}
+
+func promLabels(labels []metrics.Label) string {
+    if len(labels) == 0 {
+        return ""
+    }
+    pairs := make([]string, 0)
+    for _, label := range labels {
+        value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(label.Value)
+        pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", promName(label.Name), value))
+    }
+    sort.Strings(pairs)
+    return "{" + strings.Join(pairs, ",") + "}"
+}
+
+/* Helpers for the lock service. */
+
+/* Result label of a response: "error" if its Err field is set, else "ok". */
+func opResult(response interface{}) string {
+    v := reflect.Indirect(reflect.ValueOf(response))
+    if !v.IsValid() || v.Kind() != reflect.Struct {
+        return "ok"
+    }
+    f := v.FieldByName("Err")
+    if f.IsValid() && f.Kind() == reflect.Ptr && !f.IsNil() {
+        return "error"
+    }
+    return "ok"
+}
+
+func isLeader(r *raft.Raft) bool {
+    return r != nil && r.State() == raft.Leader
+}
+
+func recordOp(role string, function string, response interface{}) {
+    if function == "" {
+        return
+    }
+    metrics.IncrCounterWithLabels([]string{"locks", role, "op"}, 1, []metrics.Label{{Name: "op", Value: function}, {Name: "result", Value: opResult(response)}})
+}
+
+/* Record client request latency by op. */
+func measureClientRequest(function string, start time.Time) {
+    metrics.MeasureSinceWithLabels([]string{"locks", "client", "request"}, start, []metrics.Label{{Name: "op", Value: function}})
+}
+
+func countClientRetry(reason string) {
+    metrics.IncrCounterWithLabels([]string{"locks", "client", "retries"}, 1, []metrics.Label{{Name: "reason", Value: reason}})
+}
+
+func countLocateLookup(result string) {
+    metrics.IncrCounterWithLabels([]string{"locks", "client", "locate_cache"}, 1, []metrics.Label{{Name: "result", Value: result}})
+}
+
+/* Worker side. */
+
+/* Count applied command, while leader. */
+func (w *WorkerFSM) recordApply(function string, response interface{}) {
+    w.FsmLock.RLock()
+    r := w.raft
+    w.FsmLock.RUnlock()
+    if isLeader(r) {
+        recordOp("worker", function, response)
+    }
+}
+
+/* Report measured load. Only called on the leader. */
+func (w *WorkerFSM) recordLoad(load WorkerLoad, recalcitrant int) {
+    metrics.SetGauge([]string{"locks", "worker", "locks"}, float32(load.NumLocks))
+    metrics.SetGauge([]string{"locks", "worker", "held_locks"}, float32(load.NumHeld))
+    metrics.SetGauge([]string{"locks", "worker", "sessions"}, float32(load.NumSessions))
+    metrics.SetGauge([]string{"locks", "worker", "recalcitrant_locks"}, float32(recalcitrant))
+}
+
+/* Master side. */
+
+/* Count applied command and report master's view, while leader. */
+func (m *MasterFSM) recordApply(function string, response interface{}) {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    if !isLeader(m.raft) {
+        return
+    }
+    recordOp("master", function, response)
+    metrics.SetGauge([]string{"locks", "master", "locks"}, float32(len(m.LockMap)))
+    metrics.SetGauge([]string{"locks", "master", "groups"}, float32(len(m.ClusterMap)))
+    metrics.SetGauge([]string{"locks", "master", "recalcitrant_locks"}, float32(len(m.RecalcitrantDestMap)))
+}
+
+/* Assumes FSM already locked. */
+func (m *MasterFSM) recordTransferDone(t Transfer) {
+    if !isLeader(m.raft) {
+        return
+    }
+    metrics.IncrCounter([]string{"locks", "master", "rebalance", "completed"}, 1)
+    if !t.Started.IsZero() {
+        metrics.AddSample([]string{"locks", "master", "transfer", "duration"}, float32(m.Clock.Sub(t.Started)) / float32(time.Millisecond))
+    }
+}
@@ -0,0 +1,151 @@
+package locks
+
+import(
+    "raft"
+    "io/ioutil"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "github.com/armon/go-metrics"
+)
+
+func TestPrometheusSinkFormat(t *testing.T) {
+    sink := NewPrometheusSink()
+    sink.IncrCounterWithLabels([]string{"locks", "master", "op"}, 1, []metrics.Label{{Name: "result", Value: "ok"}, {Name: "op", Value: "create"}})
+    sink.IncrCounterWithLabels([]string{"locks", "master", "op"}, 2, []metrics.Label{{Name: "op", Value: "create"}, {Name: "result", Value: "ok"}})
+    sink.IncrCounterWithLabels([]string{"locks", "master", "op"}, 1, []metrics.Label{{Name: "op", Value: "delete"}, {Name: "result", Value: "error"}})
+    sink.SetGauge([]string{"locks", "worker", "locks"}, 4)
+    sink.SetGauge([]string{"locks", "worker", "locks"}, 3)
+    sink.EmitKey([]string{"raft.state", "leader-ish"}, 1)
+    sink.AddSample([]string{"locks", "client", "request"}, 2.5)
+    sink.AddSample([]string{"locks", "client", "request"}, 1.5)
+    sink.IncrCounterWithLabels([]string{"odd"}, 1, []metrics.Label{{Name: "path", Value: "a\"b\\c\nd"}})
+
+    var b strings.Builder
+    sink.WriteTo(&b)
+    want := `# TYPE locks_worker_locks gauge
+locks_worker_locks 3
+# TYPE raft_state_leader_ish gauge
+raft_state_leader_ish 1
+# TYPE locks_master_op counter
+locks_master_op{op="create",result="ok"} 3
+locks_master_op{op="delete",result="error"} 1
+# TYPE odd counter
+odd{path="a\"b\\c\nd"} 1
+# TYPE locks_client_request summary
+locks_client_request_sum 4
+locks_client_request_count 2
+`
+    if b.String() != want {
+        t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+    }
+
+    recorder := httptest.NewRecorder()
+    sink.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+    if recorder.Body.String() != want || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") {
+        t.Fatalf("served %q as %q", recorder.Body.String(), recorder.Header().Get("Content-Type"))
+    }
+}
+
+func TestOpResult(t *testing.T) {
+    tests := []struct {
+        response    interface{}
+        want        string
+    }{
+        {nil, "ok"},
+        {"not a response", "ok"},
+        {RevokeResponse{Success}, "ok"},
+        {RevokeResponse{ErrLockDoesntExist}, "error"},
+        {&RevokeResponse{ErrLockDoesntExist}, "error"},
+        {&MembershipResponse{Err: Success}, "ok"},
+        {struct{ Err string }{"not a LockError"}, "ok"},
+    }
+    for _, test := range tests {
+        if got := opResult(test.response); got != test.want {
+            t.Errorf("opResult(%#v) = %s, want %s", test.response, got, test.want)
+        }
+    }
+}
+
+func TestRecordOpCountsByResult(t *testing.T) {
+    sink := NewPrometheusSink()
+    conf := metrics.DefaultConfig("")
+    conf.EnableHostname = false
+    conf.EnableRuntimeMetrics = false
+    if _, err := metrics.NewGlobal(conf, sink); err != nil {
+        t.Fatal(err)
+    }
+    defer metrics.NewGlobal(conf, &metrics.BlackholeSink{})
+    recordOp("worker", "acquire", RevokeResponse{Success})
+    recordOp("worker", "acquire", RevokeResponse{ErrLockDoesntExist})
+    recordOp("worker", "", RevokeResponse{Success})
+    countClientRetry("lock_moved")
+
+    var b strings.Builder
+    sink.WriteTo(&b)
+    for _, line := range []string{
+        `locks_worker_op{op="acquire",result="ok"} 1`,
+        `locks_worker_op{op="acquire",result="error"} 1`,
+        `locks_client_retries{reason="lock_moved"} 1`,
+    } {
+        if !strings.Contains(b.String(), line + "\n") {
+            t.Errorf("missing %s in\n%s", line, b.String())
+        }
+    }
+    if strings.Contains(b.String(), `op=""`) {
+        t.Errorf("op without a function counted")
+    }
+}
+
+func TestServeMetrics(t *testing.T) {
+    defer metrics.NewGlobal(metrics.DefaultConfig(""), &metrics.BlackholeSink{})
+    taken, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    addr := taken.Addr().String()
+    if _, err := ServeMetrics(addr, raft.NopLogger()); err == nil {
+        t.Fatalf("served metrics on an address in use")
+    }
+    taken.Close()
+
+    if _, err := ServeMetrics(addr, raft.NopLogger()); err != nil {
+        t.Fatal(err)
+    }
+    countClientRetry("served")
+    resp, err := http.Get("http://" + addr + "/metrics")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer resp.Body.Close()
+    body, _ := ioutil.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `locks_client_retries{reason="served"} 1`) {
+        t.Fatalf("got %d\n%s", resp.StatusCode, body)
+    }
+}
+
+func TestClusterStatusMeasured(t *testing.T) {
+    sink := NewPrometheusSink()
+    conf := metrics.DefaultConfig("")
+    conf.EnableHostname = false
+    conf.EnableRuntimeMetrics = false
+    if _, err := metrics.NewGlobal(conf, sink); err != nil {
+        t.Fatal(err)
+    }
+    defer metrics.NewGlobal(conf, &metrics.BlackholeSink{})
+    master := testTransport(t)
+    defer master.Close()
+    serveResponses(master, func(*raft.ClientRequest) interface{} { return ClusterStatusResponse{Err: Success} })
+    lc := &LockClient{masterServers: []raft.ServerAddress{master.LocalAddr()}, logger: raft.NopLogger()}
+    if _, err := lc.ClusterStatus(); err != nil {
+        t.Fatal(err)
+    }
+    var b strings.Builder
+    sink.WriteTo(&b)
+    if !strings.Contains(b.String(), `op="` + ClusterStatusCommand + `"`) {
+        t.Fatalf("cluster status not measured:\n%s", b.String())
+    }
+}
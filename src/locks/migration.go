@@ -0,0 +1,297 @@
+package locks
+
+import(
+    "raft"
+    "sort"
+    "strconv"
+)
+
+/* Admin commands to move locks to a chosen replica group, bypassing the
+   frequency heuristics. Moves reuse the rebalancing transfer: free locks are
+   disabled at the old group, claimed by the target and then disowned, while
+   held locks become recalcitrant and follow once released. Each move gets an
+   ID whose progress can be polled until every lock has landed. */
+
+/* Number of finished and unfinished moves remembered for progress queries. */
+const maxRememberedMoves = 100
+
+/* A manual move requested through MoveLocks or MoveDomain. */
+type LockMove struct {
+    MoveId      int
+    Target      ReplicaGroupId
+    Locks       []Lock
+}
+
+type MoveLocksResponse struct {
+    MoveId  int
+    Err     *LockError
+}
+
+type MoveProgressResponse struct {
+    MoveId      int
+    Target      ReplicaGroupId
+    /* Locks now stored at target. */
+    Landed      []Lock
+    /* Held locks that will move once released. */
+    Waiting     []Lock
+    /* Locks still being transferred. */
+    InFlight    []Lock
+    /* Locks since moved somewhere other than target. */
+    Elsewhere   []Lock
+    /* Locks deleted since move was requested. */
+    Deleted     []Lock
+    /* True once no lock is waiting or in flight. */
+    Done        bool
+    Err         *LockError
+}
+
+/* Master side. */
+
+func (m *MasterFSM) moveLocks(lockArr []Lock, target ReplicaGroupId) ([]func() [][]byte, MoveLocksResponse) {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if err := m.checkMoveTarget(target); err != nil {
+        return []func() [][]byte{}, MoveLocksResponse{-1, err}
+    }
+    return m.planMove(lockArr, target)
+}
+
+/* Move every lock directly inside domain to target and place new locks in the
+   domain there. */
+func (m *MasterFSM) moveDomain(d Domain, target ReplicaGroupId) ([]func() [][]byte, MoveLocksResponse) {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if len(string(d)) == 0 {
+        return []func() [][]byte{}, MoveLocksResponse{-1, ErrEmptyPath}
+    }
+    if string(d[0]) != "/" {
+        d = "/" + d
+    }
+    if _, ok := m.DomainPlacementMap[d]; !ok {
+        return []func() [][]byte{}, MoveLocksResponse{-1, ErrDomainDoesntExist}
+    }
+    if err := m.checkMoveTarget(target); err != nil {
+        return []func() [][]byte{}, MoveLocksResponse{-1, err}
+    }
+    if !m.placementAllowed(d, target) {
+        return []func() [][]byte{}, MoveLocksResponse{-1, ErrPlacementPolicy}
+    }
+    lockArr := make([]Lock, 0)
+    for _, l := range m.sortedLocks() {
+        if getParentDomain(string(l)) == d {
+            lockArr = append(lockArr, l)
+        }
+    }
+    callbacks, response := m.planMove(lockArr, target)
+    if response.Err == nil {
+        m.DomainPlacementMap[d] = []ReplicaGroupId{target}
+    }
+    return callbacks, response
+}
+
+/* Assumes FSM already locked. */
+func (m *MasterFSM) checkMoveTarget(target ReplicaGroupId) *LockError {
+    if _, ok := m.ClusterMap[target]; !ok {
+        return ErrNoSuchGroup
+    }
+    if m.RebalancingInProgress[target] {
+        return ErrRebalanceInProgress
+    }
+    if !m.isHealthy(target) {
+        return ErrGroupUnhealthy
+    }
+    if m.DrainingGroups[target] {
+        return ErrGroupDraining
+    }
+    return nil
+}
+
+/* Validate every lock before changing any state, then start one transfer per
+   source group. Assumes FSM already locked. */
+func (m *MasterFSM) planMove(lockArr []Lock, target ReplicaGroupId) ([]func() [][]byte, MoveLocksResponse) {
+    lockArr = uniqueLocks(lockArr)
+    bySource := make(map[ReplicaGroupId][]Lock)
+    redirected := make([]Lock, 0)
+    kept := make([]Lock, 0)
+    for _, l := range lockArr {
+        replicaGroup, ok := m.LockMap[l]
+        if !ok {
+            return []func() [][]byte{}, MoveLocksResponse{-1, ErrLockDoesntExist}
+        }
+        if !m.placementAllowed(getParentDomain(string(l)), target) {
+            return []func() [][]byte{}, MoveLocksResponse{-1, ErrPlacementPolicy}
+        }
+        if dest, recalcitrant := m.RecalcitrantDestMap[l]; recalcitrant {
+            if dest == NO_WORKER {
+                /* Lock is being deleted. */
+                return []func() [][]byte{}, MoveLocksResponse{-1, ErrLockDoesntExist}
+            }
+            /* Lock already waiting to move; change where it will land, or
+               keep it where it is if that is target. */
+            if replicaGroup == target {
+                kept = append(kept, l)
+            } else {
+                redirected = append(redirected, l)
+            }
+            continue
+        }
+        if replicaGroup == target {
+            continue
+        }
+        if m.RebalancingInProgress[replicaGroup] {
+            return []func() [][]byte{}, MoveLocksResponse{-1, ErrRebalanceInProgress}
+        }
+        bySource[replicaGroup] = append(bySource[replicaGroup], l)
+    }
+
+    for _, l := range redirected {
+        m.RecalcitrantDestMap[l] = target
+    }
+    callbacks := make([]func() [][]byte, 0)
+    if len(kept) > 0 {
+        for _, l := range kept {
+            delete(m.RecalcitrantDestMap, l)
+            delete(m.RevokeDeadlineMap, l)
+        }
+        trace := m.trace
+        callbacks = append(callbacks, func() [][]byte {
+            if err := m.askWorkerToKeepLocks(target, kept, trace); err != nil {
+                m.logger.Named("rebalance").Warn("failed to keep locks at group", "group", target, "locks", len(kept), "error", err)
+            }
+            return [][]byte{}
+        })
+    }
+    moveId := m.NextMoveId
+    m.NextMoveId++
+    m.MoveMap[moveId] = LockMove{moveId, target, lockArr}
+    delete(m.MoveMap, moveId - maxRememberedMoves)
+
+    sources := make([]int, 0)
+    for replicaGroup := range bySource {
+        sources = append(sources, int(replicaGroup))
+    }
+    sort.Ints(sources)
+    for _, source := range sources {
+        oldGroup := ReplicaGroupId(source)
+        locksToMove := bySource[oldGroup]
+        m.RebalancingInProgress[oldGroup] = true
+        m.moveGroupFreqStats(oldGroup, target, locksToMove)
+        callbacks = append(callbacks, m.startTransfer(oldGroup, target, locksToMove)...)
+    }
+    return callbacks, MoveLocksResponse{moveId, Success}
+}
+
+/* Locks in order of first appearance, without repeats. */
+func uniqueLocks(lockArr []Lock) []Lock {
+    seen := make(map[Lock]bool)
+    unique := make([]Lock, 0)
+    for _, l := range lockArr {
+        if !seen[l] {
+            seen[l] = true
+            unique = append(unique, l)
+        }
+    }
+    return unique
+}
+
+/* Tell group that held locks it was to give up once released stay there. */
+func (m *MasterFSM) askWorkerToKeepLocks(replicaGroup ReplicaGroupId, lockArr []Lock, trace raft.TraceContext) error {
+    args := make(map[string]string)
+    args[FunctionKey] = KeepLocksCommand
+    args[LockArrayKey] = lock_array_to_string(lockArr)
+    return m.genericClusterRequest(replicaGroup, args, &raft.ClientResponse{}, trace)
+}
+
+func (m *MasterFSM) moveProgress(moveId int) MoveProgressResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    move, ok := m.MoveMap[moveId]
+    if !ok {
+        return MoveProgressResponse{MoveId: moveId, Err: ErrNoSuchMove}
+    }
+    response := MoveProgressResponse{
+        MoveId:     moveId,
+        Target:     move.Target,
+        Landed:     make([]Lock, 0),
+        Waiting:    make([]Lock, 0),
+        InFlight:   make([]Lock, 0),
+        Elsewhere:  make([]Lock, 0),
+        Deleted:    make([]Lock, 0),
+        Err:        Success,
+    }
+    /* Where unfinished transfers are taking locks, and where held locks they
+       left behind go once released. */
+    carried := make(map[Lock]ReplicaGroupId)
+    waiting := make(map[Lock]ReplicaGroupId)
+    for _, t := range m.TransferMap {
+        for _, l := range t.Locks {
+            carried[l] = t.To
+        }
+        for _, l := range t.Recalcitrant {
+            delete(carried, l)
+            waiting[l] = t.To
+        }
+    }
+    for l, dest := range m.RecalcitrantDestMap {
+        waiting[l] = dest
+    }
+    for _, l := range move.Locks {
+        replicaGroup, ok := m.LockMap[l]
+        dest, isWaiting := waiting[l]
+        to, isCarried := carried[l]
+        switch {
+            case !ok:
+                response.Deleted = append(response.Deleted, l)
+            case isWaiting && dest == move.Target:
+                response.Waiting = append(response.Waiting, l)
+            case replicaGroup == move.Target:
+                response.Landed = append(response.Landed, l)
+            case isCarried && to == move.Target:
+                response.InFlight = append(response.InFlight, l)
+            default:
+                response.Elsewhere = append(response.Elsewhere, l)
+        }
+    }
+    response.Done = len(response.Waiting) == 0 && len(response.InFlight) == 0
+    return response
+}
+
+/* Client side. */
+
+/* Move locks to target replica group. Returns an ID for MoveProgress. */
+func (lc *LockClient) MoveLocks(lockArr []Lock, target ReplicaGroupId) (int, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = MoveLocksCommand
+    args[LockArrayKey] = lock_array_to_string(lockArr)
+    args[NewGroupKey] = strconv.Itoa(int(target))
+    var response MoveLocksResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    if err != nil {
+        return -1, err
+    }
+    return response.MoveId, nil
+}
+
+/* Move all locks in domain to target replica group and place new locks in the
+   domain there. Returns an ID for MoveProgress. */
+func (lc *LockClient) MoveDomain(d Domain, target ReplicaGroupId) (int, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = MoveDomainCommand
+    args[DomainArgKey] = string(d)
+    args[NewGroupKey] = strconv.Itoa(int(target))
+    var response MoveLocksResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    if err != nil {
+        return -1, err
+    }
+    return response.MoveId, nil
+}
+
+func (lc *LockClient) MoveProgress(moveId int) (MoveProgressResponse, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = MoveProgressCommand
+    args[MoveIdKey] = strconv.Itoa(moveId)
+    var response MoveProgressResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    return response, err
+}
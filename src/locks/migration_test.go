@@ -0,0 +1,229 @@
+package locks
+
+import(
+    "raft"
+    "reflect"
+    "testing"
+    "time"
+)
+
+/* Master serving groups 0 to 2. /a/l2 is held at 0 and waits to move to 1. */
+func moveMaster() *MasterFSM {
+    m := singleGroupMaster()
+    m.LockMap = map[Lock]ReplicaGroupId{"/a/l1": 0, "/a/l2": 0, "/a/l3": 1, "/b/l4": 1, "/c/l5": 2}
+    m.ClusterMap = map[ReplicaGroupId][]raft.ServerAddress{0: workerAddrs("w0", 3), 1: workerAddrs("w1", 3), 2: workerAddrs("w2", 3)}
+    m.DomainPlacementMap = map[Domain][]ReplicaGroupId{"/": {0}, "/a": {0, 1}, "/b": {1}, "/c": {2}}
+    m.NumLocksHeld = map[ReplicaGroupId]int{0: 2, 1: 2, 2: 1}
+    m.NextReplicaGroupId = 3
+    m.RecalcitrantDestMap["/a/l2"] = 1
+    m.RevokeDeadlineMap["/a/l2"] = testTime(150)
+    m.Settings = TransferSettings{}
+    return m
+}
+
+func transfersFrom(m *MasterFSM, replicaGroup ReplicaGroupId) []Transfer {
+    transfers := make([]Transfer, 0)
+    for _, t := range m.sortedTransfers() {
+        if t.From == replicaGroup {
+            transfers = append(transfers, t)
+        }
+    }
+    return transfers
+}
+
+func TestPlanMoveStartsOneTransferPerSource(t *testing.T) {
+    m := moveMaster()
+    callbacks, response := m.moveLocks([]Lock{"/a/l1", "/a/l3", "/a/l1", "/c/l5"}, 2)
+    if response.Err != nil || len(callbacks) != 2 {
+        t.Fatalf("got %v and %d callbacks, want a transfer from 0 and from 1", response.Err, len(callbacks))
+    }
+    from0, from1 := transfersFrom(m, 0), transfersFrom(m, 1)
+    if len(from0) != 1 || !reflect.DeepEqual(from0[0].Locks, []Lock{"/a/l1"}) || from0[0].To != 2 {
+        t.Fatalf("repeated lock should move once, got %+v", from0)
+    }
+    if len(from1) != 1 || !reflect.DeepEqual(from1[0].Locks, []Lock{"/a/l3"}) {
+        t.Fatalf("got %+v from group 1", from1)
+    }
+    if !m.RebalancingInProgress[0] || !m.RebalancingInProgress[1] || m.RebalancingInProgress[2] {
+        t.Fatalf("sources should be rebalancing, got %v", m.RebalancingInProgress)
+    }
+    move := m.MoveMap[response.MoveId]
+    if !reflect.DeepEqual(move.Locks, []Lock{"/a/l1", "/a/l3", "/c/l5"}) || move.Target != 2 {
+        t.Fatalf("got move %+v", move)
+    }
+    if m.NumLocksHeld[0] != 2 || m.LockMap["/a/l1"] != 0 {
+        t.Fatalf("locks should stay put until their transfer commits")
+    }
+}
+
+func TestPlanMoveRejectsWithoutChangingState(t *testing.T) {
+    tests := []struct {
+        prepare func(m *MasterFSM)
+        locks   []Lock
+        target  ReplicaGroupId
+        err     *LockError
+    }{
+        {nil, []Lock{"/a/l1"}, 3, ErrNoSuchGroup},
+        {nil, []Lock{"/a/l1", "/a/l9"}, 2, ErrLockDoesntExist},
+        {func(m *MasterFSM) { m.RecalcitrantDestMap["/a/l2"] = NO_WORKER }, []Lock{"/a/l2"}, 2, ErrLockDoesntExist},
+        {func(m *MasterFSM) { m.RebalancingInProgress[1] = true }, []Lock{"/a/l1", "/a/l3"}, 2, ErrRebalanceInProgress},
+        {func(m *MasterFSM) { m.RebalancingInProgress[2] = true }, []Lock{"/a/l1"}, 2, ErrRebalanceInProgress},
+        {func(m *MasterFSM) { m.GroupHealthMap[2] = GroupHealth{false, testTime(0)} }, []Lock{"/a/l1"}, 2, ErrGroupUnhealthy},
+        {func(m *MasterFSM) { m.DrainingGroups[2] = true }, []Lock{"/a/l1"}, 2, ErrGroupDraining},
+        {func(m *MasterFSM) { m.PlacementPolicyMap["/b"] = PinnedPolicy(1) }, []Lock{"/a/l1", "/b/l4"}, 2, ErrPlacementPolicy},
+    }
+    for i, test := range tests {
+        m := moveMaster()
+        if test.prepare != nil {
+            test.prepare(m)
+        }
+        before := masterState(m)
+        callbacks, response := m.moveLocks(test.locks, test.target)
+        if response.Err != test.err || response.MoveId != -1 || len(callbacks) != 0 {
+            t.Errorf("%d: got %v, move %d and %d callbacks, want %v", i, response.Err, response.MoveId, len(callbacks), test.err)
+            continue
+        }
+        compareState(t, masterState(m), before)
+    }
+}
+
+func TestPlanMoveRedirectsHeldLock(t *testing.T) {
+    m := moveMaster()
+    callbacks, response := m.moveLocks([]Lock{"/a/l2"}, 2)
+    if response.Err != nil || len(callbacks) != 0 || len(m.TransferMap) != 0 {
+        t.Fatalf("held lock should only be redirected, got %v, %d callbacks and transfers %v", response.Err, len(callbacks), m.TransferMap)
+    }
+    if m.RecalcitrantDestMap["/a/l2"] != 2 || !m.RevokeDeadlineMap["/a/l2"].Equal(testTime(150)) {
+        t.Fatalf("held lock should wait for 2 with the same deadline, got %v", m.RecalcitrantDestMap)
+    }
+    if progress := m.moveProgress(response.MoveId); !reflect.DeepEqual(progress.Waiting, []Lock{"/a/l2"}) || progress.Done {
+        t.Fatalf("got %+v, want lock waiting", progress)
+    }
+}
+
+func TestPlanMoveKeepsHeldLockMovedToItsOwnGroup(t *testing.T) {
+    m := moveMaster()
+    callbacks, response := m.moveLocks([]Lock{"/a/l2"}, 0)
+    if response.Err != nil || len(callbacks) != 1 || len(m.TransferMap) != 0 {
+        t.Fatalf("got %v, %d callbacks and transfers %v, want only a keep request", response.Err, len(callbacks), m.TransferMap)
+    }
+    if _, ok := m.RecalcitrantDestMap["/a/l2"]; ok {
+        t.Fatalf("held lock still waiting to move: %v", m.RecalcitrantDestMap)
+    }
+    if _, ok := m.RevokeDeadlineMap["/a/l2"]; ok {
+        t.Fatalf("held lock still has a revocation deadline")
+    }
+    if progress := m.moveProgress(response.MoveId); !reflect.DeepEqual(progress.Landed, []Lock{"/a/l2"}) || !progress.Done {
+        t.Fatalf("got %+v, want lock landed", progress)
+    }
+    /* Its release no longer starts a transfer. */
+    if callbacks := m.handleReleasedRecalcitrant("/a/l2"); len(callbacks) != 0 || len(m.TransferMap) != 0 {
+        t.Fatalf("release planned transfers %v", m.TransferMap)
+    }
+}
+
+func TestWorkerKeepLocks(t *testing.T) {
+    w := testWorker()
+    w.logger = raft.NopLogger()
+    w.keepLocks([]Lock{"/a/l2", "/a/l1", "/a/l9"})
+    if state := w.LockStateMap["/a/l2"]; state.Recalcitrant || state.Disabled || !state.Held {
+        t.Fatalf("kept lock should stay held and movable again, got %+v", state)
+    }
+    if state := w.LockStateMap["/a/l1"]; state.Recalcitrant || !state.Held || state.Client != "c:1" {
+        t.Fatalf("lock that wasn't waiting changed: %+v", state)
+    }
+
+    /* Released while the keep request was on its way. */
+    w = testWorker()
+    w.logger = raft.NopLogger()
+    w.releaseLock("/a/l2", "c:2")
+    if state := w.LockStateMap["/a/l2"]; !state.Disabled {
+        t.Fatalf("released recalcitrant lock should be disabled, got %+v", state)
+    }
+    w.keepLocks([]Lock{"/a/l2"})
+    if state := w.LockStateMap["/a/l2"]; state.Disabled || state.Recalcitrant || state.Held {
+        t.Fatalf("kept lock should be free, got %+v", state)
+    }
+}
+
+func TestMoveDomain(t *testing.T) {
+    m := moveMaster()
+    callbacks, response := m.moveDomain("a", 2)
+    if response.Err != nil || len(callbacks) != 2 {
+        t.Fatalf("got %v and %d callbacks", response.Err, len(callbacks))
+    }
+    move := m.MoveMap[response.MoveId]
+    if !reflect.DeepEqual(move.Locks, []Lock{"/a/l1", "/a/l2", "/a/l3"}) {
+        t.Fatalf("got move %+v", move)
+    }
+    if !reflect.DeepEqual(m.DomainPlacementMap["/a"], []ReplicaGroupId{2}) || m.RecalcitrantDestMap["/a/l2"] != 2 {
+        t.Fatalf("domain not placed at 2: %v, %v", m.DomainPlacementMap, m.RecalcitrantDestMap)
+    }
+    /* Subdomains and other domains stay. */
+    if len(transfersFrom(m, 2)) != 0 || !reflect.DeepEqual(m.DomainPlacementMap["/b"], []ReplicaGroupId{1}) {
+        t.Fatalf("other domains moved")
+    }
+
+    m = moveMaster()
+    m.PlacementPolicyMap["/a"] = PlacementPolicy{Excluded: []ReplicaGroupId{2}}
+    for _, test := range []struct {
+        d       Domain
+        err     *LockError
+    }{
+        {"", ErrEmptyPath},
+        {"/z", ErrDomainDoesntExist},
+        {"/a", ErrPlacementPolicy},
+    } {
+        before := masterState(m)
+        if _, response := m.moveDomain(test.d, 2); response.Err != test.err {
+            t.Errorf("%q: got %v, want %v", test.d, response.Err, test.err)
+        }
+        compareState(t, masterState(m), before)
+    }
+}
+
+func TestMoveProgress(t *testing.T) {
+    m := moveMaster()
+    if progress := m.moveProgress(9); progress.Err != ErrNoSuchMove {
+        t.Fatalf("unknown move: got %v", progress.Err)
+    }
+    _, response := m.moveLocks([]Lock{"/a/l1", "/a/l3", "/c/l5"}, 2)
+    want := MoveProgressResponse{
+        MoveId:     response.MoveId,
+        Target:     2,
+        Landed:     []Lock{"/c/l5"},
+        Waiting:    []Lock{},
+        InFlight:   []Lock{"/a/l1", "/a/l3"},
+        Elsewhere:  []Lock{},
+        Deleted:    []Lock{},
+        Err:        Success,
+    }
+    if progress := m.moveProgress(response.MoveId); !reflect.DeepEqual(progress, want) {
+        t.Fatalf("got %+v, want %+v", progress, want)
+    }
+
+    /* Group 0's transfer commits. Group 1 gives /a/l3 elsewhere instead, and
+       rebalancing a group doesn't put its other locks in flight. */
+    id := transfersFrom(m, 0)[0].Id
+    m.advanceTransfer(id, TransferDisabled, nil, nil, time.Time{})
+    m.advanceTransfer(id, TransferClaimed, nil, nil, time.Time{})
+    m.advanceTransfer(id, TransferCommitted, nil, nil, time.Time{})
+    other := transfersFrom(m, 1)[0]
+    other.To = 0
+    m.TransferMap[other.Id] = other
+    delete(m.LockMap, "/c/l5")
+    progress := m.moveProgress(response.MoveId)
+    if !reflect.DeepEqual(progress.Landed, []Lock{"/a/l1"}) || !reflect.DeepEqual(progress.Elsewhere, []Lock{"/a/l3"}) ||
+        !reflect.DeepEqual(progress.Deleted, []Lock{"/c/l5"}) || len(progress.InFlight) != 0 || !progress.Done {
+        t.Fatalf("got %+v", progress)
+    }
+
+    /* A held lock left behind by a transfer that hasn't committed waits. */
+    m = moveMaster()
+    _, response = m.moveLocks([]Lock{"/a/l1"}, 2)
+    id = transfersFrom(m, 0)[0].Id
+    m.advanceTransfer(id, TransferDisabled, []Lock{"/a/l1"}, nil, time.Time{})
+    if progress := m.moveProgress(response.MoveId); !reflect.DeepEqual(progress.Waiting, []Lock{"/a/l1"}) || len(progress.InFlight) != 0 {
+        t.Fatalf("got %+v, want lock waiting", progress)
+    }
+}
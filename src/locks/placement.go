@@ -0,0 +1,232 @@
+package locks
+
+import(
+    "sort"
+    "strconv"
+)
+
+/* Per-domain placement constraints, set through an admin command. They apply
+   to locks directly inside the domain and to the domain itself when created,
+   and are honored by initial placement, rebalancing and manual moves. */
+type PlacementPolicy struct {
+    /* If non-empty, locks in domain may only be placed at these groups. A
+       single allowed group pins the domain to that group. */
+    Allowed     []ReplicaGroupId
+    /* Locks in domain are never placed at these groups. */
+    Excluded    []ReplicaGroupId
+    /* Spread locks in domain over its groups by consistent hashing of their
+       names instead of placing each at the least loaded group. */
+    Hashed      bool
+}
+
+type DomainPolicy struct {
+    Domain      Domain
+    Policy      PlacementPolicy
+}
+
+type SetPlacementPolicyResponse struct {
+    /* Move started for locks violating the new policy; -1 if none needed. */
+    MoveId      int
+    Err         *LockError
+}
+
+type PlacementPoliciesResponse struct {
+    Policies    []DomainPolicy
+    Err         *LockError
+}
+
+/* Policy pinning a domain to a single replica group. */
+func PinnedPolicy(replicaGroup ReplicaGroupId) PlacementPolicy {
+    return PlacementPolicy{Allowed: []ReplicaGroupId{replicaGroup}}
+}
+
+func (p PlacementPolicy) allows(replicaGroup ReplicaGroupId) bool {
+    if containsGroup(p.Excluded, replicaGroup) {
+        return false
+    }
+    return len(p.Allowed) == 0 || containsGroup(p.Allowed, replicaGroup)
+}
+
+func (p PlacementPolicy) isEmpty() bool {
+    return len(p.Allowed) == 0 && len(p.Excluded) == 0 && !p.Hashed
+}
+
+/* Master side. */
+
+/* True if locks in domain may be placed at replica group. Assumes FSM already locked. */
+func (m *MasterFSM) placementAllowed(d Domain, replicaGroup ReplicaGroupId) bool {
+    policy, ok := m.PlacementPolicyMap[d]
+    return !ok || policy.allows(replicaGroup)
+}
+
+/* True if lock is only allowed at the group it is already stored at, so
+   rebalancing must leave it in place. Assumes FSM already locked. */
+func (m *MasterFSM) isPinned(l Lock) bool {
+    policy, ok := m.PlacementPolicyMap[getParentDomain(string(l))]
+    return ok && len(policy.Allowed) == 1 && policy.Allowed[0] == m.LockMap[l]
+}
+
+/* Narrows candidate groups for domain to those its policy allows. If none of
+   the candidates is allowed, falls back to the policy's allowed groups, so a
+   pinned domain lands on its group even if its parent lives elsewhere.
+   Assumes FSM already locked. */
+func (m *MasterFSM) placementCandidates(d Domain, replicaGroups []ReplicaGroupId) []ReplicaGroupId {
+    policy, ok := m.PlacementPolicyMap[d]
+    if !ok {
+        return replicaGroups
+    }
+    candidates := make([]ReplicaGroupId, 0)
+    for _, replicaGroup := range replicaGroups {
+        if policy.allows(replicaGroup) {
+            candidates = append(candidates, replicaGroup)
+        }
+    }
+    if len(candidates) > 0 {
+        return candidates
+    }
+    for _, replicaGroup := range policy.Allowed {
+        if m.isUsableGroup(replicaGroup) && policy.allows(replicaGroup) {
+            candidates = append(candidates, replicaGroup)
+        }
+    }
+    return candidates
+}
+
+/* True if group exists and is not retiring or draining. Assumes FSM already locked. */
+func (m *MasterFSM) isUsableGroup(replicaGroup ReplicaGroupId) bool {
+    _, ok := m.ClusterMap[replicaGroup]
+    return ok && !(m.RebalancingInProgress[replicaGroup] && m.NumLocksHeld[replicaGroup] == 0) && !m.DrainingGroups[replicaGroup]
+}
+
+/* Set or clear (with an empty policy) the placement policy for a domain. Locks
+   already in the domain that violate the policy are moved to an allowed group. */
+func (m *MasterFSM) setPlacementPolicy(d Domain, policy PlacementPolicy) ([]func() [][]byte, SetPlacementPolicyResponse) {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if len(string(d)) == 0 {
+        return []func() [][]byte{}, SetPlacementPolicyResponse{-1, ErrEmptyPath}
+    }
+    if string(d[0]) != "/" {
+        d = "/" + d
+    }
+    for _, groups := range [][]ReplicaGroupId{policy.Allowed, policy.Excluded} {
+        for _, replicaGroup := range groups {
+            if _, ok := m.ClusterMap[replicaGroup]; !ok {
+                return []func() [][]byte{}, SetPlacementPolicyResponse{-1, ErrNoSuchGroup}
+            }
+        }
+    }
+    /* A group both allowed and excluded is a mistake; if it is the only
+       allowed group, nowhere is left to place the domain's locks. */
+    for _, replicaGroup := range policy.Excluded {
+        if containsGroup(policy.Allowed, replicaGroup) {
+            return []func() [][]byte{}, SetPlacementPolicyResponse{-1, ErrPlacementPolicy}
+        }
+    }
+    if policy.isEmpty() {
+        delete(m.PlacementPolicyMap, d)
+        return []func() [][]byte{}, SetPlacementPolicyResponse{-1, Success}
+    }
+
+    oldPolicy, hadPolicy := m.PlacementPolicyMap[d]
+    m.PlacementPolicyMap[d] = policy
+    violating := make([]Lock, 0)
+    for _, l := range m.sortedLocks() {
+        if getParentDomain(string(l)) != d {
+            continue
+        }
+        dest, recalcitrant := m.RecalcitrantDestMap[l]
+        if (recalcitrant && dest != NO_WORKER && !policy.allows(dest)) || (!recalcitrant && !policy.allows(m.LockMap[l])) {
+            violating = append(violating, l)
+        }
+    }
+    placement, hasPlacement := m.DomainPlacementMap[d]
+    if len(violating) == 0 && (!hasPlacement || len(m.allowedOnly(d, placement)) > 0) {
+        if hasPlacement {
+            m.DomainPlacementMap[d] = m.allowedOnly(d, placement)
+        }
+        return []func() [][]byte{}, SetPlacementPolicyResponse{-1, Success}
+    }
+
+    /* Move violating locks to a single allowed group. */
+    target, err := m.choosePlacement(d, placement)
+    if err == nil {
+        err = m.checkMoveTarget(target)
+    }
+    var callbacks []func() [][]byte
+    response := MoveLocksResponse{-1, err}
+    if err == nil {
+        callbacks, response = m.planMove(violating, target)
+    }
+    if response.Err != nil {
+        if hadPolicy {
+            m.PlacementPolicyMap[d] = oldPolicy
+        } else {
+            delete(m.PlacementPolicyMap, d)
+        }
+        return []func() [][]byte{}, SetPlacementPolicyResponse{-1, response.Err}
+    }
+    if hasPlacement {
+        allowed := m.allowedOnly(d, placement)
+        if !containsGroup(allowed, target) {
+            allowed = append(allowed, target)
+        }
+        m.DomainPlacementMap[d] = allowed
+    }
+    return callbacks, SetPlacementPolicyResponse{response.MoveId, Success}
+}
+
+/* Assumes FSM already locked. */
+func (m *MasterFSM) allowedOnly(d Domain, replicaGroups []ReplicaGroupId) []ReplicaGroupId {
+    allowed := make([]ReplicaGroupId, 0)
+    for _, replicaGroup := range replicaGroups {
+        if m.placementAllowed(d, replicaGroup) {
+            allowed = append(allowed, replicaGroup)
+        }
+    }
+    return allowed
+}
+
+func (m *MasterFSM) placementPolicies() PlacementPoliciesResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    names := make([]string, 0)
+    for d := range m.PlacementPolicyMap {
+        names = append(names, string(d))
+    }
+    sort.Strings(names)
+    response := PlacementPoliciesResponse{make([]DomainPolicy, 0), Success}
+    for _, name := range names {
+        response.Policies = append(response.Policies, DomainPolicy{Domain(name), m.PlacementPolicyMap[Domain(name)]})
+    }
+    return response
+}
+
+/* Client side. */
+
+/* Set placement policy for domain; an empty policy clears it. Returns the ID
+   of the move started for locks violating the policy, or -1. */
+func (lc *LockClient) SetPlacementPolicy(d Domain, policy PlacementPolicy) (int, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = SetPlacementPolicyCommand
+    args[DomainArgKey] = string(d)
+    args[AllowedGroupsKey] = group_array_to_string(policy.Allowed)
+    args[ExcludedGroupsKey] = group_array_to_string(policy.Excluded)
+    args[HashedKey] = strconv.FormatBool(policy.Hashed)
+    var response SetPlacementPolicyResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    if err != nil {
+        return -1, err
+    }
+    return response.MoveId, nil
+}
+
+/* Returns the placement policy of every domain that has one. */
+func (lc *LockClient) PlacementPolicies() ([]DomainPolicy, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = PlacementPoliciesCommand
+    var response PlacementPoliciesResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    return response.Policies, err
+}
+
@@ -0,0 +1,148 @@
+package locks
+
+import(
+    "errors"
+    "reflect"
+    "testing"
+)
+
+func TestSetPlacementPolicyRejectsBadGroups(t *testing.T) {
+    tests := []struct {
+        name   string
+        policy PlacementPolicy
+        err    *LockError
+    }{
+        {"unknown allowed group", PlacementPolicy{Allowed: []ReplicaGroupId{0, 7}}, ErrNoSuchGroup},
+        {"unknown excluded group", PlacementPolicy{Excluded: []ReplicaGroupId{7}}, ErrNoSuchGroup},
+        {"pinned group excluded", PlacementPolicy{Allowed: []ReplicaGroupId{1}, Excluded: []ReplicaGroupId{1}}, ErrPlacementPolicy},
+        {"allowed and excluded overlap", PlacementPolicy{Allowed: []ReplicaGroupId{0, 1}, Excluded: []ReplicaGroupId{0}}, ErrPlacementPolicy},
+    }
+    for _, test := range tests {
+        m := testMaster()
+        before := m.PlacementPolicyMap["/a"]
+        callbacks, response := m.setPlacementPolicy("/a", test.policy)
+        if !errors.Is(response.Err, test.err) {
+            t.Errorf("%s: got %v, want %v", test.name, response.Err, test.err)
+        }
+        if len(callbacks) != 0 || response.MoveId != -1 {
+            t.Errorf("%s: rejected policy shouldn't start a move", test.name)
+        }
+        if !reflect.DeepEqual(m.PlacementPolicyMap["/a"], before) {
+            t.Errorf("%s: rejected policy shouldn't be stored", test.name)
+        }
+    }
+}
+
+func TestSetPlacementPolicyAcceptsDisjointGroups(t *testing.T) {
+    m := testMaster()
+    policy := PlacementPolicy{Allowed: []ReplicaGroupId{0, 1}, Excluded: []ReplicaGroupId{}}
+    if _, response := m.setPlacementPolicy("/a", policy); response.Err != nil {
+        t.Fatalf("valid policy rejected: %v", response.Err)
+    }
+    if !reflect.DeepEqual(m.PlacementPolicyMap["/a"], policy) {
+        t.Fatalf("policy not stored, got %v", m.PlacementPolicyMap["/a"])
+    }
+}
+
+/* Groups 0 to 2 all serving /a, with 1 the least loaded, and a cluster left
+   to recruit as group 3. */
+func placementMaster() *MasterFSM {
+    m := moveMaster()
+    delete(m.RecalcitrantDestMap, "/a/l2")
+    m.LockMap["/d/l6"] = 0
+    m.NumLocksHeld[0]++
+    m.DomainPlacementMap["/a"] = []ReplicaGroupId{0, 1, 2}
+    m.DomainPlacementMap["/d"] = []ReplicaGroupId{0}
+    m.GroupFreqStatsMap = map[ReplicaGroupId]FreqStats{0: {5, testTime(100)}, 1: {1, testTime(100)}, 2: {3, testTime(100)}}
+    m.RecruitAddrs = []RecruitInfo{{Addrs: workerAddrs("w0", 3)}, {Addrs: workerAddrs("w1", 3)}, {Addrs: workerAddrs("w2", 3)}, {Addrs: workerAddrs("w3", 3)}}
+    return m
+}
+
+func TestChoosePlacementHonorsPolicy(t *testing.T) {
+    tests := []struct {
+        name    string
+        policy  *PlacementPolicy
+        prepare func(m *MasterFSM)
+        d       Domain
+        want    ReplicaGroupId
+        err     *LockError
+    }{
+        {"no policy", nil, nil, "/a", 1, nil},
+        {"excluded", &PlacementPolicy{Excluded: []ReplicaGroupId{1}}, nil, "/a", 2, nil},
+        {"allowed", &PlacementPolicy{Allowed: []ReplicaGroupId{0, 2}}, nil, "/a", 2, nil},
+        {"pinned", &PlacementPolicy{Allowed: []ReplicaGroupId{0}}, nil, "/a", 0, nil},
+        {"pinned outside candidates", &PlacementPolicy{Allowed: []ReplicaGroupId{2}}, nil, "/d", 2, nil},
+        {"pinned to draining group", &PlacementPolicy{Allowed: []ReplicaGroupId{2}}, func(m *MasterFSM) { m.DrainingGroups[2] = true }, "/a", -1, ErrNoPlacement},
+        {"pinned to unhealthy group", &PlacementPolicy{Allowed: []ReplicaGroupId{2}}, func(m *MasterFSM) { m.GroupHealthMap[2] = GroupHealth{false, testTime(0)} }, "/a", -1, ErrNoPlacement},
+        {"everything excluded", &PlacementPolicy{Excluded: []ReplicaGroupId{0}}, nil, "/d", -1, ErrNoPlacement},
+    }
+    for _, test := range tests {
+        m := placementMaster()
+        if test.policy != nil {
+            m.PlacementPolicyMap[test.d] = *test.policy
+        }
+        if test.prepare != nil {
+            test.prepare(m)
+        }
+        got, err := m.choosePlacement(test.d, m.DomainPlacementMap[test.d])
+        if got != test.want || err != test.err {
+            t.Errorf("%s: got %d, %v, want %d, %v", test.name, got, err, test.want, test.err)
+        }
+    }
+}
+
+func TestGetWorkerToTakeLockHonorsPolicy(t *testing.T) {
+    tests := []struct {
+        name    string
+        policy  *PlacementPolicy
+        want    ReplicaGroupId
+    }{
+        {"no policy", nil, 1},
+        {"excluded", &PlacementPolicy{Excluded: []ReplicaGroupId{1}}, 2},
+        {"allowed", &PlacementPolicy{Allowed: []ReplicaGroupId{0, 2}}, 2},
+        {"pinned to its group", &PlacementPolicy{Allowed: []ReplicaGroupId{0}}, NO_WORKER},
+    }
+    for _, test := range tests {
+        m := placementMaster()
+        if test.policy != nil {
+            m.PlacementPolicyMap["/a"] = *test.policy
+        }
+        got := testPolicy().getWorkerToTakeLock(&masterLoadView{m}, "/a/l1", 0, map[ReplicaGroupId]float64{}, map[ReplicaGroupId]int{})
+        if got != test.want {
+            t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+        }
+    }
+}
+
+func TestSplitToNewWorkerHonorsPolicy(t *testing.T) {
+    tests := []struct {
+        name    string
+        policy  PlacementPolicy
+        moved   []Lock
+    }{
+        {"allowed", PlacementPolicy{Allowed: []ReplicaGroupId{0, 1, 2}}, []Lock{"/d/l6"}},
+        {"pinned", PinnedPolicy(0), []Lock{"/d/l6"}},
+        {"excluded", PlacementPolicy{Excluded: []ReplicaGroupId{3}}, []Lock{"/d/l6"}},
+        {"other group excluded", PlacementPolicy{Excluded: []ReplicaGroupId{2}}, []Lock{"/a/l1", "/d/l6"}},
+    }
+    for _, test := range tests {
+        m := placementMaster()
+        m.PlacementPolicyMap["/a"] = test.policy
+        if callbacks := m.splitToNewWorker(0, []Lock{"/a/l1", "/d/l6"}); len(callbacks) != 1 {
+            t.Errorf("%s: got %d callbacks, want 1", test.name, len(callbacks))
+            continue
+        }
+        transfers := transfersFrom(m, 0)
+        if len(transfers) != 1 || transfers[0].To != 3 || !reflect.DeepEqual(transfers[0].Locks, test.moved) {
+            t.Errorf("%s: got transfers %+v, want %v to 3", test.name, transfers, test.moved)
+        }
+    }
+
+    /* Nothing allowed at the new group: no group is recruited. */
+    m := placementMaster()
+    m.PlacementPolicyMap["/a"] = PinnedPolicy(0)
+    m.PlacementPolicyMap["/d"] = PinnedPolicy(0)
+    if callbacks := m.splitToNewWorker(0, []Lock{"/a/l1", "/d/l6"}); len(callbacks) != 0 || m.NextReplicaGroupId != 3 || len(m.TransferMap) != 0 {
+        t.Fatalf("recruited a group for locks pinned elsewhere")
+    }
+}
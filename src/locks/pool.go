@@ -0,0 +1,187 @@
+package locks
+
+import(
+    "raft"
+    "strconv"
+)
+
+/* Admin commands managing the pool of worker clusters the master recruits new
+   replica groups from. Entries of RecruitAddrs below NextReplicaGroupId have
+   been recruited; the rest are waiting. A waiting cluster can be marked
+   unavailable, which keeps it in the pool but stops it being recruited, or
+   removed for good. */
+
+type RecruitStatus struct {
+    ServerAddrs     []raft.ServerAddress
+    /* False if cluster was marked unavailable. */
+    Available       bool
+    /* True if cluster used to serve a replica group that has since retired. */
+    Retired         bool
+}
+
+type PoolResponse struct {
+    Err     *LockError
+}
+
+type RecruitPoolResponse struct {
+    Clusters    []RecruitStatus
+    /* Clusters that can be recruited now. */
+    Spare       int
+    Err         *LockError
+}
+
+/* Master side. */
+
+/* Number of waiting clusters that can be recruited. Assumes FSM already locked. */
+func (m *MasterFSM) spareGroups() int {
+    spare := 0
+    for i := int(m.NextReplicaGroupId); i < len(m.RecruitAddrs); i++ {
+        if !m.RecruitAddrs[i].Unavailable {
+            spare++
+        }
+    }
+    return spare
+}
+
+/* Move first available waiting cluster to position NextReplicaGroupId so it is
+   recruited next. Returns false if none is available. Assumes FSM already locked. */
+func (m *MasterFSM) nextRecruit() (RecruitInfo, bool) {
+    next := int(m.NextReplicaGroupId)
+    for i := next; i < len(m.RecruitAddrs); i++ {
+        if !m.RecruitAddrs[i].Unavailable {
+            m.RecruitAddrs[next], m.RecruitAddrs[i] = m.RecruitAddrs[i], m.RecruitAddrs[next]
+            return m.RecruitAddrs[next], true
+        }
+    }
+    return RecruitInfo{}, false
+}
+
+func sameAddrs(a []raft.ServerAddress, b []raft.ServerAddress) bool {
+    if len(a) != len(b) {
+        return false
+    }
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+    return true
+}
+
+/* Index of waiting cluster in RecruitAddrs, or -1. Assumes FSM already locked. */
+func (m *MasterFSM) findRecruit(addrs []raft.ServerAddress) int {
+    for i := int(m.NextReplicaGroupId); i < len(m.RecruitAddrs); i++ {
+        if sameAddrs(m.RecruitAddrs[i].Addrs, addrs) {
+            return i
+        }
+    }
+    return -1
+}
+
+/* True if cluster serves a replica group that hasn't retired. Assumes FSM already locked. */
+func (m *MasterFSM) isServing(addrs []raft.ServerAddress) bool {
+    for replicaGroup, serverAddrs := range m.ClusterMap {
+        if sameAddrs(serverAddrs, addrs) && m.isUsableGroup(replicaGroup) {
+            return true
+        }
+    }
+    return false
+}
+
+/* Add cluster of retired group back to pool, unless already there. Assumes
+   FSM already locked. */
+func (m *MasterFSM) returnToPool(addrs []raft.ServerAddress) {
+    if m.findRecruit(addrs) < 0 {
+        m.RecruitAddrs = append(m.RecruitAddrs, RecruitInfo{Addrs: addrs, ShouldRecruitLocally: false})
+    }
+}
+
+func (m *MasterFSM) addWorkers(addrs []raft.ServerAddress) PoolResponse {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if len(addrs) == 0 {
+        return PoolResponse{ErrInvalidRequest}
+    }
+    if !allowedClusterSize(len(addrs)) {
+        return PoolResponse{ErrGroupSize}
+    }
+    if m.findRecruit(addrs) >= 0 || m.isServing(addrs) {
+        return PoolResponse{ErrWorkersExist}
+    }
+    m.RecruitAddrs = append(m.RecruitAddrs, RecruitInfo{Addrs: addrs, ShouldRecruitLocally: false})
+    return PoolResponse{Success}
+}
+
+func (m *MasterFSM) setWorkersAvailable(addrs []raft.ServerAddress, available bool) PoolResponse {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    i := m.findRecruit(addrs)
+    if i < 0 {
+        return PoolResponse{ErrNoSuchWorkers}
+    }
+    m.RecruitAddrs[i].Unavailable = !available
+    return PoolResponse{Success}
+}
+
+func (m *MasterFSM) removeWorkers(addrs []raft.ServerAddress) PoolResponse {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    i := m.findRecruit(addrs)
+    if i < 0 {
+        return PoolResponse{ErrNoSuchWorkers}
+    }
+    m.RecruitAddrs = append(m.RecruitAddrs[:i], m.RecruitAddrs[i+1:]...)
+    return PoolResponse{Success}
+}
+
+func (m *MasterFSM) recruitPool() RecruitPoolResponse {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    response := RecruitPoolResponse{make([]RecruitStatus, 0), m.spareGroups(), Success}
+    for i := int(m.NextReplicaGroupId); i < len(m.RecruitAddrs); i++ {
+        info := m.RecruitAddrs[i]
+        retired := false
+        for _, serverAddrs := range m.ClusterMap {
+            retired = retired || sameAddrs(serverAddrs, info.Addrs)
+        }
+        response.Clusters = append(response.Clusters, RecruitStatus{info.Addrs, !info.Unavailable, retired})
+    }
+    return response
+}
+
+/* Client side. */
+
+func (lc *LockClient) poolRequest(function string, addrs []raft.ServerAddress, extra map[string]string) error {
+    args := make(map[string]string)
+    args[FunctionKey] = function
+    args[ServerAddrsKey] = addr_array_to_string(addrs)
+    for k, v := range extra {
+        args[k] = v
+    }
+    var response PoolResponse
+    return lc.adminRequest(args, &response, func() *LockError { return response.Err })
+}
+
+/* Add worker cluster to the pool new replica groups are recruited from. */
+func (lc *LockClient) AddWorkerCluster(addrs []raft.ServerAddress) error {
+    return lc.poolRequest(AddWorkersCommand, addrs, nil)
+}
+
+/* Mark waiting worker cluster available or unavailable for recruiting. */
+func (lc *LockClient) SetWorkerClusterAvailable(addrs []raft.ServerAddress, available bool) error {
+    return lc.poolRequest(SetWorkersAvailableCommand, addrs, map[string]string{AvailableKey: strconv.FormatBool(available)})
+}
+
+/* Remove waiting worker cluster from the pool for good. */
+func (lc *LockClient) RemoveWorkerCluster(addrs []raft.ServerAddress) error {
+    return lc.poolRequest(RemoveWorkersCommand, addrs, nil)
+}
+
+/* Returns worker clusters waiting to be recruited. */
+func (lc *LockClient) RecruitPool() (RecruitPoolResponse, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = RecruitPoolCommand
+    var response RecruitPoolResponse
+    err := lc.adminRequest(args, &response, func() *LockError { return response.Err })
+    return response, err
+}
@@ -0,0 +1,118 @@
+package locks
+
+import(
+    "raft"
+    "errors"
+    "reflect"
+    "testing"
+)
+
+func workerAddrs(name string, n int) []raft.ServerAddress {
+    addrs := make([]raft.ServerAddress, n)
+    for i := range addrs {
+        addrs[i] = raft.ServerAddress(name + ":" + string(rune('1' + i)))
+    }
+    return addrs
+}
+
+/* Master serving groups 0 and 1, with w2 waiting but unavailable and w3
+   waiting. */
+func poolMaster() *MasterFSM {
+    m := testMaster()
+    m.RebalancingInProgress = make(map[ReplicaGroupId]bool)
+    m.DrainingGroups = make(map[ReplicaGroupId]bool)
+    m.RecruitAddrs = []RecruitInfo{
+        {Addrs: workerAddrs("w0", 3)},
+        {Addrs: workerAddrs("w1", 3)},
+        {Addrs: workerAddrs("w2", 3), Unavailable: true},
+        {Addrs: workerAddrs("w3", 3)},
+    }
+    return m
+}
+
+func TestNextRecruitSkipsUnavailable(t *testing.T) {
+    m := poolMaster()
+    if spare := m.spareGroups(); spare != 1 {
+        t.Fatalf("spare groups = %d, want 1", spare)
+    }
+    info, ok := m.nextRecruit()
+    if !ok || !sameAddrs(info.Addrs, workerAddrs("w3", 3)) {
+        t.Fatalf("next recruit = %v, %v, want w3", info, ok)
+    }
+    /* Recruited next, so it sits at the position of the next group ID. */
+    if !sameAddrs(m.RecruitAddrs[2].Addrs, workerAddrs("w3", 3)) || !sameAddrs(m.RecruitAddrs[3].Addrs, workerAddrs("w2", 3)) {
+        t.Fatalf("pool not reordered: %v", m.RecruitAddrs)
+    }
+    if again, _ := m.nextRecruit(); !reflect.DeepEqual(again, info) {
+        t.Fatalf("asking again before recruiting should give the same cluster, got %v", again)
+    }
+    m.RecruitAddrs[2].Unavailable = true
+    if _, ok := m.nextRecruit(); ok || m.spareGroups() != 0 {
+        t.Fatalf("no cluster is available, but one was offered")
+    }
+    m.NextReplicaGroupId = 4
+    if _, ok := m.nextRecruit(); ok {
+        t.Fatalf("recruited clusters offered again")
+    }
+}
+
+func TestReturnToPool(t *testing.T) {
+    m := poolMaster()
+    /* Group 1 retires: rebalanced away with no locks left. */
+    m.RebalancingInProgress[1] = true
+    m.NumLocksHeld[1] = 0
+    m.NextReplicaGroupId = 2
+    m.returnToPool(workerAddrs("w1", 3))
+    m.returnToPool(workerAddrs("w1", 3))
+    if len(m.RecruitAddrs) != 5 {
+        t.Fatalf("retired cluster returned %d times", len(m.RecruitAddrs) - 4)
+    }
+    m.returnToPool(workerAddrs("w3", 3))
+    if len(m.RecruitAddrs) != 5 {
+        t.Fatalf("waiting cluster added to pool twice")
+    }
+    pool := m.recruitPool()
+    want := []RecruitStatus{
+        {workerAddrs("w2", 3), false, false},
+        {workerAddrs("w3", 3), true, false},
+        {workerAddrs("w1", 3), true, true},
+    }
+    if pool.Err != nil || pool.Spare != 2 || !reflect.DeepEqual(pool.Clusters, want) {
+        t.Fatalf("got %+v, want spare 2 and %v", pool, want)
+    }
+}
+
+func TestPoolAdminCommands(t *testing.T) {
+    m := poolMaster()
+    tests := []struct {
+        name    string
+        apply   func() PoolResponse
+        err     *LockError
+    }{
+        {"add nothing", func() PoolResponse { return m.addWorkers(nil) }, ErrInvalidRequest},
+        {"add even sized cluster", func() PoolResponse { return m.addWorkers(workerAddrs("w4", 2)) }, ErrGroupSize},
+        {"add waiting cluster", func() PoolResponse { return m.addWorkers(workerAddrs("w3", 3)) }, ErrWorkersExist},
+        {"add serving cluster", func() PoolResponse { return m.addWorkers(workerAddrs("w0", 3)) }, ErrWorkersExist},
+        {"add cluster", func() PoolResponse { return m.addWorkers(workerAddrs("w4", 5)) }, Success},
+        {"enable unknown cluster", func() PoolResponse { return m.setWorkersAvailable(workerAddrs("w5", 3), true) }, ErrNoSuchWorkers},
+        {"enable recruited cluster", func() PoolResponse { return m.setWorkersAvailable(workerAddrs("w1", 3), true) }, ErrNoSuchWorkers},
+        {"enable cluster", func() PoolResponse { return m.setWorkersAvailable(workerAddrs("w2", 3), true) }, Success},
+        {"disable cluster", func() PoolResponse { return m.setWorkersAvailable(workerAddrs("w3", 3), false) }, Success},
+        {"remove recruited cluster", func() PoolResponse { return m.removeWorkers(workerAddrs("w0", 3)) }, ErrNoSuchWorkers},
+        {"remove cluster", func() PoolResponse { return m.removeWorkers(workerAddrs("w4", 5)) }, Success},
+    }
+    for _, test := range tests {
+        response := test.apply()
+        if !errors.Is(response.Err, test.err) || (test.err == nil && response.Err != nil) {
+            t.Errorf("%s: got %v, want %v", test.name, response.Err, test.err)
+        }
+    }
+    pool := m.recruitPool()
+    want := []RecruitStatus{
+        {workerAddrs("w2", 3), true, false},
+        {workerAddrs("w3", 3), false, false},
+    }
+    if !reflect.DeepEqual(pool.Clusters, want) || pool.Spare != 1 {
+        t.Fatalf("got %+v, want %v", pool, want)
+    }
+}
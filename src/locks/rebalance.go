@@ -0,0 +1,598 @@
+package locks
+
+import(
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "sort"
+    "sync"
+    "time"
+)
+
+/* Rebalancing is split between a policy, which looks at load and decides which
+   locks should move where, and the master, which carries out the moves. The
+   policy runs inside Apply on every master, so it must be deterministic given
+   the same view, and every master must run it with the same settings. The
+   policy and its settings are therefore replicated: the master leader writes
+   the policy it was created with into the log, and every master plans with
+   the policy last written there. Until then locks only move by admin
+   command. */
+
+/* Destination of a LockTransfer that recruits a new replica group. */
+const NewGroup = ReplicaGroupId(-2)
+
+/* Read-only view of master state given to a RebalancePolicy. */
+type LoadView interface {
+    /* All replica groups in ID order, including retired ones. */
+    Groups() []ReplicaGroupId
+    /* Number of locks stored at group. */
+    NumLocks(replicaGroup ReplicaGroupId) int
+    GroupFreq(replicaGroup ReplicaGroupId) float64
+    GroupLastUpdate(replicaGroup ReplicaGroupId) time.Time
+    /* Latest load reported by group; NumLocks is always current. */
+    GroupLoad(replicaGroup ReplicaGroupId) WorkerLoad
+    /* True if locks are being moved off group or group is retired or draining. */
+    Rebalancing(replicaGroup ReplicaGroupId) bool
+    /* False if group stopped answering health probes. */
+    Healthy(replicaGroup ReplicaGroupId) bool
+    /* Locks stored at group, in lexicographic order. */
+    Locks(replicaGroup ReplicaGroupId) []Lock
+    LockFreq(l Lock) float64
+    LockDomain(l Lock) Domain
+    /* Groups where new locks in domain may be placed. */
+    DomainGroups(d Domain) []ReplicaGroupId
+    /* True if domain's placement policy allows group. */
+    PlacementAllowed(d Domain, replicaGroup ReplicaGroupId) bool
+    /* True if lock is pinned to the group it is stored at. */
+    Pinned(l Lock) bool
+    /* True if lock's domain places locks by consistent hashing. Such locks
+       only move when their domain's ring changes. */
+    Hashed(l Lock) bool
+    /* Number of worker clusters left to recruit. */
+    SpareGroups() int
+    /* Time of latest command applied, the same on every master. */
+    Now() time.Time
+}
+
+/* Move locks from one replica group to another, or to a newly recruited group
+   if To is NewGroup. */
+type LockTransfer struct {
+    From    ReplicaGroupId
+    To      ReplicaGroupId
+    Locks   []Lock
+}
+
+type RebalancePolicy interface {
+    /* Name the policy's type is registered under. */
+    Name() string
+    /* Called after every load change; returns the transfers to start, or
+       nothing to leave placement as is. */
+    Plan(view LoadView) []LockTransfer
+    /* Relative load of group. New locks go to the least loaded group allowed. */
+    Load(view LoadView, replicaGroup ReplicaGroupId) float64
+}
+
+/* Policy that never moves locks, for static placement. Locks can still be
+   moved with admin commands. */
+type StaticPolicy struct {}
+
+func (p StaticPolicy) Name() string {
+    return "static"
+}
+
+func (p StaticPolicy) Plan(view LoadView) []LockTransfer {
+    return nil
+}
+
+func (p StaticPolicy) Load(view LoadView, replicaGroup ReplicaGroupId) float64 {
+    return view.GroupFreq(replicaGroup)
+}
+
+/* Default policy. Splits a group whose access frequency goes over MaxFreq,
+   first by handing locks to other groups serving the same domains and
+   otherwise by recruiting a new group, and retires a group that stays under
+   MinFreq for MaxInactivePeriods. Once no groups are left to recruit, the split
+   threshold becomes StabilizeFactor times the average group frequency. A group
+   reaching any of Limits is split too, and locks only move to groups that stay
+   under them. */
+type FrequencyPolicy struct {
+    /* Threshold at which to split. */
+    MaxFreq             float64
+    /* Threshold at which to join. */
+    MinFreq             float64
+    /* Ideal frequency of accesses at worker cluster. */
+    IdealFreq           float64
+    /* Max number of inactive periods before join. */
+    MaxInactivePeriods  int
+    /* Per group limits on other load measures; zero means no limit. */
+    Limits              WorkerLoad
+    StabilizeFactor     float64
+    IdealFactor         float64
+    Period              time.Duration
+}
+
+func NewFrequencyPolicy(maxFreq float64, minFreq float64, idealFreq float64, maxInactivePeriods int) *FrequencyPolicy {
+    return &FrequencyPolicy{
+        MaxFreq:            maxFreq,
+        MinFreq:            minFreq,
+        IdealFreq:          idealFreq,
+        MaxInactivePeriods: maxInactivePeriods,
+        StabilizeFactor:    STABILIZE_FACTOR,
+        IdealFactor:        IDEAL_FACTOR,
+        Period:             PERIOD,
+    }
+}
+
+func (p *FrequencyPolicy) Name() string {
+    return "frequency"
+}
+
+func (p *FrequencyPolicy) Plan(view LoadView) []LockTransfer {
+    /* Trigger rebalancing if frequency of replica group >= rebalance threshold. */
+    overworkedWorker := p.findOverworkedWorker(view)
+    if overworkedWorker != NO_WORKER {
+        return p.shedLoad(view, overworkedWorker)
+    }
+    underworkedWorker := p.findUnderworkedWorker(view)
+    if underworkedWorker != NO_WORKER {
+        return p.retireWorker(view, underworkedWorker)
+    }
+    return nil
+}
+
+/* Relative load of group: each measure as a fraction of its threshold, summed. */
+func (p *FrequencyPolicy) Load(view LoadView, replicaGroup ReplicaGroupId) float64 {
+    load := view.GroupLoad(replicaGroup)
+    score := fraction(view.GroupFreq(replicaGroup), p.MaxFreq)
+    score += fraction(float64(load.NumLocks), float64(p.Limits.NumLocks))
+    score += fraction(float64(load.NumSessions), float64(p.Limits.NumSessions))
+    score += fraction(float64(load.NumHeld), float64(p.Limits.NumHeld))
+    score += fraction(float64(load.QueueDepth), float64(p.Limits.QueueDepth))
+    score += fraction(float64(load.ApplyLatency), float64(p.Limits.ApplyLatency))
+    return score
+}
+
+func fraction(value float64, limit float64) float64 {
+    if limit <= 0 {
+        return 0
+    }
+    return value / limit
+}
+
+/* True if load reaches any of the policy's limits. */
+func (p *FrequencyPolicy) overLimits(load WorkerLoad) bool {
+    over := func(value int64, limit int64) bool {
+        return limit > 0 && value >= limit
+    }
+    return over(int64(load.NumLocks), int64(p.Limits.NumLocks)) ||
+        over(int64(load.NumSessions), int64(p.Limits.NumSessions)) ||
+        over(int64(load.NumHeld), int64(p.Limits.NumHeld)) ||
+        over(int64(load.QueueDepth), int64(p.Limits.QueueDepth)) ||
+        over(int64(load.ApplyLatency), int64(p.Limits.ApplyLatency))
+}
+
+func (p *FrequencyPolicy) shedLoad(view LoadView, replicaGroup ReplicaGroupId) []LockTransfer {
+    var locksToMove []Lock
+    overFreq := view.GroupFreq(replicaGroup) >= p.calcMaxFreq(view)
+    if overFreq {
+        locksToMove = movableLocks(view, p.getLocksToShedLoadToIdeal(view, replicaGroup))
+    } else {
+        locksToMove = movableLocks(view, getLocksToSplitByCount(view, replicaGroup))
+    }
+    if len(locksToMove) == 0 {
+        /* Recruiting a group takes load off a group storing hashed locks
+           by giving the new group a slice of their rings. */
+        if view.SpareGroups() > 0 && storesHashedLocks(view, replicaGroup) {
+            return []LockTransfer{{replicaGroup, NewGroup, nil}}
+        }
+        return nil
+    }
+    if transfers := p.tryRedistributeLocks(view, replicaGroup, locksToMove); transfers != nil {
+        return transfers
+    }
+    if overFreq {
+        locksToMove = movableLocks(view, p.getLocksToSplitEvenly(view, replicaGroup))
+    }
+    if view.SpareGroups() > 0 && len(locksToMove) > 0 {
+        return []LockTransfer{{replicaGroup, NewGroup, locksToMove}}
+    }
+    return nil
+}
+
+func (p *FrequencyPolicy) retireWorker(view LoadView, replicaGroup ReplicaGroupId) []LockTransfer {
+    locksToMove := view.Locks(replicaGroup)
+    /* Group can't retire while it stores locks pinned to it. */
+    if len(movableLocks(view, locksToMove)) < len(locksToMove) {
+        return nil
+    }
+    return p.tryRedistributeLocks(view, replicaGroup, locksToMove)
+}
+
+/* Spread locks over other groups serving their domains. Returns nil if some
+   lock has nowhere to go. */
+func (p *FrequencyPolicy) tryRedistributeLocks(view LoadView, replicaGroup ReplicaGroupId, locksToRedistribute []Lock) []LockTransfer {
+    redistributeMap := make(map[ReplicaGroupId][]Lock)
+    anticipatedAdditionalLoad := make(map[ReplicaGroupId]float64)
+    anticipatedAdditionalLocks := make(map[ReplicaGroupId]int)
+    for _, l := range locksToRedistribute {
+        newReplicaGroup := p.getWorkerToTakeLock(view, l, replicaGroup, anticipatedAdditionalLoad, anticipatedAdditionalLocks)
+        if newReplicaGroup == NO_WORKER {
+            /* abort if no other worker to join with. */
+            return nil
+        }
+        anticipatedAdditionalLoad[newReplicaGroup] += view.LockFreq(l)
+        anticipatedAdditionalLocks[newReplicaGroup]++
+        redistributeMap[newReplicaGroup] = append(redistributeMap[newReplicaGroup], l)
+    }
+    targets := make([]int, 0)
+    for newReplicaGroup := range redistributeMap {
+        targets = append(targets, int(newReplicaGroup))
+    }
+    sort.Ints(targets)
+    transfers := make([]LockTransfer, 0)
+    for _, target := range targets {
+        transfers = append(transfers, LockTransfer{replicaGroup, ReplicaGroupId(target), redistributeMap[ReplicaGroupId(target)]})
+    }
+    return transfers
+}
+
+/* Least loaded group serving lock's domain that can take the lock without
+   going over the split threshold or limits; NO_WORKER if there is none. */
+func (p *FrequencyPolicy) getWorkerToTakeLock(view LoadView, l Lock, replicaGroup ReplicaGroupId, anticipatedAdditionalLoad map[ReplicaGroupId]float64, anticipatedAdditionalLocks map[ReplicaGroupId]int) ReplicaGroupId {
+    lockFreq := view.LockFreq(l)
+    maxFreq := p.calcMaxFreq(view)
+    d := view.LockDomain(l)
+    chosen := NO_WORKER
+    minLoad := 0.0
+    for _, domainGroup := range view.DomainGroups(d) {
+        if domainGroup == replicaGroup || view.Rebalancing(domainGroup) || !view.Healthy(domainGroup) || !view.PlacementAllowed(d, domainGroup) {
+            continue
+        }
+        if view.GroupFreq(domainGroup) + anticipatedAdditionalLoad[domainGroup] + lockFreq >= maxFreq {
+            continue
+        }
+        groupLoad := view.GroupLoad(domainGroup)
+        groupLoad.NumLocks += anticipatedAdditionalLocks[domainGroup] + 1
+        if p.overLimits(groupLoad) {
+            continue
+        }
+        load := p.Load(view, domainGroup)
+        if chosen == NO_WORKER || load < minLoad {
+            chosen = domainGroup
+            minLoad = load
+        }
+    }
+    return chosen
+}
+
+func (p *FrequencyPolicy) calcMaxFreq(view LoadView) float64 {
+    if view.SpareGroups() == 0 {
+        return p.StabilizeFactor * getTotalFreq(view) / float64(len(view.Groups()))
+    }
+    return p.MaxFreq
+}
+
+func (p *FrequencyPolicy) findOverworkedWorker(view LoadView) ReplicaGroupId {
+    maxFreq := p.calcMaxFreq(view)
+    for _, replicaGroup := range view.Groups() {
+        overloaded := view.GroupFreq(replicaGroup) >= maxFreq || p.overLimits(view.GroupLoad(replicaGroup))
+        if overloaded && !view.Rebalancing(replicaGroup) && view.Healthy(replicaGroup) {
+            return replicaGroup
+        }
+    }
+    return NO_WORKER
+}
+
+func (p *FrequencyPolicy) findUnderworkedWorker(view LoadView) ReplicaGroupId {
+    for _, replicaGroup := range view.Groups() {
+        inactivePeriods := view.Now().Sub(view.GroupLastUpdate(replicaGroup)) / p.Period
+        if view.GroupFreq(replicaGroup) <= p.MinFreq && inactivePeriods >= time.Duration(p.MaxInactivePeriods) && !view.Rebalancing(replicaGroup) && view.Healthy(replicaGroup) {
+            return replicaGroup
+        }
+    }
+    return NO_WORKER
+}
+
+// Lexicographically split evenly based on frequency of access
+func (p *FrequencyPolicy) getLocksToSplitEvenly(view LoadView, replicaGroup ReplicaGroupId) []Lock {
+    totFreq := view.GroupFreq(replicaGroup)
+    currSplitFreq := 0.0
+    splitLocks := make([]Lock, 0)
+    for _, l := range view.Locks(replicaGroup) {
+        if currSplitFreq >= totFreq / 2.0 {
+            return splitLocks
+        }
+        currSplitFreq += view.LockFreq(l)
+        splitLocks = append(splitLocks, l)
+    }
+    return splitLocks
+}
+
+func (p *FrequencyPolicy) getLocksToShedLoadToIdeal(view LoadView, replicaGroup ReplicaGroupId) []Lock {
+    idealFreq := p.IdealFreq
+    if view.SpareGroups() == 0 {
+        idealFreq = (getTotalFreq(view) / float64(len(view.Groups()))) * p.IdealFactor
+    }
+    goalFreq := view.GroupFreq(replicaGroup) - idealFreq
+    currSplitFreq := 0.0
+    splitLocks := make([]Lock, 0)
+    for _, l := range view.Locks(replicaGroup) {
+        if currSplitFreq >= goalFreq {
+            return splitLocks
+        }
+        currSplitFreq += view.LockFreq(l)
+        splitLocks = append(splitLocks, l)
+    }
+    return splitLocks
+}
+
+/* First half of group's locks in lexicographic order. */
+func getLocksToSplitByCount(view LoadView, replicaGroup ReplicaGroupId) []Lock {
+    lockList := view.Locks(replicaGroup)
+    return lockList[:(len(lockList) + 1) / 2]
+}
+
+func getTotalFreq(view LoadView) float64 {
+    total := 0.0
+    for _, replicaGroup := range view.Groups() {
+        total += view.GroupFreq(replicaGroup)
+    }
+    return total
+}
+
+func storesHashedLocks(view LoadView, replicaGroup ReplicaGroupId) bool {
+    for _, l := range view.Locks(replicaGroup) {
+        if view.Hashed(l) {
+            return true
+        }
+    }
+    return false
+}
+
+/* Removes locks that rebalancing may not move. */
+func movableLocks(view LoadView, lockArr []Lock) []Lock {
+    movable := make([]Lock, 0)
+    for _, l := range lockArr {
+        if !view.Pinned(l) && !view.Hashed(l) {
+            movable = append(movable, l)
+        }
+    }
+    return movable
+}
+
+/* Master side. */
+
+/* LoadView backed by master state. Only used while FSM is locked. */
+type masterLoadView struct {
+    m   *MasterFSM
+}
+
+func (v *masterLoadView) Groups() []ReplicaGroupId {
+    return v.m.sortedGroups()
+}
+
+func (v *masterLoadView) NumLocks(replicaGroup ReplicaGroupId) int {
+    return v.m.NumLocksHeld[replicaGroup]
+}
+
+func (v *masterLoadView) GroupFreq(replicaGroup ReplicaGroupId) float64 {
+    return v.m.GroupFreqStatsMap[replicaGroup].AvgFreq
+}
+
+func (v *masterLoadView) GroupLastUpdate(replicaGroup ReplicaGroupId) time.Time {
+    return v.m.GroupFreqStatsMap[replicaGroup].LastUpdate
+}
+
+func (v *masterLoadView) GroupLoad(replicaGroup ReplicaGroupId) WorkerLoad {
+    return v.m.groupLoad(replicaGroup)
+}
+
+func (v *masterLoadView) Rebalancing(replicaGroup ReplicaGroupId) bool {
+    return v.m.RebalancingInProgress[replicaGroup] || v.m.DrainingGroups[replicaGroup]
+}
+
+func (v *masterLoadView) Healthy(replicaGroup ReplicaGroupId) bool {
+    return v.m.isHealthy(replicaGroup)
+}
+
+func (v *masterLoadView) Locks(replicaGroup ReplicaGroupId) []Lock {
+    lockList := make([]Lock, 0)
+    for _, l := range v.m.sortedLocks() {
+        if v.m.LockMap[l] == replicaGroup {
+            lockList = append(lockList, l)
+        }
+    }
+    return lockList
+}
+
+func (v *masterLoadView) LockFreq(l Lock) float64 {
+    return v.m.LockFreqStatsMap[l].AvgFreq
+}
+
+func (v *masterLoadView) LockDomain(l Lock) Domain {
+    return getParentDomain(string(l))
+}
+
+func (v *masterLoadView) DomainGroups(d Domain) []ReplicaGroupId {
+    return append([]ReplicaGroupId{}, v.m.DomainPlacementMap[d]...)
+}
+
+func (v *masterLoadView) PlacementAllowed(d Domain, replicaGroup ReplicaGroupId) bool {
+    return v.m.placementAllowed(d, replicaGroup)
+}
+
+func (v *masterLoadView) Pinned(l Lock) bool {
+    return v.m.isPinned(l)
+}
+
+func (v *masterLoadView) Hashed(l Lock) bool {
+    return v.m.isHashed(getParentDomain(string(l)))
+}
+
+func (v *masterLoadView) SpareGroups() int {
+    return v.m.spareGroups()
+}
+
+func (v *masterLoadView) Now() time.Time {
+    return v.m.Clock
+}
+
+/* Rebalance policy as replicated between masters: the name of its type and
+   its settings encoded as JSON. The zero value means no policy. */
+type PolicySpec struct {
+    Name        string
+    Settings    json.RawMessage
+}
+
+var policyTypesLock sync.RWMutex
+
+/* Policy types by name, each returning an empty policy to decode settings into. */
+var policyTypes = map[string]func() RebalancePolicy{
+    "static":       func() RebalancePolicy { return &StaticPolicy{} },
+    "frequency":    func() RebalancePolicy { return &FrequencyPolicy{} },
+}
+
+/* Register a custom policy type, so masters can decode its settings from the
+   log. Every master must register the same types before it is created. */
+func RegisterRebalancePolicy(name string, newPolicy func() RebalancePolicy) {
+    policyTypesLock.Lock()
+    defer policyTypesLock.Unlock()
+    policyTypes[name] = newPolicy
+}
+
+/* Spec of policy, or the zero spec for nil. */
+func specOf(policy RebalancePolicy) (PolicySpec, error) {
+    if policy == nil {
+        return PolicySpec{}, nil
+    }
+    policyTypesLock.RLock()
+    _, ok := policyTypes[policy.Name()]
+    policyTypesLock.RUnlock()
+    if !ok {
+        return PolicySpec{}, fmt.Errorf("rebalance policy %q not registered", policy.Name())
+    }
+    settings, err := json.Marshal(policy)
+    if err != nil {
+        return PolicySpec{}, err
+    }
+    return PolicySpec{policy.Name(), settings}, nil
+}
+
+/* Decode policy from spec; nil for the zero spec. */
+func (s PolicySpec) policy() (RebalancePolicy, error) {
+    if s.Name == "" {
+        return nil, nil
+    }
+    policyTypesLock.RLock()
+    newPolicy, ok := policyTypes[s.Name]
+    policyTypesLock.RUnlock()
+    if !ok {
+        return nil, fmt.Errorf("rebalance policy %q not registered", s.Name)
+    }
+    policy := newPolicy()
+    if err := json.Unmarshal(s.Settings, policy); err != nil {
+        return nil, err
+    }
+    return policy, nil
+}
+
+func (s PolicySpec) equal(other PolicySpec) bool {
+    return s.Name == other.Name && bytes.Equal(s.Settings, other.Settings)
+}
+
+/* Plan with the policy in spec from now on. Policies that can't be decoded
+   are refused, which every master does alike. */
+func (m *MasterFSM) setRebalancePolicy(spec PolicySpec) PolicyResponse {
+    policy, err := spec.policy()
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    if err != nil {
+        m.logger.Warn("refusing rebalance policy", "policy", spec.Name, "error", err)
+        return PolicyResponse{ErrInvalidRequest}
+    }
+    m.Policy = spec
+    m.policy = policy
+    m.rebalanceLogger().Debug("rebalance policy set", "policy", spec.Name, "settings", string(spec.Settings))
+    return PolicyResponse{Success}
+}
+
+type PolicyResponse struct {
+    Err     *LockError
+}
+
+func rebalancePolicyCommand(spec PolicySpec) ([]byte, error) {
+    specJSON, err := json.Marshal(spec)
+    if err != nil {
+        return nil, err
+    }
+    args := make(map[string]string)
+    args[FunctionKey] = RebalancePolicyCommand
+    args[PolicyKey] = string(specJSON)
+    return json.Marshal(args)
+}
+
+/* Load of group as weighed by rebalance policy, used to choose where to place
+   new locks. Assumes FSM already locked. */
+func (m *MasterFSM) placementLoad(replicaGroup ReplicaGroupId) float64 {
+    if m.policy == nil {
+        return m.GroupFreqStatsMap[replicaGroup].AvgFreq
+    }
+    return m.policy.Load(&masterLoadView{m}, replicaGroup)
+}
+
+/* Start the transfers in a rebalance plan. Transfers from groups that were
+   already rebalancing or to groups that can't take locks are skipped, as are
+   locks not stored at the source or not allowed at the destination.
+   Assumes FSM already locked. */
+func (m *MasterFSM) applyRebalancePlan(plan []LockTransfer) []func() [][]byte {
+    busy := make(map[ReplicaGroupId]bool)
+    for replicaGroup := range m.RebalancingInProgress {
+        busy[replicaGroup] = true
+    }
+    callbacks := make([]func() [][]byte, 0)
+    logger := m.rebalanceLogger()
+    for _, transfer := range plan {
+        oldGroup := transfer.From
+        newGroup := transfer.To
+        if _, ok := m.ClusterMap[oldGroup]; !ok || busy[oldGroup] || !m.isHealthy(oldGroup) {
+            logger.Trace("skipped planned transfer, source busy or unavailable", "from", oldGroup, "to", newGroup)
+            continue
+        }
+        if newGroup == NewGroup {
+            if m.spareGroups() == 0 {
+                logger.Debug("skipped planned split, no spare groups", "from", oldGroup, "locks", len(transfer.Locks))
+                continue
+            }
+            callbacks = append(callbacks, m.splitToNewWorker(oldGroup, m.locksAt(oldGroup, transfer.Locks))...)
+            continue
+        }
+        if _, ok := m.ClusterMap[newGroup]; !ok || newGroup == oldGroup || m.RebalancingInProgress[newGroup] || m.DrainingGroups[newGroup] || !m.isHealthy(newGroup) {
+            logger.Trace("skipped planned transfer, destination busy or unavailable", "from", oldGroup, "to", newGroup)
+            continue
+        }
+        locksToMove := make([]Lock, 0)
+        for _, l := range m.locksAt(oldGroup, transfer.Locks) {
+            if m.placementAllowed(getParentDomain(string(l)), newGroup) {
+                locksToMove = append(locksToMove, l)
+            }
+        }
+        if len(locksToMove) == 0 {
+            continue
+        }
+        m.RebalancingInProgress[oldGroup] = true
+        m.patchReferencesToOldWorker(oldGroup, newGroup, locksToMove)
+        callbacks = append(callbacks, m.startTransfer(oldGroup, newGroup, locksToMove)...)
+    }
+    return callbacks
+}
+
+/* Filters out locks not stored at replica group. Assumes FSM already locked. */
+func (m *MasterFSM) locksAt(replicaGroup ReplicaGroupId, lockArr []Lock) []Lock {
+    stored := make([]Lock, 0)
+    for _, l := range lockArr {
+        if storedAt, ok := m.LockMap[l]; ok && storedAt == replicaGroup {
+            stored = append(stored, l)
+        }
+    }
+    return stored
+}
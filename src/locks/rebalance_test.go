@@ -0,0 +1,320 @@
+package locks
+
+import(
+    "encoding/json"
+    "reflect"
+    "sort"
+    "testing"
+    "time"
+)
+
+/* LoadView over hand-written load, with every group serving domain "/". */
+type fakeView struct {
+    groupFreq   map[ReplicaGroupId]float64
+    lastUpdate  map[ReplicaGroupId]time.Time
+    load        map[ReplicaGroupId]WorkerLoad
+    rebalancing map[ReplicaGroupId]bool
+    unhealthy   map[ReplicaGroupId]bool
+    excluded    map[ReplicaGroupId]bool
+    lockGroup   map[Lock]ReplicaGroupId
+    lockFreq    map[Lock]float64
+    pinned      map[Lock]bool
+    hashed      map[Lock]bool
+    spare       int
+    now         time.Time
+}
+
+func newFakeView(groupFreq map[ReplicaGroupId]float64, lockGroup map[Lock]ReplicaGroupId, lockFreq map[Lock]float64) *fakeView {
+    v := &fakeView{
+        groupFreq:   groupFreq,
+        lastUpdate:  make(map[ReplicaGroupId]time.Time),
+        load:        make(map[ReplicaGroupId]WorkerLoad),
+        rebalancing: make(map[ReplicaGroupId]bool),
+        unhealthy:   make(map[ReplicaGroupId]bool),
+        excluded:    make(map[ReplicaGroupId]bool),
+        lockGroup:   lockGroup,
+        lockFreq:    lockFreq,
+        pinned:      make(map[Lock]bool),
+        hashed:      make(map[Lock]bool),
+        spare:       1,
+        now:         testTime(100),
+    }
+    for replicaGroup := range groupFreq {
+        v.lastUpdate[replicaGroup] = v.now
+    }
+    return v
+}
+
+func (v *fakeView) Groups() []ReplicaGroupId {
+    groups := make([]int, 0)
+    for replicaGroup := range v.groupFreq {
+        groups = append(groups, int(replicaGroup))
+    }
+    sort.Ints(groups)
+    ids := make([]ReplicaGroupId, 0)
+    for _, replicaGroup := range groups {
+        ids = append(ids, ReplicaGroupId(replicaGroup))
+    }
+    return ids
+}
+
+func (v *fakeView) NumLocks(replicaGroup ReplicaGroupId) int {
+    return len(v.Locks(replicaGroup))
+}
+
+func (v *fakeView) GroupFreq(replicaGroup ReplicaGroupId) float64 {
+    return v.groupFreq[replicaGroup]
+}
+
+func (v *fakeView) GroupLastUpdate(replicaGroup ReplicaGroupId) time.Time {
+    return v.lastUpdate[replicaGroup]
+}
+
+func (v *fakeView) GroupLoad(replicaGroup ReplicaGroupId) WorkerLoad {
+    load := v.load[replicaGroup]
+    load.NumLocks = v.NumLocks(replicaGroup)
+    return load
+}
+
+func (v *fakeView) Rebalancing(replicaGroup ReplicaGroupId) bool {
+    return v.rebalancing[replicaGroup]
+}
+
+func (v *fakeView) Healthy(replicaGroup ReplicaGroupId) bool {
+    return !v.unhealthy[replicaGroup]
+}
+
+func (v *fakeView) Locks(replicaGroup ReplicaGroupId) []Lock {
+    names := make([]string, 0)
+    for l, lockGroup := range v.lockGroup {
+        if lockGroup == replicaGroup {
+            names = append(names, string(l))
+        }
+    }
+    sort.Strings(names)
+    lockArr := make([]Lock, 0)
+    for _, l := range names {
+        lockArr = append(lockArr, Lock(l))
+    }
+    return lockArr
+}
+
+func (v *fakeView) LockFreq(l Lock) float64 {
+    return v.lockFreq[l]
+}
+
+func (v *fakeView) LockDomain(l Lock) Domain {
+    return getParentDomain(string(l))
+}
+
+func (v *fakeView) DomainGroups(d Domain) []ReplicaGroupId {
+    return v.Groups()
+}
+
+func (v *fakeView) PlacementAllowed(d Domain, replicaGroup ReplicaGroupId) bool {
+    return !v.excluded[replicaGroup]
+}
+
+func (v *fakeView) Pinned(l Lock) bool {
+    return v.pinned[l]
+}
+
+func (v *fakeView) Hashed(l Lock) bool {
+    return v.hashed[l]
+}
+
+func (v *fakeView) SpareGroups() int {
+    return v.spare
+}
+
+func (v *fakeView) Now() time.Time {
+    return v.now
+}
+
+/* Group 0 over the split threshold with four locks, group 1 nearly idle. */
+func overloadedView() *fakeView {
+    return newFakeView(
+        map[ReplicaGroupId]float64{0: 12, 1: 1},
+        map[Lock]ReplicaGroupId{"/l1": 0, "/l2": 0, "/l3": 0, "/l4": 0, "/l5": 1},
+        map[Lock]float64{"/l1": 4, "/l2": 4, "/l3": 2, "/l4": 2, "/l5": 1})
+}
+
+func testPolicy() *FrequencyPolicy {
+    return NewFrequencyPolicy(10, 0.5, 5, 3)
+}
+
+func TestStaticPolicyNeverMovesLocks(t *testing.T) {
+    view := overloadedView()
+    view.groupFreq[1] = 0
+    view.lastUpdate[1] = testTime(0)
+    if plan := (StaticPolicy{}).Plan(view); len(plan) != 0 {
+        t.Fatalf("static policy planned %v", plan)
+    }
+    if load := (StaticPolicy{}).Load(view, 0); load != 12 {
+        t.Fatalf("static policy load should be group frequency, got %v", load)
+    }
+}
+
+func TestFrequencyPolicyShedsToOtherGroup(t *testing.T) {
+    plan := testPolicy().Plan(overloadedView())
+    /* Sheds down to IdealFreq: 12 - 5 = 7 needs /l1 and /l2. */
+    want := []LockTransfer{{0, 1, []Lock{"/l1", "/l2"}}}
+    if !reflect.DeepEqual(plan, want) {
+        t.Fatalf("got %v, want %v", plan, want)
+    }
+}
+
+func TestFrequencyPolicyRecruitsWhenNoGroupCanTakeLocks(t *testing.T) {
+    view := overloadedView()
+    view.groupFreq[1] = 9
+    plan := testPolicy().Plan(view)
+    /* Splits evenly by frequency: /l1 and /l2 make half of 12. */
+    want := []LockTransfer{{0, NewGroup, []Lock{"/l1", "/l2"}}}
+    if !reflect.DeepEqual(plan, want) {
+        t.Fatalf("got %v, want %v", plan, want)
+    }
+
+    view.spare = 0
+    view.groupFreq[1] = 1
+    view.unhealthy[1] = true
+    if plan := testPolicy().Plan(view); len(plan) != 0 {
+        t.Fatalf("no spare groups and no healthy destination, but planned %v", plan)
+    }
+}
+
+func TestFrequencyPolicySkipsUnusableDestinations(t *testing.T) {
+    for _, mark := range []func(v *fakeView){
+        func(v *fakeView) { v.unhealthy[1] = true },
+        func(v *fakeView) { v.rebalancing[1] = true },
+        func(v *fakeView) { v.excluded[1] = true },
+    } {
+        view := overloadedView()
+        mark(view)
+        plan := testPolicy().Plan(view)
+        if len(plan) != 1 || plan[0].To != NewGroup {
+            t.Errorf("expected recruiting a new group, got %v", plan)
+        }
+    }
+}
+
+func TestFrequencyPolicyLeavesPinnedAndHashedLocks(t *testing.T) {
+    view := overloadedView()
+    view.pinned["/l1"] = true
+    plan := testPolicy().Plan(view)
+    want := []LockTransfer{{0, 1, []Lock{"/l2"}}}
+    if !reflect.DeepEqual(plan, want) {
+        t.Fatalf("got %v, want %v", plan, want)
+    }
+    view.pinned["/l2"] = true
+    if plan := testPolicy().Plan(view); len(plan) != 0 {
+        t.Fatalf("hottest locks pinned, but planned %v", plan)
+    }
+    /* A new group takes a slice of the hashed locks' ring instead. */
+    view.pinned["/l2"] = false
+    view.hashed["/l2"] = true
+    want = []LockTransfer{{0, NewGroup, nil}}
+    if plan := testPolicy().Plan(view); !reflect.DeepEqual(plan, want) {
+        t.Fatalf("got %v, want %v", plan, want)
+    }
+}
+
+func TestFrequencyPolicySplitsOnLimits(t *testing.T) {
+    view := overloadedView()
+    view.groupFreq[0] = 3
+    policy := testPolicy()
+    policy.Limits.NumLocks = 4
+    plan := policy.Plan(view)
+    /* First half of the locks by name; group 1 stays under the limit. */
+    want := []LockTransfer{{0, 1, []Lock{"/l1", "/l2"}}}
+    if !reflect.DeepEqual(plan, want) {
+        t.Fatalf("got %v, want %v", plan, want)
+    }
+    if load := policy.Load(view, 0); load != 3.0/10 + 1 {
+        t.Fatalf("load should add each measure as a fraction of its limit, got %v", load)
+    }
+}
+
+func TestFrequencyPolicyRetiresIdleGroup(t *testing.T) {
+    view := overloadedView()
+    view.groupFreq[0] = 3
+    view.groupFreq[1] = 0.1
+    policy := testPolicy()
+    if plan := policy.Plan(view); len(plan) != 0 {
+        t.Fatalf("group idle for less than MaxInactivePeriods retired: %v", plan)
+    }
+    view.lastUpdate[1] = view.now.Add(-3 * policy.Period)
+    want := []LockTransfer{{1, 0, []Lock{"/l5"}}}
+    if plan := policy.Plan(view); !reflect.DeepEqual(plan, want) {
+        t.Fatalf("got %v, want %v", plan, want)
+    }
+    view.pinned["/l5"] = true
+    if plan := policy.Plan(view); len(plan) != 0 {
+        t.Fatalf("group storing pinned lock retired: %v", plan)
+    }
+}
+
+func TestFrequencyPolicyStabilizesWithoutSpareGroups(t *testing.T) {
+    view := overloadedView()
+    view.spare = 0
+    /* Threshold becomes StabilizeFactor times the average of 6.5. */
+    if plan := testPolicy().Plan(view); len(plan) != 0 {
+        t.Fatalf("got %v, want no transfers", plan)
+    }
+}
+
+func TestPolicySpecRoundTrip(t *testing.T) {
+    policy := testPolicy()
+    policy.Limits = WorkerLoad{NumLocks: 100, ApplyLatency: time.Second}
+    for _, original := range []RebalancePolicy{policy, StaticPolicy{}} {
+        spec, err := specOf(original)
+        if err != nil {
+            t.Fatal(err)
+        }
+        data, _ := json.Marshal(spec)
+        var decodedSpec PolicySpec
+        json.Unmarshal(data, &decodedSpec)
+        if !decodedSpec.equal(spec) {
+            t.Fatalf("spec changed over the wire: %v, %v", spec, decodedSpec)
+        }
+        decoded, err := decodedSpec.policy()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if decoded.Name() != original.Name() || !reflect.DeepEqual(reflect.Indirect(reflect.ValueOf(decoded)).Interface(), reflect.Indirect(reflect.ValueOf(original)).Interface()) {
+            t.Fatalf("got %#v, want %#v", decoded, original)
+        }
+    }
+    if spec, err := specOf(nil); err != nil || spec.Name != "" {
+        t.Fatalf("nil policy should have zero spec, got %v, %v", spec, err)
+    }
+    if policy, err := (PolicySpec{}).policy(); err != nil || policy != nil {
+        t.Fatalf("zero spec should be no policy, got %v, %v", policy, err)
+    }
+    if _, err := (PolicySpec{Name: "unknown"}).policy(); err == nil {
+        t.Fatalf("unregistered policy decoded")
+    }
+}
+
+/* Masters created with different thresholds plan alike once the leader's
+   policy is applied. */
+func TestRebalancePolicyReplicated(t *testing.T) {
+    leader := testMaster()
+    leader.configuredPolicy = NewFrequencyPolicy(10, 0.5, 5, 3)
+    follower := testMaster()
+    follower.configuredPolicy = NewFrequencyPolicy(100, 0, 50, 30)
+    spec, err := specOf(leader.configuredPolicy)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, m := range []*MasterFSM{leader, follower} {
+        if response := m.setRebalancePolicy(spec); response.Err != nil {
+            t.Fatalf("policy refused: %v", response.Err)
+        }
+        if !reflect.DeepEqual(m.policy, leader.configuredPolicy) {
+            t.Fatalf("master plans with %#v, want leader's %#v", m.policy, leader.configuredPolicy)
+        }
+    }
+    if response := follower.setRebalancePolicy(PolicySpec{Name: "unknown"}); response.Err == nil || !follower.Policy.equal(spec) {
+        t.Fatalf("undecodable policy should be refused and leave policy as is")
+    }
+}
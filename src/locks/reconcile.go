@@ -0,0 +1,203 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "sort"
+    "time"
+)
+
+/* After a restart or change of leader, callbacks the old leader never ran
+   may have left workers out of step with the master: a lock created but never
+   claimed, or deleted but never disowned. Once it has applied the whole log,
+   a new master leader asks each replica group which locks it stores and
+   corrects the difference. Locks taking part in a transfer are left to the
+   transfer, and held locks are never taken from their holder. */
+
+/* Time between attempts to reconcile replica groups not yet reconciled. */
+var ReconcileInterval time.Duration = 2 * time.Second
+
+type InventoryResponse struct {
+    Locks   []Lock
+    /* Stored locks that are held, in order. */
+    Held    []Lock
+    Err     *LockError
+}
+
+/* Worker side. */
+
+/* Locks stored here, in order. */
+func (w *WorkerFSM) inventory() InventoryResponse {
+    w.FsmLock.RLock()
+    defer w.FsmLock.RUnlock()
+    stored := make([]string, 0)
+    for l := range w.LockStateMap {
+        stored = append(stored, string(l))
+    }
+    sort.Strings(stored)
+    locks := make([]Lock, 0)
+    held := make([]Lock, 0)
+    for _, l := range stored {
+        locks = append(locks, Lock(l))
+        if w.LockStateMap[Lock(l)].Held {
+            held = append(held, Lock(l))
+        }
+    }
+    return InventoryResponse{locks, held, Success}
+}
+
+/* Master side. */
+
+/* While leader, reconcile each replica group once per term of leadership. */
+func (m *MasterFSM) reconcileLoop(r *raft.Raft, stop chan struct{}) {
+    reconciled := make(map[ReplicaGroupId]bool)
+    caughtUp := false
+    ticker := time.NewTicker(ReconcileInterval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-stop:
+                return
+            case <-ticker.C:
+        }
+        if r.State() != raft.Leader {
+            reconciled = make(map[ReplicaGroupId]bool)
+            caughtUp = false
+            continue
+        }
+        if !caughtUp {
+            /* Master's view is only complete once earlier entries are applied. */
+            if r.Barrier(ReconcileInterval).Error() != nil {
+                continue
+            }
+            caughtUp = true
+        }
+        m.FsmLock.RLock()
+        groups := m.sortedGroups()
+        m.FsmLock.RUnlock()
+        for _, replicaGroup := range groups {
+            if !reconciled[replicaGroup] && m.reconcileGroup(replicaGroup) == nil {
+                reconciled[replicaGroup] = true
+            }
+        }
+    }
+}
+
+/* Have replica group claim the locks master places there that it lacks, and
+   disown the locks it stores that master places elsewhere or has deleted.
+   Held locks are never disowned. Locks may be created, deleted or moved
+   while the group is asked, so each claim and disown is checked against
+   master's view again just before it is sent. */
+func (m *MasterFSM) reconcileGroup(replicaGroup ReplicaGroupId) error {
+    inventory, err := m.askWorkerForInventory(replicaGroup)
+    if err != nil {
+        return err
+    }
+    storedSet := make(map[Lock]bool)
+    for _, l := range inventory.Locks {
+        storedSet[l] = true
+    }
+    held := make(map[Lock]bool)
+    for _, l := range inventory.Held {
+        held[l] = true
+    }
+    m.FsmLock.RLock()
+    missing := m.missingLocks(replicaGroup, m.sortedLocks(), storedSet)
+    m.FsmLock.RUnlock()
+    if len(missing) > 0 {
+        if err := m.askWorkerToClaimLocks(replicaGroup, missing, nil, nil, raft.NoTrace); err != nil {
+            return err
+        }
+    }
+    /* Claimed locks are checked with the stored ones, in case they were
+       deleted or moved while being claimed; they were claimed free. */
+    stored := append(append([]Lock{}, inventory.Locks...), missing...)
+    m.FsmLock.RLock()
+    extra := m.extraLocks(replicaGroup, stored, held)
+    m.FsmLock.RUnlock()
+    for storedAt, locks := range extra {
+        m.FsmLock.RLock()
+        locks = m.extraLocks(replicaGroup, locks, held)[storedAt]
+        var forward *LockForward
+        if storedAt != NO_WORKER {
+            forward = &LockForward{storedAt, m.ClusterMap[storedAt]}
+        }
+        m.FsmLock.RUnlock()
+        if len(locks) == 0 {
+            continue
+        }
+        if err := m.askWorkerToDisownLocks(replicaGroup, locks, forward, raft.NoTrace); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+/* Locks taking part in a transfer or waiting for release, which are left to
+   the transfer. Assumes FSM already locked. */
+func (m *MasterFSM) unsettledLocks() map[Lock]bool {
+    unsettled := make(map[Lock]bool)
+    for _, t := range m.TransferMap {
+        for _, l := range t.Locks {
+            unsettled[l] = true
+        }
+    }
+    for l := range m.RecalcitrantDestMap {
+        unsettled[l] = true
+    }
+    return unsettled
+}
+
+/* Those of locks that master places at replica group but aren't stored
+   there, in the order given. Unsettled locks are left out. Assumes FSM already
+   locked. */
+func (m *MasterFSM) missingLocks(replicaGroup ReplicaGroupId, locks []Lock, stored map[Lock]bool) []Lock {
+    unsettled := m.unsettledLocks()
+    missing := make([]Lock, 0)
+    for _, l := range locks {
+        if storedAt, ok := m.LockMap[l]; ok && storedAt == replicaGroup && !stored[l] && !unsettled[l] {
+            missing = append(missing, l)
+        }
+    }
+    return missing
+}
+
+/* Locks stored at replica group that master places elsewhere, by where
+   master places them, or NO_WORKER for locks master doesn't know. Held and
+   unsettled locks are left out. Assumes FSM already locked. */
+func (m *MasterFSM) extraLocks(replicaGroup ReplicaGroupId, stored []Lock, held map[Lock]bool) map[ReplicaGroupId][]Lock {
+    unsettled := m.unsettledLocks()
+    extra := make(map[ReplicaGroupId][]Lock)
+    for _, l := range stored {
+        storedAt, ok := m.LockMap[l]
+        if (ok && storedAt == replicaGroup) || unsettled[l] {
+            continue
+        }
+        if !ok {
+            storedAt = NO_WORKER
+        }
+        if held[l] {
+            m.logger.Warn("held lock not placed at group, leaving it", "lock", l, "group", replicaGroup, "placed", storedAt)
+            continue
+        }
+        extra[storedAt] = append(extra[storedAt], l)
+    }
+    return extra
+}
+
+func (m *MasterFSM) askWorkerForInventory(replicaGroup ReplicaGroupId) (InventoryResponse, error) {
+    args := make(map[string]string)
+    args[FunctionKey] = InventoryCommand
+    resp := raft.ClientResponse{}
+    var response InventoryResponse
+    if err := m.genericClusterRequest(replicaGroup, args, &resp, raft.NoTrace); err != nil {
+        return response, err
+    }
+    if unmarshal_err := json.Unmarshal(resp.ResponseData, &response); unmarshal_err != nil {
+        return response, ErrNotApplied
+    }
+    if response.Err != nil {
+        return response, response.Err
+    }
+    return response, nil
+}
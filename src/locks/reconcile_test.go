@@ -0,0 +1,111 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "reflect"
+    "sync"
+    "testing"
+    "time"
+)
+
+func TestInventoryReportsHeldLocks(t *testing.T) {
+    response := testWorker().inventory()
+    if !reflect.DeepEqual(response.Locks, []Lock{"/a/l1", "/a/l2", "/b/l3"}) || !reflect.DeepEqual(response.Held, []Lock{"/a/l1", "/a/l2"}) {
+        t.Fatalf("got %+v", response)
+    }
+}
+
+func TestExtraLocksLeavesHeldAndUnsettledLocks(t *testing.T) {
+    m := testMaster()
+    m.LockMap["/c/moved"] = 1
+    stored := []Lock{"/a/l1", "/a/l2", "/b/l3", "/c/moved", "/c/deleted", "/c/held"}
+    held := map[Lock]bool{"/c/held": true}
+    /* /a/l2 waits for release and /b/l3 is in a transfer. */
+    want := map[ReplicaGroupId][]Lock{1: {"/c/moved"}, NO_WORKER: {"/c/deleted"}}
+    if extra := m.extraLocks(0, stored, held); !reflect.DeepEqual(extra, want) {
+        t.Fatalf("got %v, want %v", extra, want)
+    }
+
+    /* Checked again before disowning: a transfer started and a lock was
+       created at the group since the inventory. */
+    m.TransferMap[5] = Transfer{Id: 5, From: 0, To: 1, Locks: []Lock{"/c/moved"}}
+    m.LockMap["/c/deleted"] = 0
+    if extra := m.extraLocks(0, []Lock{"/c/moved", "/c/deleted"}, held); len(extra) != 0 {
+        t.Fatalf("locks master now places here or is moving were still extra: %v", extra)
+    }
+}
+
+/* Master whose group 0 is a fake worker storing stored, recording the
+   requests it gets. onClaim runs when asked to claim. */
+func reconcileMaster(t *testing.T, stored []Lock, onClaim func(m *MasterFSM)) (*MasterFSM, func() []map[string]string) {
+    m := testMaster()
+    m.Trans = testTransport(t)
+    m.WorkerSessionMap = make(map[ReplicaGroupId]*raft.Session)
+    worker := testTransport(t)
+    t.Cleanup(func() {
+        worker.Close()
+        m.Trans.Close()
+    })
+    m.ClusterMap[0] = []raft.ServerAddress{worker.LocalAddr()}
+    var requestsLock sync.Mutex
+    requests := make([]map[string]string, 0)
+    serveResponses(worker, func(req *raft.ClientRequest) interface{} {
+        args := make(map[string]string)
+        json.Unmarshal(req.Entries[0].Data, &args)
+        requestsLock.Lock()
+        requests = append(requests, args)
+        requestsLock.Unlock()
+        switch args[FunctionKey] {
+            case InventoryCommand:
+                return InventoryResponse{stored, []Lock{}, Success}
+            case ClaimLocksCommand:
+                onClaim(m)
+        }
+        return nil
+    })
+    return m, func() []map[string]string {
+        requestsLock.Lock()
+        defer requestsLock.Unlock()
+        return requests
+    }
+}
+
+func TestReconcileClaimsMissingLocks(t *testing.T) {
+    m, requests := reconcileMaster(t, []Lock{"/a/l1"}, func(*MasterFSM) {})
+    m.LockMap["/c/new"] = 0
+    if err := m.reconcileGroup(0); err != nil {
+        t.Fatal(err)
+    }
+    got := requests()
+    if len(got) != 2 || got[1][FunctionKey] != ClaimLocksCommand || got[1][LockArrayKey] != lock_array_to_string([]Lock{"/c/new"}) {
+        t.Fatalf("got requests %v, want inventory and claim of /c/new", got)
+    }
+}
+
+func TestReconcileDisownsLockDeletedWhileClaimed(t *testing.T) {
+    deleteLock := func(m *MasterFSM) {
+        /* Master is read locked while it asks; the delete is applied once
+           the claim is answered, before the master looks again. */
+        go func() {
+            m.FsmLock.Lock()
+            delete(m.LockMap, "/c/new")
+            m.NumLocksHeld[0]--
+            m.FsmLock.Unlock()
+        }()
+        time.Sleep(50 * time.Millisecond)
+    }
+    m, requests := reconcileMaster(t, []Lock{"/a/l1"}, deleteLock)
+    m.LockMap["/c/new"] = 0
+    m.NumLocksHeld[0]++
+    if err := m.reconcileGroup(0); err != nil {
+        t.Fatal(err)
+    }
+    got := requests()
+    if len(got) != 3 || got[2][FunctionKey] != DisownLocksCommand || got[2][LockArrayKey] != lock_array_to_string([]Lock{"/c/new"}) {
+        t.Fatalf("got requests %v, want lock deleted while claimed to be disowned", got)
+    }
+    if _, ok := got[2][GroupArgKey]; ok {
+        t.Fatalf("deleted lock disowned with forward: %v", got[2])
+    }
+}
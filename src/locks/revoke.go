@@ -0,0 +1,302 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "sort"
+    "strconv"
+    "sync"
+    "time"
+)
+
+/* Revocation of recalcitrant locks. When a held lock has to move or be
+   deleted, the worker tells its holder with a revocation event sent to the
+   client's address, and the client's RevocationHandler is called so it can
+   release the lock soon. If the transfer settings set a deadline, the master
+   leader forces the release of any lock still held once the deadline passes;
+   the holder then gets a second, forced event. Events are resent until the
+   client answers or the deadline passes. */
+
+/* Time a holder has to release a recalcitrant lock before its release is
+   forced, for masters created from now on; 0 never forces. The master
+   leader's setting is written into the master log (see TransferSettings). */
+var RevocationDeadline time.Duration = 0
+
+/* Time between checks for revocation deadlines that have passed. */
+var RevocationCheckInterval time.Duration = time.Second
+
+/* Time between attempts to send a revocation event the client didn't answer. */
+var RevocationAlertRetryInterval time.Duration = 500 * time.Millisecond
+
+/* Attempts to send a revocation event with no deadline before giving up. */
+var RevocationAlertAttempts = 5
+
+/* Called on a lock holder when it is asked to release a lock. The deadline is
+   zero if the release will never be forced. If forced is true, the lock has
+   already been taken away. Runs on the event goroutine of the client's
+   transport; clients sharing a transport share its events, so each one's
+   handler is called. */
+type RevocationHandler func(l Lock, deadline time.Time, forced bool)
+
+type RevokeResponse struct {
+    Err     *LockError
+}
+
+/* Worker side. */
+
+/* Callback telling client it is asked to give up lock, or that it lost it.
+   Sent from its own goroutine so an unreachable client doesn't hold up the
+   worker. */
+func (w *WorkerFSM) revocationAlert(l Lock, client raft.ServerAddress, deadline time.Time, forced bool) func() [][]byte {
+    return func() [][]byte {
+        args := make(map[string]string)
+        args[FunctionKey] = RevocationEventCommand
+        args[LockArgKey] = string(l)
+        args[DeadlineKey] = time_to_string(deadline)
+        args[ForcedKey] = strconv.FormatBool(forced)
+        send, json_err := clientEventSender(client, args)
+        if json_err != nil {
+            return [][]byte{}
+        }
+        logger := w.logger.With("lock", l, "client", client, "forced", forced)
+        go sendClientEvent(send, deadline, logger)
+        return [][]byte{}
+    }
+}
+
+/* Function sending event with args to client. */
+func clientEventSender(client raft.ServerAddress, args map[string]string) (func() error, error) {
+    command, json_err := json.Marshal(args)
+    if json_err != nil {
+        return nil, json_err
+    }
+    return func() error {
+        resp := raft.ClientResponse{}
+        send_err := raft.SendSingletonRequestToCluster([]raft.ServerAddress{client}, command, &resp)
+        return requestError(send_err, &resp)
+    }, nil
+}
+
+/* Send event until the client answers. Gives up once deadline passes, as a
+   revoked lock's release is then forced, or after RevocationAlertAttempts if
+   there is no deadline. Returns whether the client answered. */
+func sendClientEvent(send func() error, deadline time.Time, logger raft.Logger) bool {
+    for attempt := 1; ; attempt++ {
+        err := send()
+        if err == nil {
+            return true
+        }
+        if deadline.IsZero() && attempt >= RevocationAlertAttempts {
+            logger.Warn("giving up on client event", "attempts", attempt, "error", err)
+            return false
+        }
+        if !deadline.IsZero() && time.Now().Add(RevocationAlertRetryInterval).After(deadline) {
+            logger.Warn("giving up on client event, deadline reached", "attempts", attempt, "error", err)
+            return false
+        }
+        logger.Debug("client event not answered, will retry", "attempt", attempt, "error", err)
+        time.Sleep(RevocationAlertRetryInterval)
+    }
+}
+
+/* Take recalcitrant lock away from its holder. Repeating it resends the
+   release alert to the master in case it was lost. */
+func (w *WorkerFSM) forceRelease(l Lock) (RevokeResponse, []func() [][]byte) {
+    w.FsmLock.Lock()
+    defer w.FsmLock.Unlock()
+    state, ok := w.LockStateMap[l]
+    if !ok {
+        return RevokeResponse{ErrLockDoesntExist}, []func() [][]byte{}
+    }
+    if !state.Recalcitrant {
+        return RevokeResponse{ErrInvalidRequest}, []func() [][]byte{}
+    }
+    callbacks := make([]func() [][]byte, 0)
+    if state.Held {
+        callbacks = append(callbacks, w.revocationAlert(l, state.Client, time.Time{}, true))
+        state.Held = false
+        state.Client = ""
+    }
+    state.Disabled = true
+    w.LockStateMap[l] = state
+    callbacks = append(callbacks, w.generateRecalcitrantReleaseAlert(l)...)
+    return RevokeResponse{Success}, callbacks
+}
+
+/* Master side. */
+
+/* Deadline for locks becoming recalcitrant now, or zero if there is none.
+   Only called on the leader; the result is replicated in the log. */
+func (m *MasterFSM) newRevocationDeadline() time.Time {
+    m.FsmLock.RLock()
+    revokeAfter := m.Settings.RevokeAfter
+    m.FsmLock.RUnlock()
+    if revokeAfter <= 0 {
+        return time.Time{}
+    }
+    return time.Now().Add(revokeAfter)
+}
+
+/* Assumes FSM already locked. */
+func (m *MasterFSM) setRevocationDeadline(l Lock, deadline time.Time) {
+    if !deadline.IsZero() {
+        m.RevokeDeadlineMap[l] = deadline
+    }
+}
+
+/* While leader, force the release of recalcitrant locks whose deadline passed. */
+func (m *MasterFSM) revocationLoop(r *raft.Raft, stop chan struct{}) {
+    ticker := time.NewTicker(RevocationCheckInterval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-stop:
+                return
+            case <-ticker.C:
+        }
+        if r.State() != raft.Leader {
+            continue
+        }
+        expired, groups := m.expiredRevocations(time.Now())
+        for _, l := range expired {
+            if err := m.askWorkerToForceRelease(groups[l], l); err != nil {
+                m.rebalanceLogger().Warn("forcing release failed, will retry", "lock", l, "group", groups[l], "error", err)
+            }
+        }
+    }
+}
+
+/* Recalcitrant locks whose deadline passed by now, in order, and the groups
+   storing them. */
+func (m *MasterFSM) expiredRevocations(now time.Time) ([]Lock, map[Lock]ReplicaGroupId) {
+    m.FsmLock.RLock()
+    defer m.FsmLock.RUnlock()
+    names := make([]string, 0)
+    for l, deadline := range m.RevokeDeadlineMap {
+        if now.After(deadline) {
+            names = append(names, string(l))
+        }
+    }
+    sort.Strings(names)
+    expired := make([]Lock, 0)
+    groups := make(map[Lock]ReplicaGroupId)
+    for _, l := range names {
+        expired = append(expired, Lock(l))
+        groups[Lock(l)] = m.LockMap[Lock(l)]
+    }
+    return expired, groups
+}
+
+func (m *MasterFSM) askWorkerToForceRelease(replicaGroup ReplicaGroupId, l Lock) error {
+    args := make(map[string]string)
+    args[FunctionKey] = RevokeLockCommand
+    args[LockArgKey] = string(l)
+    return m.genericClusterRequest(replicaGroup, args, &raft.ClientResponse{}, raft.NoTrace)
+}
+
+/* Client side. */
+
+/* Set function called when the service asks this client to release a lock. */
+func (lc *LockClient) SetRevocationHandler(handler RevocationHandler) {
+    lc.handlerLock.Lock()
+    defer lc.handlerLock.Unlock()
+    lc.revocationHandler = handler
+}
+
+/* Clients listening for events on a transport. Workers send events to a
+   client's address, so every client sharing a transport gets them; a single
+   goroutine per transport reads them until its last client is destroyed. */
+type eventListeners struct {
+    clients map[*LockClient]bool
+    stop    chan struct{}
+}
+
+var listeners = make(map[*raft.NetworkTransport]*eventListeners)
+var listenersLock sync.Mutex
+
+/* Start getting events sent to the client's transport. */
+func (lc *LockClient) listenForEvents() {
+    listenersLock.Lock()
+    defer listenersLock.Unlock()
+    l, ok := listeners[lc.trans]
+    if !ok {
+        l = &eventListeners{make(map[*LockClient]bool), make(chan struct{})}
+        listeners[lc.trans] = l
+        go serveEvents(lc.trans, l)
+    }
+    l.clients[lc] = true
+}
+
+/* Stop getting events, stopping the transport's goroutine if no client is
+   left on it. */
+func (lc *LockClient) stopListening() {
+    listenersLock.Lock()
+    defer listenersLock.Unlock()
+    l, ok := listeners[lc.trans]
+    if !ok || !l.clients[lc] {
+        return
+    }
+    delete(l.clients, lc)
+    if len(l.clients) == 0 {
+        close(l.stop)
+        delete(listeners, lc.trans)
+    }
+}
+
+/* Clients listening now. */
+func (l *eventListeners) current() []*LockClient {
+    listenersLock.Lock()
+    defer listenersLock.Unlock()
+    clients := make([]*LockClient, 0, len(l.clients))
+    for lc := range l.clients {
+        clients = append(clients, lc)
+    }
+    return clients
+}
+
+/* Answer events sent by workers to trans, passing them on to its clients. */
+func serveEvents(trans *raft.NetworkTransport, l *eventListeners) {
+    for {
+        var rpc raft.RPC
+        select {
+            case <-l.stop:
+                return
+            case rpc = <-trans.Consumer():
+        }
+        req, ok := rpc.Command.(*raft.ClientRequest)
+        if !ok || len(req.Entries) == 0 {
+            rpc.Respond(&raft.ClientResponse{Success: false}, nil)
+            continue
+        }
+        args := make(map[string]string)
+        if err := json.Unmarshal(req.Entries[0].Data, &args); err != nil {
+            rpc.Respond(&raft.ClientResponse{Success: false}, nil)
+            continue
+        }
+        clients := l.current()
+        switch args[FunctionKey] {
+            case LockMovedEventCommand:
+                /* Answered once followed, so the worker retries if it fails. */
+                followed := len(clients) > 0
+                for _, lc := range clients {
+                    if err := lc.followMovedLocks(args); err != nil {
+                        followed = false
+                    }
+                }
+                rpc.Respond(&raft.ClientResponse{Success: followed}, nil)
+            case RevocationEventCommand:
+                rpc.Respond(&raft.ClientResponse{Success: len(clients) > 0}, nil)
+                forced, _ := strconv.ParseBool(args[ForcedKey])
+                for _, lc := range clients {
+                    lc.handlerLock.Lock()
+                    handler := lc.revocationHandler
+                    lc.handlerLock.Unlock()
+                    if handler != nil {
+                        handler(Lock(args[LockArgKey]), string_to_time(args[DeadlineKey]), forced)
+                    }
+                }
+            default:
+                rpc.Respond(&raft.ClientResponse{Success: false}, nil)
+        }
+    }
+}
@@ -0,0 +1,151 @@
+package locks
+
+import(
+    "raft"
+    "errors"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestRevocationDeadlineFollowsSettings(t *testing.T) {
+    m := testMaster()
+    m.Settings = TransferSettings{}
+    if deadline := m.newRevocationDeadline(); !deadline.IsZero() {
+        t.Fatalf("no deadline set, but got %v", deadline)
+    }
+    m.setTransferSettings(TransferSettings{RevokeAfter: time.Minute})
+    deadline := m.newRevocationDeadline()
+    if left := time.Until(deadline); left <= 0 || left > time.Minute {
+        t.Fatalf("deadline should be a minute away, got %v", left)
+    }
+}
+
+func TestExpiredRevocations(t *testing.T) {
+    m := testMaster()
+    m.RevokeDeadlineMap["/b/l3"] = testTime(125)
+    if expired, _ := m.expiredRevocations(testTime(125)); len(expired) != 0 {
+        t.Fatalf("nothing is past its deadline, but got %v", expired)
+    }
+    expired, groups := m.expiredRevocations(testTime(126))
+    if !reflect.DeepEqual(expired, []Lock{"/b/l3"}) || groups["/b/l3"] != 1 {
+        t.Fatalf("got %v at %v, want /b/l3 at group 1", expired, groups)
+    }
+    expired, _ = m.expiredRevocations(testTime(131))
+    if !reflect.DeepEqual(expired, []Lock{"/a/l2", "/b/l3"}) {
+        t.Fatalf("got %v, want both locks in order", expired)
+    }
+}
+
+func TestForceRelease(t *testing.T) {
+    w := testWorker()
+    w.logger = raft.NopLogger()
+    if response, _ := w.forceRelease("/a/l9"); response.Err != ErrLockDoesntExist {
+        t.Fatalf("unknown lock: got %v", response.Err)
+    }
+    if response, _ := w.forceRelease("/a/l1"); response.Err != ErrInvalidRequest {
+        t.Fatalf("lock not recalcitrant: got %v", response.Err)
+    }
+    response, callbacks := w.forceRelease("/a/l2")
+    state := w.LockStateMap["/a/l2"]
+    if response.Err != nil || state.Held || state.Client != "" || !state.Disabled {
+        t.Fatalf("held lock not taken away: %v, %+v", response.Err, state)
+    }
+    /* Forced event to holder and release alert to master. */
+    if len(callbacks) != 2 {
+        t.Fatalf("got %d callbacks, want 2", len(callbacks))
+    }
+    /* Repeating only resends the release alert. */
+    if response, callbacks := w.forceRelease("/a/l2"); response.Err != nil || len(callbacks) != 1 {
+        t.Fatalf("repeat: got %v and %d callbacks, want 1", response.Err, len(callbacks))
+    }
+}
+
+func TestSendClientEventRetries(t *testing.T) {
+    defer func(interval time.Duration) { RevocationAlertRetryInterval = interval }(RevocationAlertRetryInterval)
+    RevocationAlertRetryInterval = time.Millisecond
+    unanswered := errors.New("unanswered")
+    sends := 0
+    failing := func(failures int) func() error {
+        sends = 0
+        return func() error {
+            sends++
+            if sends <= failures {
+                return unanswered
+            }
+            return nil
+        }
+    }
+    if !sendClientEvent(failing(2), time.Time{}, raft.NopLogger()) || sends != 3 {
+        t.Fatalf("event should be answered on third send, sent %d times", sends)
+    }
+    if sendClientEvent(failing(100), time.Time{}, raft.NopLogger()) || sends != RevocationAlertAttempts {
+        t.Fatalf("event without deadline sent %d times, want %d", sends, RevocationAlertAttempts)
+    }
+    deadline := time.Now().Add(20 * time.Millisecond)
+    if sendClientEvent(failing(10000), deadline, raft.NopLogger()) {
+        t.Fatalf("event never answered, but reported answered")
+    }
+    if time.Now().After(deadline.Add(20 * time.Millisecond)) || sends < 2 {
+        t.Fatalf("event should be resent until the deadline, sent %d times", sends)
+    }
+}
+
+/* Send revocation event for l to trans, returning whether it was answered. */
+func sendRevocation(t *testing.T, trans *raft.NetworkTransport, l Lock) bool {
+    args := map[string]string{FunctionKey: RevocationEventCommand, LockArgKey: string(l), DeadlineKey: time_to_string(time.Time{}), ForcedKey: "false"}
+    send, err := clientEventSender(trans.LocalAddr(), args)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return send() == nil
+}
+
+func TestClientsSharingTransportGetEvents(t *testing.T) {
+    trans := testTransport(t)
+    defer trans.Close()
+    revoked := make(chan string, 10)
+    client := func(name string) *LockClient {
+        lc, _ := CreateLockClient(trans, nil, raft.NopLogger())
+        lc.SetRevocationHandler(func(l Lock, deadline time.Time, forced bool) { revoked <- name })
+        return lc
+    }
+    first, second := client("first"), client("second")
+    if !sendRevocation(t, trans, "/a/l1") {
+        t.Fatalf("event not answered")
+    }
+    got := map[string]bool{<-revoked: true, <-revoked: true}
+    if !got["first"] || !got["second"] {
+        t.Fatalf("both clients should get the event, got %v", got)
+    }
+
+    /* A destroyed client gets no more events. */
+    first.DestroyLockClient()
+    sendRevocation(t, trans, "/a/l1")
+    if name := <-revoked; name != "second" {
+        t.Fatalf("destroyed client got event")
+    }
+    third := client("third")
+    sendRevocation(t, trans, "/a/l1")
+    got = map[string]bool{<-revoked: true, <-revoked: true}
+    if !got["second"] || !got["third"] || len(revoked) != 0 {
+        t.Fatalf("got %v", got)
+    }
+
+    /* The transport's goroutine stops with its last client. */
+    listenersLock.Lock()
+    l := listeners[trans]
+    listenersLock.Unlock()
+    second.DestroyLockClient()
+    third.DestroyLockClient()
+    select {
+        case <-l.stop:
+        default:
+            t.Fatalf("event goroutine not stopped")
+    }
+    listenersLock.Lock()
+    defer listenersLock.Unlock()
+    if _, ok := listeners[trans]; ok {
+        t.Fatalf("transport still listened on")
+    }
+}
@@ -0,0 +1,67 @@
+package locks
+
+import(
+    "encoding/json"
+    "fmt"
+)
+
+/* Master and worker snapshots are the FSM encoded as JSON, wrapped with the
+   version of the format so later versions can restore them. Version 1
+   snapshots were the bare FSM and lost lock and group frequencies and recruit
+   pool addresses; restoring one keeps what it has and resets the rest. */
+
+const (
+    legacySnapshotVersion = 1
+    /* Version written by Snapshot. */
+    currentSnapshotVersion = 2
+)
+
+type versionedSnapshot struct {
+    Version int
+    State   json.RawMessage
+}
+
+func encodeSnapshot(state interface{}) ([]byte, error) {
+    stateJSON, err := json.Marshal(state)
+    if err != nil {
+        return nil, err
+    }
+    return json.Marshal(versionedSnapshot{currentSnapshotVersion, stateJSON})
+}
+
+/* Unwrap snapshot into its format version and encoded state. */
+func decodeSnapshot(byte_arr []byte) (int, []byte, error) {
+    var snapshot versionedSnapshot
+    if err := json.Unmarshal(byte_arr, &snapshot); err != nil {
+        return 0, nil, err
+    }
+    if snapshot.Version == 0 || snapshot.State == nil {
+        return legacySnapshotVersion, byte_arr, nil
+    }
+    if snapshot.Version > currentSnapshotVersion {
+        return 0, nil, fmt.Errorf("snapshot version %d is newer than supported version %d", snapshot.Version, currentSnapshotVersion)
+    }
+    return snapshot.Version, snapshot.State, nil
+}
+
+/* Bring master restored from an older snapshot up to the current version. */
+func migrateMasterSnapshot(m *MasterFSM, version int) {
+    if version < 2 {
+        /* Frequencies weren't saved. Start measuring them again from the
+           last command applied, rather than from the zero time. */
+        for l := range m.LockFreqStatsMap {
+            m.LockFreqStatsMap[l] = FreqStats{AvgFreq: 0, LastUpdate: m.Clock}
+        }
+        for replicaGroup := range m.GroupFreqStatsMap {
+            m.GroupFreqStatsMap[replicaGroup] = FreqStats{AvgFreq: 0, LastUpdate: m.Clock}
+        }
+        /* Recruit pool addresses weren't saved, so its entries can't be used. */
+        recruitAddrs := make([]RecruitInfo, 0)
+        for _, info := range m.RecruitAddrs {
+            if len(info.Addrs) > 0 {
+                recruitAddrs = append(recruitAddrs, info)
+            }
+        }
+        m.RecruitAddrs = recruitAddrs
+    }
+}
@@ -0,0 +1,212 @@
+package locks
+
+import(
+    "raft"
+    "bytes"
+    "encoding/json"
+    "io/ioutil"
+    "reflect"
+    "testing"
+    "time"
+)
+
+func testTime(sec int64) time.Time {
+    return time.Unix(sec, 0).UTC()
+}
+
+func testMaster() *MasterFSM {
+    return &MasterFSM{
+        LockMap:            map[Lock]ReplicaGroupId{"/a/l1": 0, "/a/l2": 1, "/b/l3": 1},
+        ClusterMap:         map[ReplicaGroupId][]raft.ServerAddress{0: {"w0:1", "w0:2", "w0:3"}, 1: {"w1:1", "w1:2", "w1:3"}},
+        DomainPlacementMap: map[Domain][]ReplicaGroupId{"/": {0}, "/a": {0, 1}, "/b": {1}},
+        NumLocksHeld:       map[ReplicaGroupId]int{0: 1, 1: 2},
+        NextReplicaGroupId: 2,
+        MasterCluster:      []raft.ServerAddress{"m:1", "m:2", "m:3"},
+        RecruitAddrs:       []RecruitInfo{
+            {Addrs: []raft.ServerAddress{"w2:1", "w2:2", "w2:3"}, ShouldRecruitLocally: true},
+            {Addrs: []raft.ServerAddress{"w3:1", "w3:2", "w3:3"}, Unavailable: true},
+        },
+        RecruitClustersLocally: true,
+        RecalcitrantDestMap:    map[Lock]ReplicaGroupId{"/a/l2": 0},
+        RebalancingInProgress:  map[ReplicaGroupId]bool{1: true},
+        LockFreqStatsMap:       map[Lock]FreqStats{"/a/l1": {2.5, testTime(100)}, "/a/l2": {0.5, testTime(90)}},
+        GroupFreqStatsMap:      map[ReplicaGroupId]FreqStats{0: {2.5, testTime(100)}, 1: {0.5, testTime(90)}},
+        GroupLoadMap:           map[ReplicaGroupId]WorkerLoad{0: {NumLocks: 1, NumSessions: 2, NumHeld: 1, QueueDepth: 3, ApplyLatency: time.Millisecond}},
+        GroupHealthMap:         map[ReplicaGroupId]GroupHealth{1: {false, testTime(95)}},
+        DrainingGroups:         map[ReplicaGroupId]bool{1: true},
+        RevokeDeadlineMap:      map[Lock]time.Time{"/a/l2": testTime(130)},
+        TransferMap:            map[int]Transfer{
+            4: {Id: 4, From: 1, To: 0, Locks: []Lock{"/a/l2", "/b/l3"}, Recalcitrant: []Lock{"/a/l2"}, Live: true,
+                States: map[Lock]MigratedLock{"/b/l3": {true, "c:1", 7, 3, 1}}, State: TransferDisabled},
+        },
+        NextTransferId:         5,
+        Clock:                  testTime(120),
+        PlacementPolicyMap:     map[Domain]PlacementPolicy{"/b": {Allowed: []ReplicaGroupId{0, 1}, Hashed: true}},
+        MoveMap:                map[int]LockMove{2: {2, 0, []Lock{"/b/l3"}}},
+        NextMoveId:             3,
+        Policy:                 PolicySpec{"frequency", json.RawMessage(`{"MaxFreq":10,"MinFreq":1}`)},
+        Settings:               TransferSettings{Live: true, RevokeAfter: 10 * time.Second},
+        logger:                 raft.NopLogger(),
+    }
+}
+
+/* Replicated state of master, by field. */
+func masterState(m *MasterFSM) map[string]interface{} {
+    return map[string]interface{}{
+        "LockMap":                m.LockMap,
+        "ClusterMap":             m.ClusterMap,
+        "DomainPlacementMap":     m.DomainPlacementMap,
+        "NumLocksHeld":           m.NumLocksHeld,
+        "NextReplicaGroupId":     m.NextReplicaGroupId,
+        "MasterCluster":          m.MasterCluster,
+        "RecruitAddrs":           m.RecruitAddrs,
+        "RecruitClustersLocally": m.RecruitClustersLocally,
+        "RecalcitrantDestMap":    m.RecalcitrantDestMap,
+        "RebalancingInProgress":  m.RebalancingInProgress,
+        "LockFreqStatsMap":       m.LockFreqStatsMap,
+        "GroupFreqStatsMap":      m.GroupFreqStatsMap,
+        "GroupLoadMap":           m.GroupLoadMap,
+        "GroupHealthMap":         m.GroupHealthMap,
+        "DrainingGroups":         m.DrainingGroups,
+        "RevokeDeadlineMap":      m.RevokeDeadlineMap,
+        "TransferMap":            m.TransferMap,
+        "NextTransferId":         m.NextTransferId,
+        "Clock":                  m.Clock,
+        "PlacementPolicyMap":     m.PlacementPolicyMap,
+        "MoveMap":                m.MoveMap,
+        "NextMoveId":             m.NextMoveId,
+        "Policy":                 m.Policy,
+        "Settings":               m.Settings,
+    }
+}
+
+func testWorker() *WorkerFSM {
+    return &WorkerFSM{
+        LockStateMap:   map[Lock]lockState{
+            "/a/l1": {Held: true, Client: "c:1", FreqCount: 4, SaveFreqCount: 2},
+            "/a/l2": {Held: true, Client: "c:2", Recalcitrant: true},
+            "/b/l3": {Disabled: true, Migrating: true},
+        },
+        SequencerMap:   map[Lock]Sequencer{"/a/l1": 3, "/a/l2": 1, "/b/l3": 9},
+        ForwardMap:     map[Lock]LockForward{"/b/l4": {2, []raft.ServerAddress{"w2:1", "w2:2", "w2:3"}}},
+        MasterCluster:  []raft.ServerAddress{"m:1", "m:2", "m:3"},
+        PeriodStart:    testTime(100),
+        Clock:          testTime(104),
+        Sessions:       map[raft.ServerAddress]bool{"c:1": true, "c:2": true},
+    }
+}
+
+func workerState(w *WorkerFSM) map[string]interface{} {
+    return map[string]interface{}{
+        "LockStateMap":     w.LockStateMap,
+        "SequencerMap":     w.SequencerMap,
+        "ForwardMap":       w.ForwardMap,
+        "MasterCluster":    w.MasterCluster,
+        "PeriodStart":      w.PeriodStart,
+        "Clock":            w.Clock,
+        "Sessions":         w.Sessions,
+    }
+}
+
+func persistSnapshot(t *testing.T, fsm raft.FSM) []byte {
+    snapshot, err := fsm.Snapshot()
+    if err != nil {
+        t.Fatalf("snapshot failed: %v", err)
+    }
+    store := raft.NewInmemSnapshotStore()
+    sink, err := store.Create(raft.SnapshotVersionMax, 1, 1, raft.Configuration{}, 1, nil)
+    if err != nil {
+        t.Fatalf("creating sink failed: %v", err)
+    }
+    if err := snapshot.Persist(sink); err != nil {
+        t.Fatalf("persist failed: %v", err)
+    }
+    _, source, err := store.Open(sink.ID())
+    if err != nil {
+        t.Fatalf("opening snapshot failed: %v", err)
+    }
+    defer source.Close()
+    data, err := ioutil.ReadAll(source)
+    if err != nil {
+        t.Fatalf("reading snapshot failed: %v", err)
+    }
+    return data
+}
+
+func restore(t *testing.T, fsm raft.FSM, data []byte) {
+    if err := fsm.Restore(ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+        t.Fatalf("restore failed: %v", err)
+    }
+}
+
+func compareState(t *testing.T, got map[string]interface{}, want map[string]interface{}) {
+    for field := range want {
+        if !reflect.DeepEqual(got[field], want[field]) {
+            t.Errorf("%s not restored: got %+v, want %+v", field, got[field], want[field])
+        }
+    }
+}
+
+func TestMasterSnapshotRoundTrip(t *testing.T) {
+    original := testMaster()
+    restored := &MasterFSM{}
+    restore(t, restored, persistSnapshot(t, original))
+    compareState(t, masterState(restored), masterState(original))
+}
+
+func TestWorkerSnapshotRoundTrip(t *testing.T) {
+    original := testWorker()
+    restored := &WorkerFSM{}
+    restore(t, restored, persistSnapshot(t, original))
+    compareState(t, workerState(restored), workerState(original))
+}
+
+func TestMasterSnapshotCoversEveryExportedField(t *testing.T) {
+    /* Catch fields added to MasterFSM without being restored or tested. */
+    notReplicated := map[string]bool{"FsmLock": true, "WorkerSessionMap": true, "SessionLock": true, "Trans": true}
+    state := masterState(testMaster())
+    fsmType := reflect.TypeOf(MasterFSM{})
+    for i := 0; i < fsmType.NumField(); i++ {
+        field := fsmType.Field(i)
+        if field.PkgPath != "" || notReplicated[field.Name] {
+            continue
+        }
+        if _, ok := state[field.Name]; !ok {
+            t.Errorf("field %s missing from snapshot round trip test", field.Name)
+        }
+    }
+}
+
+func TestRestoreLegacyMasterSnapshot(t *testing.T) {
+    /* Version 1 snapshots were the bare FSM, whose frequencies and recruit
+       addresses encoded as empty objects. */
+    original := testMaster()
+    legacy, err := json.Marshal(masterState(original))
+    if err != nil {
+        t.Fatal(err)
+    }
+    var fields map[string]json.RawMessage
+    json.Unmarshal(legacy, &fields)
+    fields["LockFreqStatsMap"] = json.RawMessage(`{"/a/l1": {}, "/a/l2": {}}`)
+    fields["GroupFreqStatsMap"] = json.RawMessage(`{"0": {}, "1": {}}`)
+    fields["RecruitAddrs"] = json.RawMessage(`[{"ShouldRecruitLocally": true}, {}]`)
+    legacy, _ = json.Marshal(fields)
+
+    restored := &MasterFSM{}
+    restore(t, restored, legacy)
+    want := masterState(original)
+    want["LockFreqStatsMap"] = map[Lock]FreqStats{"/a/l1": {0, original.Clock}, "/a/l2": {0, original.Clock}}
+    want["GroupFreqStatsMap"] = map[ReplicaGroupId]FreqStats{0: {0, original.Clock}, 1: {0, original.Clock}}
+    want["RecruitAddrs"] = []RecruitInfo{}
+    compareState(t, masterState(restored), want)
+}
+
+func TestRestoreNewerSnapshotFails(t *testing.T) {
+    data, err := json.Marshal(versionedSnapshot{currentSnapshotVersion + 1, json.RawMessage(`{}`)})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := (&MasterFSM{}).Restore(ioutil.NopCloser(bytes.NewReader(data))); err == nil {
+        t.Fatalf("restored snapshot from a newer version")
+    }
+}
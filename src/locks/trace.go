@@ -0,0 +1,60 @@
+package locks
+
+import(
+    "raft"
+    "fmt"
+)
+
+/* Requests are traced through raft's span exporter (see raft.SetSpanExporter),
+   and only while one is set. A lock client starts a trace for each request and
+   sends it with every request it makes to masters and replica groups. Masters
+   and workers trace each command they apply under the trace of its log entry.
+   Requests sent from their callbacks carry that trace on, so frequency
+   updates and the lock transfers a request sets off join its trace.
+     client.<op>                 lock client or admin request, e.g. client.DrainGroup
+     client.locate, client.send  asking master for a lock's group, sending to it
+     raft.apply, raft.callbacks  leader committing and applying, then callbacks
+     master.<op>, worker.<op>    applying command, on every server
+     master.transfer_step        worker requests of one lock transfer step */
+
+/* Span of command being applied. */
+func startApplySpan(role string, log *raft.Log, function string, args map[string]string, trans *raft.NetworkTransport) *raft.Span {
+    span := raft.StartSpan(log.Trace, role + "." + function)
+    if trans != nil {
+        span.SetAttr("server", trans.LocalAddr())
+    }
+    span.SetAttr("term", log.Term)
+    span.SetAttr("index", log.Index)
+    if l, ok := args[LockArgKey]; ok {
+        span.SetAttr("lock", l)
+    }
+    if group, ok := args[GroupArgKey]; ok {
+        span.SetAttr("group", group)
+    }
+    return span
+}
+
+/* Client side. */
+
+/* Start span of work done by client, with attributes given as alternating
+   keys and values; empty ones are left out. Requests sent until the returned function is called carry
+   the span; a span started outside any other starts a new trace. */
+func (lc *LockClient) startSpan(name string, attrs ...interface{}) func() {
+    parent := lc.trace
+    var span *raft.Span
+    if parent.Valid() {
+        span = raft.StartSpan(parent, "client." + name)
+    } else {
+        span = raft.StartTrace("client." + name)
+    }
+    for i := 0; i + 1 < len(attrs); i += 2 {
+        if attrs[i+1] != "" {
+            span.SetAttr(fmt.Sprint(attrs[i]), attrs[i+1])
+        }
+    }
+    lc.trace = span.Context()
+    return func() {
+        lc.trace = parent
+        span.End()
+    }
+}
@@ -0,0 +1,121 @@
+package locks
+
+import(
+    "raft"
+    "reflect"
+    "sync"
+    "testing"
+)
+
+type recordingExporter struct {
+    lock  sync.Mutex
+    spans []*raft.Span
+}
+
+func (e *recordingExporter) ExportSpan(span *raft.Span) {
+    e.lock.Lock()
+    defer e.lock.Unlock()
+    e.spans = append(e.spans, span)
+}
+
+func recordSpans(t *testing.T) *recordingExporter {
+    e := &recordingExporter{}
+    raft.SetSpanExporter(e)
+    t.Cleanup(func() { raft.SetSpanExporter(nil) })
+    return e
+}
+
+func TestClientSpansNest(t *testing.T) {
+    e := recordSpans(t)
+    lc := &LockClient{}
+    endOp := lc.startSpan(AcquireLockCommand, "lock", "/a/l1", "group", "")
+    op := lc.trace
+    endSend := lc.startSpan("send")
+    if lc.trace.TraceID != op.TraceID || lc.trace.SpanID == op.SpanID {
+        t.Fatalf("send should be a new span of trace %v, got %v", op, lc.trace)
+    }
+    endSend()
+    if lc.trace != op {
+        t.Fatalf("ending send should restore %v, got %v", op, lc.trace)
+    }
+    endOp()
+    if lc.trace != raft.NoTrace {
+        t.Fatalf("ending request should leave client untraced, got %v", lc.trace)
+    }
+    if len(e.spans) != 2 {
+        t.Fatalf("got %d spans, want 2", len(e.spans))
+    }
+    send, acquire := e.spans[0], e.spans[1]
+    if send.Name != "client.send" || send.ParentID != acquire.SpanID || send.TraceID != acquire.TraceID {
+        t.Fatalf("send span %+v not child of %+v", send, acquire)
+    }
+    if acquire.Name != "client." + AcquireLockCommand || acquire.ParentID != "" {
+        t.Fatalf("request span %+v should be a root", acquire)
+    }
+    /* Empty attributes are left out. */
+    if !reflect.DeepEqual(acquire.Attrs, map[string]string{"lock": "/a/l1"}) {
+        t.Fatalf("got attributes %v", acquire.Attrs)
+    }
+    /* The next request starts a trace of its own. */
+    lc.startSpan(ReleaseLockCommand)()
+    if e.spans[2].TraceID == acquire.TraceID {
+        t.Fatalf("second request joined first request's trace")
+    }
+}
+
+func TestApplySpanJoinsLogTrace(t *testing.T) {
+    e := recordSpans(t)
+    parent := raft.StartTrace("client." + AcquireLockCommand)
+    log := &raft.Log{Index: 7, Term: 2, Trace: parent.Context()}
+    startApplySpan("worker", log, AcquireLockCommand, map[string]string{LockArgKey: "/a/l1"}, nil).End()
+    if len(e.spans) != 1 {
+        t.Fatalf("got %d spans, want 1", len(e.spans))
+    }
+    span := e.spans[0]
+    if span.Name != "worker." + AcquireLockCommand || span.TraceID != parent.TraceID || span.ParentID != parent.SpanID {
+        t.Fatalf("apply span %+v not child of %+v", span, parent)
+    }
+    want := map[string]string{"term": "2", "index": "7", "lock": "/a/l1"}
+    if !reflect.DeepEqual(span.Attrs, want) {
+        t.Fatalf("got attributes %v, want %v", span.Attrs, want)
+    }
+    /* Untraced entries get no span. */
+    if span := startApplySpan("worker", &raft.Log{}, AcquireLockCommand, nil, nil); span != nil {
+        t.Fatalf("untraced entry got span %+v", span)
+    }
+}
+
+func TestNoSpansWithoutExporter(t *testing.T) {
+    raft.SetSpanExporter(nil)
+    lc := &LockClient{}
+    end := lc.startSpan(AcquireLockCommand)
+    if lc.trace != raft.NoTrace {
+        t.Fatalf("traced without exporter: %v", lc.trace)
+    }
+    end()
+}
+
+func TestClusterStatusSendsTrace(t *testing.T) {
+    e := recordSpans(t)
+    master := testTransport(t)
+    defer master.Close()
+    traces := make(chan raft.TraceContext, 1)
+    serveResponses(master, func(req *raft.ClientRequest) interface{} {
+        traces <- req.Trace
+        return ClusterStatusResponse{Err: Success}
+    })
+    lc := &LockClient{masterServers: []raft.ServerAddress{master.LocalAddr()}, logger: raft.NopLogger()}
+    if _, err := lc.ClusterStatus(); err != nil {
+        t.Fatal(err)
+    }
+    if len(e.spans) != 1 {
+        t.Fatalf("got %d spans, want 1", len(e.spans))
+    }
+    span := e.spans[0]
+    if span.Name != "client." + ClusterStatusCommand || span.ParentID != "" {
+        t.Fatalf("got span %+v, want root span for %s", span, ClusterStatusCommand)
+    }
+    if sent := <-traces; sent.TraceID != span.TraceID || sent.SpanID != span.SpanID {
+        t.Fatalf("request carried %+v, want span %+v", sent, span)
+    }
+}
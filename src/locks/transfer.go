@@ -0,0 +1,385 @@
+package locks
+
+import(
+    "raft"
+    "encoding/json"
+    "sort"
+    "strconv"
+    "time"
+
+    "github.com/armon/go-metrics"
+)
+
+/* Moving locks between replica groups takes several requests to workers, sent
+   from callbacks on the master leader. Each move is recorded in the master log
+   as a Transfer and advanced one state at a time, so a new leader can pick up
+   where the old one died. Worker commands are idempotent, which lets a step be
+   repeated when it isn't known to have finished.
+
+       planned   -> disabled:  old group disables locks, reporting held ones
+       disabled  -> claimed:   new group claims locks that weren't held
+       claimed   -> committed: master records locks at new group
+       committed -> disowned:  old group forgets locks, keeping a forward to
+                               the new group; transfer is done
+
+   A held lock stays at the old group until released, then moves in its own
+   transfer starting at disabled. A live transfer instead freezes every lock
+   when disabling it and moves held locks with their state (see live.go). */
+
+type TransferState int
+
+const (
+    TransferPlanned TransferState = iota
+    TransferDisabled
+    TransferClaimed
+    TransferCommitted
+    TransferDisowned
+)
+
+/* Settings for moving locks that every master must apply alike, so they are
+   replicated: the master leader writes the settings it was created with into
+   the log. Until it does, transfers use the zero settings. */
+type TransferSettings struct {
+    /* Move held locks with their state instead of waiting for release. */
+    Live            bool
+    /* Time holders have to release held locks that must move before their
+       release is forced; 0 never forces. */
+    RevokeAfter     time.Duration
+}
+
+type TransferSettingsResponse struct {
+    Err     *LockError
+}
+
+/* Time between attempts to resume transfers that stopped partway. */
+var TransferRetryInterval time.Duration = 2 * time.Second
+
+type Transfer struct {
+    Id              int
+    From            ReplicaGroupId
+    To              ReplicaGroupId
+    Locks           []Lock
+    /* Held locks left at old group to move once released; set once disabled. */
+    Recalcitrant    []Lock
+    /* True if moving a single held lock after its release. */
+    Released        bool
+    /* True if held locks move with their state instead of waiting. */
+    Live            bool
+    /* State of locks frozen by a live transfer; set once disabled. */
+    States          map[Lock]MigratedLock
+    State           TransferState
+    /* FSM time transfer was planned. */
+    Started         time.Time
+    /* Trace of the request that set off the transfer; its steps are traced
+       under it. */
+    Trace           raft.TraceContext
+}
+
+func (s TransferState) String() string {
+    switch s {
+        case TransferPlanned:
+            return "planned"
+        case TransferDisabled:
+            return "disabled"
+        case TransferClaimed:
+            return "claimed"
+        case TransferCommitted:
+            return "committed"
+        case TransferDisowned:
+            return "disowned"
+    }
+    return "unknown"
+}
+
+/* Locks moving now, leaving out held ones. */
+func (t Transfer) moving() []Lock {
+    recalcitrant := make(map[Lock]bool)
+    for _, l := range t.Recalcitrant {
+        recalcitrant[l] = true
+    }
+    moving := make([]Lock, 0)
+    for _, l := range t.Locks {
+        if !recalcitrant[l] {
+            moving = append(moving, l)
+        }
+    }
+    return moving
+}
+
+/* Master side. */
+
+/* Record a transfer and return the callback starting it. Assumes FSM already locked. */
+func (m *MasterFSM) startTransfer(oldReplicaGroup ReplicaGroupId, newReplicaGroup ReplicaGroupId, locksToMove []Lock) []func() [][]byte {
+    id := m.planTransfer(oldReplicaGroup, newReplicaGroup, locksToMove, false, TransferPlanned)
+    f := func() [][]byte {
+        return m.runTransferStep(id)
+    }
+    return []func() [][]byte{f}
+}
+
+/* Assumes FSM already locked. */
+func (m *MasterFSM) planTransfer(oldReplicaGroup ReplicaGroupId, newReplicaGroup ReplicaGroupId, locksToMove []Lock, released bool, state TransferState) int {
+    id := m.NextTransferId
+    m.NextTransferId++
+    live := m.Settings.Live && !released
+    m.TransferMap[id] = Transfer{id, oldReplicaGroup, newReplicaGroup, locksToMove, nil, released, live, nil, state, m.Clock, m.trace}
+    logger := m.rebalanceLogger().With("transfer", id)
+    logger.Debug("transfer planned", "from", oldReplicaGroup, "to", newReplicaGroup, "locks", len(locksToMove), "state", state, "live", live)
+    if logger.Enabled(raft.LevelTrace) {
+        for _, l := range locksToMove {
+            logger.Trace("lock in transfer", "lock", l, "from", oldReplicaGroup, "to", newReplicaGroup)
+        }
+    }
+    if isLeader(m.raft) {
+        metrics.IncrCounter([]string{"locks", "master", "rebalance", "started"}, 1)
+    }
+    return id
+}
+
+/* True if a transfer moves locks from or to group. Assumes FSM already locked. */
+func (m *MasterFSM) inTransfer(replicaGroup ReplicaGroupId) bool {
+    for _, t := range m.TransferMap {
+        if t.From == replicaGroup || t.To == replicaGroup {
+            return true
+        }
+    }
+    return false
+}
+
+/* Move transfer from one state to the next. Steps repeated by a retry or a
+   new leader are ignored. */
+func (m *MasterFSM) advanceTransfer(id int, state TransferState, recalcitrantLocks []Lock, states map[Lock]MigratedLock, deadline time.Time) []func() [][]byte {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    t, ok := m.TransferMap[id]
+    if !ok || state != t.State + 1 {
+        return []func() [][]byte{}
+    }
+    t.State = state
+    m.rebalanceLogger().Debug("transfer advanced", "transfer", id, "from", t.From, "to", t.To, "state", state, "recalcitrant", len(recalcitrantLocks))
+    switch state {
+        case TransferDisabled:
+            t.Recalcitrant = recalcitrantLocks
+            t.States = states
+            for _, l := range recalcitrantLocks {
+                m.setRevocationDeadline(l, deadline)
+            }
+        case TransferCommitted:
+            if t.Released {
+                m.commitRecalcitrantTransfer(t.From, t.To, t.Locks[0])
+            } else {
+                m.commitLockGroupTransfer(t.From, t.To, t.moving(), t.Recalcitrant)
+            }
+        case TransferDisowned:
+            delete(m.TransferMap, id)
+            m.recordTransferDone(t)
+            return []func() [][]byte{}
+    }
+    m.TransferMap[id] = t
+    f := func() [][]byte {
+        return m.runTransferStep(id)
+    }
+    return []func() [][]byte{f}
+}
+
+func (m *MasterFSM) setTransferSettings(settings TransferSettings) TransferSettingsResponse {
+    m.FsmLock.Lock()
+    defer m.FsmLock.Unlock()
+    m.Settings = settings
+    m.rebalanceLogger().Debug("transfer settings set", "live", settings.Live, "revoke_after", settings.RevokeAfter)
+    return TransferSettingsResponse{Success}
+}
+
+func transferSettingsCommand(settings TransferSettings) ([]byte, error) {
+    settingsJSON, err := json.Marshal(settings)
+    if err != nil {
+        return nil, err
+    }
+    args := make(map[string]string)
+    args[FunctionKey] = TransferSettingsCommand
+    args[SettingsKey] = string(settingsJSON)
+    return json.Marshal(args)
+}
+
+/* Claim transfer for a step; false if a step is already running. */
+func (m *MasterFSM) beginStep(id int) bool {
+    m.stepLock.Lock()
+    defer m.stepLock.Unlock()
+    if m.stepping == nil {
+        m.stepping = make(map[int]bool)
+    }
+    if m.stepping[id] {
+        return false
+    }
+    m.stepping[id] = true
+    return true
+}
+
+func (m *MasterFSM) endStep(id int) {
+    m.stepLock.Lock()
+    defer m.stepLock.Unlock()
+    delete(m.stepping, id)
+}
+
+/* Carry out the worker side of transfer's next step and return the command
+   recording it, or nothing if a worker couldn't be reached. Must be called
+   from a callback, not while FSM is locked. */
+func (m *MasterFSM) runTransferStep(id int) [][]byte {
+    if !m.beginStep(id) {
+        return [][]byte{}
+    }
+    defer m.endStep(id)
+    m.FsmLock.RLock()
+    t, ok := m.TransferMap[id]
+    if !ok {
+        m.FsmLock.RUnlock()
+        return [][]byte{}
+    }
+    forward := &LockForward{t.To, m.ClusterMap[t.To]}
+    logger := m.rebalanceLogger().With("transfer", id, "state", t.State)
+    m.FsmLock.RUnlock()
+    logger.Trace("running transfer step", "from", t.From, "to", t.To)
+    span := raft.StartSpan(t.Trace, "master.transfer_step")
+    span.SetAttr("transfer", id)
+    span.SetAttr("state", t.State)
+    defer span.End()
+    trace := span.Context()
+    recalcitrantLocks := make([]Lock, 0)
+    var states map[Lock]MigratedLock
+    deadline := m.newRevocationDeadline()
+    switch t.State {
+        case TransferPlanned:
+            if t.Live {
+                var err error
+                if states, err = m.askWorkerToMigrateLocks(t.From, t.Locks, trace); err != nil {
+                    logger.Warn("transfer step failed, will retry", "group", t.From, "error", err)
+                    return [][]byte{}
+                }
+                break
+            }
+            recalcitrant, err := m.initiateTransfer(t.From, t.Locks, deadline, trace)
+            if err != nil {
+                logger.Warn("transfer step failed, will retry", "group", t.From, "error", err)
+                return [][]byte{}
+            }
+            for _, l := range t.Locks {
+                if _, ok := recalcitrant[l]; ok {
+                    recalcitrantLocks = append(recalcitrantLocks, l)
+                }
+            }
+        case TransferDisabled:
+            if moving := t.moving(); len(moving) > 0 {
+                if err := m.askWorkerToClaimLocks(t.To, moving, t.States, forward, trace); err != nil {
+                    logger.Warn("transfer step failed, will retry", "group", t.To, "error", err)
+                    return [][]byte{}
+                }
+            }
+        case TransferCommitted:
+            if moving := t.moving(); len(moving) > 0 {
+                if err := m.askWorkerToDisownLocks(t.From, moving, forward, trace); err != nil {
+                    logger.Warn("transfer step failed, will retry", "group", t.From, "error", err)
+                    return [][]byte{}
+                }
+            }
+    }
+    args := make(map[string]string)
+    args[FunctionKey] = TransferStepCommand
+    args[TransferIdKey] = strconv.Itoa(id)
+    args[TransferStateKey] = strconv.Itoa(int(t.State + 1))
+    args[LockArray2Key] = lock_array_to_string(recalcitrantLocks)
+    args[DeadlineKey] = time_to_string(deadline)
+    if len(states) > 0 {
+        statesJSON, json_err := json.Marshal(states)
+        if json_err != nil {
+            return [][]byte{}
+        }
+        args[StatesKey] = string(statesJSON)
+    }
+    command, json_err := json.Marshal(args)
+    if json_err != nil {
+        return [][]byte{}
+    }
+    return [][]byte{command}
+}
+
+/* While leader, resume transfers left unfinished by an earlier leader or by
+   unreachable workers. Each step's command is applied with its callbacks, so a
+   resumed transfer runs to the end unless a worker can't be reached. */
+func (m *MasterFSM) transferResumeLoop(r *raft.Raft, stop chan struct{}) {
+    ticker := time.NewTicker(TransferRetryInterval)
+    defer ticker.Stop()
+    for {
+        select {
+            case <-stop:
+                return
+            case <-ticker.C:
+        }
+        if r.State() != raft.Leader {
+            continue
+        }
+        m.FsmLock.RLock()
+        ids := make([]int, 0)
+        for id := range m.TransferMap {
+            ids = append(ids, id)
+        }
+        m.FsmLock.RUnlock()
+        sort.Ints(ids)
+        for _, id := range ids {
+            for _, command := range m.runTransferStep(id) {
+                r.ApplyCommand(command, raft.NoTrace)
+            }
+        }
+    }
+}
+
+/* Transfers in progress, in ID order. Assumes FSM already locked. */
+func (m *MasterFSM) sortedTransfers() []Transfer {
+    ids := make([]int, 0)
+    for id := range m.TransferMap {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+    transfers := make([]Transfer, 0)
+    for _, id := range ids {
+        transfers = append(transfers, m.TransferMap[id])
+    }
+    return transfers
+}
+
+/* Held lock left behind by a transfer that hasn't committed yet was released.
+   Take it out of that transfer and move it on its own. Assumes FSM already locked. */
+func (m *MasterFSM) splitReleasedFromTransfer(l Lock) []func() [][]byte {
+    for _, t := range m.sortedTransfers() {
+        if t.Released || t.State >= TransferCommitted || !containsLock(t.Recalcitrant, l) {
+            continue
+        }
+        t.Locks = withoutLock(t.Locks, l)
+        t.Recalcitrant = withoutLock(t.Recalcitrant, l)
+        m.TransferMap[t.Id] = t
+        id := m.planTransfer(t.From, t.To, []Lock{l}, true, TransferDisabled)
+        f := func() [][]byte {
+            return m.runTransferStep(id)
+        }
+        return []func() [][]byte{f}
+    }
+    return []func() [][]byte{}
+}
+
+func containsLock(lockArr []Lock, l Lock) bool {
+    for _, curr := range lockArr {
+        if curr == l {
+            return true
+        }
+    }
+    return false
+}
+
+func withoutLock(lockArr []Lock, l Lock) []Lock {
+    remaining := make([]Lock, 0)
+    for _, curr := range lockArr {
+        if curr != l {
+            remaining = append(remaining, curr)
+        }
+    }
+    return remaining
+}
@@ -0,0 +1,72 @@
+package locks
+
+import(
+    "raft"
+    "reflect"
+    "testing"
+    "time"
+)
+
+/* Snapshot master and restore it into a new one, as after a restart. */
+func restartMaster(t *testing.T, m *MasterFSM) *MasterFSM {
+    restarted := &MasterFSM{logger: raft.NopLogger()}
+    restore(t, restarted, persistSnapshot(t, m))
+    return restarted
+}
+
+func advanceIgnored(t *testing.T, m *MasterFSM, id int, state TransferState) {
+    before := masterState(m)
+    if callbacks := m.advanceTransfer(id, state, nil, nil, testTime(0)); len(callbacks) != 0 {
+        t.Fatalf("advancing to %v from %v should be ignored, got %d callbacks", state, m.TransferMap[id].State, len(callbacks))
+    }
+    compareState(t, masterState(m), before)
+}
+
+func TestAdvanceTransferIgnoresRepeatedAndSkippedSteps(t *testing.T) {
+    m := testMaster()
+    id := m.planTransfer(0, 1, []Lock{"/a/l1"}, false, TransferPlanned)
+    for state := TransferDisabled; state <= TransferDisowned; state++ {
+        if state + 1 <= TransferDisowned {
+            advanceIgnored(t, m, id, state + 1)
+        }
+        callbacks := m.advanceTransfer(id, state, nil, nil, testTime(0))
+        if state == TransferDisowned {
+            if _, ok := m.TransferMap[id]; ok || len(callbacks) != 0 {
+                t.Fatalf("disowned transfer should be done, got %v and %d callbacks", m.TransferMap[id], len(callbacks))
+            }
+        } else if len(callbacks) != 1 || m.TransferMap[id].State != state {
+            t.Fatalf("transfer should advance to %v with next step, got %v and %d callbacks", state, m.TransferMap[id].State, len(callbacks))
+        }
+        /* Repeats of this or earlier steps, before and after a restart. */
+        for retry := TransferDisabled; retry <= state; retry++ {
+            advanceIgnored(t, m, id, retry)
+        }
+        m = restartMaster(t, m)
+        for retry := TransferDisabled; retry <= state; retry++ {
+            advanceIgnored(t, m, id, retry)
+        }
+    }
+    if m.LockMap["/a/l1"] != 1 || m.NumLocksHeld[0] != 0 || m.NumLocksHeld[1] != 3 {
+        t.Fatalf("lock committed wrongly: at %v, held %v", m.LockMap["/a/l1"], m.NumLocksHeld)
+    }
+}
+
+func TestAdvanceTransferKeepsRecalcitrantLocks(t *testing.T) {
+    m := testMaster()
+    m.RevokeDeadlineMap = make(map[Lock]time.Time)
+    id := m.planTransfer(0, 1, []Lock{"/a/l1"}, false, TransferPlanned)
+    m.advanceTransfer(id, TransferDisabled, []Lock{"/a/l1"}, nil, testTime(200))
+    m = restartMaster(t, m)
+    transfer := m.TransferMap[id]
+    if !reflect.DeepEqual(transfer.Recalcitrant, []Lock{"/a/l1"}) || len(transfer.moving()) != 0 {
+        t.Fatalf("held lock should stay behind, got %+v", transfer)
+    }
+    if !m.RevokeDeadlineMap["/a/l1"].Equal(testTime(200)) {
+        t.Fatalf("revocation deadline not recorded: %v", m.RevokeDeadlineMap)
+    }
+    m.advanceTransfer(id, TransferClaimed, nil, nil, testTime(0))
+    m.advanceTransfer(id, TransferCommitted, nil, nil, testTime(0))
+    if m.LockMap["/a/l1"] != 0 || m.RecalcitrantDestMap["/a/l1"] != 1 {
+        t.Fatalf("held lock should stay at 0 bound for 1, got %v and %v", m.LockMap["/a/l1"], m.RecalcitrantDestMap)
+    }
+}
@@ -1,13 +1,52 @@
  package locks
 
 import(
+    "raft"
+    "encoding/json"
     "strings"
     "strconv"
-    "fmt"
+    "time"
 )
 
 /* JSON util functions. */
 
+func addr_array_to_string(addrs []raft.ServerAddress) string {
+    var string_form []string
+    for _, addr := range addrs {
+        string_form = append(string_form, string(addr))
+    }
+    return strings.Join(string_form, ";")
+}
+
+func string_to_addr_array(s string) []raft.ServerAddress {
+    addrs := make([]raft.ServerAddress, 0)
+    if s == "" {
+        return addrs
+    }
+    for _, addr := range strings.Split(s, ";") {
+        addrs = append(addrs, raft.ServerAddress(addr))
+    }
+    return addrs
+}
+
+func load_to_string(load WorkerLoad) string {
+    data, err := json.Marshal(load)
+    if err != nil {
+        return ""
+    }
+    return string(data)
+}
+
+/* Returns false if s doesn't hold a load report, e.g. from an older worker. */
+func string_to_load(s string) (WorkerLoad, bool) {
+    var load WorkerLoad
+    if s == "" {
+        return load, false
+    }
+    err := json.Unmarshal([]byte(s), &load)
+    return load, err == nil
+}
+
  func lock_array_to_string(lock_arr []Lock) string {
     var string_form []string
     for _, l := range lock_arr {
@@ -45,11 +84,50 @@ func int_array_to_string(int_arr []int) string {
     string_arr := strings.Split(s, ";")
     var int_arr []int
     for _, s := range string_arr {
-        i, err := strconv.Atoi(s)
-        if err != nil {
-            fmt.Println("Error in string to int array: ", err)
-        }
+        /* Invalid counts are read as 0. */
+        i, _ := strconv.Atoi(s)
         int_arr = append(int_arr, i)
     }
     return int_arr
  }
+
+func group_array_to_string(groups []ReplicaGroupId) string {
+    ints := make([]int, 0)
+    for _, g := range groups {
+        ints = append(ints, int(g))
+    }
+    return int_array_to_string(ints)
+}
+
+func string_to_group_array(s string) []ReplicaGroupId {
+    groups := make([]ReplicaGroupId, 0)
+    for _, i := range string_to_int_array(s) {
+        groups = append(groups, ReplicaGroupId(i))
+    }
+    return groups
+}
+
+/* Move FSM clock to time leader stamped on log entry. Entries appended by a
+   new leader may be stamped earlier than ones before them, so the clock never
+   goes back. Entries without a stamp leave it where it is. */
+func advanceClock(clock *time.Time, stamp time.Time) {
+    if stamp.After(*clock) {
+        *clock = stamp
+    }
+}
+
+/* Times are sent as Unix nanoseconds; the zero time as the empty string. */
+func time_to_string(t time.Time) string {
+    if t.IsZero() {
+        return ""
+    }
+    return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func string_to_time(s string) time.Time {
+    nanos, err := strconv.ParseInt(s, 10, 64)
+    if err != nil {
+        return time.Time{}
+    }
+    return time.Unix(0, nanos)
+}
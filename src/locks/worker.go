@@ -5,10 +5,10 @@ import(
     "io"
     "encoding/json"
     "bytes"
+    "sort"
     "strconv"
     "sync"
     "time"
-    "fmt"
 )
 
 type WorkerFSM struct{
@@ -16,11 +16,27 @@ type WorkerFSM struct{
     /* Map of lock to lock state. */
     LockStateMap    map[Lock]lockState
     SequencerMap    map[Lock]Sequencer
+    /* Groups that locks migrated away from here went to. */
+    ForwardMap      map[Lock]LockForward
     MasterCluster   []raft.ServerAddress
     PeriodStart     time.Time
+    /* Time of latest log entry applied, used instead of local clock. */
+    Clock           time.Time
+    /* Clients that have sent requests and whose sessions haven't ended. */
+    Sessions        map[raft.ServerAddress]bool
     MasterSession   *raft.Session
     SessionLock     sync.RWMutex
     Trans           *raft.NetworkTransport
+    /* Raft instance running this FSM, used to measure apply queue depth. */
+    raft            *raft.Raft
+    /* Time spent applying commands in current period, and number applied. */
+    applyTime       time.Duration
+    applyCount      int
+    /* Where this worker logs; not replicated. */
+    logger          raft.Logger
+    /* Trace of log entry being applied; callbacks send their requests under
+       it. */
+    trace           raft.TraceContext
 }
 
 type WorkerSnapshot struct {
@@ -36,42 +52,82 @@ type lockState struct{
     Recalcitrant    bool
     /* Behaves as though Held by nonexistant client; used for rebalancing */
     Disabled		bool
+    /* Frozen while its state is copied to another group by live migration. */
+    Migrating       bool
     /* Count number of accesses in last period. */
     FreqCount       int
     /* Frequency count used to be sent to master. */
     SaveFreqCount         int
 }
 
-func CreateWorkers(n int, masterCluster []raft.ServerAddress, clusterAddrs []raft.ServerAddress, transports []*raft.NetworkTransport) ([]raft.FSM) {
+/* Create workers. Logger may be nil, in which case the default logger is used. */
+func CreateWorkers(n int, masterCluster []raft.ServerAddress, clusterAddrs []raft.ServerAddress, transports []*raft.NetworkTransport, logger raft.Logger) ([]raft.FSM) {
+    if logger == nil {
+        logger = raft.DefaultLogger()
+    }
     workers := make([]raft.FSM, n)
     for i := range(workers) {
         workers[i] = &WorkerFSM {
             LockStateMap: make(map[Lock]lockState),
             SequencerMap: make(map[Lock]Sequencer),
+            ForwardMap: make(map[Lock]LockForward),
             MasterCluster: masterCluster,
+            Sessions: make(map[raft.ServerAddress]bool),
             Trans: transports[i],
+            logger: logger.Named("worker").With("server", transports[i].LocalAddr()),
         }
     }
     return workers
 }
 
-func (w *WorkerFSM) Apply(log *raft.Log) (interface{}, []func() [][]byte) { 
+func (w *WorkerFSM) Apply(log *raft.Log) (result interface{}, callbacks []func() [][]byte) { 
     /* Interpret log to find command. Call appropriate function. */
+    start := time.Now()
+    defer w.recordApplyLatency(start)
+    w.FsmLock.Lock()
+    advanceClock(&w.Clock, log.AppendedAt)
+    w.trace = log.Trace
+    w.FsmLock.Unlock()
     args := make(map[string]string)
     err := json.Unmarshal(log.Data, &args)
     if err != nil {
-        //fmt.Println("WORKER: error in apply, ", err) 
+        w.logger.Warn("invalid command", "term", log.Term, "index", log.Index, "error", err)
     }
     function := args[FunctionKey]
+    w.logger.Trace("applying command", "op", function, "term", log.Term, "index", log.Index)
+    span := startApplySpan("worker", log, function, args, w.Trans)
+    defer span.End()
+    defer func() {
+        w.recordApply(function, result)
+    }()
     switch function {
         case ClaimLocksCommand:
             lock_arr := string_to_lock_array(args[LockArrayKey])
-            w.claimLocks(lock_arr)
-            return nil, []func()[][]byte{} 
+            states := make(map[Lock]MigratedLock)
+            if statesStr, ok := args[StatesKey]; ok {
+                json.Unmarshal([]byte(statesStr), &states)
+            }
+            var here *LockForward
+            if group, err := strconv.Atoi(args[GroupArgKey]); err == nil {
+                here = &LockForward{ReplicaGroupId(group), string_to_addr_array(args[ServerAddrsKey])}
+            }
+            return nil, w.claimLocks(lock_arr, states, here)
         case DisownLocksCommand:
             lock_arr := string_to_lock_array(args[LockArrayKey])
-            w.disownLocks(lock_arr)
+            var forward *LockForward
+            if group, err := strconv.Atoi(args[GroupArgKey]); err == nil {
+                forward = &LockForward{ReplicaGroupId(group), string_to_addr_array(args[ServerAddrsKey])}
+            }
+            w.disownLocks(lock_arr, forward)
             return nil, []func()[][]byte{}
+        case KeepLocksCommand:
+            lock_arr := string_to_lock_array(args[LockArrayKey])
+            w.keepLocks(lock_arr)
+            return nil, []func()[][]byte{}
+        case MigrateCommand:
+            lock_arr := string_to_lock_array(args[LockArrayKey])
+            response := w.migrateLocks(lock_arr)
+            return response, []func()[][]byte{}
         case AcquireLockCommand:
             l := Lock(args[LockArgKey])
             clientAddr := raft.ServerAddress(args[ClientAddrKey])
@@ -86,15 +142,36 @@ func (w *WorkerFSM) Apply(log *raft.Log) (interface{}, []func() [][]byte) {
             l := Lock(args[LockArgKey])
             s, err := strconv.Atoi(args[SequencerArgKey])
             if err != nil {
-                //fmt.Println("WORKER: error unpacking command")
-                return ValidateLockResponse{false, ErrInvalidRequest}, nil
+                return ValidateLockResponse{false, ErrInvalidRequest, nil}, nil
             }
             response := w.validateLock(l, Sequencer(s))
             return response, []func()[][]byte{}
+        case LockInfoCommand:
+            l := Lock(args[LockArgKey])
+            response := w.lockInfo(l)
+            return response, []func()[][]byte{}
         case TransferCommand:
             lock_arr := string_to_lock_array(args[LockArrayKey])
-            response := w.handleTransferRequest(lock_arr)
-            return response, []func()[][]byte{}
+            deadline := string_to_time(args[DeadlineKey])
+            response, callback := w.handleTransferRequest(lock_arr, deadline)
+            return response, callback
+        case RevokeLockCommand:
+            l := Lock(args[LockArgKey])
+            response, callback := w.forceRelease(l)
+            return response, callback
+        case HealthCheckCommand:
+            return HealthCheckResponse{Success}, []func()[][]byte{}
+        case InventoryCommand:
+            return w.inventory(), []func()[][]byte{}
+        case AddServerCommand:
+            callback, response := w.changeMembership(raft.ServerAddress(args[ServerAddrKey]), true)
+            return response, callback
+        case RemoveServerCommand:
+            callback, response := w.changeMembership(raft.ServerAddress(args[ServerAddrKey]), false)
+            return response, callback
+        case SetMasterClusterCommand:
+            w.setMasterCluster(string_to_addr_array(args[ServerAddrsKey]))
+            return nil, []func()[][]byte{}
         case ReleaseForClientCommand:
             c := raft.ServerAddress(args[ClientAddrKey])
             w.releaseForClient(c)
@@ -118,6 +195,16 @@ func (w *WorkerFSM) Restore(i io.ReadCloser) error {
     w.LockStateMap = snapshotRestored.LockStateMap
     w.SequencerMap = snapshotRestored.SequencerMap
     w.MasterCluster = snapshotRestored.MasterCluster
+    w.Sessions = snapshotRestored.Sessions
+    if w.Sessions == nil {
+        w.Sessions = make(map[raft.ServerAddress]bool)
+    }
+    w.ForwardMap = snapshotRestored.ForwardMap
+    if w.ForwardMap == nil {
+        w.ForwardMap = make(map[Lock]LockForward)
+    }
+    w.PeriodStart = snapshotRestored.PeriodStart
+    w.Clock = snapshotRestored.Clock
     w.FsmLock.Unlock()
     return nil
 }
@@ -148,14 +235,18 @@ func (s WorkerSnapshot) Release() {
 
 func (w *WorkerFSM) convertToJSON() ([]byte, error) {
     w.FsmLock.Lock()
-    b, err := json.Marshal(w)
+    b, err := encodeSnapshot(w)
     w.FsmLock.Unlock()
     return b, err
 }
 
 func convertFromJSONWorker(byte_arr []byte) (WorkerFSM, error) {
     var w WorkerFSM
-    err := json.Unmarshal(byte_arr, &w)
+    _, state, err := decodeSnapshot(byte_arr)
+    if err != nil {
+        return w, err
+    }
+    err = json.Unmarshal(state, &w)
     return w, err
 }
 
@@ -164,41 +255,48 @@ func (w *WorkerFSM) tryAcquireLock(l Lock, client raft.ServerAddress) (AcquireLo
     w.FsmLock.Lock()
     defer w.FsmLock.Unlock()
     callbacks := w.updateFreqForOneOp(l)
-    //fmt.Println("WORKER: trying to acquire lock ", string(l))
+    w.Sessions[client] = true
+     if forward := w.forwardOf(l); forward != nil {
+         return AcquireLockResponse{-1, ErrLockMoved, forward}, callbacks
+     }
      if _, ok := w.LockStateMap[l]; !ok {
-         //fmt.Println("WORKER: error lock doesn't exist")
-         return AcquireLockResponse{-1, ErrLockDoesntExist}, callbacks
+         return AcquireLockResponse{-1, ErrLockDoesntExist, nil}, callbacks
      }
      state := w.LockStateMap[l]
      if state.Held && state.Client == client {
-        return AcquireLockResponse{w.SequencerMap[l], ""}, callbacks
+        return AcquireLockResponse{w.SequencerMap[l], Success, nil}, callbacks
      }
      if state.Held || state.Disabled {
-         //fmt.Println("WORKER: error lock held or disabled")
-         return AcquireLockResponse{-1, ErrLockHeld}, callbacks
+         return AcquireLockResponse{-1, ErrLockHeld, nil}, callbacks
      }
      state.Held = true
      state.Client = client
      w.LockStateMap[l] = state
      w.SequencerMap[l] += 1
-     response := AcquireLockResponse{w.SequencerMap[l], ""}
+     response := AcquireLockResponse{w.SequencerMap[l], Success, nil}
      return response, callbacks
 }
 
 func (w *WorkerFSM) releaseLock(l Lock, client raft.ServerAddress) (ReleaseLockResponse, []func() [][]byte) {
-    //fmt.Println("WORKER: releasing lock ", string(l))
     w.FsmLock.Lock()
     defer w.FsmLock.Unlock()
     callbacks := w.updateFreqForOneOp(l)
+    w.Sessions[client] = true
+    if forward := w.forwardOf(l); forward != nil {
+        return ReleaseLockResponse{ErrLockMoved, forward}, callbacks
+    }
     if _, ok := w.LockStateMap[l]; !ok {
-        return ReleaseLockResponse{ErrLockDoesntExist}, callbacks
+        return ReleaseLockResponse{ErrLockDoesntExist, nil}, callbacks
     }
     state := w.LockStateMap[l]
+    if state.Migrating {
+        return ReleaseLockResponse{ErrLockMoving, nil}, callbacks
+    }
     if !state.Held {
-        return ReleaseLockResponse{ErrLockNotHeld}, callbacks
+        return ReleaseLockResponse{ErrLockNotHeld, nil}, callbacks
     }
     if state.Client != client {
-        return ReleaseLockResponse{ErrBadClientRelease}, callbacks
+        return ReleaseLockResponse{ErrBadClientRelease, nil}, callbacks
     }
     state.Client = ""
     state.Held = false
@@ -206,56 +304,128 @@ func (w *WorkerFSM) releaseLock(l Lock, client raft.ServerAddress) (ReleaseLockR
 
     /* Notify master if lock recalcitrant */
     if state.Recalcitrant {
-        //fmt.Println("Marked recalcitrant")
+        w.logger.Named("rebalance").Debug("recalcitrant lock released", "lock", l, "client", client)
         state.Disabled = true
         w.LockStateMap[l] = state
         // TODO: support returning 2 callbacks!!!
-        return ReleaseLockResponse{""}, w.generateRecalcitrantReleaseAlert(l)
+        return ReleaseLockResponse{Success, nil}, w.generateRecalcitrantReleaseAlert(l)
     }
 
-    return ReleaseLockResponse{""}, callbacks
+    return ReleaseLockResponse{Success, nil}, callbacks
 }
 
 func (w *WorkerFSM) validateLock(l Lock, s Sequencer) ValidateLockResponse {
     w.FsmLock.RLock()
     defer w.FsmLock.RUnlock()
+    if forward := w.forwardOf(l); forward != nil {
+        return ValidateLockResponse{false, ErrLockMoved, forward}
+    }
     if _, ok := w.LockStateMap[l]; !ok {
-        return ValidateLockResponse{false, ErrLockDoesntExist}
+        return ValidateLockResponse{false, ErrLockDoesntExist, nil}
     }
     if s == w.SequencerMap[l] {
-        return ValidateLockResponse{true, ""}
+        return ValidateLockResponse{true, Success, nil}
     } else {
-        return ValidateLockResponse{false, ""}
+        return ValidateLockResponse{false, Success, nil}
     }
 }
 
-func (w *WorkerFSM) claimLocks(lock_arr []Lock) {
+func (w *WorkerFSM) lockInfo(l Lock) LockInfoResponse {
+    w.FsmLock.RLock()
+    defer w.FsmLock.RUnlock()
+    state, ok := w.LockStateMap[l]
+    if !ok {
+        return LockInfoResponse{Err: ErrLockDoesntExist}
+    }
+    return LockInfoResponse{state.Held, state.Client, w.SequencerMap[l], state.Recalcitrant, state.Disabled, Success}
+}
+
+/* Take over locks, with the state they had at their old group if they were
+   migrated live. Holders of locks that arrive held are told the locks are
+   here, at the location given by here, if it is known. */
+func (w *WorkerFSM) claimLocks(lock_arr []Lock, states map[Lock]MigratedLock, here *LockForward) []func() [][]byte {
     w.FsmLock.Lock()
     defer w.FsmLock.Unlock()
+    held := make(map[raft.ServerAddress][]Lock)
     for _, l := range lock_arr {
-        fmt.Println("WORKER: claiming lock ", string(l))
-        w.LockStateMap[l] = lockState{Held: false, Client: "", Recalcitrant: false, }
-        w.SequencerMap[l] = 0
+        /* Claim may be repeated after lock is already in use. */
+        if _, ok := w.LockStateMap[l]; ok {
+            continue
+        }
+        w.logger.Named("rebalance").Trace("claiming lock", "lock", l)
+        delete(w.ForwardMap, l)
+        migrated := states[l]
+        w.LockStateMap[l] = lockState{Held: migrated.Held, Client: migrated.Client, Recalcitrant: false, FreqCount: migrated.FreqCount, SaveFreqCount: migrated.SaveFreqCount}
+        w.SequencerMap[l] = migrated.SeqNo
+        if migrated.Held {
+            w.Sessions[migrated.Client] = true
+            held[migrated.Client] = append(held[migrated.Client], l)
+        }
+    }
+    callbacks := make([]func() [][]byte, 0)
+    if here == nil {
+        return callbacks
+    }
+    clients := make([]string, 0, len(held))
+    for client := range held {
+        clients = append(clients, string(client))
+    }
+    sort.Strings(clients)
+    for _, client := range clients {
+        callbacks = append(callbacks, w.holderMovedAlert(raft.ServerAddress(client), held[raft.ServerAddress(client)], *here))
     }
+    return callbacks
 }
 
-func (w *WorkerFSM) disownLocks(lock_arr []Lock) {
+/* Forget locks. If they moved to another group, remember where so clients
+   asking here can follow them. */
+func (w *WorkerFSM) disownLocks(lock_arr []Lock, forward *LockForward) {
     w.FsmLock.Lock()
     defer w.FsmLock.Unlock()
     for _, l := range lock_arr {
-        fmt.Println("WORKER: disowning lock ", string(l))
+        w.logger.Named("rebalance").Trace("disowning lock", "lock", l)
         delete(w.LockStateMap, l)
+        if forward != nil {
+            w.ForwardMap[l] = *forward
+        }
     }
 }
 
+/* Locks that were to move once released stay here after all. Re-enable any
+   already released while waiting. */
+func (w *WorkerFSM) keepLocks(lock_arr []Lock) {
+    w.FsmLock.Lock()
+    defer w.FsmLock.Unlock()
+    for _, l := range lock_arr {
+        state, ok := w.LockStateMap[l]
+        if !ok || !state.Recalcitrant {
+            continue
+        }
+        w.logger.Named("rebalance").Debug("keeping recalcitrant lock", "lock", l)
+        state.Recalcitrant = false
+        state.Disabled = false
+        w.LockStateMap[l] = state
+    }
+}
 
-func (w *WorkerFSM) handleTransferRequest(lock_arr []Lock) (TransferResponse) {
+/* Disable locks so they can move. Held locks become recalcitrant instead,
+   and their holders are asked to release them by deadline. */
+func (w *WorkerFSM) handleTransferRequest(lock_arr []Lock, deadline time.Time) (TransferResponse, []func() [][]byte) {
     w.FsmLock.Lock()
     defer w.FsmLock.Unlock()
     recalcitrantLocks := make(map[Lock]int)
+    callbacks := make([]func() [][]byte, 0)
     for _, l := range lock_arr {
-        state := w.LockStateMap[l]
+        /* Transfer may be repeated after lock was already disowned. */
+        state, ok := w.LockStateMap[l]
+        if !ok {
+            continue
+        }
         if state.Held {
+            w.logger.Named("rebalance").Debug("lock held, marked recalcitrant", "lock", l, "client", state.Client)
+            if !state.Recalcitrant {
+                callbacks = append(callbacks, w.revocationAlert(l, state.Client, deadline, false))
+            }
             state.Recalcitrant = true
             recalcitrantLocks[l] = 1
         } else {
@@ -263,48 +433,65 @@ func (w *WorkerFSM) handleTransferRequest(lock_arr []Lock) (TransferResponse) {
         }
         w.LockStateMap[l] = state
     }
-    return TransferResponse{recalcitrantLocks}
+    return TransferResponse{recalcitrantLocks}, callbacks
 }
 
 func (w *WorkerFSM) generateRecalcitrantReleaseAlert(l Lock) []func()[][]byte {
     /* Update map */
     /* Send message to master that was released */
+    trace := w.trace
     f := func() [][]byte {
         args := make(map[string]string)
         args[FunctionKey] = ReleasedRecalcitrantCommand
         args[LockArgKey] = string(l)
         command, json_err := json.Marshal(args)
         if json_err != nil {
-            //TODO
-            //fmt.Println("WORKER: JSON ERROR")
+            return [][]byte{}
         }
-        //fmt.Println("WORKER: release recalcitrant lock")
-        w.sendToMaster(command)
+        w.sendToMaster(command, trace)
         return [][]byte{}
     }
     return []func()[][]byte{f}
 }
 
-func (w *WorkerFSM) sendToMaster(command []byte) {
+/* Send command belonging to trace to master. If it can't be reached, ask
+   each known master for the current servers and, if they changed, try again. */
+func (w *WorkerFSM) sendToMaster(command []byte, trace raft.TraceContext) {
+    err := w.trySendToMaster(command, trace)
+    if err != nil && w.refreshMasters() {
+        err = w.trySendToMaster(command, trace)
+    }
+    if err != nil {
+        w.logger.Warn("request to master failed", "error", err)
+    }
+}
+
+func (w *WorkerFSM) trySendToMaster(command []byte, trace raft.TraceContext) error {
+    w.FsmLock.RLock()
+    masters := w.MasterCluster
+    w.FsmLock.RUnlock()
     w.SessionLock.Lock()
     defer w.SessionLock.Unlock()
     var err error = nil
     if w.MasterSession == nil {
-        w.MasterSession, err = raft.CreateClientSession(w.Trans, w.MasterCluster, nil)
+        w.MasterSession, err = raft.CreateClientSession(w.Trans, masters, nil, w.logger)
     }
     if err != nil {
-        return
+        return err
     }
-    send_err := w.MasterSession.SendRequest(command, &raft.ClientResponse{})
+    send_err := w.MasterSession.SendRequestWithTrace(command, &raft.ClientResponse{}, trace)
     if send_err != nil {
-        //fmt.Println("WORKER: error while sending recalcitrant release ")
+        /* Session gives up on errors; open a new one next time. */
+        w.MasterSession = nil
     }
+    return send_err
 }
 
 func (w *WorkerFSM) releaseForClient(client raft.ServerAddress) {
     w.FsmLock.Lock()
     defer w.FsmLock.Unlock()
-    //fmt.Println("WORKER: Releasing locks for client ", client)
+    w.logger.Debug("releasing locks for ended session", "client", client)
+    delete(w.Sessions, client)
     for l := range(w.LockStateMap) {
         state := w.LockStateMap[l]
         if (state.Client == client && state.Held) {
@@ -322,7 +509,7 @@ func (w *WorkerFSM) updateFreqForOneOp(l Lock) []func()[][]byte {
     }
     result := []func()[][]byte{}
     /* Check if should enter new period. */
-    if (time.Since(w.PeriodStart) >= PERIOD) {
+    if (w.Clock.Sub(w.PeriodStart) >= PERIOD) {
         /* Send stats to master. */
         locks := make([]Lock, 0)
         counts := make([]int, 0)
@@ -334,10 +521,12 @@ func (w *WorkerFSM) updateFreqForOneOp(l Lock) []func()[][]byte {
             state.FreqCount = 0
             w.LockStateMap[curr] = state
         }
+        load := w.currentLoad()
         /* Reset period start time. */
-        w.PeriodStart = time.Now()
+        w.PeriodStart = w.Clock
+        trace := w.trace
         f := func()[][]byte {
-            w.sendFrequencyStatsToMaster(locks, counts)
+            w.sendFrequencyStatsToMaster(locks, counts, load, trace)
             return [][]byte{}
         }
         result = append(result, f)
@@ -349,17 +538,16 @@ func (w *WorkerFSM) updateFreqForOneOp(l Lock) []func()[][]byte {
     return result
 }
 
-func (w *WorkerFSM) sendFrequencyStatsToMaster(locks []Lock, counts []int) {
+func (w *WorkerFSM) sendFrequencyStatsToMaster(locks []Lock, counts []int, load WorkerLoad, trace raft.TraceContext) {
     args := make(map[string]string)
     args[FunctionKey] = FrequencyUpdateCommand
     args[LockArrayKey] = lock_array_to_string(locks)
     args[CountArrayKey] = int_array_to_string(counts)
+    args[LoadKey] = load_to_string(load)
     command, json_err := json.Marshal(args)
     if json_err != nil {
-        //TODO
-        //fmt.Println("WORKER: JSON ERROR")
+        return
     }
-    //fmt.Println("WORKER: sending frequency update")
-    w.sendToMaster(command)
+    w.sendToMaster(command, trace)
 }
 
@@ -600,6 +600,12 @@ func (r *Raft) Leader() ServerAddress {
 // for the command to be started. This must be run on the leader or it
 // will fail.
 func (r *Raft) Apply(cmd []byte, timeout time.Duration) ApplyFuture {
+	return r.ApplyWithTrace(cmd, timeout, NoTrace)
+}
+
+// ApplyWithTrace is like Apply, but records trace in the log entry so the
+// FSM can trace its work under it.
+func (r *Raft) ApplyWithTrace(cmd []byte, timeout time.Duration, trace TraceContext) ApplyFuture {
 	metrics.IncrCounter([]string{"raft", "apply"}, 1)
 	var timer <-chan time.Time
 	if timeout > 0 {
@@ -609,8 +615,9 @@ func (r *Raft) Apply(cmd []byte, timeout time.Duration) ApplyFuture {
 	// Create a log future, no index or term yet
 	logFuture := &logFuture{
 		log: Log{
-			Type: LogCommand,
-			Data: cmd,
+			Type:  LogCommand,
+			Data:  cmd,
+			Trace: trace,
 		},
 	}
 	logFuture.init()
@@ -625,6 +632,16 @@ func (r *Raft) Apply(cmd []byte, timeout time.Duration) ApplyFuture {
 	}
 }
 
+// ApplyCommand applies cmd the way a client request is applied: once the
+// FSM has applied it, the callbacks it returned run on this server and the
+// commands they return are applied in turn. This must be run on the leader.
+// It returns the last error met applying a command.
+func (r *Raft) ApplyCommand(cmd []byte, trace TraceContext) error {
+	var err error
+	r.applyCommand(cmd, trace, &ClientResponse{}, &err)
+	return err
+}
+
 // Barrier is used to issue a command that blocks until all preceeding
 // operations have been applied to the FSM. It can be used to ensure the
 // FSM reflects all queued writes. An optional timeout can be provided to
@@ -897,6 +914,28 @@ func (r *Raft) String() string {
 	return fmt.Sprintf("Node at %s [%v]", r.localAddr, r.getState())
 }
 
+// ApplyBacklog returns the number of committed log entries that have not yet
+// been applied to the FSM.
+func (r *Raft) ApplyBacklog() uint64 {
+	commitIndex := r.getCommitIndex()
+	lastApplied := r.getLastApplied()
+	if commitIndex < lastApplied {
+		return 0
+	}
+	return commitIndex - lastApplied
+}
+
+// KeepClientSession opens a session for a client that has not contacted this
+// leader itself, as if it had sent a request. The session ends, applying
+// endSessionCommand, unless the client keeps it alive. Does nothing if the
+// client already has a session or this server is not the leader.
+func (r *Raft) KeepClientSession(clientAddr ServerAddress, endSessionCommand []byte) {
+	if r.getState() != Leader || endSessionCommand == nil {
+		return
+	}
+	r.keepClientSession(clientAddr, endSessionCommand)
+}
+
 // LastContact returns the time of last contact by a leader.
 // This only makes sense if we are currently a follower.
 func (r *Raft) LastContact() time.Time {
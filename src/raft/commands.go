@@ -161,6 +161,8 @@ type ClientRequest struct {
     ClientAddr ServerAddress
     // Command to be executed when client session terminates.
     EndSessionCommand []byte
+    // Trace the request belongs to, if any.
+    Trace TraceContext
 }
 
 // See WithRPCHeader.
@@ -0,0 +1,519 @@
+package raft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSegmentSize is the size at which a FileStore starts a new
+	// log segment.
+	DefaultSegmentSize = 64 * 1024 * 1024
+
+	segmentPrefix   = "segment-"
+	segmentSuffix   = ".wal"
+	stableStateFile = "stable.json"
+
+	// Each record is a 4 byte payload length, a 4 byte CRC32 of the
+	// payload, and the msgpack encoded log.
+	recordHeaderSize = 8
+)
+
+var (
+	// ErrCorruptLog is returned when a log segment other than the last is
+	// damaged. Damage at the end of the last segment is expected after a
+	// crash and is truncated instead.
+	ErrCorruptLog = errors.New("log segment is corrupt")
+
+	// ErrLogGap is returned when storing logs that don't follow the last
+	// stored log.
+	ErrLogGap = errors.New("log index does not follow last stored log")
+
+	// ErrDeleteMiddle is returned when asked to delete logs that are neither
+	// a prefix nor a suffix of the stored logs.
+	ErrDeleteMiddle = errors.New("can only delete a prefix or suffix of the log")
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// FileStore implements the LogStore and StableStore interfaces on disk, so
+// a server keeps its log, term and vote across restarts. Logs are appended
+// to a write-ahead log split into segment files, each named after the index
+// of its first log, and synced before StoreLogs returns. Stable state is
+// small and rewritten atomically on each change. Only the position of each
+// log is kept in memory; GetLog reads it from its segment.
+type FileStore struct {
+	l           sync.RWMutex
+	dir         string
+	segmentSize int64
+	segments    []*segment
+	positions   map[uint64]logPosition
+	lowIndex    uint64
+	highIndex   uint64
+	stable      stableState
+}
+
+// segment is a single file of the write-ahead log.
+type segment struct {
+	path  string
+	first uint64
+	size  int64
+	file  *os.File
+}
+
+type logPosition struct {
+	seg    *segment
+	offset int64
+}
+
+// stableState is everything stored in the stable state file. FirstIndex
+// records logs deleted from the front of the first segment, which stay in
+// the file until the whole segment is deleted.
+type stableState struct {
+	KV         map[string][]byte
+	KVInt      map[string]uint64
+	FirstIndex uint64
+}
+
+// NewFileStore opens the store in dir, creating it if needed, and recovers
+// its contents. A partly written log at the end of the last segment is
+// truncated.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f := &FileStore{
+		dir:         dir,
+		segmentSize: DefaultSegmentSize,
+		positions:   make(map[uint64]logPosition),
+		stable: stableState{
+			KV:    make(map[string][]byte),
+			KVInt: make(map[string]uint64),
+		},
+	}
+	if err := f.loadStable(); err != nil {
+		return nil, err
+	}
+	if err := f.recover(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Close closes every segment file.
+func (f *FileStore) Close() error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	var firstErr error
+	for _, seg := range f.segments {
+		if err := seg.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	f.segments = nil
+	return firstErr
+}
+
+// FirstIndex implements the LogStore interface.
+func (f *FileStore) FirstIndex() (uint64, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.lowIndex, nil
+}
+
+// LastIndex implements the LogStore interface.
+func (f *FileStore) LastIndex() (uint64, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.highIndex, nil
+}
+
+// GetLog implements the LogStore interface.
+func (f *FileStore) GetLog(index uint64, log *Log) error {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	pos, ok := f.positions[index]
+	if !ok {
+		return ErrLogNotFound
+	}
+	payload, err := readRecord(pos.seg.file, pos.offset)
+	if err != nil {
+		return fmt.Errorf("failed to read log %d from %s: %v", index, pos.seg.path, err)
+	}
+	return decodeMsgPack(payload, log)
+}
+
+// StoreLog implements the LogStore interface.
+func (f *FileStore) StoreLog(log *Log) error {
+	return f.StoreLogs([]*Log{log})
+}
+
+// StoreLogs implements the LogStore interface. Logs at or before the last
+// stored log replace it and everything after it.
+func (f *FileStore) StoreLogs(logs []*Log) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	dirty := make(map[*segment]bool)
+	for _, log := range logs {
+		if f.highIndex != 0 && log.Index <= f.highIndex {
+			if err := f.truncateFrom(log.Index); err != nil {
+				return err
+			}
+		}
+		if f.highIndex != 0 && log.Index != f.highIndex+1 {
+			return ErrLogGap
+		}
+		buf, err := encodeMsgPack(log)
+		if err != nil {
+			return err
+		}
+		seg, err := f.activeSegment(log.Index, dirty)
+		if err != nil {
+			return err
+		}
+		record := make([]byte, recordHeaderSize+buf.Len())
+		binary.BigEndian.PutUint32(record[0:4], uint32(buf.Len()))
+		binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(buf.Bytes(), crcTable))
+		copy(record[recordHeaderSize:], buf.Bytes())
+		if _, err := seg.file.WriteAt(record, seg.size); err != nil {
+			return err
+		}
+		f.positions[log.Index] = logPosition{seg, seg.size}
+		seg.size += int64(len(record))
+		dirty[seg] = true
+		if f.lowIndex == 0 {
+			f.lowIndex = log.Index
+		}
+		f.highIndex = log.Index
+	}
+	for seg := range dirty {
+		if err := seg.file.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteRange implements the LogStore interface. Raft only deletes a prefix
+// of the log, when compacting, or a suffix, when replacing conflicting logs.
+func (f *FileStore) DeleteRange(min, max uint64) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if f.highIndex == 0 || max < f.lowIndex || min > f.highIndex {
+		return nil
+	}
+	switch {
+	case min <= f.lowIndex:
+		return f.deletePrefix(max)
+	case max >= f.highIndex:
+		return f.truncateFrom(min)
+	}
+	return ErrDeleteMiddle
+}
+
+// Set implements the StableStore interface.
+func (f *FileStore) Set(key []byte, val []byte) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.stable.KV[string(key)] = val
+	return f.writeStable()
+}
+
+// Get implements the StableStore interface.
+func (f *FileStore) Get(key []byte) ([]byte, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.stable.KV[string(key)], nil
+}
+
+// SetUint64 implements the StableStore interface.
+func (f *FileStore) SetUint64(key []byte, val uint64) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.stable.KVInt[string(key)] = val
+	return f.writeStable()
+}
+
+// GetUint64 implements the StableStore interface.
+func (f *FileStore) GetUint64(key []byte) (uint64, error) {
+	f.l.RLock()
+	defer f.l.RUnlock()
+	return f.stable.KVInt[string(key)], nil
+}
+
+// activeSegment returns the segment to append the log with the given index
+// to, starting a new one if there is none or the last is full. The full
+// segment is synced before the new one is created.
+func (f *FileStore) activeSegment(index uint64, dirty map[*segment]bool) (*segment, error) {
+	if n := len(f.segments); n > 0 && f.segments[n-1].size < f.segmentSize {
+		return f.segments[n-1], nil
+	}
+	if n := len(f.segments); n > 0 && dirty[f.segments[n-1]] {
+		if err := f.segments[n-1].file.Sync(); err != nil {
+			return nil, err
+		}
+		delete(dirty, f.segments[n-1])
+	}
+	path := filepath.Join(f.dir, fmt.Sprintf("%s%020d%s", segmentPrefix, index, segmentSuffix))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syncDir(f.dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+	seg := &segment{path: path, first: index, file: file}
+	f.segments = append(f.segments, seg)
+	return seg, nil
+}
+
+// deletePrefix deletes logs up to and including max. Segments holding only
+// deleted logs are removed; the rest stay and are skipped on recovery.
+func (f *FileStore) deletePrefix(max uint64) error {
+	if max >= f.highIndex {
+		return f.deleteAll()
+	}
+	f.stable.FirstIndex = max + 1
+	if err := f.writeStable(); err != nil {
+		return err
+	}
+	for i := f.lowIndex; i <= max; i++ {
+		delete(f.positions, i)
+	}
+	f.lowIndex = max + 1
+	for len(f.segments) > 1 && f.segments[1].first <= f.lowIndex {
+		if err := f.removeSegment(f.segments[0]); err != nil {
+			return err
+		}
+		f.segments = f.segments[1:]
+	}
+	return nil
+}
+
+// truncateFrom deletes the log at index and every log after it.
+func (f *FileStore) truncateFrom(index uint64) error {
+	if index <= f.lowIndex {
+		return f.deleteAll()
+	}
+	for len(f.segments) > 0 {
+		seg := f.segments[len(f.segments)-1]
+		if seg.first < index {
+			pos, ok := f.positions[index]
+			if !ok || pos.seg != seg {
+				break
+			}
+			if err := seg.file.Truncate(pos.offset); err != nil {
+				return err
+			}
+			if err := seg.file.Sync(); err != nil {
+				return err
+			}
+			seg.size = pos.offset
+			break
+		}
+		if err := f.removeSegment(seg); err != nil {
+			return err
+		}
+		f.segments = f.segments[:len(f.segments)-1]
+	}
+	for i := index; i <= f.highIndex; i++ {
+		delete(f.positions, i)
+	}
+	f.highIndex = index - 1
+	return nil
+}
+
+// deleteAll removes every segment, so the next log stored may have any index.
+func (f *FileStore) deleteAll() error {
+	for len(f.segments) > 0 {
+		if err := f.removeSegment(f.segments[len(f.segments)-1]); err != nil {
+			return err
+		}
+		f.segments = f.segments[:len(f.segments)-1]
+	}
+	f.positions = make(map[uint64]logPosition)
+	f.lowIndex, f.highIndex = 0, 0
+	if f.stable.FirstIndex != 0 {
+		f.stable.FirstIndex = 0
+		return f.writeStable()
+	}
+	return nil
+}
+
+func (f *FileStore) removeSegment(seg *segment) error {
+	seg.file.Close()
+	if err := os.Remove(seg.path); err != nil {
+		return err
+	}
+	return syncDir(f.dir)
+}
+
+// recover rebuilds the log positions from the segment files.
+func (f *FileStore) recover() error {
+	entries, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		f.segments = append(f.segments, &segment{path: filepath.Join(f.dir, name), first: first})
+	}
+	sort.Slice(f.segments, func(i, j int) bool {
+		return f.segments[i].first < f.segments[j].first
+	})
+	for i, seg := range f.segments {
+		if seg.file, err = os.OpenFile(seg.path, os.O_RDWR, 0644); err != nil {
+			return err
+		}
+		if err := f.scanSegment(seg, i == len(f.segments)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanSegment records the position of each log in seg. A damaged record at
+// the end of the last segment was being written during a crash and is cut
+// off; anywhere else it is an error.
+func (f *FileStore) scanSegment(seg *segment, last bool) error {
+	var offset int64
+	for {
+		payload, err := readRecord(seg.file, offset)
+		if err == io.EOF {
+			break
+		}
+		var log Log
+		if err == nil {
+			err = decodeMsgPack(payload, &log)
+		}
+		if err == nil && f.highIndex != 0 && log.Index != f.highIndex+1 {
+			err = ErrLogGap
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("%v: %s at offset %d: %v", ErrCorruptLog, seg.path, offset, err)
+			}
+			if err := seg.file.Truncate(offset); err != nil {
+				return err
+			}
+			if err := seg.file.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		if log.Index >= f.stable.FirstIndex {
+			f.positions[log.Index] = logPosition{seg, offset}
+			if f.lowIndex == 0 {
+				f.lowIndex = log.Index
+			}
+		}
+		f.highIndex = log.Index
+		offset += recordHeaderSize + int64(len(payload))
+	}
+	seg.size = offset
+	if f.lowIndex == 0 {
+		f.highIndex = 0
+	}
+	return nil
+}
+
+// readRecord reads the record at offset, returning io.EOF if there is none
+// and an error if it is incomplete or fails its checksum.
+func readRecord(file *os.File, offset int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	n, err := file.ReadAt(header, offset)
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if n < recordHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	if n, _ := file.ReadAt(payload, offset+recordHeaderSize); n < len(payload) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+func (f *FileStore) loadStable() error {
+	data, err := ioutil.ReadFile(filepath.Join(f.dir, stableStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &f.stable); err != nil {
+		return fmt.Errorf("failed to read stable state: %v", err)
+	}
+	if f.stable.KV == nil {
+		f.stable.KV = make(map[string][]byte)
+	}
+	if f.stable.KVInt == nil {
+		f.stable.KVInt = make(map[string]uint64)
+	}
+	return nil
+}
+
+// writeStable replaces the stable state file, writing the new state to a
+// temporary file first so a crash leaves either the old or the new state.
+func (f *FileStore) writeStable() error {
+	data, err := json.Marshal(f.stable)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(f.dir, stableStateFile)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(f.dir)
+}
+
+// syncDir flushes changes to the entries of dir.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,232 @@
+package raft
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testFileStore(t *testing.T, dir string, segmentSize int64) *FileStore {
+	store, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.segmentSize = segmentSize
+	return store
+}
+
+func testFileLogs(first, last uint64) []*Log {
+	logs := make([]*Log, 0)
+	for i := first; i <= last; i++ {
+		logs = append(logs, &Log{
+			Index:      i,
+			Term:       1,
+			Type:       LogCommand,
+			Data:       []byte("data"),
+			AppendedAt: time.Unix(int64(i), 0).UTC(),
+		})
+	}
+	return logs
+}
+
+func checkFileLogs(t *testing.T, store *FileStore, first, last uint64) {
+	if idx, _ := store.FirstIndex(); idx != first {
+		t.Fatalf("bad first index: %d, want %d", idx, first)
+	}
+	if idx, _ := store.LastIndex(); idx != last {
+		t.Fatalf("bad last index: %d, want %d", idx, last)
+	}
+	if last == 0 {
+		return
+	}
+	for i := first; i <= last; i++ {
+		var log Log
+		if err := store.GetLog(i, &log); err != nil {
+			t.Fatalf("err getting log %d: %v", i, err)
+		}
+		if log.Index != i || !bytes.Equal(log.Data, []byte("data")) || !log.AppendedAt.Equal(time.Unix(int64(i), 0)) {
+			t.Fatalf("bad log %d: %#v", i, log)
+		}
+	}
+	var log Log
+	if err := store.GetLog(first-1, &log); err != ErrLogNotFound {
+		t.Fatalf("expected log %d to be missing, got %v", first-1, err)
+	}
+	if err := store.GetLog(last+1, &log); err != ErrLogNotFound {
+		t.Fatalf("expected log %d to be missing, got %v", last+1, err)
+	}
+}
+
+func TestFileStore_StoreAndReopen(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raft")
+	defer os.RemoveAll(dir)
+
+	store := testFileStore(t, dir, 256)
+	if err := store.StoreLogs(testFileLogs(1, 40)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.StoreLog(testFileLogs(41, 41)[0]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 1, 41)
+	if len(store.segments) < 2 {
+		t.Fatalf("expected several segments, got %d", len(store.segments))
+	}
+	store.Close()
+
+	store = testFileStore(t, dir, 256)
+	defer store.Close()
+	checkFileLogs(t, store, 1, 41)
+}
+
+func TestFileStore_DeleteRange(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raft")
+	defer os.RemoveAll(dir)
+
+	store := testFileStore(t, dir, 256)
+	if err := store.StoreLogs(testFileLogs(1, 40)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	segments := len(store.segments)
+
+	// Compact a prefix.
+	if err := store.DeleteRange(1, 25); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 26, 40)
+	if len(store.segments) >= segments {
+		t.Fatalf("expected old segments to be removed")
+	}
+
+	// Replace a conflicting suffix.
+	if err := store.DeleteRange(31, 40); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 26, 30)
+	if err := store.DeleteRange(28, 28); err != ErrDeleteMiddle {
+		t.Fatalf("expected ErrDeleteMiddle, got %v", err)
+	}
+	if err := store.StoreLogs(testFileLogs(31, 35)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.Close()
+
+	store = testFileStore(t, dir, 256)
+	checkFileLogs(t, store, 26, 35)
+
+	// Delete everything, then start again after a snapshot.
+	if err := store.DeleteRange(26, 35); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 0, 0)
+	if err := store.StoreLogs(testFileLogs(100, 102)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.Close()
+
+	store = testFileStore(t, dir, 256)
+	defer store.Close()
+	checkFileLogs(t, store, 100, 102)
+}
+
+func TestFileStore_OverwriteSuffix(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raft")
+	defer os.RemoveAll(dir)
+
+	store := testFileStore(t, dir, DefaultSegmentSize)
+	defer store.Close()
+	if err := store.StoreLogs(testFileLogs(1, 10)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.StoreLogs(testFileLogs(5, 7)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 1, 7)
+	if err := store.StoreLogs(testFileLogs(9, 9)); err != ErrLogGap {
+		t.Fatalf("expected ErrLogGap, got %v", err)
+	}
+}
+
+func TestFileStore_TornWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raft")
+	defer os.RemoveAll(dir)
+
+	store := testFileStore(t, dir, DefaultSegmentSize)
+	if err := store.StoreLogs(testFileLogs(1, 10)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := store.segments[0].path
+	store.Close()
+
+	// Simulate a crash partway through writing log 11.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	file.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, 5})
+	file.Close()
+
+	store = testFileStore(t, dir, DefaultSegmentSize)
+	defer store.Close()
+	checkFileLogs(t, store, 1, 10)
+	if err := store.StoreLogs(testFileLogs(11, 12)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	checkFileLogs(t, store, 1, 12)
+}
+
+func TestFileStore_CorruptSegment(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raft")
+	defer os.RemoveAll(dir)
+
+	store := testFileStore(t, dir, 256)
+	if err := store.StoreLogs(testFileLogs(1, 40)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := store.segments[0].path
+	store.Close()
+
+	// Damage a log in a segment that isn't the last.
+	file, err := os.OpenFile(path, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	file.WriteAt([]byte("xx"), recordHeaderSize+2)
+	file.Close()
+
+	if _, err := NewFileStore(dir); err == nil {
+		t.Fatalf("expected corrupt segment to be reported")
+	}
+}
+
+func TestFileStore_StableStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "raft")
+	defer os.RemoveAll(dir)
+
+	store := testFileStore(t, dir, DefaultSegmentSize)
+	if val, err := store.Get([]byte("missing")); err != nil || len(val) != 0 {
+		t.Fatalf("bad: %v %v", val, err)
+	}
+	if err := store.Set([]byte("vote"), []byte("server-1")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := store.SetUint64([]byte("term"), 7); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	store.Close()
+
+	store = testFileStore(t, dir, DefaultSegmentSize)
+	defer store.Close()
+	if val, _ := store.Get([]byte("vote")); string(val) != "server-1" {
+		t.Fatalf("bad vote: %s", val)
+	}
+	if val, _ := store.GetUint64([]byte("term")); val != 7 {
+		t.Fatalf("bad term: %d", val)
+	}
+	if _, err := os.Stat(filepath.Join(dir, stableStateFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary stable state left behind")
+	}
+}
@@ -1,5 +1,7 @@
 package raft
 
+import "time"
+
 // LogType describes various types of log entries.
 type LogType uint8
 
@@ -47,6 +49,15 @@ type Log struct {
 
 	// Data holds the log entry's type-specific data.
 	Data []byte
+
+	// AppendedAt is the time the leader appended the entry to its log. It
+	// is replicated with the entry, so FSMs can use it instead of their own
+	// clocks and stay identical across servers.
+	AppendedAt time.Time
+
+	// Trace is the trace of the client request the entry was applied for,
+	// if any, so FSMs can trace their work under it.
+	Trace TraceContext
 }
 
 // LogStore is used to provide an interface for storing
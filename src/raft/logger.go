@@ -0,0 +1,304 @@
+package raft
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log line. Lines below a logger's level are
+// dropped.
+type LogLevel int
+
+const (
+	LevelTrace LogLevel = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+var levelNames = []string{"trace", "debug", "info", "warn", "error", "off"}
+
+func (l LogLevel) String() string {
+	if l < LevelTrace || l > LevelOff {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (LogLevel, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(strings.TrimSpace(name), levelName) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelOff, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger is a leveled, structured logger. Each method takes a message
+// followed by alternating keys and values, e.g.
+//
+//	logger.Debug("transfer planned", "lock", id, "group", dest)
+type Logger interface {
+	Trace(msg string, args ...interface{})
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+
+	// Enabled reports whether lines at level would be written, so callers can
+	// skip building expensive fields.
+	Enabled(level LogLevel) bool
+
+	// With returns a logger adding the given keys and values to every line.
+	With(args ...interface{}) Logger
+
+	// Named returns a logger for a subsystem. Names nest with dots, e.g.
+	// "master.rebalance".
+	Named(name string) Logger
+}
+
+// LogLevels holds a default level and per-subsystem overrides, and may be
+// changed while loggers using it are running. Its spec is a comma separated
+// list of a default level and name=level overrides, e.g.
+// "info,rebalance=trace". An override applies to loggers whose name has it
+// as a dot separated component; if several apply, the most verbose wins.
+type LogLevels struct {
+	lock      sync.RWMutex
+	level     LogLevel
+	overrides map[string]LogLevel
+}
+
+// NewLogLevels parses spec. An empty spec means "info".
+func NewLogLevels(spec string) (*LogLevels, error) {
+	levels := &LogLevels{level: LevelInfo}
+	if err := levels.Set(spec); err != nil {
+		return nil, err
+	}
+	return levels, nil
+}
+
+// Set replaces the levels with those in spec. On error they are unchanged.
+func (l *LogLevels) Set(spec string) error {
+	level := LevelInfo
+	overrides := make(map[string]LogLevel)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.Index(part, "=")
+		if eq < 0 {
+			parsed, err := ParseLevel(part)
+			if err != nil {
+				return err
+			}
+			level = parsed
+			continue
+		}
+		name := strings.TrimSpace(part[:eq])
+		if name == "" {
+			return fmt.Errorf("missing logger name in %q", part)
+		}
+		parsed, err := ParseLevel(part[eq+1:])
+		if err != nil {
+			return err
+		}
+		overrides[name] = parsed
+	}
+	l.lock.Lock()
+	l.level = level
+	l.overrides = overrides
+	l.lock.Unlock()
+	return nil
+}
+
+// String returns the levels as a spec, with overrides sorted by name.
+func (l *LogLevels) String() string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	overrides := make([]string, 0, len(l.overrides))
+	for name, level := range l.overrides {
+		overrides = append(overrides, name+"="+level.String())
+	}
+	sort.Strings(overrides)
+	return strings.Join(append([]string{l.level.String()}, overrides...), ",")
+}
+
+// Level returns the level for loggers with the given name.
+func (l *LogLevels) Level(name string) LogLevel {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	level := l.level
+	if name == "" || len(l.overrides) == 0 {
+		return level
+	}
+	found := false
+	for _, component := range strings.Split(name, ".") {
+		override, ok := l.overrides[component]
+		if ok && (!found || override < level) {
+			level = override
+			found = true
+		}
+	}
+	return level
+}
+
+// Logger writing one line per call in logfmt, e.g.
+//
+//	2006-01-02T15:04:05.000Z07:00 level=debug name=master.rebalance msg="transfer planned" lock=a group=2
+type writerLogger struct {
+	out    *lockedWriter
+	levels *LogLevels
+	name   string
+	fields []interface{}
+}
+
+type lockedWriter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewLogger returns a logger writing to w at the given levels. Nil levels
+// means "info".
+func NewLogger(w io.Writer, levels *LogLevels) Logger {
+	if levels == nil {
+		levels = &LogLevels{level: LevelInfo}
+	}
+	return &writerLogger{out: &lockedWriter{w: w}, levels: levels}
+}
+
+// DefaultLogger writes to stdout at info.
+func DefaultLogger() Logger {
+	return NewLogger(os.Stdout, nil)
+}
+
+// NopLogger discards everything.
+func NopLogger() Logger {
+	return NewLogger(io.Discard, &LogLevels{level: LevelOff})
+}
+
+func (l *writerLogger) Trace(msg string, args ...interface{}) { l.log(LevelTrace, msg, args) }
+func (l *writerLogger) Debug(msg string, args ...interface{}) { l.log(LevelDebug, msg, args) }
+func (l *writerLogger) Info(msg string, args ...interface{})  { l.log(LevelInfo, msg, args) }
+func (l *writerLogger) Warn(msg string, args ...interface{})  { l.log(LevelWarn, msg, args) }
+func (l *writerLogger) Error(msg string, args ...interface{}) { l.log(LevelError, msg, args) }
+
+func (l *writerLogger) Enabled(level LogLevel) bool {
+	return level < LevelOff && level >= l.levels.Level(l.name)
+}
+
+func (l *writerLogger) With(args ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(args))
+	fields = append(fields, l.fields...)
+	fields = append(fields, args...)
+	return &writerLogger{out: l.out, levels: l.levels, name: l.name, fields: fields}
+}
+
+func (l *writerLogger) Named(name string) Logger {
+	if l.name != "" {
+		name = l.name + "." + name
+	}
+	return &writerLogger{out: l.out, levels: l.levels, name: name, fields: l.fields}
+}
+
+func (l *writerLogger) log(level LogLevel, msg string, args []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString(time.Now().Format("2006-01-02T15:04:05.000Z07:00"))
+	b.WriteString(" level=")
+	b.WriteString(level.String())
+	if l.name != "" {
+		b.WriteString(" name=")
+		b.WriteString(l.name)
+	}
+	b.WriteString(" msg=")
+	b.WriteString(logValue(msg))
+	writeFields(&b, l.fields)
+	writeFields(&b, args)
+	b.WriteByte('\n')
+	l.out.lock.Lock()
+	l.out.w.Write(b.Bytes())
+	l.out.lock.Unlock()
+}
+
+func writeFields(b *bytes.Buffer, args []interface{}) {
+	for i := 0; i < len(args); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fmt.Sprint(args[i]))
+		b.WriteByte('=')
+		if i+1 < len(args) {
+			b.WriteString(logValue(fmt.Sprint(args[i+1])))
+		} else {
+			b.WriteString("MISSING")
+		}
+	}
+}
+
+// Quote values that would otherwise be ambiguous in logfmt.
+func logValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// NewStdLogAdapter returns a *log.Logger for code, such as Config.Logger,
+// that logs through the standard library. Lines prefixed "[ERR]", "[WARN]",
+// "[INFO]", "[DEBUG]" or "[TRACE]", as raft's are, are logged at that level;
+// others at info.
+func NewStdLogAdapter(logger Logger) *log.Logger {
+	return log.New(&stdLogWriter{logger: logger}, "", 0)
+}
+
+type stdLogWriter struct {
+	logger Logger
+}
+
+var stdLogPrefixes = []struct {
+	prefix string
+	level  LogLevel
+}{
+	{"[ERR]", LevelError},
+	{"[ERROR]", LevelError},
+	{"[WARN]", LevelWarn},
+	{"[INFO]", LevelInfo},
+	{"[DEBUG]", LevelDebug},
+	{"[TRACE]", LevelTrace},
+}
+
+func (w *stdLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	level := LevelInfo
+	for _, prefix := range stdLogPrefixes {
+		if strings.HasPrefix(msg, prefix.prefix) {
+			level = prefix.level
+			msg = strings.TrimSpace(strings.TrimPrefix(msg, prefix.prefix))
+			break
+		}
+	}
+	switch level {
+	case LevelTrace:
+		w.logger.Trace(msg)
+	case LevelDebug:
+		w.logger.Debug(msg)
+	case LevelWarn:
+		w.logger.Warn(msg)
+	case LevelError:
+		w.logger.Error(msg)
+	default:
+		w.logger.Info(msg)
+	}
+	return len(p), nil
+}
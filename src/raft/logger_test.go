@@ -0,0 +1,132 @@
+package raft
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for i, name := range levelNames {
+		for _, spelling := range []string{name, strings.ToUpper(name), " " + name + " "} {
+			level, err := ParseLevel(spelling)
+			if err != nil || level != LogLevel(i) {
+				t.Fatalf("ParseLevel(%q) = %v, %v", spelling, level, err)
+			}
+		}
+		if LogLevel(i).String() != name {
+			t.Fatalf("level %d named %q, want %q", i, LogLevel(i).String(), name)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatalf("unknown level parsed")
+	}
+	if s := LogLevel(42).String(); s != "level(42)" {
+		t.Fatalf("unknown level named %q", s)
+	}
+}
+
+func TestNewLogLevels(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]LogLevel
+		str  string
+	}{
+		{"", map[string]LogLevel{"": LevelInfo, "master": LevelInfo}, "info"},
+		{"warn", map[string]LogLevel{"": LevelWarn, "master.rebalance": LevelWarn}, "warn"},
+		{" debug , rebalance=trace,raft=error ", map[string]LogLevel{
+			"":                 LevelDebug,
+			"master":           LevelDebug,
+			"master.rebalance": LevelTrace,
+			"raft":             LevelError,
+			"worker.raft":      LevelError,
+			"rebalancer":       LevelDebug,
+		}, "debug,raft=error,rebalance=trace"},
+		// The most verbose override applying to a name wins.
+		{"info,master=error,rebalance=debug", map[string]LogLevel{
+			"master":           LevelError,
+			"master.rebalance": LevelDebug,
+			"rebalance.master": LevelDebug,
+		}, "info,master=error,rebalance=debug"},
+	}
+	for _, test := range tests {
+		levels, err := NewLogLevels(test.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", test.spec, err)
+		}
+		for name, want := range test.want {
+			if got := levels.Level(name); got != want {
+				t.Errorf("%q: level of %q = %v, want %v", test.spec, name, got, want)
+			}
+		}
+		if levels.String() != test.str {
+			t.Errorf("%q: String() = %q, want %q", test.spec, levels.String(), test.str)
+		}
+	}
+	for _, spec := range []string{"loud", "info,master=loud", "info,=debug"} {
+		if _, err := NewLogLevels(spec); err == nil {
+			t.Errorf("bad spec %q accepted", spec)
+		}
+	}
+}
+
+func TestLogLevelsSetKeepsLevelsOnError(t *testing.T) {
+	levels, _ := NewLogLevels("debug,raft=warn")
+	if err := levels.Set("info,raft=loud"); err == nil {
+		t.Fatalf("bad spec accepted")
+	}
+	if levels.String() != "debug,raft=warn" {
+		t.Fatalf("levels changed by bad spec: %s", levels)
+	}
+}
+
+func TestLoggerFiltersAndFormats(t *testing.T) {
+	var b bytes.Buffer
+	levels, _ := NewLogLevels("info,rebalance=trace")
+	logger := NewLogger(&b, levels).Named("master").With("server", "m:1")
+	logger.Debug("dropped")
+	logger.Info("kept", "lock", "/a/l1", "note", "two words")
+	logger.Named("rebalance").Trace("traced", "odd")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines:\n%s", len(lines), b.String())
+	}
+	for i, want := range []string{
+		` level=info name=master msg=kept server=m:1 lock=/a/l1 note="two words"`,
+		` level=trace name=master.rebalance msg=traced server=m:1 odd=MISSING`,
+	} {
+		if !strings.HasSuffix(lines[i], want) {
+			t.Errorf("line %d = %q, want suffix %q", i, lines[i], want)
+		}
+	}
+	if logger.Enabled(LevelDebug) || !logger.Named("rebalance").Enabled(LevelTrace) {
+		t.Errorf("Enabled disagrees with levels")
+	}
+
+	// Levels changed at runtime apply to existing loggers.
+	levels.Set("off")
+	b.Reset()
+	logger.Error("dropped")
+	if b.Len() != 0 || logger.Enabled(LevelError) {
+		t.Errorf("logged with levels off: %q", b.String())
+	}
+	if NopLogger().Enabled(LevelError) {
+		t.Errorf("NopLogger enabled")
+	}
+}
+
+func TestStdLogAdapter(t *testing.T) {
+	var b bytes.Buffer
+	levels, _ := NewLogLevels("debug")
+	std := NewStdLogAdapter(NewLogger(&b, levels))
+	std.Printf("[WARN] raft: heartbeat timeout reached")
+	std.Printf("[TRACE] dropped")
+	std.Printf("no prefix")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines:\n%s", len(lines), b.String())
+	}
+	if !strings.HasSuffix(lines[0], ` level=warn msg="raft: heartbeat timeout reached"`) || !strings.HasSuffix(lines[1], ` level=info msg="no prefix"`) {
+		t.Fatalf("got:\n%s", b.String())
+	}
+}
@@ -854,6 +854,7 @@ func (r *Raft) dispatchLogs(applyLogs []*logFuture) {
 		lastIndex++
 		applyLog.log.Index = lastIndex
 		applyLog.log.Term = term
+		applyLog.log.AppendedAt = now
 		logs[idx] = &applyLog.log
 		r.leaderState.inflight.PushBack(applyLog)
 	}
@@ -1374,32 +1375,15 @@ func (r *Raft) clientRequest(rpc RPC, c *ClientRequest) {
     var rpcErr error
     if (r.getState() == Leader) {
         // Maintain sessions
-        if (c.KeepSession) {
-            r.leaderState.clientSessionsLock.RLock()
-            _, ok := r.leaderState.clientSessions[c.ClientAddr]
-            r.leaderState.clientSessionsLock.RUnlock()
-            // If first session, start heartbeat loop.
-            if c.EndSessionCommand != nil {
-                if !ok {
-                    r.leaderState.clientSessionsLock.Lock()
-                    r.leaderState.clientSessions[c.ClientAddr] = &clientSession{}
-                    r.leaderState.clientSessions[c.ClientAddr].heartbeatCh = make (chan bool, 1)
-                    r.leaderState.clientSessions[c.ClientAddr].endSessionCommand = c.EndSessionCommand
-                    r.leaderState.clientSessionsLock.Unlock()
-                    go r.clientSessionHeartbeatLoop(c.ClientAddr)
-                }
-                r.leaderState.clientSessionsLock.RLock()
-                ch := r.leaderState.clientSessions[c.ClientAddr].heartbeatCh
-                r.leaderState.clientSessionsLock.RUnlock()
-                ch <- true
-            }
+        if (c.KeepSession && c.EndSessionCommand != nil) {
+            r.keepClientSession(c.ClientAddr, c.EndSessionCommand)
         }
         // Apply all commands in client request.
         go func(r *Raft, resp *ClientResponse, rpc RPC, c *ClientRequest) {
             var rpcErr error
             for _,entry := range(c.Entries) {
                 if (entry != nil) {
-                    r.applyCommand(entry.Data, resp, &rpcErr)
+                    r.applyCommand(entry.Data, c.Trace, resp, &rpcErr)
                 }
             }
             rpc.Respond(resp, rpcErr)
@@ -1411,28 +1395,58 @@ func (r *Raft) clientRequest(rpc RPC, c *ClientRequest) {
     }
 }
 
+// keepClientSession records contact from a client, opening its session if it
+// has none. Only called on the leader.
+func (r *Raft) keepClientSession(clientAddr ServerAddress, endSessionCommand []byte) {
+    r.leaderState.clientSessionsLock.Lock()
+    session, ok := r.leaderState.clientSessions[clientAddr]
+    // If first session, start heartbeat loop.
+    if !ok {
+        session = &clientSession{heartbeatCh: make(chan bool, 1), endSessionCommand: endSessionCommand}
+        r.leaderState.clientSessions[clientAddr] = session
+        go r.clientSessionHeartbeatLoop(clientAddr)
+    }
+    r.leaderState.clientSessionsLock.Unlock()
+    select {
+    case session.heartbeatCh <- true:
+    default:
+    }
+}
+
 // Apply a command from leader to all raft FSMs. */
-func (r *Raft) applyCommand(command []byte, resp *ClientResponse, rpcErr *error) {
-    f := r.Apply(command, 0)
+func (r *Raft) applyCommand(command []byte, trace TraceContext, resp *ClientResponse, rpcErr *error) {
+    /* Spans time committing and applying the entry, then its callbacks. */
+    span := StartSpan(trace, "raft.apply")
+    span.SetAttr("server", r.localAddr)
+    f := r.ApplyWithTrace(command, 0, span.Context())
     if f.Error() != nil {
         r.logger.Printf("err: %v",f.Error())
         *rpcErr = f.Error()
         resp.Success = false
+        span.SetAttr("error", f.Error())
     }
+    span.End()
     /* If callback, make leader execute callback */
     var nextCommands [][]byte
     callbacks := f.Callback()
+    var callbackSpan *Span
+    if len(callbacks) > 0 {
+        callbackSpan = StartSpan(trace, "raft.callbacks")
+    }
     for _,callback := range callbacks {
         commands := callback()
         for _, command := range commands {
             nextCommands = append(nextCommands, command)
         }
     }
+    callbackSpan.SetAttr("callbacks", len(callbacks))
+    callbackSpan.SetAttr("commands", len(nextCommands))
+    callbackSpan.End()
     data, _:= json.Marshal(f.Response())
     resp.ResponseData = data
     resp.Success = true
     for _,nextCommand := range nextCommands {
-        r.applyCommand(nextCommand, resp, rpcErr)
+        r.applyCommand(nextCommand, trace, resp, rpcErr)
     }
 }
 
@@ -1454,7 +1468,7 @@ func (r *Raft) clientSessionHeartbeatLoop(clientAddr ServerAddress) {
             command := r.leaderState.clientSessions[clientAddr].endSessionCommand
             r.leaderState.clientSessionsLock.RUnlock()
             if command != nil {
-                r.applyCommand(command, &ClientResponse{}, &err)
+                r.applyCommand(command, NoTrace, &ClientResponse{}, &err)
             }
             r.leaderState.clientSessionsLock.Lock()
             delete(r.leaderState.clientSessions, clientAddr)
@@ -30,11 +30,11 @@ type MockSnapshot struct {
 	maxIndex int
 }
 
-func (m *MockFSM) Apply(log *Log) interface{} {
+func (m *MockFSM) Apply(log *Log) (interface{}, []func() [][]byte) {
 	m.Lock()
 	defer m.Unlock()
 	m.logs = append(m.logs, log.Data)
-	return len(m.logs)
+	return len(m.logs), nil
 }
 
 func (m *MockFSM) Snapshot() (FSMSnapshot, error) {
@@ -2423,3 +2423,24 @@ func TestRaft_ProtocolVersion_Upgrade_2_3(t *testing.T) {
 //
 // Storage errors handled properly.
 // Commit index updated properly.
+
+func TestRaft_KeepClientSession(t *testing.T) {
+	c := MakeCluster(3, t, nil)
+	defer c.Close()
+	leader := c.Leader()
+	follower := c.Followers()[0]
+
+	follower.KeepClientSession("client:1", []byte("end"))
+	leader.KeepClientSession("client:1", []byte("end"))
+	leader.KeepClientSession("client:1", []byte("other"))
+
+	leader.leaderState.clientSessionsLock.RLock()
+	session, ok := leader.leaderState.clientSessions["client:1"]
+	leader.leaderState.clientSessionsLock.RUnlock()
+	if !ok || string(session.endSessionCommand) != "end" {
+		t.Fatalf("leader should keep the first session opened, got %v", session)
+	}
+	if follower.leaderState.clientSessions != nil && len(follower.leaderState.clientSessions) != 0 {
+		t.Fatalf("follower opened a session")
+	}
+}
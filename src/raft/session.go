@@ -3,7 +3,6 @@ package raft
 import (
     "net"
     "time"
-    "fmt"
     "errors"
     "bufio"
 
@@ -17,10 +16,16 @@ type Session struct {
     stopCh              chan bool
     active              bool
     endSessionCommand   []byte
+    logger              Logger
 }
 
 // Send request to cluster without using session.
 func SendSingletonRequestToCluster(addrs []ServerAddress, data []byte, resp *ClientResponse) error {
+    return SendSingletonRequestToClusterWithTrace(addrs, data, resp, NoTrace)
+}
+
+// Send request belonging to trace to cluster without using session.
+func SendSingletonRequestToClusterWithTrace(addrs []ServerAddress, data []byte, resp *ClientResponse, trace TraceContext) error {
     if resp == nil {
         return errors.New("Response is nil")
     }
@@ -35,15 +40,21 @@ func SendSingletonRequestToCluster(addrs []ServerAddress, data []byte, resp *Cli
                 Data: data,
             },
         },
+        Trace: trace,
     }
     return sendSingletonRpcToActiveLeader(addrs, &clientRequest, resp)
 }
 
 
 /* Open client session to cluster. Takes clientID, server addresses for all servers in cluster, and returns success or failure.
-   Start go routine to periodically send heartbeat messages and switch to new leader when necessary. */ 
-func CreateClientSession(trans *NetworkTransport, addrs []ServerAddress, endSessionCommand []byte) (*Session, error) {
+   Start go routine to periodically send heartbeat messages and switch to new leader when necessary.
+   Logger may be nil, in which case the default logger is used. */
+func CreateClientSession(trans *NetworkTransport, addrs []ServerAddress, endSessionCommand []byte, logger Logger) (*Session, error) {
+    if logger == nil {
+        logger = DefaultLogger()
+    }
     session := &Session{
+        logger: logger.Named("session").With("local", trans.LocalAddr()),
         trans: trans,
         raftServers: addrs,
         active: true,
@@ -64,6 +75,11 @@ func CreateClientSession(trans *NetworkTransport, addrs []ServerAddress, endSess
 
 /* Make request to open session. */
 func (s *Session) SendRequest(data []byte, resp *ClientResponse) error {
+    return s.SendRequestWithTrace(data, resp, NoTrace)
+}
+
+/* Make request belonging to trace to open session. */
+func (s *Session) SendRequestWithTrace(data []byte, resp *ClientResponse, trace TraceContext) error {
     if !s.active {
         return errors.New("Inactive client session.")
     }
@@ -83,6 +99,7 @@ func (s *Session) SendRequest(data []byte, resp *ClientResponse) error {
         ClientAddr: s.trans.LocalAddr(),
         EndSessionCommand: s.endSessionCommand,
         KeepSession: true,
+        Trace: trace,
     }
     return s.sendToActiveLeader(&req, resp)
 }
@@ -94,7 +111,7 @@ func (s *Session) CloseClientSession() error {
         return errors.New("Inactive client session")
     }
     s.stopCh <- true
-    fmt.Println("closed client session")
+    s.logger.Debug("closed client session")
     return nil
 }
 
@@ -107,7 +124,7 @@ func (s *Session) sessionKeepAliveLoop() {
             s.active = false
         }
         if !s.active {
-            fmt.Println("client session no longer active")
+            s.logger.Debug("client session no longer active")
             return
         }
         // Send RPC
@@ -120,9 +137,11 @@ func (s *Session) sessionKeepAliveLoop() {
           KeepSession: true,
           EndSessionCommand: s.endSessionCommand,
         }
-        s.sendToActiveLeader(&heartbeat, &ClientResponse{})
+        if err := s.sendToActiveLeader(&heartbeat, &ClientResponse{}); err != nil {
+            s.logger.Warn("session heartbeat failed", "error", err)
+        }
     }
-    fmt.Println("client session no longer active")
+    s.logger.Debug("client session no longer active")
 }
 
 func (s *Session) sendToActiveLeader(request *ClientRequest, response *ClientResponse) error {
@@ -190,7 +209,6 @@ func sendSingletonRpcToActiveLeader(addrs []ServerAddress, request *ClientReques
         err = sendRPC(conn, rpcClientRequest, request)
         /* Try another server if server went down. */
         for err != nil {
-            fmt.Println("error sending: ", err)
             if retries <= 0 {
                 if conn != nil {
                     conn.conn.Close()
@@ -250,7 +268,6 @@ func buildNetConn(target ServerAddress) (*netConn, error) {
     // Dial a new connection
     conn, err := net.Dial("tcp", string(target))
 	if err != nil {
-        fmt.Println("error dialing: ", err)
         return nil, err
 	}
 
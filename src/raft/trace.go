@@ -0,0 +1,150 @@
+package raft
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// TraceContext identifies a span of a trace. It travels with client requests
+// and log entries so work done for a request on other servers joins its trace.
+// The zero value means the request isn't traced.
+type TraceContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// NoTrace is the context of untraced work.
+var NoTrace = TraceContext{}
+
+// Valid reports whether t belongs to a trace.
+func (t TraceContext) Valid() bool {
+	return t.TraceID != ""
+}
+
+// Span is a timed piece of work within a trace. Spans are only created while
+// an exporter is set; methods on a nil *Span do nothing, so callers needn't
+// check.
+type Span struct {
+	TraceID  string            `json:"trace_id"`
+	SpanID   string            `json:"span_id"`
+	ParentID string            `json:"parent_id,omitempty"`
+	Name     string            `json:"name"`
+	Start    time.Time         `json:"start"`
+	Duration time.Duration     `json:"duration_ns"`
+	Attrs    map[string]string `json:"attrs,omitempty"`
+}
+
+// SpanExporter receives every span once it ends. It is called from many
+// goroutines at once.
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+var (
+	exporterLock sync.RWMutex
+	exporter     SpanExporter
+)
+
+// SetSpanExporter sends spans from the whole process to e. Nil turns tracing
+// off, which is the default.
+func SetSpanExporter(e SpanExporter) {
+	exporterLock.Lock()
+	exporter = e
+	exporterLock.Unlock()
+}
+
+func spanExporter() SpanExporter {
+	exporterLock.RLock()
+	defer exporterLock.RUnlock()
+	return exporter
+}
+
+// StartTrace begins the root span of a new trace. Returns nil if tracing is
+// off.
+func StartTrace(name string) *Span {
+	if spanExporter() == nil {
+		return nil
+	}
+	return &Span{TraceID: newTraceID(16), SpanID: newTraceID(8), Name: name, Start: time.Now()}
+}
+
+// StartSpan begins a span within parent's trace. Returns nil if tracing is
+// off or parent isn't traced.
+func StartSpan(parent TraceContext, name string) *Span {
+	if !parent.Valid() || spanExporter() == nil {
+		return nil
+	}
+	return &Span{TraceID: parent.TraceID, SpanID: newTraceID(8), ParentID: parent.SpanID, Name: name, Start: time.Now()}
+}
+
+// Context returns the context to give work done within s, or NoTrace for a
+// nil span.
+func (s *Span) Context() TraceContext {
+	if s == nil {
+		return NoTrace
+	}
+	return TraceContext{TraceID: s.TraceID, SpanID: s.SpanID}
+}
+
+// SetAttr records an attribute of the span.
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	if s.Attrs == nil {
+		s.Attrs = make(map[string]string)
+	}
+	s.Attrs[key] = fmt.Sprint(value)
+}
+
+// End records the span's duration and exports it.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.Duration = time.Since(s.Start)
+	if e := spanExporter(); e != nil {
+		e.ExportSpan(s)
+	}
+}
+
+func newTraceID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// FileExporter appends each span to a file as a line of JSON, for local use.
+// Spans of one trace can be put together by trace_id and parent_id.
+type FileExporter struct {
+	lock sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// NewFileExporter opens path for appending, creating it if needed.
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (e *FileExporter) ExportSpan(span *Span) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.enc.Encode(span)
+}
+
+// Close closes the file. Spans exported afterwards are dropped.
+func (e *FileExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.file.Close()
+}